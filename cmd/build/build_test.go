@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"testing"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/paulmach/orb/maptile"
 	"github.com/schollz/progressbar/v3"
 	"github.com/tilezen/go-tilepacks/tilepack"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 // stubOutputter records Save calls so processResults tests can verify behavior
@@ -42,9 +44,74 @@ func TestProcessResults(t *testing.T) {
 	close(results)
 
 	bar := progressbar.NewOptions(2, progressbar.OptionSetWriter(io.Discard))
-	processResults(results, out, bar)
+	newResultWriter(out, nil, bar).processResults(results)
 
 	if len(out.saved) != 2 {
 		t.Errorf("expected 2 saved tiles, got %d", len(out.saved))
 	}
 }
+
+func TestProcessResults_Errors(t *testing.T) {
+	// Tiles that couldn't be fetched must be counted as failed, not saved.
+	out := &stubOutputter{}
+	results := make(chan *tilepack.TileResponse, 2)
+
+	results <- &tilepack.TileResponse{Tile: maptile.New(0, 0, 0), Err: errors.New("not found")}
+	results <- &tilepack.TileResponse{Tile: maptile.New(1, 0, 1), Data: []byte("b")}
+	close(results)
+
+	bar := progressbar.NewOptions(2, progressbar.OptionSetWriter(io.Discard))
+	writer := newResultWriter(out, nil, bar)
+	writer.processResults(results)
+
+	if len(out.saved) != 1 || out.saved[0].tile != maptile.New(1, 0, 1) {
+		t.Errorf("expected only tile 1/1/0 to be saved, got %+v", out.saved)
+	}
+	if n := writer.failedCount.Load(); n != 1 {
+		t.Errorf("expected 1 failed tile, got %d", n)
+	}
+}
+
+func TestProcessResults_VectorLayers(t *testing.T) {
+	// A tile with a single "roads" layer holding one point feature.
+	var feature, layer, tile []byte
+	feature = protowire.AppendTag(feature, 4, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, []byte{9, 0, 0})
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType)
+	layer = protowire.AppendString(layer, "roads")
+	layer = protowire.AppendTag(layer, 2, protowire.BytesType)
+	layer = protowire.AppendBytes(layer, feature)
+	tile = protowire.AppendTag(tile, 3, protowire.BytesType)
+	tile = protowire.AppendBytes(tile, layer)
+
+	out := &stubOutputter{}
+	results := make(chan *tilepack.TileResponse, 2)
+	results <- &tilepack.TileResponse{Tile: maptile.New(0, 0, 3), Data: tile}
+	results <- &tilepack.TileResponse{Tile: maptile.New(0, 0, 5), Data: tile}
+	close(results)
+
+	layers := tilepack.NewVectorLayerCollector()
+	bar := progressbar.NewOptions(2, progressbar.OptionSetWriter(io.Discard))
+	newResultWriter(out, layers, bar).processResults(results)
+
+	got := layers.VectorLayers()
+	if len(got) != 1 || got[0].ID != "roads" || got[0].MinZoom != 3 || got[0].MaxZoom != 5 {
+		t.Errorf("unexpected vector layers: %+v", got)
+	}
+}
+
+func TestResultWriter_Concurrency(t *testing.T) {
+	// Only outputters that can save concurrently get more than one writer.
+	bar := progressbar.NewOptions(0, progressbar.OptionSetWriter(io.Discard))
+	if n := newResultWriter(&stubOutputter{}, nil, bar).concurrency(8); n != 1 {
+		t.Errorf("stub outputter: got %d writers, want 1", n)
+	}
+
+	disk, err := tilepack.NewDiskOutputter("root=" + t.TempDir() + " format=pbf")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	if n := newResultWriter(disk, nil, bar).concurrency(8); n != 8 {
+		t.Errorf("disk outputter: got %d writers, want 8", n)
+	}
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/paulmach/orb"
@@ -16,32 +24,208 @@ import (
 	"github.com/schollz/progressbar/v3"
 
 	"github.com/tilezen/go-tilepacks/tilepack"
+
+	// Object storage drivers for bucket URL DSNs.
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
 )
 
-func processResults(results chan *tilepack.TileResponse, processor tilepack.TileOutputter, progress *progressbar.ProgressBar) {
-	tileCount := 0
+// multiStringFlag collects the values of a flag that may be repeated.
+type multiStringFlag []string
+
+func (m *multiStringFlag) String() string {
+	return strings.Join(*m, ", ")
+}
+
+func (m *multiStringFlag) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// parseRequestConfig turns the -header, -header-file and -url-param flag
+// values into request headers, URL template parameters and the list of secret
+// values that must be kept out of logs.
+func parseRequestConfig(headerFlags []string, headerFile string, urlParamFlags []string) (http.Header, map[string]string, []string, error) {
+	headers := http.Header{}
+	var secrets []string
+
+	if headerFile != "" {
+		fileHeaders, fileSecrets, err := tilepack.ReadHeaderFile(headerFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read header file: %w", err)
+		}
+		for name, values := range fileHeaders {
+			headers[name] = values
+		}
+		secrets = append(secrets, fileSecrets...)
+	}
+
+	for _, h := range headerFlags {
+		name, value, err := tilepack.ParseHeaderLine(h)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		value, envSecrets, err := tilepack.ExpandEnvReferences(value)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+
+		headers.Add(name, value)
+		secrets = append(secrets, envSecrets...)
+	}
+
+	urlParams := make(map[string]string, len(urlParamFlags))
+	for _, p := range urlParamFlags {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok || name == "" {
+			return nil, nil, nil, fmt.Errorf("invalid URL parameter %q: expected name=value", p)
+		}
+
+		value, envSecrets, err := tilepack.ExpandEnvReferences(value)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("URL parameter %s: %w", name, err)
+		}
+
+		urlParams[name] = value
+		secrets = append(secrets, envSecrets...)
+	}
+
+	return headers, urlParams, secrets, nil
+}
+
+// resultWriter saves the tiles fetched by the workers. Several goroutines
+// may run processResults at once when the outputter saves concurrently.
+type resultWriter struct {
+	saver          *tilepack.TileSaver
+	validatorStore tilepack.TileValidatorStore
+	layers         *tilepack.VectorLayerCollector
+	progress       *progressbar.ProgressBar
+
+	tileCount      atomic.Int64
+	unchangedCount atomic.Int64
+	failedCount    atomic.Int64
+}
+
+func newResultWriter(processor tilepack.TileOutputter, layers *tilepack.VectorLayerCollector, progress *progressbar.ProgressBar) *resultWriter {
+	validatorStore, _ := processor.(tilepack.TileValidatorStore)
+	return &resultWriter{
+		saver:          tilepack.NewTileSaver(processor),
+		validatorStore: validatorStore,
+		layers:         layers,
+		progress:       progress,
+	}
+}
+
+// concurrency returns the number of goroutines worth running processResults
+// in, at most limit.
+func (w *resultWriter) concurrency(limit int) int {
+	// Validators are stored one tile at a time.
+	if !w.saver.Concurrent() || w.validatorStore != nil || limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// processResults saves each result until results is closed, counting the
+// failed and unchanged tiles. When layers is not nil the saved tiles are also
+// decoded to collect their vector_layers.
+func (w *resultWriter) processResults(results chan *tilepack.TileResponse) {
 	for result := range results {
-		err := processor.Save(result.Tile, result.Data)
+		w.tileCount.Add(1)
+		w.progress.Add(1)
+
+		if result.Err != nil {
+			w.failedCount.Add(1)
+			log.Printf("Couldn't fetch tile %v: %+v", result.Tile, result.Err)
+			continue
+		}
+
+		if result.NotModified {
+			w.unchangedCount.Add(1)
+			continue
+		}
+
+		err := w.saver.Save(result)
 		if err != nil {
 			log.Printf("Couldn't save tile %+v", err)
+			continue
+		}
+
+		if w.layers != nil {
+			if err := w.layers.Add(result.Tile, result.Data); err != nil {
+				log.Printf("Couldn't decode layers of tile %+v: %+v", result.Tile, err)
+			}
 		}
 
-		tileCount += 1
-		progress.Add(1)
+		if w.validatorStore != nil {
+			if err := w.validatorStore.SaveValidators(result.Tile, result.Validators); err != nil {
+				log.Printf("Couldn't save validators for tile %+v: %+v", result.Tile, err)
+			}
+		}
+	}
+}
+
+// finish reports the results once every processResults has returned.
+func (w *resultWriter) finish() {
+	w.progress.Finish()
+	log.Printf("Processed %d tiles", w.tileCount.Load())
+	if unchanged := w.unchangedCount.Load(); unchanged > 0 {
+		log.Printf("%d tiles were unchanged since the last build", unchanged)
+	}
+	if failed := w.failedCount.Load(); failed > 0 {
+		log.Printf("%d tile requests failed", failed)
+	}
+}
+
+// sampleQueues samples the queue depths until stop is closed, logging them
+// every interval if it is positive.
+func sampleQueues(stats *tilepack.QueueStats, interval time.Duration, stop chan struct{}) {
+	sample := time.NewTicker(250 * time.Millisecond)
+	defer sample.Stop()
+
+	var report <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sample.C:
+			stats.Sample()
+		case <-report:
+			log.Printf("Queue depths: %s", stats)
+		}
 	}
+}
 
-	progress.Finish()
-	log.Printf("Processed %d tiles", tileCount)
+// flagWasSet returns true if the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func main() {
-	generatorStr := flag.String("generator", "xyz", "Which tile fetcher to use. Options are xyz, metatile, tapalcatl2.")
+	generatorStr := flag.String("generator", "xyz", "Which tile fetcher to use. Options are xyz, wmts, metatile, tapalcatl2.")
 	fileTransportRoot := flag.String("file-transport-root", "", "The root directory for tiles if -url-template defines a file:// URL scheme")
-	outputMode := flag.String("output-mode", "mbtiles", "Valid modes are: disk, mbtiles, pmtiles.")
-	outputDSN := flag.String("dsn", "", "Path, or DSN string, to output files.")
+	outputMode := flag.String("output-mode", "mbtiles", "Valid modes are: disk, mbtiles, pmtiles, zip, tar, metatile, tapalcatl2.")
+	outputDSN := flag.String("dsn", "", "Path, bucket URL (s3://, gs://, azblob://) or DSN string, to output files.")
 	boundingBoxStr := flag.String("bounds", "-90.0,-180.0,90.0,180.0", "Comma-separated bounding box in south,west,north,east format. Defaults to the whole world.")
 	zoomsStr := flag.String("zooms", "0,1,2,3,4,5,6,7,8,9,10", "Comma-separated list of zoom levels or a '{MIN_ZOOM}-{MAX_ZOOM}' range string.")
 	numTileFetchWorkers := flag.Int("workers", 25, "Number of tile fetch workers to use.")
+	numResultWriters := flag.Int("writers", runtime.NumCPU(), "Number of goroutines saving tiles, for outputters that can save concurrently: disk, and pmtiles, which compresses tiles in them.")
+	queueStatsInterval := flag.Duration("queue-stats-interval", 0, "Log the depths of the job and result queues at this interval, e.g. 30s, to show whether fetching or saving tiles is the slower side. They are always logged at the end.")
 	mbtilesBatchSize := flag.Int("batch-size", 50, "(For mbtiles outputter) Number of tiles to batch together before writing to mbtiles")
 	mbtilesTilesetName := flag.String("tileset-name", "tileset", "(For mbtiles outputter) Name of the tileset to write to the mbtiles file metadata.")
 	mbtilesFormat := flag.String("mbtiles-format", "pbf", "(Deprecated. Use --output-format instead)")
@@ -52,11 +236,38 @@ func main() {
 	ensureGzip := flag.Bool("ensure-gzip", true, "Ensure tile data is gzipped. Only applies to XYZ tiles.")
 	urlTemplateStr := flag.String("url-template", "", "(For xyz generator) URL template to make tile requests with. If URL template begins with file:// you must pass the -file-transport-root flag.")
 	layerNameStr := flag.String("layer-name", "", "(For metatile, tapalcatl2 generator) The layer name to use for hash building.")
-	formatStr := flag.String("format", "mvt", "(For metatile generator) The format of the tile inside the metatile to extract.")
+	formatStr := flag.String("format", "mvt", "(For metatile, tapalcatl2 generator) The format of the tile inside the metatile or t2 archive to extract. Defaults to png for tapalcatl2.")
 	pathTemplateStr := flag.String("path-template", "", "(For metatile, tapalcatl2 generator) The template to use for the path part of the S3 path to the t2 archive.")
 	bucketStr := flag.String("bucket", "", "(For metatile, tapalcatl2 generator) The name of the S3 bucket to request t2 archives from.")
 	requesterPays := flag.Bool("requester-pays", false, "(For metatile, tapalcatl2 generator) Whether to make S3 requests with requester pays enabled.")
 	materializedZoomsStr := flag.String("materialized-zooms", "", "(For tapalcatl2 generator) Specifies the materialized zooms for t2 archives.")
+	wmtsCapabilities := flag.String("wmts-capabilities", "", "(For wmts generator) URL or path of the WMTS GetCapabilities document.")
+	wmtsLayer := flag.String("wmts-layer", "", "(For wmts generator) Identifier of the layer to fetch. Optional if the service has a single layer.")
+	wmtsStyle := flag.String("wmts-style", "", "(For wmts generator) Style identifier. Defaults to the layer's default style.")
+	wmtsTileMatrixSet := flag.String("wmts-tile-matrix-set", "", "(For wmts generator) Tile matrix set identifier. Defaults to the first Web Mercator set of the layer.")
+	wmtsFormat := flag.String("wmts-format", "", "(For wmts generator) Tile MIME type, e.g. image/png. Defaults to the layer's first format.")
+	wmtsEncoding := flag.String("wmts-encoding", "", "(For wmts generator) Request encoding, kvp or rest. Defaults to rest when the layer has a tile ResourceURL.")
+	retryMaxAttempts := flag.Int("retry-max-attempts", 30, "(For xyz, wmts generator) Maximum number of requests made for a single tile, including the first.")
+	retryStatusesStr := flag.String("retry-statuses", "408,429,500,502-504", "(For xyz, wmts generator) Comma-separated list of HTTP status codes or ranges to retry.")
+	retryNetworkErrors := flag.Bool("retry-network-errors", true, "(For xyz, wmts generator) Retry requests that fail with timeouts or connection errors.")
+	retryMaxTime := flag.Int("retry-max-time", 300, "(For xyz, wmts generator) Maximum number of seconds to spend retrying a single tile. 0 means no limit.")
+	retryRespectRetryAfter := flag.Bool("retry-respect-retry-after", true, "(For xyz, wmts generator) Wait for the duration given in a Retry-After response header before retrying.")
+	var headerFlags, urlParamFlags multiStringFlag
+	flag.Var(&headerFlags, "header", "(For xyz, wmts generator) A \"Name: value\" header to send with every tile request. May be repeated. ${NAME} in the value is replaced with the NAME environment variable and kept out of logs.")
+	headerFile := flag.String("header-file", "", "(For xyz, wmts generator) Path to a file of \"Name: value\" headers, one per line, to send with every tile request. Values are kept out of logs.")
+	subdomainsStr := flag.String("subdomains", "a,b,c", "(For xyz generator) Comma-separated list of subdomains to rotate through for the {s} placeholder in -url-template.")
+	scale := flag.Int("scale", 1, "(For xyz generator) Tile scale used for the {ratio} (e.g. @2x) and {scale} placeholders in -url-template.")
+	flag.Var(&urlParamFlags, "url-param", "(For xyz generator) A name=value pair that fills the {name} placeholder in -url-template. May be repeated. ${NAME} in the value is replaced with the NAME environment variable and kept out of logs.")
+	updateArchive := flag.String("update", "", "(For mbtiles outputter) Path to an existing mbtiles file to refresh in place. Tiles are requested with the ETag and Last-Modified values stored by a previous build, and only tiles that changed are rewritten.")
+	vectorLayers := flag.Bool("vector-layers", false, "(For mbtiles, pmtiles, zip and tar outputters and disk sidecars) Decode the tiles as they are saved to write the vector_layers of the json metadata. Only applies to pbf and mvt tiles.")
+	hashName := flag.String("hash", tilepack.DefaultContentHasher.Name(), "(For mbtiles, pmtiles, zip, tar and dedup=hardlink disk outputters) Content hash tiles are deduplicated by. Options are "+strings.Join(tilepack.ContentHasherNames(), ", ")+".")
+	pmtilesCompression := flag.String("pmtiles-compression", "", "(For pmtiles outputter) Compression tiles are stored with. Options are "+strings.Join(tilepack.TileCompressionNames(), ", ")+". Defaults to gzip for pbf, mvt and mlt tiles and none for images. Tiles are transcoded from whatever compression they arrive in.")
+	pmtilesMemoryMB := flag.Int64("pmtiles-memory", 0, "(For pmtiles outputter) Memory budget in megabytes for the directory entries and deduplication index. When set, they spill to temporary files so archives of any size can be built, at some cost in speed. 0 keeps everything in memory.")
+	mbtilesSchema := flag.String("mbtiles-schema", tilepack.MbtilesSchemaDedup, "(For mbtiles outputter) Table layout of a new archive. dedup stores identical tiles once behind a tiles view, flat writes a single tiles table. An existing archive keeps its layout.")
+	mbtilesWAL := flag.Bool("mbtiles-wal", false, "(For mbtiles outputter) Write in SQLite WAL mode, so the archive can be read while it is written. It is switched back to a rollback journal when done.")
+	mbtilesExclusive := flag.Bool("mbtiles-exclusive", false, "(For mbtiles outputter) Hold an exclusive lock on the archive while writing, which is faster but keeps other processes from reading it.")
+	mbtilesOptimize := flag.Bool("mbtiles-optimize", false, "(For mbtiles outputter) Run ANALYZE and VACUUM once all tiles are written.")
+	storeValidators := flag.Bool("store-validators", false, "(For mbtiles outputter) Store the ETag and Last-Modified values of each tile so a later build can refresh the archive with -update.")
 	flag.Parse()
 
 	if *cpuProfile != "" {
@@ -71,10 +282,29 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *updateArchive != "" {
+		if *outputMode != "mbtiles" {
+			log.Fatalf("-update is only supported with the mbtiles outputter")
+		}
+		if *outputDSN != "" && *outputDSN != *updateArchive {
+			log.Fatalf("-dsn must be omitted or match the -update archive")
+		}
+		if _, err := os.Stat(*updateArchive); err != nil {
+			log.Fatalf("Couldn't open archive to update: %+v", err)
+		}
+		*outputDSN = *updateArchive
+		*storeValidators = true
+	}
+
 	if *outputDSN == "" {
 		log.Fatalf("Output DSN (-dsn) is required")
 	}
 
+	hasher, hashErr := tilepack.ParseContentHasher(*hashName)
+	if hashErr != nil {
+		log.Fatalf("Invalid -hash: %v", hashErr)
+	}
+
 	boundingBoxStrSplit := strings.Split(*boundingBoxStr, ",")
 	if len(boundingBoxStrSplit) != 4 {
 		log.Fatalf("Bounding box string must be a comma-separated list of 4 numbers")
@@ -140,23 +370,217 @@ func main() {
 		}
 	}
 
+	var outputter tilepack.TileOutputter
+	var outputterErr error
+	// metadata is written by the mbtiles, pmtiles, zip and tar outputters,
+	// and the disk outputter's sidecar, on Close.
+	var metadata *tilepack.MbtilesMetadata
+
+	switch *outputMode {
+	case "disk":
+		metadata = tilepack.NewMbtilesMetadata(map[string]string{})
+		if *mbtilesTilesetName != "" {
+			metadata.Set("name", *mbtilesTilesetName)
+		}
+
+		diskOutputter, err := tilepack.NewDiskOutputter(*outputDSN)
+		if err == nil {
+			diskOutputter.SetMetadata(metadata)
+			diskOutputter.SetContentHasher(hasher)
+		}
+		outputter, outputterErr = diskOutputter, err
+	case "zip", "tar":
+		metadata = tilepack.NewMbtilesMetadata(map[string]string{})
+		if *mbtilesTilesetName != "" {
+			metadata.Set("name", *mbtilesTilesetName)
+		}
+
+		newBundleOutputter := tilepack.NewZipOutputter
+		if *outputMode == "tar" {
+			newBundleOutputter = tilepack.NewTarOutputter
+		}
+		bundleOutputter, err := newBundleOutputter(*outputDSN)
+		if err == nil {
+			bundleOutputter.SetMetadata(metadata)
+			bundleOutputter.SetContentHasher(hasher)
+		}
+		outputter, outputterErr = bundleOutputter, err
+	case "metatile":
+		outputter, outputterErr = tilepack.NewMetatileOutputter(*outputDSN)
+	case "tapalcatl2":
+		outputter, outputterErr = tilepack.NewTapalcatl2Outputter(*outputDSN)
+	case "mbtiles":
+		metadata = tilepack.NewMbtilesMetadata(map[string]string{})
+
+		if *updateArchive != "" {
+			// Keep the existing metadata, overriding only what was asked for.
+			reader, err := tilepack.NewMbtilesReader(*updateArchive)
+			if err != nil {
+				log.Fatalf("Couldn't open archive to update: %+v", err)
+			}
+			metadata, err = reader.Metadata()
+			reader.Close()
+			if err != nil {
+				log.Fatalf("Couldn't read metadata of archive to update: %+v", err)
+			}
+			if format, ok := metadata.Get("format"); ok && !flagWasSet("output-format") && !flagWasSet("mbtiles-format") {
+				*mbtilesFormat = format
+				*outputFormat = format
+			}
+			if name, ok := metadata.Get("name"); ok && !flagWasSet("tileset-name") {
+				*mbtilesTilesetName = name
+			}
+		}
+
+		// mbtilesFormat is deprecated, use outputFormat instead
+		if *mbtilesFormat != "" {
+			log.Printf("Warning: --mbtiles-format is deprecated, use --output-format instead")
+			*outputFormat = *mbtilesFormat
+		}
+
+		if *outputFormat == "" {
+			log.Fatalf("--output-format is required for mbtiles output")
+		}
+		metadata.Set("format", *outputFormat)
+
+		if *outputFormat != "pbf" && *ensureGzip {
+			log.Printf("Warning: gzipping is only required for PBF tiles. You may want to disable it for other formats with --ensure-gzip=false")
+		}
+
+		if *mbtilesTilesetName == "" {
+			log.Fatalf("--tileset-name is required for mbtiles output")
+		}
+		metadata.Set("name", *mbtilesTilesetName)
+
+		mbtilesOutputter, err := tilepack.NewMbtilesOutputter(*outputDSN, *mbtilesBatchSize, *invertedY, metadata)
+		if err == nil {
+			mbtilesOutputter.SetStoreValidators(*storeValidators)
+			mbtilesOutputter.SetContentHasher(hasher)
+			mbtilesOutputter.SetWAL(*mbtilesWAL)
+			mbtilesOutputter.SetExclusive(*mbtilesExclusive)
+			mbtilesOutputter.SetOptimize(*mbtilesOptimize)
+			err = mbtilesOutputter.SetSchema(*mbtilesSchema)
+		}
+		outputter, outputterErr = mbtilesOutputter, err
+	case "pmtiles":
+		metadata = tilepack.NewMbtilesMetadata(map[string]string{})
+
+		if *outputFormat == "" {
+			log.Fatalf("--output-format is required for pmtiles output")
+		}
+		metadata.Set("format", *outputFormat)
+
+		if *outputFormat != "pbf" && *ensureGzip {
+			log.Printf("Warning: gzipping is only required for PBF tiles. You may want to disable it for other formats with --ensure-gzip=false")
+		}
+
+		if *mbtilesTilesetName == "" {
+			log.Fatalf("--tileset-name is required for pmtiles output")
+		}
+		metadata.Set("name", *mbtilesTilesetName)
+
+		pmtilesOutputter, err := tilepack.NewPmtilesOutputter(*outputDSN, *outputFormat, metadata)
+		if err == nil {
+			pmtilesOutputter.SetContentHasher(hasher)
+			if *pmtilesCompression != "" {
+				compression, compressionErr := tilepack.ParseTileCompression(*pmtilesCompression)
+				if compressionErr != nil {
+					log.Fatalf("Invalid -pmtiles-compression: %v", compressionErr)
+				}
+				err = pmtilesOutputter.SetTileCompression(compression)
+			}
+		}
+		if err == nil && *pmtilesMemoryMB > 0 {
+			err = pmtilesOutputter.SetMemoryBudget(*pmtilesMemoryMB << 20)
+		}
+		outputter, outputterErr = pmtilesOutputter, err
+	default:
+		log.Fatalf("Unknown outputter: %s", *outputMode)
+	}
+
+	if outputterErr != nil {
+		log.Fatalf("Couldn't create %s output: %+v", *outputMode, outputterErr)
+	}
+
+	// In update mode the outputter holds the validators the tiles were last
+	// fetched with, and the xyz generator reads them back to make
+	// conditional requests.
+	var validators tilepack.TileValidatorReader
+	if *updateArchive != "" {
+		validators, _ = outputter.(tilepack.TileValidatorReader)
+	}
+
 	var jobCreator tilepack.JobGenerator
+	var retryStats *tilepack.RetryStats
 	var err error
 	switch *generatorStr {
-	case "xyz":
-		if *urlTemplateStr == "" {
+	case "xyz", "wmts":
+		if *generatorStr == "xyz" && *urlTemplateStr == "" {
 			log.Fatalf("URL template is required")
 		}
 
+		if *generatorStr == "wmts" && *wmtsCapabilities == "" {
+			log.Fatalf("-wmts-capabilities is required for the wmts generator")
+		}
+
+		retryStatuses, statusErr := tilepack.ParseRetryStatuses(*retryStatusesStr)
+		if statusErr != nil {
+			log.Fatalf("Failed to parse -retry-statuses: %v", statusErr)
+		}
+
+		headers, urlParams, secrets, configErr := parseRequestConfig(headerFlags, *headerFile, urlParamFlags)
+		if configErr != nil {
+			log.Fatalf("Invalid request configuration: %v", configErr)
+		}
+
+		retryStats = tilepack.NewRetryStats()
+		retryPolicy := tilepack.DefaultRetryPolicy()
+		retryPolicy.MaxAttempts = *retryMaxAttempts
+		retryPolicy.RetryableStatuses = retryStatuses
+		retryPolicy.RetryNetworkErrors = *retryNetworkErrors
+		retryPolicy.MaxElapsed = time.Duration(*retryMaxTime) * time.Second
+		retryPolicy.RespectRetryAfter = *retryRespectRetryAfter
+		retryPolicy.Stats = retryStats
+
+		xyzOpts := &tilepack.XYZJobGeneratorOptions{
+			URLTemplate:   *urlTemplateStr,
+			Bounds:        bounds,
+			Zooms:         zooms,
+			HTTPTimeout:   time.Duration(*requestTimeout) * time.Second,
+			InvertedY:     *invertedY,
+			EnsureGzip:    *ensureGzip,
+			MbtilesFormat: *mbtilesFormat,
+			RetryPolicy:   retryPolicy,
+			Headers:       headers,
+			URLParams:     urlParams,
+			Secrets:       secrets,
+			Subdomains:    strings.Split(*subdomainsStr, ","),
+			Scale:         *scale,
+			Validators:    validators,
+		}
+
 		if strings.HasPrefix(*urlTemplateStr, "file://") {
 
 			if *fileTransportRoot == "" {
 				log.Fatalf("-file-transport-root flag is required when URL template uses file://")
 			}
 
-			jobCreator, err = tilepack.NewFileTransportXYZJobGenerator(*fileTransportRoot, *urlTemplateStr, bounds, zooms, time.Duration(*requestTimeout)*time.Second, *invertedY, *ensureGzip)
+			xyzOpts.FileTransportRoot = *fileTransportRoot
+			xyzOpts.MbtilesFormat = ""
+		}
+
+		if *generatorStr == "wmts" {
+			jobCreator, err = tilepack.NewWMTSJobGenerator(&tilepack.WMTSJobGeneratorOptions{
+				XYZJobGeneratorOptions: *xyzOpts,
+				Capabilities:           *wmtsCapabilities,
+				Layer:                  *wmtsLayer,
+				Style:                  *wmtsStyle,
+				TileMatrixSet:          *wmtsTileMatrixSet,
+				Format:                 *wmtsFormat,
+				Encoding:               *wmtsEncoding,
+			})
 		} else {
-			jobCreator, err = tilepack.NewXYZJobGenerator(*urlTemplateStr, bounds, zooms, time.Duration(*requestTimeout)*time.Second, *invertedY, *ensureGzip, *mbtilesFormat)
+			jobCreator, err = tilepack.NewXYZJobGeneratorWithOptions(xyzOpts)
 		}
 
 	case "metatile":
@@ -208,7 +632,14 @@ func main() {
 			materializedZooms[i] = maptile.Zoom(z)
 		}
 
-		jobCreator, err = tilepack.NewTapalcatl2JobGenerator(*bucketStr, *requesterPays, *pathTemplateStr, *layerNameStr, materializedZooms, zooms, bounds)
+		// -format defaults to mvt for metatiles, but t2 archives were read
+		// for their png tiles before it applied to them.
+		t2Format := "png"
+		if flagWasSet("format") {
+			t2Format = *formatStr
+		}
+
+		jobCreator, err = tilepack.NewTapalcatl2JobGenerator(*bucketStr, *requesterPays, *pathTemplateStr, *layerNameStr, t2Format, materializedZooms, zooms, bounds)
 	default:
 		log.Fatalf("Unknown job generator type %s", *generatorStr)
 	}
@@ -227,62 +658,6 @@ func main() {
 	)
 	log.Printf("Expecting to fetch %d tiles", expectedTileCount)
 
-	var outputter tilepack.TileOutputter
-	var outputterErr error
-
-	switch *outputMode {
-	case "disk":
-		outputter, outputterErr = tilepack.NewDiskOutputter(*outputDSN)
-	case "mbtiles":
-		metadata := tilepack.NewMbtilesMetadata(map[string]string{})
-
-		// mbtilesFormat is deprecated, use outputFormat instead
-		if *mbtilesFormat != "" {
-			log.Printf("Warning: --mbtiles-format is deprecated, use --output-format instead")
-			*outputFormat = *mbtilesFormat
-		}
-
-		if *outputFormat == "" {
-			log.Fatalf("--output-format is required for mbtiles output")
-		}
-		metadata.Set("format", *outputFormat)
-
-		if *outputFormat != "pbf" && *ensureGzip {
-			log.Printf("Warning: gzipping is only required for PBF tiles. You may want to disable it for other formats with --ensure-gzip=false")
-		}
-
-		if *mbtilesTilesetName == "" {
-			log.Fatalf("--tileset-name is required for mbtiles output")
-		}
-		metadata.Set("name", *mbtilesTilesetName)
-
-		outputter, outputterErr = tilepack.NewMbtilesOutputter(*outputDSN, *mbtilesBatchSize, *invertedY, metadata)
-	case "pmtiles":
-		metadata := tilepack.NewMbtilesMetadata(map[string]string{})
-
-		if *outputFormat == "" {
-			log.Fatalf("--output-format is required for pmtiles output")
-		}
-		metadata.Set("format", *outputFormat)
-
-		if *outputFormat != "pbf" && *ensureGzip {
-			log.Printf("Warning: gzipping is only required for PBF tiles. You may want to disable it for other formats with --ensure-gzip=false")
-		}
-
-		if *mbtilesTilesetName == "" {
-			log.Fatalf("--tileset-name is required for pmtiles output")
-		}
-		metadata.Set("name", *mbtilesTilesetName)
-
-		outputter, outputterErr = tilepack.NewPmtilesOutputter(*outputDSN, *outputFormat, metadata)
-	default:
-		log.Fatalf("Unknown outputter: %s", *outputMode)
-	}
-
-	if outputterErr != nil {
-		log.Fatalf("Couldn't create %s output: %+v", *outputMode, outputterErr)
-	}
-
 	err = outputter.CreateTiles()
 
 	if err != nil {
@@ -291,6 +666,16 @@ func main() {
 
 	log.Printf("Created %s output\n", *outputMode)
 
+	// Ctrl-C stops fetching tiles, but the tiles already fetched are still
+	// saved and the output is closed so it stays readable. A second Ctrl-C
+	// exits at once.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+		log.Print("Interrupted, saving the tiles already fetched. Interrupt again to exit at once.")
+	}()
+
 	jobs := make(chan *tilepack.TileRequest, 2000)
 	results := make(chan *tilepack.TileResponse, 2000)
 
@@ -306,21 +691,43 @@ func main() {
 		workerWG.Add(1)
 		go func() {
 			defer workerWG.Done()
-			worker(workerN, jobs, results)
+			worker(ctx, workerN, jobs, results)
 		}()
 	}
 
-	// Start the worker that receives data from HTTP workers
+	var layers *tilepack.VectorLayerCollector
+	if *vectorLayers {
+		if metadata == nil || (*outputFormat != "pbf" && *outputFormat != "mvt") {
+			log.Fatalf("-vector-layers needs pbf or mvt tiles")
+		}
+		layers = tilepack.NewVectorLayerCollector()
+	}
+
+	// Start the writers that receive data from HTTP workers
+	writer := newResultWriter(outputter, layers, progress)
 	resultWG := &sync.WaitGroup{}
-	resultWG.Add(1)
-	go func() {
-		defer resultWG.Done()
-		processResults(results, outputter, progress)
-	}()
+	for w := 0; w < writer.concurrency(*numResultWriters); w++ {
+		resultWG.Add(1)
+		go func() {
+			defer resultWG.Done()
+			writer.processResults(results)
+		}()
+	}
 
-	jobCreator.CreateJobs(jobs)
+	// A full jobs queue means the workers can't keep up, and a full results
+	// queue that the writers can't.
+	queueStats := tilepack.NewQueueStats()
+	queueStats.Add("jobs", func() int { return len(jobs) }, cap(jobs))
+	queueStats.Add("results", func() int { return len(results) }, cap(results))
+	stopSampling := make(chan struct{})
+	go sampleQueues(queueStats, *queueStatsInterval, stopSampling)
 
 	// Add tile request jobs
+	err = jobCreator.CreateJobs(ctx, jobs)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Couldn't create all tile requests: %+v", err)
+	}
+
 	close(jobs)
 	log.Print("Job queue closed")
 
@@ -329,19 +736,43 @@ func main() {
 	close(results)
 	log.Print("Finished making tile requests")
 
+	if retryStats != nil {
+		log.Printf("Tile request summary: %s", retryStats)
+	}
+
 	// Wait for the results to be written out
 	resultWG.Wait()
+	close(stopSampling)
+	writer.finish()
+	log.Printf("Queue depths: %s", queueStats)
 	log.Print("Finished processing tiles")
 
-	err = outputter.AssignSpatialMetadata(bounds, zooms[0], zooms[len(zooms)-1])
-	if err != nil {
-		log.Printf("Wrote tiles but failed to assign spatial metadata, %v", err)
+	// An update refreshes tiles of an existing archive, whose spatial
+	// metadata already describes the whole tileset.
+	if *updateArchive == "" {
+		err = outputter.AssignSpatialMetadata(bounds, zooms[0], zooms[len(zooms)-1])
+		if err != nil {
+			log.Printf("Wrote tiles but failed to assign spatial metadata, %v", err)
+		}
+	}
+
+	if layers != nil {
+		if n := layers.UndecodableTiles(); n > 0 {
+			log.Printf("%d tiles could not be decoded and are missing from vector_layers", n)
+		}
+		if err := layers.Apply(metadata); err != nil {
+			log.Printf("Couldn't write vector_layers metadata: %+v", err)
+		}
 	}
 
 	err = outputter.Close()
 	if err != nil {
 		log.Printf("Error closing processor: %+v", err)
 	}
+
+	if ctx.Err() != nil {
+		log.Fatalf("Build was interrupted, %s output holds the tiles fetched before it was", *outputMode)
+	}
 }
 
 func calculateExpectedTiles(bounds orb.Bound, zooms []maptile.Zoom) uint32 {
@@ -36,3 +36,39 @@ func Test_calculateExpectedTiles(t *testing.T) {
 		}
 	})
 }
+
+func Test_parseRequestConfig(t *testing.T) {
+	t.Setenv("BUILD_TEST_KEY", "k3y")
+
+	headers, params, secrets, err := parseRequestConfig(
+		[]string{"X-Client: tilepack", "Authorization: Bearer ${BUILD_TEST_KEY}"},
+		"",
+		[]string{"key=${BUILD_TEST_KEY}", "style=dark"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if headers.Get("X-Client") != "tilepack" || headers.Get("Authorization") != "Bearer k3y" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if params["key"] != "k3y" || params["style"] != "dark" {
+		t.Errorf("unexpected params %v", params)
+	}
+	// Only values that came from the environment are secrets.
+	for _, s := range secrets {
+		if s != "k3y" {
+			t.Errorf("unexpected secret %q", s)
+		}
+	}
+	if len(secrets) != 2 {
+		t.Errorf("expected 2 secrets, got %v", secrets)
+	}
+
+	if _, _, _, err := parseRequestConfig(nil, "", []string{"novalue"}); err == nil {
+		t.Error("expected error for URL parameter without '='")
+	}
+	if _, _, _, err := parseRequestConfig([]string{"nocolon"}, "", nil); err == nil {
+		t.Error("expected error for malformed header")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func testDiff() *tilepack.ArchiveDiff {
+	return &tilepack.ArchiveDiff{
+		Zooms: map[maptile.Zoom]*tilepack.ZoomDiff{
+			2: {Added: 1, AddedBytes: 10},
+			0: {Unchanged: 1},
+			1: {Removed: 2, RemovedBytes: 30, Changed: 1, ChangedBytes: 5},
+		},
+		BaseChecksum:   &tilepack.ArchiveChecksum{},
+		TargetChecksum: &tilepack.ArchiveChecksum{},
+	}
+}
+
+func TestNewDiffReport(t *testing.T) {
+	report := newDiffReport("a.mbtiles", "b.pmtiles", testDiff())
+
+	if len(report.Zooms) != 3 || *report.Zooms[0].Zoom != 0 || *report.Zooms[2].Zoom != 2 {
+		t.Fatalf("zooms must be sorted: %+v", report.Zooms)
+	}
+	if report.Zooms[1].ByteDelta != -25 {
+		t.Errorf("z1 byte delta: got %d, want -25", report.Zooms[1].ByteDelta)
+	}
+	if report.Total.Added != 1 || report.Total.Removed != 2 || report.Total.ByteDelta != -15 {
+		t.Errorf("total: %+v", report.Total)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeTable(&buf, newDiffReport("a", "b", testDiff())); err != nil {
+		t.Fatalf("writeTable: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected header, 3 zooms and total, got:\n%s", buf.String())
+	}
+	if fields := strings.Fields(lines[4]); fields[0] != "total" || fields[len(fields)-1] != "-15" {
+		t.Errorf("total row: %q", lines[4])
+	}
+}
+
+func TestChangeFeature(t *testing.T) {
+	feature := changeFeature(&tilepack.TileChange{Tile: maptile.New(0, 0, 1), Kind: tilepack.TileRemoved, OldSize: 7})
+
+	if feature.Properties["change"] != "removed" || feature.Properties["old_size"] != 7 {
+		t.Errorf("properties: %v", feature.Properties)
+	}
+	bound := feature.Geometry.Bound()
+	if bound.Min[0] != -180 || bound.Max[0] != 0 {
+		t.Errorf("footprint: %v", bound)
+	}
+}
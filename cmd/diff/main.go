@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// zoomReport is the JSON form of a tilepack.ZoomDiff.
+type zoomReport struct {
+	Zoom         *maptile.Zoom `json:"zoom,omitempty"`
+	Added        int64         `json:"added"`
+	Removed      int64         `json:"removed"`
+	Changed      int64         `json:"changed"`
+	Unchanged    int64         `json:"unchanged"`
+	AddedBytes   int64         `json:"added_bytes"`
+	RemovedBytes int64         `json:"removed_bytes"`
+	ChangedBytes int64         `json:"changed_bytes"`
+	ByteDelta    int64         `json:"byte_delta"`
+}
+
+type diffReport struct {
+	Base           string       `json:"base"`
+	Target         string       `json:"target"`
+	BaseChecksum   string       `json:"base_checksum"`
+	TargetChecksum string       `json:"target_checksum"`
+	Zooms          []zoomReport `json:"zooms"`
+	Total          zoomReport   `json:"total"`
+}
+
+func newZoomReport(zoom *maptile.Zoom, d *tilepack.ZoomDiff) zoomReport {
+	return zoomReport{
+		Zoom:         zoom,
+		Added:        d.Added,
+		Removed:      d.Removed,
+		Changed:      d.Changed,
+		Unchanged:    d.Unchanged,
+		AddedBytes:   d.AddedBytes,
+		RemovedBytes: d.RemovedBytes,
+		ChangedBytes: d.ChangedBytes,
+		ByteDelta:    d.ByteDelta(),
+	}
+}
+
+func newDiffReport(base string, target string, diff *tilepack.ArchiveDiff) *diffReport {
+	report := &diffReport{
+		Base:           base,
+		Target:         target,
+		BaseChecksum:   diff.BaseChecksum.String(),
+		TargetChecksum: diff.TargetChecksum.String(),
+		Zooms:          make([]zoomReport, 0, len(diff.Zooms)),
+		Total:          newZoomReport(nil, diff.Total()),
+	}
+
+	for _, z := range diff.SortedZooms() {
+		zoom := z
+		report.Zooms = append(report.Zooms, newZoomReport(&zoom, diff.Zooms[z]))
+	}
+
+	return report
+}
+
+// writeTable writes report as a table with one row per zoom.
+func writeTable(w io.Writer, report *diffReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "zoom\tadded\tremoved\tchanged\tunchanged\tbyte delta\t")
+
+	row := func(label string, r zoomReport) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%+d\t\n", label, r.Added, r.Removed, r.Changed, r.Unchanged, r.ByteDelta)
+	}
+
+	for _, r := range report.Zooms {
+		row(fmt.Sprintf("%d", *r.Zoom), r)
+	}
+	row("total", report.Total)
+
+	return tw.Flush()
+}
+
+// changeFeature returns the footprint of a changed tile as a GeoJSON feature.
+func changeFeature(change *tilepack.TileChange) *geojson.Feature {
+	feature := geojson.NewFeature(change.Tile.Bound().ToPolygon())
+	feature.Properties["z"] = change.Tile.Z
+	feature.Properties["x"] = change.Tile.X
+	feature.Properties["y"] = change.Tile.Y
+	feature.Properties["change"] = change.Kind.String()
+	feature.Properties["old_size"] = change.OldSize
+	feature.Properties["new_size"] = change.NewSize
+	return feature
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "Write the report as JSON instead of a table.")
+	geojsonPath := flag.String("geojson", "", "Write the footprints of added, removed and changed tiles to this GeoJSON file.")
+	patchPath := flag.String("patch", "", "Write an MBTiles patch archive holding only the added and changed tiles, and listing the removed ones, to this path.")
+	hashName := flag.String("hash", tilepack.DefaultContentHasher.Name(), "Content hash tiles are compared and checksummed by. Options are "+strings.Join(tilepack.ContentHasherNames(), ", ")+". The patch records it, so it applies whichever is used.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] BASE TARGET\n\nCompares two mbtiles, pmtiles or disk archives tile by tile.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	basePath, targetPath := flag.Arg(0), flag.Arg(1)
+
+	hasher, err := tilepack.ParseContentHasher(*hashName)
+	if err != nil {
+		log.Fatalf("Invalid -hash: %v", err)
+	}
+
+	base, err := tilepack.OpenTileReader(basePath)
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", basePath, err)
+	}
+	defer base.Close()
+
+	target, err := tilepack.OpenTileReader(targetPath)
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", targetPath, err)
+	}
+	defer target.Close()
+
+	var features *geojson.FeatureCollection
+	if *geojsonPath != "" {
+		features = geojson.NewFeatureCollection()
+	}
+
+	var patch *tilepack.PatchWriter
+	var patchMetadata *tilepack.MbtilesMetadata
+	if *patchPath != "" {
+		if _, err := os.Stat(*patchPath); err == nil {
+			log.Fatalf("Patch path %s already exists and cannot be overwritten", *patchPath)
+		}
+
+		patchMetadata, err = target.Metadata()
+		if err != nil {
+			log.Fatalf("Couldn't read metadata of %s: %+v", targetPath, err)
+		}
+
+		patch, err = tilepack.NewPatchWriter(*patchPath, 1000, hasher, patchMetadata)
+		if err != nil {
+			log.Fatalf("Couldn't create patch %s: %+v", *patchPath, err)
+		}
+	}
+
+	diff, err := tilepack.DiffTileReaders(base, target, hasher, func(change *tilepack.TileChange) error {
+		if features != nil {
+			features.Append(changeFeature(change))
+		}
+
+		if patch == nil {
+			return nil
+		}
+		if change.Kind == tilepack.TileRemoved {
+			return patch.Delete(change.Tile)
+		}
+		return patch.Save(change.Tile, change.Data)
+	})
+	if err != nil {
+		log.Fatalf("Couldn't compare %s and %s: %+v", basePath, targetPath, err)
+	}
+
+	if patch != nil {
+		// The metadata is written on Close, so the checksums can be added now.
+		patchMetadata.Set(tilepack.PatchBaseChecksumKey, diff.BaseChecksum.String())
+		patchMetadata.Set(tilepack.PatchTargetChecksumKey, diff.TargetChecksum.String())
+
+		if err := patch.Close(); err != nil {
+			log.Fatalf("Couldn't write patch %s: %+v", *patchPath, err)
+		}
+	}
+
+	if features != nil {
+		data, err := features.MarshalJSON()
+		if err != nil {
+			log.Fatalf("Couldn't encode GeoJSON: %+v", err)
+		}
+		if err := os.WriteFile(*geojsonPath, data, 0644); err != nil {
+			log.Fatalf("Couldn't write %s: %+v", *geojsonPath, err)
+		}
+	}
+
+	report := newDiffReport(basePath, targetPath, diff)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeTable(os.Stdout, report)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't write report: %+v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestParseBounds_KeepsAntimeridianCrossing(t *testing.T) {
+	bounds, err := parseBounds("-10, 170, 10, -170")
+	if err != nil {
+		t.Fatalf("parseBounds: %v", err)
+	}
+	want := orb.Bound{Min: orb.Point{170, -10}, Max: orb.Point{-170, 10}}
+	if bounds != want {
+		t.Errorf("bounds = %v, want %v", bounds, want)
+	}
+
+	if _, err := parseBounds("1,2,3"); err == nil {
+		t.Error("expected an error for three numbers")
+	}
+}
+
+func TestParseZoomRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max maptile.Zoom
+		wantErr  bool
+	}{
+		{in: "3-8", min: 3, max: 8},
+		{in: "5", min: 5, max: 5},
+		{in: "8-3", wantErr: true},
+		{in: "a-3", wantErr: true},
+	}
+	for _, test := range tests {
+		minZoom, maxZoom, err := parseZoomRange(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseZoomRange(%q): expected an error", test.in)
+			}
+			continue
+		}
+		if err != nil || minZoom != test.min || maxZoom != test.max {
+			t.Errorf("parseZoomRange(%q) = %d, %d, %v, want %d, %d", test.in, minZoom, maxZoom, err, test.min, test.max)
+		}
+	}
+}
+
+func TestParseSelectionGeometry(t *testing.T) {
+	polygon := `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"geometry", polygon, "Polygon"},
+		{"feature", `{"type":"Feature","properties":{},"geometry":` + polygon + `}`, "Polygon"},
+		{"collection", `{"type":"FeatureCollection","features":[
+			{"type":"Feature","properties":{},"geometry":` + polygon + `},
+			{"type":"Feature","properties":{},"geometry":` + polygon + `}]}`, "GeometryCollection"},
+	}
+	for _, test := range tests {
+		geometry, err := parseSelectionGeometry([]byte(test.in))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if geometry.GeoJSONType() != test.want {
+			t.Errorf("%s: type = %s, want %s", test.name, geometry.GeoJSONType(), test.want)
+		}
+	}
+
+	if _, err := parseSelectionGeometry([]byte(`{"type":"FeatureCollection","features":[]}`)); err == nil {
+		t.Error("expected an error for an empty feature collection")
+	}
+}
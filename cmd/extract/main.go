@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/tilezen/go-tilepacks/tilepack"
+
+	// Object storage drivers for bucket URL DSNs.
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+)
+
+// parseBounds parses a south,west,north,east bounding box.
+func parseBounds(s string) (orb.Bound, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return orb.Bound{}, fmt.Errorf("bounding box must be a comma-separated list of 4 numbers")
+	}
+
+	values := make([]float64, 4)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("bounding box could not be parsed as numbers: %w", err)
+		}
+		values[i] = value
+	}
+
+	// West may be greater than east for a box crossing the antimeridian, so
+	// the corners are kept as given rather than normalized.
+	return orb.Bound{Min: orb.Point{values[1], values[0]}, Max: orb.Point{values[3], values[2]}}, nil
+}
+
+// parseZoomRange parses a '{MIN_ZOOM}-{MAX_ZOOM}' range or a single zoom.
+func parseZoomRange(s string) (maptile.Zoom, maptile.Zoom, error) {
+	minStr, maxStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		maxStr = minStr
+	}
+
+	minZoom, err := strconv.ParseUint(minStr, 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse min zoom (%s): %w", minStr, err)
+	}
+	maxZoom, err := strconv.ParseUint(maxStr, 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse max zoom (%s): %w", maxStr, err)
+	}
+	if minZoom > maxZoom {
+		return 0, 0, fmt.Errorf("invalid zoom range %s", s)
+	}
+	return maptile.Zoom(minZoom), maptile.Zoom(maxZoom), nil
+}
+
+// parseSelectionGeometry reads the polygons of a GeoJSON geometry, feature or
+// feature collection.
+func parseSelectionGeometry(data []byte) (orb.Geometry, error) {
+	var doc struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	switch doc.Type {
+	case "FeatureCollection":
+		fc, err := geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(fc.Features) == 0 {
+			return nil, fmt.Errorf("feature collection has no features")
+		}
+		if len(fc.Features) == 1 {
+			return fc.Features[0].Geometry, nil
+		}
+		collection := make(orb.Collection, 0, len(fc.Features))
+		for _, feature := range fc.Features {
+			collection = append(collection, feature.Geometry)
+		}
+		return collection, nil
+	case "Feature":
+		feature, err := geojson.UnmarshalFeature(data)
+		if err != nil {
+			return nil, err
+		}
+		return feature.Geometry, nil
+	default:
+		geometry, err := geojson.UnmarshalGeometry(data)
+		if err != nil {
+			return nil, err
+		}
+		return geometry.Geometry(), nil
+	}
+}
+
+// archiveZoomRange returns the zoom range recorded in the metadata of the
+// input archive.
+func archiveZoomRange(metadata *tilepack.MbtilesMetadata) (maptile.Zoom, maptile.Zoom, error) {
+	minZoom, err := metadata.MinZoom()
+	if err != nil {
+		return 0, 0, err
+	}
+	maxZoom, err := metadata.MaxZoom()
+	if err != nil {
+		return 0, 0, err
+	}
+	return maptile.Zoom(minZoom), maptile.Zoom(maxZoom), nil
+}
+
+func main() {
+	boundsStr := flag.String("bounds", "", "Comma-separated bounding box in south,west,north,east format. Defaults to the whole world.")
+	geojsonPath := flag.String("geojson", "", "Path to a GeoJSON Polygon or MultiPolygon, or a Feature or FeatureCollection of them. Only tiles touching it are copied.")
+	zoomsStr := flag.String("zooms", "", "A '{MIN_ZOOM}-{MAX_ZOOM}' range string or a single zoom. Defaults to the zoom range in the input metadata.")
+	outputMode := flag.String("output-mode", "mbtiles", "Valid modes are: disk, mbtiles, pmtiles, zip, tar, metatile, tapalcatl2.")
+	outputDSN := flag.String("dsn", "", "Path, or DSN string, to output files.")
+	batchSize := flag.Int("batch-size", 1000, "(For mbtiles outputter) Number of tiles to batch together before writing to mbtiles")
+	mbtilesSchema := flag.String("mbtiles-schema", tilepack.MbtilesSchemaDedup, "(For mbtiles outputter) Table layout of a new archive. dedup stores identical tiles once behind a tiles view, flat writes a single tiles table. An existing archive keeps its layout.")
+	mbtilesWAL := flag.Bool("mbtiles-wal", false, "(For mbtiles outputter) Write in SQLite WAL mode, so the archive can be read while it is written. It is switched back to a rollback journal when done.")
+	mbtilesExclusive := flag.Bool("mbtiles-exclusive", false, "(For mbtiles outputter) Hold an exclusive lock on the archive while writing, which is faster but keeps other processes from reading it.")
+	mbtilesOptimize := flag.Bool("mbtiles-optimize", false, "(For mbtiles outputter) Run ANALYZE and VACUUM once all tiles are written.")
+	hashName := flag.String("hash", tilepack.DefaultContentHasher.Name(), "(For mbtiles, pmtiles, zip, tar and dedup=hardlink disk outputters) Content hash tiles are deduplicated by. Options are "+strings.Join(tilepack.ContentHasherNames(), ", ")+".")
+	pmtilesCompression := flag.String("pmtiles-compression", "", "(For pmtiles outputter) Compression tiles are stored with. Options are "+strings.Join(tilepack.TileCompressionNames(), ", ")+". Defaults to gzip for vector tiles and none for images.")
+	tilesetName := flag.String("tileset-name", "", "(For mbtiles and pmtiles outputter) Name of the tileset to write to the metadata. Defaults to the input's name.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] INPUT\n\nCopies the tiles of an mbtiles, pmtiles or disk archive within a bounding box, polygon or zoom range to a new archive.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	inputPath := flag.Arg(0)
+
+	if *outputDSN == "" {
+		log.Fatalf("Output DSN (-dsn) is required")
+	}
+	hasher, err := tilepack.ParseContentHasher(*hashName)
+	if err != nil {
+		log.Fatalf("Invalid -hash: %v", err)
+	}
+	if *boundsStr != "" && *geojsonPath != "" {
+		log.Fatalf("-bounds and -geojson cannot be used together")
+	}
+	if *outputMode != "disk" && *outputMode != "metatile" && *outputMode != "tapalcatl2" && !tilepack.IsBucketURL(*outputDSN) {
+		// Writing into an existing archive would merge the extract with it.
+		if _, err := os.Stat(*outputDSN); err == nil {
+			log.Fatalf("Output path %s already exists and cannot be overwritten", *outputDSN)
+		}
+	}
+
+	reader, err := tilepack.OpenTileReader(inputPath)
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", inputPath, err)
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		log.Fatalf("Couldn't read metadata of %s: %+v", inputPath, err)
+	}
+
+	var minZoom, maxZoom maptile.Zoom
+	if *zoomsStr != "" {
+		minZoom, maxZoom, err = parseZoomRange(*zoomsStr)
+	} else {
+		minZoom, maxZoom, err = archiveZoomRange(metadata)
+		if err != nil {
+			err = fmt.Errorf("%s has no zoom range in its metadata, use -zooms: %w", inputPath, err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var selection *tilepack.TileSelection
+	switch {
+	case *geojsonPath != "":
+		data, err := os.ReadFile(*geojsonPath)
+		if err != nil {
+			log.Fatalf("Couldn't read %s: %+v", *geojsonPath, err)
+		}
+		geometry, err := parseSelectionGeometry(data)
+		if err != nil {
+			log.Fatalf("Couldn't parse %s: %+v", *geojsonPath, err)
+		}
+		selection, err = tilepack.NewGeometrySelection(geometry, minZoom, maxZoom)
+		if err != nil {
+			log.Fatalf("Invalid geometry in %s: %+v", *geojsonPath, err)
+		}
+	case *boundsStr != "":
+		bounds, err := parseBounds(*boundsStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		selection = tilepack.NewBoundsSelection(bounds, minZoom, maxZoom)
+	default:
+		selection = tilepack.NewBoundsSelection(orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}, minZoom, maxZoom)
+	}
+
+	// The spatial keys are assigned again from the extracted tiles.
+	for _, key := range []string{"bounds", "center", "minzoom", "maxzoom"} {
+		metadata.Delete(key)
+	}
+	if *tilesetName != "" {
+		metadata.Set("name", *tilesetName)
+	}
+
+	var outputter tilepack.TileOutputter
+	switch *outputMode {
+	case "disk":
+		diskOutputter, diskErr := tilepack.NewDiskOutputter(*outputDSN)
+		if diskErr == nil {
+			diskOutputter.SetMetadata(metadata)
+			diskOutputter.SetContentHasher(hasher)
+		}
+		outputter, err = diskOutputter, diskErr
+	case "zip", "tar":
+		newBundleOutputter := tilepack.NewZipOutputter
+		if *outputMode == "tar" {
+			newBundleOutputter = tilepack.NewTarOutputter
+		}
+		bundleOutputter, bundleErr := newBundleOutputter(*outputDSN)
+		if bundleErr == nil {
+			bundleOutputter.SetMetadata(metadata)
+			bundleOutputter.SetContentHasher(hasher)
+		}
+		outputter, err = bundleOutputter, bundleErr
+	case "metatile":
+		outputter, err = tilepack.NewMetatileOutputter(*outputDSN)
+	case "tapalcatl2":
+		outputter, err = tilepack.NewTapalcatl2Outputter(*outputDSN)
+	case "mbtiles":
+		mbtilesOutputter, mbtilesErr := tilepack.NewMbtilesOutputter(*outputDSN, *batchSize, false, metadata)
+		if mbtilesErr == nil {
+			mbtilesOutputter.SetContentHasher(hasher)
+			mbtilesOutputter.SetWAL(*mbtilesWAL)
+			mbtilesOutputter.SetExclusive(*mbtilesExclusive)
+			mbtilesOutputter.SetOptimize(*mbtilesOptimize)
+			mbtilesErr = mbtilesOutputter.SetSchema(*mbtilesSchema)
+		}
+		outputter, err = mbtilesOutputter, mbtilesErr
+	case "pmtiles":
+		format, formatErr := metadata.Format()
+		if formatErr != nil {
+			log.Fatalf("Couldn't read format of %s: %+v", inputPath, formatErr)
+		}
+		pmtilesOutputter, pmtilesErr := tilepack.NewPmtilesOutputter(*outputDSN, format, metadata)
+		if pmtilesErr == nil {
+			pmtilesOutputter.SetContentHasher(hasher)
+			if *pmtilesCompression != "" {
+				compression, compressionErr := tilepack.ParseTileCompression(*pmtilesCompression)
+				if compressionErr != nil {
+					log.Fatalf("Invalid -pmtiles-compression: %v", compressionErr)
+				}
+				pmtilesErr = pmtilesOutputter.SetTileCompression(compression)
+			}
+		}
+		outputter, err = pmtilesOutputter, pmtilesErr
+	default:
+		log.Fatalf("Unknown outputter: %s", *outputMode)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't create %s output: %+v", *outputMode, err)
+	}
+
+	log.Printf("Extracting zooms %d-%d of %s to %s", minZoom, maxZoom, inputPath, *outputDSN)
+
+	result, err := tilepack.ExtractTiles(reader, outputter, selection)
+	if err != nil {
+		outputter.Close()
+		log.Fatalf("Couldn't extract tiles: %+v", err)
+	}
+
+	if result.Tiles == 0 {
+		log.Printf("No tiles matched the selection")
+	} else if err := outputter.AssignSpatialMetadata(result.Bounds, result.MinZoom, result.MaxZoom); err != nil {
+		log.Printf("Wrote tiles but failed to assign spatial metadata, %v", err)
+	}
+
+	if err := outputter.Close(); err != nil {
+		log.Fatalf("Couldn't close %s output: %+v", *outputMode, err)
+	}
+	log.Printf("Extracted %d tiles", result.Tiles)
+}
@@ -4,8 +4,6 @@ import (
 	"flag"
 	"log"
 
-	"github.com/paulmach/orb"
-	"github.com/paulmach/orb/maptile"
 	"github.com/tilezen/go-tilepacks/tilepack"
 )
 
@@ -19,62 +17,31 @@ func main() {
 
 	for _, path := range flag.Args() {
 
-		mbtilesReader, err := tilepack.NewMbtilesReader(path)
+		spatial, err := tilepack.ComputeSpatialMetadata(path)
 
 		if err != nil {
-			log.Fatalf("Couldn't read input mbtiles %s: %+v", path, err)
+			log.Fatalf("Couldn't compute spatial metadata of %s: %+v", path, err)
 		}
 
-		var bounds *orb.Bound
-		minZoom := uint(20)
-		maxZoom := uint(0)
-
-		err = mbtilesReader.VisitAllTiles(func(t maptile.Tile, data []byte) {
-
-			tb := t.Bound()
-
-			if bounds == nil {
-				bounds = &tb
-			} else {
-				tb = bounds.Union(tb)
-				bounds = &tb
-			}
-
-			minZoom = min(minZoom, uint(t.Z))
-			maxZoom = max(maxZoom, uint(t.Z))
+		err = tilepack.UpdateArchiveMetadata(path, func(metadata *tilepack.MbtilesMetadata) error {
+			spatial.Apply(metadata)
+			return nil
 		})
 
-		if err != nil {
-			log.Fatalf("Couldn't read tiles from %s: %+v", path, err)
-		}
-
-		mbtilesReader.Close()
-
-		metadata := tilepack.NewMbtilesMetadata(map[string]string{})
-
-		mbtilesWriter, err := tilepack.NewMbtilesOutputter(path, 0, false, metadata)
-
-		if err != nil {
-			log.Fatalf("Couldn't read input mbtiles %s: %+v", path, err)
-		}
-
-		err = mbtilesWriter.AssignSpatialMetadata(*bounds, maptile.Zoom(minZoom), maptile.Zoom(maxZoom))
-
 		if err != nil {
 			log.Fatalf("Failed to assign spatial metadata to %s: %+v", path, err)
 		}
 
-		mbtilesWriter.Close()
-
 		if verify {
 
-			mbtilesReader, err := tilepack.NewMbtilesReader(path)
+			reader, err := tilepack.OpenTileReader(path)
 
 			if err != nil {
-				log.Fatalf("Couldn't read input mbtiles %s: %+v", path, err)
+				log.Fatalf("Couldn't read input %s: %+v", path, err)
 			}
 
-			metadata, err := mbtilesReader.Metadata()
+			metadata, err := reader.Metadata()
+			reader.Close()
 
 			if err != nil {
 				log.Fatalf("Unable to read metadata for %s, %v", path, err)
@@ -89,7 +56,7 @@ func main() {
 			center, zoom, err := metadata.Center()
 
 			if err != nil {
-				log.Fatalf("Failed to derive bounds metadata after update")
+				log.Fatalf("Failed to derive center metadata after update")
 			}
 
 			minZoom, err := metadata.MinZoom()
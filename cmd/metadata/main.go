@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+const usage = `Usage: %s [flags] COMMAND ARCHIVE [ARGS]
+
+Reads and edits the metadata of an mbtiles or pmtiles archive.
+
+Commands:
+  get ARCHIVE [KEY]               Print one value, or every key and value.
+  set ARCHIVE KEY VALUE...        Set one or more keys.
+  delete ARCHIVE KEY...           Delete keys.
+  import-json ARCHIVE FILE        Set the keys of a JSON object, as written by export-json. FILE may be - for stdin.
+  export-json ARCHIVE             Print the metadata as a JSON object.
+
+`
+
+// readMetadata returns the metadata of the archive at path.
+func readMetadata(path string) (*tilepack.MbtilesMetadata, error) {
+	reader, err := tilepack.OpenTileReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return reader.Metadata()
+}
+
+// get writes the value of key, or every key and value when key is empty.
+func get(w io.Writer, metadata *tilepack.MbtilesMetadata, key string) error {
+	if key != "" {
+		value, ok := metadata.Get(key)
+		if !ok {
+			return fmt.Errorf("key %s is not set", key)
+		}
+		fmt.Fprintln(w, value)
+		return nil
+	}
+
+	keys := metadata.Keys()
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, _ := metadata.Get(k)
+		fmt.Fprintf(w, "%s\t%s\n", k, value)
+	}
+	return nil
+}
+
+// importJSON sets the keys of the JSON object in data on metadata. When
+// replace is true the existing keys are removed first.
+func importJSON(metadata *tilepack.MbtilesMetadata, data []byte, replace bool) error {
+	imported := tilepack.NewMbtilesMetadata(nil)
+	if err := json.Unmarshal(data, imported); err != nil {
+		return fmt.Errorf("invalid metadata JSON: %w", err)
+	}
+
+	if replace {
+		for _, key := range metadata.Keys() {
+			metadata.Delete(key)
+		}
+	}
+	for _, key := range imported.Keys() {
+		value, _ := imported.Get(key)
+		metadata.Set(key, value)
+	}
+	return nil
+}
+
+func main() {
+	force := flag.Bool("force", false, "Write metadata that does not pass validation against the MBTiles spec.")
+	replace := flag.Bool("replace", false, "(For import-json) Remove every existing key before importing.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, archivePath, args := flag.Arg(0), flag.Arg(1), flag.Args()[2:]
+
+	if _, err := os.Stat(archivePath); err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+
+	var update func(*tilepack.MbtilesMetadata) error
+
+	switch command {
+	case "get":
+		if len(args) > 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		metadata, err := readMetadata(archivePath)
+		if err != nil {
+			log.Fatalf("Couldn't read metadata of %s: %+v", archivePath, err)
+		}
+		key := ""
+		if len(args) == 1 {
+			key = args[0]
+		}
+		if err := get(os.Stdout, metadata, key); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "export-json":
+		if len(args) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		metadata, err := readMetadata(archivePath)
+		if err != nil {
+			log.Fatalf("Couldn't read metadata of %s: %+v", archivePath, err)
+		}
+		data, err := json.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			log.Fatalf("Couldn't encode metadata: %+v", err)
+		}
+		fmt.Println(string(data))
+		return
+	case "set":
+		if len(args) == 0 || len(args)%2 != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		update = func(m *tilepack.MbtilesMetadata) error {
+			for i := 0; i < len(args); i += 2 {
+				m.Set(args[i], args[i+1])
+			}
+			return nil
+		}
+	case "delete":
+		if len(args) == 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		update = func(m *tilepack.MbtilesMetadata) error {
+			for _, key := range args {
+				if _, ok := m.Get(key); !ok {
+					return fmt.Errorf("key %s is not set", key)
+				}
+				m.Delete(key)
+			}
+			return nil
+		}
+	case "import-json":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		var data []byte
+		var err error
+		if args[0] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(args[0])
+		}
+		if err != nil {
+			log.Fatalf("Couldn't read %s: %+v", args[0], err)
+		}
+		update = func(m *tilepack.MbtilesMetadata) error {
+			return importJSON(m, data, *replace)
+		}
+	default:
+		log.Printf("Unknown command %q", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := tilepack.UpdateArchiveMetadata(archivePath, func(m *tilepack.MbtilesMetadata) error {
+		if err := update(m); err != nil {
+			return err
+		}
+		if err := m.Validate(); err != nil && !*force {
+			return fmt.Errorf("metadata is invalid, use -force to write it anyway: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Couldn't update metadata of %s: %v", archivePath, err)
+	}
+}
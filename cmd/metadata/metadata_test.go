@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestGet(t *testing.T) {
+	metadata := tilepack.NewMbtilesMetadata(map[string]string{"name": "test", "format": "pbf"})
+
+	var buf bytes.Buffer
+	if err := get(&buf, metadata, ""); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if buf.String() != "format\tpbf\nname\ttest\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := get(&buf, metadata, "name"); err != nil || buf.String() != "test\n" {
+		t.Errorf("get name: %q, %v", buf.String(), err)
+	}
+	if err := get(&buf, metadata, "missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	data := []byte(`{"name": "imported", "minzoom": 2, "bounds": [-1, -2, 3, 4], "json": {"vector_layers": []}}`)
+
+	metadata := tilepack.NewMbtilesMetadata(map[string]string{"name": "old", "attribution": "kept"})
+	if err := importJSON(metadata, data, false); err != nil {
+		t.Fatalf("importJSON: %v", err)
+	}
+	want := map[string]string{
+		"name":        "imported",
+		"minzoom":     "2",
+		"bounds":      "-1,-2,3,4",
+		"json":        `{"vector_layers":[]}`,
+		"attribution": "kept",
+	}
+	for key, value := range want {
+		if got, _ := metadata.Get(key); got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+
+	if err := importJSON(metadata, data, true); err != nil {
+		t.Fatalf("importJSON: %v", err)
+	}
+	if _, ok := metadata.Get("attribution"); ok {
+		t.Error("-replace must remove keys missing from the JSON")
+	}
+
+	if err := importJSON(metadata, []byte(`[1, 2]`), false); err == nil {
+		t.Error("expected an error for a JSON array")
+	}
+}
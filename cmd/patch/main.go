@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func main() {
+	force := flag.Bool("force", false, "Apply the patch even if the archive is not the one it was made from, and whatever the result.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ARCHIVE PATCH\n\nApplies a patch made with diff -patch to an mbtiles file in place.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	archivePath, patchPath := flag.Arg(0), flag.Arg(1)
+
+	for _, path := range []string{archivePath, patchPath} {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatalf("Couldn't open %s: %+v", path, err)
+		}
+	}
+
+	result, err := tilepack.ApplyMbtilesPatch(archivePath, patchPath, *force)
+	if errors.Is(err, tilepack.ErrPatchChecksumMismatch) {
+		log.Fatalf("Refusing to patch %s: %v. Use -force to apply it anyway.", archivePath, err)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't apply %s to %s: %+v", patchPath, archivePath, err)
+	}
+
+	log.Printf("Wrote %d tiles, deleted %d tiles and removed %d unreferenced images", result.Written, result.Deleted, result.ImagesRemoved)
+	log.Printf("Archive checksum is now %s", result.Checksum)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	gohttp "net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/tilezen/go-tilepacks/http"
@@ -25,6 +26,7 @@ func loggingMiddleware(logger *log.Logger) func(gohttp.Handler) gohttp.Handler {
 func main() {
 	mbtilesFile := flag.String("input", "", "The name of the mbtiles file to serve from.")
 	addr := flag.String("listen", ":8080", "The address and port to listen on")
+	hashName := flag.String("hash", tilepack.DefaultContentHasher.Name(), "Content hash tile ETags are made from. Options are "+strings.Join(tilepack.ContentHasherNames(), ", ")+".")
 	flag.Parse()
 
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
@@ -33,12 +35,17 @@ func main() {
 		logger.Fatal("Need to provide --input parameter")
 	}
 
+	hasher, err := tilepack.ParseContentHasher(*hashName)
+	if err != nil {
+		logger.Fatalf("Invalid -hash: %v", err)
+	}
+
 	reader, err := tilepack.NewMbtilesReader(*mbtilesFile)
 	if err != nil {
 		logger.Fatalf("Couldn't create MBtilesReader, %v", err)
 	}
 
-	mbtilesHandler := http.MbtilesHandler(reader)
+	mbtilesHandler := http.MbtilesHandlerWithHasher(reader, hasher)
 
 	router := gohttp.NewServeMux()
 	router.HandleFunc("/preview.html", previewHTMLHandler)
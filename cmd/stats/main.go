@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+// zoomReport is the JSON form of a tilepack.ZoomStats.
+type zoomReport struct {
+	Zoom   *maptile.Zoom `json:"zoom,omitempty"`
+	Tiles  int64         `json:"tiles"`
+	Bytes  int64         `json:"bytes"`
+	Min    int           `json:"min_size"`
+	Median int           `json:"median_size"`
+	P99    int           `json:"p99_size"`
+	Max    int           `json:"max_size"`
+}
+
+type tileReport struct {
+	Z    maptile.Zoom `json:"z"`
+	X    uint32       `json:"x"`
+	Y    uint32       `json:"y"`
+	Size int          `json:"size"`
+}
+
+type layerReport struct {
+	Name      string       `json:"name"`
+	Tiles     int64        `json:"tiles"`
+	Features  int64        `json:"features"`
+	Bytes     int64        `json:"bytes"`
+	ByteShare float64      `json:"byte_share"`
+	MinZoom   maptile.Zoom `json:"minzoom"`
+	MaxZoom   maptile.Zoom `json:"maxzoom"`
+}
+
+type statsReport struct {
+	Archive          string        `json:"archive"`
+	Addressed        int64         `json:"addressed_tiles"`
+	Unique           int64         `json:"unique_tiles"`
+	DedupRatio       float64       `json:"dedup_ratio"`
+	Zooms            []zoomReport  `json:"zooms"`
+	Total            zoomReport    `json:"total"`
+	Largest          []tileReport  `json:"largest"`
+	Layers           []layerReport `json:"layers,omitempty"`
+	UndecodableTiles int64         `json:"undecodable_tiles,omitempty"`
+}
+
+func newZoomReport(zoom *maptile.Zoom, s *tilepack.ZoomStats) zoomReport {
+	return zoomReport{
+		Zoom:   zoom,
+		Tiles:  s.Tiles,
+		Bytes:  s.Bytes,
+		Min:    s.SizePercentile(0),
+		Median: s.SizePercentile(50),
+		P99:    s.SizePercentile(99),
+		Max:    s.SizePercentile(100),
+	}
+}
+
+func newStatsReport(archive string, stats *tilepack.ArchiveStats) *statsReport {
+	report := &statsReport{
+		Archive:          archive,
+		Addressed:        stats.Addressed,
+		Unique:           stats.Unique,
+		DedupRatio:       stats.DedupRatio(),
+		Zooms:            make([]zoomReport, 0, len(stats.Zooms)),
+		Total:            newZoomReport(nil, stats.Total()),
+		Largest:          make([]tileReport, 0, len(stats.Largest)),
+		UndecodableTiles: stats.UndecodableTiles,
+	}
+
+	for _, z := range stats.SortedZooms() {
+		zoom := z
+		report.Zooms = append(report.Zooms, newZoomReport(&zoom, stats.Zooms[z]))
+	}
+
+	for _, t := range stats.Largest {
+		report.Largest = append(report.Largest, tileReport{Z: t.Tile.Z, X: t.Tile.X, Y: t.Tile.Y, Size: t.Size})
+	}
+
+	for _, name := range stats.SortedLayers() {
+		layer := stats.Layers[name]
+		report.Layers = append(report.Layers, layerReport{
+			Name:      name,
+			Tiles:     layer.Tiles,
+			Features:  layer.Features,
+			Bytes:     layer.Bytes,
+			ByteShare: stats.LayerByteShare(name),
+			MinZoom:   layer.MinZoom,
+			MaxZoom:   layer.MaxZoom,
+		})
+	}
+
+	return report
+}
+
+// writeTables writes report as a table per section.
+func writeTables(w io.Writer, report *statsReport) error {
+	fmt.Fprintf(w, "%d addressed tiles, %d unique (dedup ratio %.2f)\n\n", report.Addressed, report.Unique, report.DedupRatio)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "zoom\ttiles\tbytes\tmin\tmedian\tp99\tmax\t")
+	row := func(label string, r zoomReport) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t\n", label, r.Tiles, r.Bytes, r.Min, r.Median, r.P99, r.Max)
+	}
+	for _, r := range report.Zooms {
+		row(fmt.Sprintf("%d", *r.Zoom), r)
+	}
+	row("total", report.Total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Largest) > 0 {
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "largest tile\tsize\t")
+		for _, t := range report.Largest {
+			fmt.Fprintf(tw, "%d/%d/%d\t%d\t\n", t.Z, t.X, t.Y, t.Size)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Layers) > 0 {
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "layer\ttiles\tfeatures\tbytes\tshare\tzooms\t")
+		for _, l := range report.Layers {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f%%\t%d-%d\t\n", l.Name, l.Tiles, l.Features, l.Bytes, l.ByteShare*100, l.MinZoom, l.MaxZoom)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if report.UndecodableTiles > 0 {
+		fmt.Fprintf(w, "\n%d tiles could not be decoded as MVT\n", report.UndecodableTiles)
+	}
+	return nil
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "Write the report as JSON instead of tables.")
+	largest := flag.Int("largest", 10, "Number of largest tiles to list.")
+	hashName := flag.String("hash", tilepack.DefaultContentHasher.Name(), "Content hash unique tiles are counted by. Options are "+strings.Join(tilepack.ContentHasherNames(), ", ")+".")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ARCHIVE\n\nReports tile counts, sizes and MVT layer statistics of an mbtiles, pmtiles or disk archive.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	archivePath := flag.Arg(0)
+
+	hasher, err := tilepack.ParseContentHasher(*hashName)
+	if err != nil {
+		log.Fatalf("Invalid -hash: %v", err)
+	}
+
+	if _, err := os.Stat(archivePath); err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+
+	reader, err := tilepack.OpenTileReader(archivePath)
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+	defer reader.Close()
+
+	stats, err := tilepack.CollectStats(reader, hasher, *largest)
+	if err != nil {
+		log.Fatalf("Couldn't read %s: %+v", archivePath, err)
+	}
+
+	report := newStatsReport(archivePath, stats)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeTables(os.Stdout, report)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't write report: %+v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func TestWriteTables(t *testing.T) {
+	stats := &tilepack.ArchiveStats{
+		Zooms: map[maptile.Zoom]*tilepack.ZoomStats{
+			1: {Tiles: 4, Bytes: 40},
+			0: {Tiles: 1, Bytes: 10},
+		},
+		Addressed: 5,
+		Unique:    2,
+		Largest:   []tilepack.TileSize{{Tile: maptile.New(1, 0, 1), Size: 25}},
+		Layers: map[string]*tilepack.LayerStats{
+			"water": {Tiles: 5, Features: 5, Bytes: 30, MaxZoom: 1},
+			"roads": {Tiles: 1, Features: 3, Bytes: 10},
+		},
+	}
+
+	report := newStatsReport("a.mbtiles", stats)
+	if report.DedupRatio != 2.5 || *report.Zooms[0].Zoom != 0 || report.Total.Tiles != 5 {
+		t.Fatalf("report: %+v", report)
+	}
+	if report.Layers[0].Name != "roads" || report.Layers[1].ByteShare != 0.75 {
+		t.Errorf("layers: %+v", report.Layers)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTables(&buf, report); err != nil {
+		t.Fatalf("writeTables: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"dedup ratio 2.50", "1/1/0", "75.0%", "total"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func main() {
+	write := flag.Bool("write", false, "Write the vector_layers into the archive's json metadata instead of only printing them.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ARCHIVE\n\nDecodes every MVT tile of an mbtiles or pmtiles archive to list its vector_layers.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	archivePath := flag.Arg(0)
+
+	if _, err := os.Stat(archivePath); err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+
+	reader, err := tilepack.OpenTileReader(archivePath)
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+
+	layers, err := tilepack.CollectVectorLayers(reader)
+	reader.Close()
+	if err != nil {
+		log.Fatalf("Couldn't read tiles of %s: %+v", archivePath, err)
+	}
+	if n := layers.UndecodableTiles(); n > 0 {
+		log.Printf("%d tiles could not be decoded and are missing from vector_layers", n)
+	}
+
+	if *write {
+		err = tilepack.UpdateArchiveMetadata(archivePath, layers.Apply)
+		if err != nil {
+			log.Fatalf("Couldn't write metadata of %s: %+v", archivePath, err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string]interface{}{"vector_layers": layers.VectorLayers()}); err != nil {
+		log.Fatalf("Couldn't write vector_layers: %+v", err)
+	}
+}
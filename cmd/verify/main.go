@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tilezen/go-tilepacks/tilepack"
+)
+
+func main() {
+	strict := flag.Bool("strict", false, "Fail on warnings as well as errors.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ARCHIVE\n\nChecks the integrity of an mbtiles or pmtiles archive and writes a JSON report to stdout.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	archivePath := flag.Arg(0)
+
+	if _, err := os.Stat(archivePath); err != nil {
+		log.Fatalf("Couldn't open %s: %+v", archivePath, err)
+	}
+
+	report, err := tilepack.VerifyArchive(archivePath)
+	if err != nil {
+		log.Fatalf("Couldn't verify %s: %+v", archivePath, err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("Couldn't write report: %+v", err)
+	}
+
+	if !report.OK() || (*strict && report.Warnings > 0) {
+		log.Printf("%s failed verification with %d errors and %d warnings", archivePath, report.Errors, report.Warnings)
+		os.Exit(1)
+	}
+}
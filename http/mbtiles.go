@@ -18,6 +18,12 @@ var (
 )
 
 func MbtilesHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
+	return MbtilesHandlerWithHasher(reader, tilepack.DefaultContentHasher)
+}
+
+// MbtilesHandlerWithHasher serves tiles like MbtilesHandler, with ETags made
+// from their hasher content hash. The hash ignores gzip, so the ETags are weak.
+func MbtilesHandlerWithHasher(reader tilepack.MbtilesReader, hasher *tilepack.ContentHasher) gohttp.HandlerFunc {
 
 	return func(w gohttp.ResponseWriter, r *gohttp.Request) {
 		requestedTile, err := parseTileFromPath(r.URL.Path)
@@ -38,6 +44,13 @@ func MbtilesHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
 			return
 		}
 
+		etag := `W/"` + hasher.Sum(*result.Data).String() + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(gohttp.StatusNotModified)
+			return
+		}
+
 		acceptEncoding := r.Header.Get("Accept-Encoding")
 		if strings.Contains(acceptEncoding, "gzip") {
 			w.Header().Set("Content-Encoding", "gzip")
@@ -50,6 +63,18 @@ func MbtilesHandler(reader tilepack.MbtilesReader) gohttp.HandlerFunc {
 	}
 }
 
+// etagMatches reports whether an If-None-Match header lists etag. The
+// comparison is weak, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func parseTileFromPath(url string) (*maptile.Tile, error) {
 	match := tilezenRegex.FindStringSubmatch(url)
 	if match == nil {
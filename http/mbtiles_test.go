@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/paulmach/orb/maptile"
@@ -237,3 +238,45 @@ func TestMbtilesHandler_GzipHeader(t *testing.T) {
 		t.Errorf("decompressed body mismatch: got %q, want %q", got, originalData)
 	}
 }
+
+// TestMbtilesHandler_ETag verifies that tiles carry a weak ETag made from
+// their content hash, and that a matching If-None-Match gets a 304.
+func TestMbtilesHandler_ETag(t *testing.T) {
+	tile := maptile.New(0, 0, 0)
+	tileData := []byte("real-tile-data")
+
+	reader := &stubReader{data: map[maptile.Tile][]byte{tile: gzipData(tileData)}}
+	handler := MbtilesHandlerWithHasher(reader, tilepack.XXHashContentHasher)
+
+	req := httptest.NewRequest(http.MethodGet, "/tilezen/vector/v1/512/all/0/0/0.mvt", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	etag := rr.Header().Get("ETag")
+	want := `W/"` + tilepack.XXHashContentHasher.Sum(tileData).String() + `"`
+	if etag != want {
+		t.Fatalf("ETag = %q, want %q", etag, want)
+	}
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + strings.TrimPrefix(etag, "W/"), "*"} {
+		req = httptest.NewRequest(http.MethodGet, "/tilezen/vector/v1/512/all/0/0/0.mvt", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: expected 304, got %d", ifNoneMatch, rr.Code)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 must not have a body", ifNoneMatch)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/tilezen/vector/v1/512/all/0/0/0.mvt", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: expected 200, got %d", rr.Code)
+	}
+}
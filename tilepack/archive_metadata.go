@@ -0,0 +1,184 @@
+package tilepack
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// UpdateArchiveMetadata reads the metadata of the MBTiles or PMTiles archive
+// at path, passes it to update and writes the result back, replacing all of
+// the archive's metadata. Keys update deletes are removed from the archive.
+//
+// For PMTiles, update sees the same metadata as the reader's Metadata, and
+// the format, bounds, center and zoom keys are also written to the header.
+// Those keys are always present in the header, so deleting them only removes
+// them from the JSON metadata.
+func UpdateArchiveMetadata(path string, update func(*MbtilesMetadata) error) error {
+	if strings.HasSuffix(strings.ToLower(path), ".pmtiles") {
+		return updatePmtilesMetadata(path, update)
+	}
+	return updateMbtilesMetadata(path, update)
+}
+
+func updateMbtilesMetadata(path string, update func(*MbtilesMetadata) error) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	rows, err := txn.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	values := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		values[name] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	metadata := NewMbtilesMetadata(values)
+	if err := update(metadata); err != nil {
+		return err
+	}
+
+	if _, err := txn.Exec("DELETE FROM metadata"); err != nil {
+		return fmt.Errorf("failed to clear metadata: %w", err)
+	}
+	for _, name := range metadata.Keys() {
+		value, _ := metadata.Get(name)
+		if _, err := txn.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			return fmt.Errorf("failed to add %s metadata key: %w", name, err)
+		}
+	}
+
+	return txn.Commit()
+}
+
+func updatePmtilesMetadata(path string, update func(*MbtilesMetadata) error) error {
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	jsonMetadata, err := reader.JSONMetadata()
+	if err != nil {
+		return err
+	}
+
+	metadata, err := NewMbtilesMetadataFromPmtiles(reader.header, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	stored, err := NewMbtilesMetadataFromPmtiles(pmtiles.HeaderV3{}, jsonMetadata)
+	if err != nil {
+		return err
+	}
+
+	// Keys only filled from the header are left out of the JSON again unless
+	// update changed them.
+	fromHeader := map[string]string{}
+	for _, key := range metadata.Keys() {
+		if _, ok := stored.Get(key); !ok {
+			fromHeader[key], _ = metadata.Get(key)
+		}
+	}
+
+	if err := update(metadata); err != nil {
+		return err
+	}
+
+	for key, value := range fromHeader {
+		if v, ok := metadata.Get(key); ok && v == value {
+			metadata.Delete(key)
+		}
+	}
+
+	return reader.rewriteMetadata(path, metadata)
+}
+
+// rewriteMetadata writes a copy of the archive with metadata as its JSON
+// metadata section to a temporary file beside path, then renames it over
+// path. The spatial keys and format of metadata are also written to the
+// header. Directories and tile data are copied unchanged; their offsets are
+// relative to their sections, so only the header has to be updated.
+func (r *pmtilesReader) rewriteMetadata(path string, metadata *MbtilesMetadata) error {
+	metadataBytes, err := pmtiles.SerializeMetadata(metadata.PmtilesJSON(), r.header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("error serializing pmtiles metadata: %w", err)
+	}
+
+	h := r.header
+	if err := metadata.ApplyToPmtilesHeader(&h); err != nil {
+		return err
+	}
+	h.RootOffset = pmtiles.HeaderV3LenBytes
+	h.MetadataOffset = h.RootOffset + h.RootLength
+	h.MetadataLength = uint64(len(metadataBytes))
+	h.LeafDirectoryOffset = h.MetadataOffset + h.MetadataLength
+	h.TileDataOffset = h.LeafDirectoryOffset + h.LeafDirectoryLength
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	section := func(offset uint64, length uint64) io.Reader {
+		return io.NewSectionReader(r.file, int64(offset), int64(length))
+	}
+
+	parts := []struct {
+		name string
+		data io.Reader
+	}{
+		{"header", bytes.NewReader(pmtiles.SerializeHeader(h))},
+		{"root directory", section(r.header.RootOffset, r.header.RootLength)},
+		{"metadata", bytes.NewReader(metadataBytes)},
+		{"leaf directories", section(r.header.LeafDirectoryOffset, r.header.LeafDirectoryLength)},
+		{"tile data", section(r.header.TileDataOffset, r.header.TileDataLength)},
+	}
+	for _, part := range parts {
+		if _, err := io.Copy(out, part.data); err != nil {
+			return fmt.Errorf("error writing pmtiles %s: %w", part.name, err)
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if info, err := r.file.Stat(); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	return os.Rename(out.Name(), path)
+}
@@ -0,0 +1,122 @@
+package tilepack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestUpdateArchiveMetadata_Mbtiles(t *testing.T) {
+	path := writeTestMbtiles(t, "meta.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("a")})
+
+	err := UpdateArchiveMetadata(path, func(m *MbtilesMetadata) error {
+		m.Set("attribution", "OSM")
+		delete(m.metadata, "name")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateArchiveMetadata: %v", err)
+	}
+
+	reader, err := NewMbtilesReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := metadata.Get("attribution"); v != "OSM" {
+		t.Errorf("attribution: got %q", v)
+	}
+	if _, ok := metadata.Get("name"); ok {
+		t.Error("name should have been deleted")
+	}
+	if v, _ := metadata.Get("format"); v != "pbf" {
+		t.Errorf("format: got %q", v)
+	}
+}
+
+func TestUpdateArchiveMetadata_Pmtiles(t *testing.T) {
+	tiles := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): []byte("\x89PNG\r\n\x1a\nzero"),
+		maptile.New(1, 1, 1): []byte("\x89PNG\r\n\x1a\none"),
+	}
+	path := writeTestPmtiles(t, tiles)
+
+	json := `{"vector_layers":[{"id":"roads","description":"","minzoom":0,"maxzoom":1,"fields":{}}]}`
+	err := UpdateArchiveMetadata(path, func(m *MbtilesMetadata) error {
+		m.Set("description", "A much longer description that moves every section after the metadata")
+		m.Set("json", json)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateArchiveMetadata: %v", err)
+	}
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+
+	raw, err := reader.JSONMetadata()
+	if err != nil {
+		t.Fatalf("JSONMetadata: %v", err)
+	}
+	if _, ok := raw["vector_layers"].([]interface{}); !ok {
+		t.Errorf("vector_layers must be stored at the top level: %+v", raw)
+	}
+	if _, ok := raw["bounds"]; ok {
+		t.Errorf("unchanged keys from the header must not be copied into the JSON: %+v", raw)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if v, _ := metadata.Get("json"); !strings.Contains(v, `"id":"roads"`) {
+		t.Errorf("json: got %s", v)
+	}
+	if v, _ := metadata.Get("name"); v != "test" {
+		t.Errorf("name: got %q", v)
+	}
+
+	for tile, want := range tiles {
+		got, err := reader.GetTile(tile)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("tile %+v: got %q, %v", tile, got, err)
+		}
+	}
+
+	report, err := VerifyPmtiles(path)
+	if err != nil || !report.OK() {
+		t.Errorf("rewritten archive does not verify: %v %+v", err, report)
+	}
+}
+
+func TestUpdateArchiveMetadata_PmtilesHeader(t *testing.T) {
+	path := writeTestPmtiles(t, map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("\x89PNG\r\n\x1a\n")})
+
+	err := UpdateArchiveMetadata(path, func(m *MbtilesMetadata) error {
+		if v, _ := m.Get("maxzoom"); v != "3" {
+			t.Errorf("update must see the header's maxzoom, got %q", v)
+		}
+		m.SetMaxZoom(5)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateArchiveMetadata: %v", err)
+	}
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+	if reader.Header().MaxZoom != 5 {
+		t.Errorf("header maxzoom: got %d, want 5", reader.Header().MaxZoom)
+	}
+}
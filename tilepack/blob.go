@@ -0,0 +1,172 @@
+package tilepack
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/protomaps/go-pmtiles/pmtiles"
+	"gocloud.dev/blob"
+)
+
+// pmtilesUploadPartSize is the part size of multipart PMTiles uploads, and so
+// the most of an archive that is buffered in memory at a time.
+const pmtilesUploadPartSize = 32 << 20
+
+// bucketSchemes are the URL schemes of the object storage DSNs the PMTiles and
+// disk outputters accept. The gocloud.dev/blob driver of a scheme must be
+// registered, usually with a blank import, for its URLs to open.
+var bucketSchemes = []string{"s3", "gs", "azblob", "file", "mem"}
+
+// IsBucketURL reports whether dsn names an object in, or a prefix of, an
+// s3://, gs://, azblob://, file:// or mem:// bucket rather than a local path.
+func IsBucketURL(dsn string) bool {
+	for _, scheme := range bucketSchemes {
+		if strings.HasPrefix(dsn, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// openBucketURL opens the bucket of an object storage URL and returns it with
+// the key the URL's path names within it. The query configures the bucket,
+// e.g. s3://tiles/planet.pmtiles?region=us-east-1.
+//
+// file:// URLs have no bucket name, so the directory of an object is its
+// bucket, and a whole path is the bucket of a prefix.
+func openBucketURL(ctx context.Context, rawURL string, object bool) (*blob.Bucket, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("error parsing bucket URL %q: %w", rawURL, err)
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	bucketURL := *u
+	bucketURL.Path = ""
+	if u.Scheme == "file" {
+		bucketURL.Path, key = u.Path, ""
+		if object {
+			bucketURL.Path, key = path.Split(u.Path)
+		}
+	}
+	if object && (key == "" || strings.HasSuffix(key, "/")) {
+		return nil, "", fmt.Errorf("bucket URL %q does not name an object", rawURL)
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("error opening bucket %q: %w", bucketURL.String(), err)
+	}
+	return bucket, key, nil
+}
+
+// archiveFile is the destination of an archive written in a single pass.
+// Close commits the archive; Abort discards what it can of a failed one.
+type archiveFile interface {
+	Write(p []byte) (int, error)
+	Close() error
+	Abort()
+}
+
+// localArchiveFile is an archive written to a local file. An aborted file is
+// closed and left in place.
+type localArchiveFile struct {
+	*os.File
+}
+
+func (f localArchiveFile) Abort() {
+	f.File.Close()
+}
+
+// bucketArchiveFile is an archive uploaded to a bucket. The object only
+// appears once Close succeeds; large archives go up as multipart uploads of
+// pmtilesUploadPartSize parts.
+type bucketArchiveFile struct {
+	bucket *blob.Bucket
+	writer *blob.Writer
+	cancel context.CancelFunc
+}
+
+// createArchiveFile creates the archive dsn names, which is either a local
+// path or an object storage URL, with the given Content-Type.
+func createArchiveFile(dsn string, contentType string) (archiveFile, error) {
+	if !IsBucketURL(dsn) {
+		f, err := os.Create(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return localArchiveFile{f}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket, key, err := openBucketURL(ctx, dsn, true)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	writer, err := bucket.NewWriter(ctx, key, &blob.WriterOptions{
+		ContentType: contentType,
+		BufferSize:  pmtilesUploadPartSize,
+	})
+	if err != nil {
+		cancel()
+		bucket.Close()
+		return nil, fmt.Errorf("error creating %s: %w", dsn, err)
+	}
+	return &bucketArchiveFile{bucket: bucket, writer: writer, cancel: cancel}, nil
+}
+
+func (f *bucketArchiveFile) Write(p []byte) (int, error) {
+	return f.writer.Write(p)
+}
+
+func (f *bucketArchiveFile) Close() error {
+	err := f.writer.Close()
+	f.cancel()
+	if closeErr := f.bucket.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort cancels the upload before closing the writer, so that the partial
+// archive is not committed.
+func (f *bucketArchiveFile) Abort() {
+	f.cancel()
+	f.writer.Close()
+	f.bucket.Close()
+}
+
+// tileContentTypes are the Content-Types of uploaded tiles by their format,
+// and of the metatile and t2 zips tiles are grouped into.
+var tileContentTypes = map[string]string{
+	"pbf":  "application/vnd.mapbox-vector-tile",
+	"mvt":  "application/vnd.mapbox-vector-tile",
+	"mlt":  "application/vnd.maplibre-vector-tile",
+	"json": "application/json",
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"avif": "image/avif",
+	"zip":  "application/zip",
+}
+
+// tileContentType returns the Content-Type of tiles of format.
+func tileContentType(format string) string {
+	if contentType, ok := tileContentTypes[strings.ToLower(format)]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// tileContentEncodings are the Content-Encodings of compressed tiles.
+var tileContentEncodings = map[pmtiles.Compression]string{
+	pmtiles.Gzip:   "gzip",
+	pmtiles.Brotli: "br",
+	pmtiles.Zstd:   "zstd",
+}
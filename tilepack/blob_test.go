@@ -0,0 +1,167 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+)
+
+func TestOpenBucketURL_Keys(t *testing.T) {
+	dir := t.TempDir()
+
+	bucket, key, err := openBucketURL(context.Background(), "file://"+dir+"/planet.pmtiles", true)
+	if err != nil {
+		t.Fatalf("openBucketURL: %v", err)
+	}
+	bucket.Close()
+	if key != "planet.pmtiles" {
+		t.Errorf("object key = %q, want planet.pmtiles", key)
+	}
+
+	bucket, key, err = openBucketURL(context.Background(), "file://"+dir, false)
+	if err != nil {
+		t.Fatalf("openBucketURL: %v", err)
+	}
+	bucket.Close()
+	if key != "" {
+		t.Errorf("prefix = %q, want the bucket root", key)
+	}
+
+	if _, _, err := openBucketURL(context.Background(), "file://"+dir+"/", true); err == nil {
+		t.Errorf("expected an error for a URL without an object key")
+	}
+	if _, _, err := openBucketURL(context.Background(), "nope://bucket/key", true); err == nil {
+		t.Errorf("expected an error for an unregistered scheme")
+	}
+}
+
+func TestPmtilesOutputter_Bucket(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewPmtilesOutputter("file://"+dir+"/test.pmtiles?metadata=skip", "png", NewMbtilesMetadata(map[string]string{"name": "test"}))
+	if err != nil {
+		t.Fatalf("NewPmtilesOutputter: %v", err)
+	}
+	o.logger.SetOutput(testWriter{t})
+
+	for tile, data := range gridTiles(3) {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reader, err := NewPmtilesReader(filepath.Join(dir, "test.pmtiles"))
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+	data, err := reader.GetTile(maptile.New(5, 2, 3))
+	if err != nil {
+		t.Fatalf("GetTile: %v", err)
+	}
+	if want := gridTiles(3)[maptile.New(5, 2, 3)]; !bytes.Equal(data, want) {
+		t.Errorf("tile 3/5/2 = %q, want %q", data, want)
+	}
+}
+
+func TestArchiveFile_BucketAbort(t *testing.T) {
+	dir := t.TempDir()
+	f, err := createArchiveFile("file://"+dir+"/test.pmtiles", "application/vnd.pmtiles")
+	if err != nil {
+		t.Fatalf("createArchiveFile: %v", err)
+	}
+	if _, err := f.Write([]byte("partial")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Abort()
+
+	if _, err := os.Stat(filepath.Join(dir, "test.pmtiles")); !os.IsNotExist(err) {
+		t.Errorf("aborted archive was uploaded: %v", err)
+	}
+}
+
+func TestDiskOutputter_Bucket(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewDiskOutputter("root=file://" + dir + "/tiles?create_dir=true format=pbf workers=4")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	if err := o.CreateTiles(); err != nil {
+		t.Fatalf("CreateTiles: %v", err)
+	}
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write([]byte{0x1a, 0x00})
+	w.Close()
+
+	tiles := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0):   {0x1a, 0x00},
+		maptile.New(15, 10, 5): gzipped.Bytes(),
+	}
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	bucket, err := blob.OpenBucket(context.Background(), "file://"+dir+"/tiles")
+	if err != nil {
+		t.Fatalf("OpenBucket: %v", err)
+	}
+	defer bucket.Close()
+
+	tests := []struct {
+		key      string
+		tile     maptile.Tile
+		encoding string
+	}{
+		{"0/0/0.pbf", maptile.New(0, 0, 0), ""},
+		{"5/15/10.pbf", maptile.New(15, 10, 5), "gzip"},
+	}
+	for _, test := range tests {
+		attrs, err := bucket.Attributes(context.Background(), test.key)
+		if err != nil {
+			t.Fatalf("Attributes(%s): %v", test.key, err)
+		}
+		if attrs.ContentType != "application/vnd.mapbox-vector-tile" {
+			t.Errorf("%s Content-Type = %q", test.key, attrs.ContentType)
+		}
+		if attrs.ContentEncoding != test.encoding {
+			t.Errorf("%s Content-Encoding = %q, want %q", test.key, attrs.ContentEncoding, test.encoding)
+		}
+
+		data, err := bucket.ReadAll(context.Background(), test.key)
+		if err != nil {
+			t.Fatalf("ReadAll(%s): %v", test.key, err)
+		}
+		if !bytes.Equal(data, tiles[test.tile]) {
+			t.Errorf("%s = %x, want %x", test.key, data, tiles[test.tile])
+		}
+	}
+}
+
+func TestDiskOutputter_BucketErrors(t *testing.T) {
+	if _, err := NewDiskOutputter("root=file://" + t.TempDir() + " format=pbf workers=0"); err == nil {
+		t.Errorf("expected an error for zero workers")
+	}
+
+	// fileblob refuses to open a bucket directory that does not exist.
+	_, err := NewDiskOutputter("root=file://" + filepath.Join(t.TempDir(), "missing") + " format=pbf")
+	if err == nil || !strings.Contains(err.Error(), "error opening bucket") {
+		t.Errorf("NewDiskOutputter error = %v, want an error opening the bucket", err)
+	}
+}
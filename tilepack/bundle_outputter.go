@@ -0,0 +1,305 @@
+package tilepack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aaronland/go-string/dsn"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// bundleFile is a tile stored in a bundle, which later tiles with the same
+// content can point at.
+type bundleFile struct {
+	name string
+	zip  *zipEntry
+}
+
+// bundleWriter writes the files of a bundle in a single pass.
+type bundleWriter interface {
+	Create(name string, data []byte) (bundleFile, error)
+	// Link adds a file with the content of an earlier one.
+	Link(name string, target bundleFile) error
+	// Close finishes the bundle, without closing the file it is written to.
+	Close() error
+}
+
+// bundleOutputter streams tiles into a single zip or tar.gz file, laid out
+// as the disk outputter lays out a tree, with the metadata in a JSON entry
+// at the end.
+type bundleOutputter struct {
+	TileOutputter
+	file   archiveFile
+	writer bundleWriter
+
+	format   string
+	layout   *diskLayout
+	sidecar  string
+	metadata *MbtilesMetadata
+
+	// files maps the content of the tiles saved so far to where they are
+	// stored, when duplicate tiles are stored once.
+	files  map[ContentHash]bundleFile
+	hasher *ContentHasher
+	closed bool
+}
+
+// NewZipOutputter creates an outputter that writes tiles into a zip file.
+// dsnStr holds space separated key=value pairs: path, a local path or a
+// bucket URL, and format are required. layout, template, shard and sidecar
+// work as they do for NewDiskOutputter, except that the sidecar defaults to
+// metadata. compression=store|deflate picks how tiles are stored, deflate by
+// default.
+//
+// A tile with the bytes of an earlier one is given that tile's stored file
+// instead of being stored again. The central directory entries then overlap,
+// which some extractors, such as Info-ZIP unzip, reject; dedup=false stores
+// duplicates again for them.
+func NewZipOutputter(dsnStr string) (*bundleOutputter, error) {
+	o, dsnMap, err := newBundleOutputter(dsnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	method := zip.Deflate
+	switch dsnMap["compression"] {
+	case "", "deflate":
+	case "store":
+		method = zip.Store
+	default:
+		return nil, fmt.Errorf("unknown zip compression %q: must be store or deflate", dsnMap["compression"])
+	}
+
+	if o.file, err = createArchiveFile(dsnMap["path"], "application/zip"); err != nil {
+		return nil, fmt.Errorf("error creating zip file: %w", err)
+	}
+	o.writer = &zipBundleWriter{zip: newZipWriter(o.file, method, time.Now())}
+	return o, nil
+}
+
+// NewTarOutputter creates an outputter that writes tiles into a gzipped tar
+// file. dsnStr takes the keys of NewZipOutputter except compression.
+// Duplicate tiles are stored as hardlinks to the first tile with their
+// content, unless dedup=false.
+func NewTarOutputter(dsnStr string) (*bundleOutputter, error) {
+	o, dsnMap, err := newBundleOutputter(dsnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.file, err = createArchiveFile(dsnMap["path"], "application/gzip"); err != nil {
+		return nil, fmt.Errorf("error creating tar file: %w", err)
+	}
+
+	gz, _ := gzip.NewWriterLevel(o.file, gzip.BestCompression)
+	o.writer = &tarBundleWriter{gzip: gz, tar: tar.NewWriter(gz), modified: time.Now()}
+	return o, nil
+}
+
+// newBundleOutputter parses the DSN keys shared by the bundle formats. The
+// caller creates the file.
+func newBundleOutputter(dsnStr string) (*bundleOutputter, map[string]string, error) {
+	dsnMap, err := dsn.StringToDSNWithKeys(dsnStr, "path", "format")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shard := 0
+	if value, ok := dsnMap["shard"]; ok {
+		if shard, err = strconv.Atoi(value); err != nil || shard < 1 {
+			return nil, nil, fmt.Errorf("invalid shard %q: must be a positive integer", value)
+		}
+	}
+	layout, err := newDiskLayout(dsnMap["layout"], dsnMap["template"], uint32(shard))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := &bundleOutputter{
+		format:  dsnMap["format"],
+		layout:  layout,
+		sidecar: diskSidecars["metadata"],
+		files:   make(map[ContentHash]bundleFile),
+	}
+	if value, ok := dsnMap["sidecar"]; ok {
+		if o.sidecar, ok = diskSidecars[value]; !ok {
+			return nil, nil, fmt.Errorf("unknown sidecar %q: must be metadata or tilejson", value)
+		}
+	}
+	switch dsnMap["dedup"] {
+	case "", "true":
+	case "false":
+		o.files = nil
+	default:
+		return nil, nil, fmt.Errorf("invalid dedup %q: must be true or false", dsnMap["dedup"])
+	}
+	return o, dsnMap, nil
+}
+
+// SetMetadata sets the metadata written to the metadata entry. Its format
+// key is filled in from the DSN when it is not set.
+func (o *bundleOutputter) SetMetadata(metadata *MbtilesMetadata) {
+	o.metadata = metadata
+}
+
+// SetContentHasher sets the hash duplicate tiles are found by.
+func (o *bundleOutputter) SetContentHasher(hasher *ContentHasher) {
+	o.hasher = hasher
+}
+
+// ContentHasher returns the hash duplicate tiles are found by.
+func (o *bundleOutputter) ContentHasher() *ContentHasher {
+	if o.hasher == nil {
+		return DefaultContentHasher
+	}
+	return o.hasher
+}
+
+func (o *bundleOutputter) CreateTiles() error {
+	return nil
+}
+
+func (o *bundleOutputter) Save(tile maptile.Tile, data []byte) error {
+	name := o.layout.Path(tile, o.format)
+	if o.files == nil {
+		_, err := o.writer.Create(name, data)
+		return err
+	}
+
+	// Entries are shared by tiles with the same bytes, as tiles are stored as
+	// they are given.
+	hash := o.ContentHasher().SumStored(data)
+
+	if file, ok := o.files[hash]; ok {
+		return o.writer.Link(name, file)
+	}
+	file, err := o.writer.Create(name, data)
+	if err != nil {
+		return err
+	}
+	o.files[hash] = file
+	return nil
+}
+
+func (o *bundleOutputter) AssignSpatialMetadata(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
+	metadata := o.entryMetadata()
+	metadata.SetBounds(bounds)
+	// Set default center zoom as minZoom level
+	metadata.SetCenter(bounds.Center(), minZoom)
+	metadata.SetMinZoom(minZoom)
+	metadata.SetMaxZoom(maxZoom)
+	return nil
+}
+
+// Close writes the metadata entry and finishes the bundle. A bundle in a
+// bucket only appears once Close succeeds.
+func (o *bundleOutputter) Close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	err := o.writeMetadata()
+	if err == nil {
+		err = o.writer.Close()
+	}
+	if err != nil {
+		o.file.Abort()
+		return err
+	}
+	return o.file.Close()
+}
+
+// entryMetadata returns the metadata of the metadata entry, creating it if
+// none was set, with the format of the tiles.
+func (o *bundleOutputter) entryMetadata() *MbtilesMetadata {
+	if o.metadata == nil {
+		o.metadata = NewMbtilesMetadata(map[string]string{})
+	}
+	if _, ok := o.metadata.Get("format"); !ok {
+		o.metadata.Set("format", o.format)
+	}
+	return o.metadata
+}
+
+func (o *bundleOutputter) writeMetadata() error {
+	data, err := o.layout.sidecarJSON(o.entryMetadata(), o.sidecar, o.format)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", o.sidecar, err)
+	}
+
+	_, err = o.writer.Create(o.sidecar, data)
+	return err
+}
+
+// zipBundleWriter writes a zip bundle, giving duplicate tiles the entry of
+// the first tile with their content.
+type zipBundleWriter struct {
+	zip *zipWriter
+}
+
+func (w *zipBundleWriter) Create(name string, data []byte) (bundleFile, error) {
+	entry, err := w.zip.Create(name, data)
+	if err != nil {
+		return bundleFile{}, fmt.Errorf("error writing %s to zip: %w", name, err)
+	}
+	return bundleFile{name: name, zip: entry}, nil
+}
+
+func (w *zipBundleWriter) Link(name string, target bundleFile) error {
+	w.zip.Alias(name, target.zip)
+	return nil
+}
+
+func (w *zipBundleWriter) Close() error {
+	return w.zip.Close()
+}
+
+// tarBundleWriter writes a gzipped tar bundle, storing duplicate tiles as
+// hardlinks.
+type tarBundleWriter struct {
+	gzip     *gzip.Writer
+	tar      *tar.Writer
+	modified time.Time
+}
+
+func (w *tarBundleWriter) Create(name string, data []byte) (bundleFile, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  w.modified,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return bundleFile{}, fmt.Errorf("error writing %s to tar: %w", name, err)
+	}
+	if _, err := w.tar.Write(data); err != nil {
+		return bundleFile{}, fmt.Errorf("error writing %s to tar: %w", name, err)
+	}
+	return bundleFile{name: name}, nil
+}
+
+func (w *tarBundleWriter) Link(name string, target bundleFile) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     name,
+		Linkname: target.name,
+		Mode:     0644,
+		ModTime:  w.modified,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("error writing %s to tar: %w", name, err)
+	}
+	return nil
+}
+
+func (w *tarBundleWriter) Close() error {
+	return errors.Join(w.tar.Close(), w.gzip.Close())
+}
@@ -0,0 +1,210 @@
+package tilepack
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// saveBundleTiles saves two tiles with the same content and one other, and
+// assigns spatial metadata.
+func saveBundleTiles(t *testing.T, o *bundleOutputter) {
+	t.Helper()
+	o.SetMetadata(NewMbtilesMetadata(map[string]string{"name": "bundle"}))
+	if err := o.CreateTiles(); err != nil {
+		t.Fatalf("CreateTiles: %v", err)
+	}
+	tiles := []struct {
+		tile maptile.Tile
+		data string
+	}{
+		{maptile.New(0, 0, 1), "ocean"},
+		{maptile.New(1, 0, 1), "land"},
+		{maptile.New(1, 1, 1), "ocean"},
+	}
+	for _, tile := range tiles {
+		if err := o.Save(tile.tile, []byte(tile.data)); err != nil {
+			t.Fatalf("Save %v: %v", tile.tile, err)
+		}
+	}
+	bounds := orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}}
+	if err := o.AssignSpatialMetadata(bounds, 1, 1); err != nil {
+		t.Fatalf("AssignSpatialMetadata: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestZipOutputter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.zip")
+	o, err := NewZipOutputter("path=" + path + " format=pbf layout=tms")
+	if err != nil {
+		t.Fatalf("NewZipOutputter: %v", err)
+	}
+	saveBundleTiles(t, o)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	files := readZipFiles(t, data)
+	want := map[string]string{"1/0/1.pbf": "ocean", "1/1/1.pbf": "land", "1/1/0.pbf": "ocean"}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s = %q, want %q", name, files[name], content)
+		}
+	}
+
+	metadata := NewMbtilesMetadata(nil)
+	if err := metadata.UnmarshalJSON([]byte(files["metadata.json"])); err != nil {
+		t.Fatalf("metadata.json: %v", err)
+	}
+	if name, _ := metadata.Name(); name != "bundle" {
+		t.Errorf("name = %q, want bundle", name)
+	}
+	if format, _ := metadata.Format(); format != "pbf" {
+		t.Errorf("format = %q, want pbf", format)
+	}
+	if z, err := metadata.MaxZoom(); err != nil || z != 1 {
+		t.Errorf("maxzoom = %d, %v, want 1", z, err)
+	}
+
+	// The duplicate tile is stored once.
+	if n := strings.Count(string(data), "ocean"); n != 1 {
+		t.Errorf("ocean is stored %d times, want once", n)
+	}
+}
+
+func TestTarOutputter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.tar.gz")
+	o, err := NewTarOutputter("path=" + path + " format=pbf sidecar=tilejson")
+	if err != nil {
+		t.Fatalf("NewTarOutputter: %v", err)
+	}
+	saveBundleTiles(t, o)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	r := tar.NewReader(gz)
+
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %s: %v", header.Name, err)
+		}
+		headers[header.Name] = header
+		contents[header.Name] = string(data)
+	}
+
+	if contents["1/0/0.pbf"] != "ocean" || contents["1/1/0.pbf"] != "land" {
+		t.Errorf("unexpected tile contents %v", contents)
+	}
+	link := headers["1/1/1.pbf"]
+	if link == nil || link.Typeflag != tar.TypeLink || link.Linkname != "1/0/0.pbf" {
+		t.Errorf("duplicate tile header = %+v, want a hardlink to 1/0/0.pbf", link)
+	}
+	if !strings.Contains(contents["tilejson.json"], `"tilejson": "3.0.0"`) {
+		t.Errorf("tilejson.json = %s", contents["tilejson.json"])
+	}
+}
+
+func TestBundleOutputter_NoDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.zip")
+	o, err := NewZipOutputter("path=" + path + " format=pbf compression=store dedup=false")
+	if err != nil {
+		t.Fatalf("NewZipOutputter: %v", err)
+	}
+	saveBundleTiles(t, o)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if n := strings.Count(string(data), "ocean"); n != 2 {
+		t.Errorf("ocean is stored %d times, want 2", n)
+	}
+}
+
+func TestBundleOutputter_DedupOnlyIdenticalBytes(t *testing.T) {
+	// A tile with the same content as another but compressed differently is
+	// stored as it was given, not linked to the other's bytes.
+	path := filepath.Join(t.TempDir(), "tiles.tar.gz")
+	o, err := NewTarOutputter("path=" + path + " format=pbf")
+	if err != nil {
+		t.Fatalf("NewTarOutputter: %v", err)
+	}
+	raw := []byte("ocean")
+	if err := o.Save(maptile.New(0, 0, 1), gzipBytes(raw)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Save(maptile.New(1, 0, 1), raw); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			t.Fatal("1/1/0.pbf is missing")
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if header.Name != "1/1/0.pbf" {
+			continue
+		}
+		data, _ := io.ReadAll(r)
+		if header.Typeflag != tar.TypeReg || string(data) != "ocean" {
+			t.Errorf("1/1/0.pbf = %q (type %c), want the raw tile", data, header.Typeflag)
+		}
+		break
+	}
+}
+
+func TestBundleOutputter_BadOptions(t *testing.T) {
+	for _, options := range []string{"compression=lzma", "dedup=maybe", "sidecar=yaml", "layout=quadkey"} {
+		path := filepath.Join(t.TempDir(), "tiles.zip")
+		if _, err := NewZipOutputter("path=" + path + " format=pbf " + options); err == nil {
+			t.Errorf("expected an error for %s", options)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: the zip was created before the options were checked", options)
+		}
+	}
+}
@@ -4,6 +4,18 @@ import (
 	"github.com/paulmach/orb/maptile"
 )
 
+// TileValidators are the HTTP cache validators a server returned for a tile,
+// used to make conditional requests when refreshing an existing archive.
+type TileValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// IsEmpty returns true if neither validator is set.
+func (v *TileValidators) IsEmpty() bool {
+	return v == nil || (v.ETag == "" && v.LastModified == "")
+}
+
 type TileRequest struct {
 	Tile maptile.Tile
 	URL  string
@@ -13,4 +25,27 @@ type TileResponse struct {
 	Tile    maptile.Tile
 	Data    []byte
 	Elapsed float64
+	// Validators are the validators the server sent with Data, if any.
+	Validators *TileValidators
+	// NotModified is true when a conditional request found the stored tile
+	// still current. Data is empty and the tile should not be rewritten.
+	NotModified bool
+	// Err is set when the tile couldn't be fetched, and Data is empty. When
+	// a request covers many tiles, as the archives of the metatile and
+	// tapalcatl2 generators do, Tile is the tile of the request.
+	Err error
+
+	// contentHash caches the ContentHash of Data computed with hashedWith.
+	contentHash ContentHash
+	hashedWith  *ContentHasher
+}
+
+// ContentHash returns the hash of Data computed with hasher. It is computed
+// once, so the outputter and anything else handling the response share it.
+func (r *TileResponse) ContentHash(hasher *ContentHasher) ContentHash {
+	if r.hashedWith != hasher {
+		r.contentHash = hasher.Sum(r.Data)
+		r.hashedWith = hasher
+	}
+	return r.contentHash
 }
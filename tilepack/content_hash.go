@@ -0,0 +1,124 @@
+package tilepack
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// ContentHash is the hash of a tile's content. It is comparable, so it can
+// key maps, and holds sums of up to 32 bytes.
+type ContentHash struct {
+	sum  [sha256.Size]byte
+	size uint8
+}
+
+// Bytes returns the hash sum.
+func (h ContentHash) Bytes() []byte {
+	return h.sum[:h.size]
+}
+
+// String returns the hash sum in hex.
+func (h ContentHash) String() string {
+	return hex.EncodeToString(h.Bytes())
+}
+
+// IsZero returns true for the zero ContentHash, which no hasher returns.
+func (h ContentHash) IsZero() bool {
+	return h.size == 0
+}
+
+// ContentHasher hashes tile content with one hash algorithm. Diffs, patches,
+// statistics and ETags compare tiles by their Sum, so all of them agree on
+// when two tiles are the same. Outputters deduplicate tiles with one too: the
+// pmtiles outputter by Sum, as it transcodes tiles to one compression, and the
+// others by SumStored, as they store tiles as they are given.
+type ContentHasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+var (
+	// MD5ContentHasher is the default. Patch checksums were computed with it
+	// before the hash was configurable, so patches made then still apply, and
+	// its SumStored is the tile_id MBTiles archives have always used.
+	MD5ContentHasher = &ContentHasher{name: "md5", newHash: md5.New}
+	// SHA256ContentHasher is the slowest and the most collision resistant.
+	SHA256ContentHasher = &ContentHasher{name: "sha256", newHash: sha256.New}
+	// XXHashContentHasher is the fastest. Its 64 bit sums make a collision,
+	// which would deduplicate two different tiles, likely once an archive
+	// holds billions of unique tiles.
+	XXHashContentHasher = &ContentHasher{name: "xxhash", newHash: func() hash.Hash { return xxhash.New() }}
+
+	DefaultContentHasher = MD5ContentHasher
+)
+
+var contentHashers = map[string]*ContentHasher{}
+
+func init() {
+	for _, h := range []*ContentHasher{MD5ContentHasher, SHA256ContentHasher, XXHashContentHasher} {
+		contentHashers[h.name] = h
+	}
+}
+
+// ContentHasherNames returns the names ParseContentHasher accepts.
+func ContentHasherNames() []string {
+	names := make([]string, 0, len(contentHashers))
+	for name := range contentHashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseContentHasher returns the ContentHasher with the given name.
+func ParseContentHasher(name string) (*ContentHasher, error) {
+	h, ok := contentHashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown content hash %q: must be one of %v", name, ContentHasherNames())
+	}
+	return h, nil
+}
+
+// Name returns the name ParseContentHasher accepts for h.
+func (h *ContentHasher) Name() string {
+	return h.name
+}
+
+// Sum returns the hash of a tile's content. Compressed tiles are hashed after
+// decompression, detected as the pmtiles outputter detects the compression of
+// the vector tiles it transcodes, so the same tile compressed by different
+// writers hashes the same.
+func (h *ContentHasher) Sum(data []byte) ContentHash {
+	digest := h.newHash()
+	if c := detectTileCompression(data, pmtiles.Mvt); c != pmtiles.NoCompression {
+		if decoded, err := decompressTile(data, c); err == nil {
+			digest.Write(decoded)
+			return newContentHash(digest)
+		}
+	}
+	digest.Write(data)
+	return newContentHash(digest)
+}
+
+// SumStored returns the hash of a tile's bytes as they are, compressed or
+// not. Outputters that store tiles as they are given deduplicate them by it,
+// so a tile is never stored as the bytes of another that only has the same
+// content.
+func (h *ContentHasher) SumStored(data []byte) ContentHash {
+	digest := h.newHash()
+	digest.Write(data)
+	return newContentHash(digest)
+}
+
+func newContentHash(digest hash.Hash) ContentHash {
+	var h ContentHash
+	h.size = uint8(len(digest.Sum(h.sum[:0])))
+	return h
+}
@@ -0,0 +1,161 @@
+package tilepack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+func TestContentHasher_IgnoresGzipEncoding(t *testing.T) {
+	raw := []byte("tile content")
+	for _, name := range ContentHasherNames() {
+		hasher, err := ParseContentHasher(name)
+		if err != nil {
+			t.Fatalf("ParseContentHasher(%q): %v", name, err)
+		}
+		if hasher.Sum(gzipBytes(raw)) != hasher.Sum(raw) {
+			t.Errorf("%s: gzipped and raw content must hash the same", name)
+		}
+		if hasher.Sum([]byte("a")) == hasher.Sum([]byte("b")) {
+			t.Errorf("%s: different content must hash differently", name)
+		}
+	}
+}
+
+func TestContentHasher_IgnoresCompression(t *testing.T) {
+	// Every compression the pmtiles outputter transcodes vector tiles from
+	// must hash as the tile it decompresses to.
+	mvt := []byte{0x1a, 0x02, 0x78, 0x01}
+	var compressor tileCompressor
+	for _, c := range []pmtiles.Compression{pmtiles.Gzip, pmtiles.Brotli, pmtiles.Zstd} {
+		compressed, err := compressor.compress(mvt, c)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+		if DefaultContentHasher.Sum(compressed) != DefaultContentHasher.Sum(mvt) {
+			t.Errorf("%s: compressed and raw content must hash the same", tileCompressionName(c))
+		}
+	}
+}
+
+func TestContentHasher_Sizes(t *testing.T) {
+	tests := []struct {
+		hasher *ContentHasher
+		size   int
+	}{
+		{MD5ContentHasher, 16},
+		{SHA256ContentHasher, 32},
+		{XXHashContentHasher, 8},
+	}
+	for _, test := range tests {
+		h := test.hasher.Sum([]byte("tile"))
+		if len(h.Bytes()) != test.size || len(h.String()) != 2*test.size {
+			t.Errorf("%s: got %d bytes %q, want %d", test.hasher.Name(), len(h.Bytes()), h, test.size)
+		}
+		if h.IsZero() {
+			t.Errorf("%s: hash must not be zero", test.hasher.Name())
+		}
+	}
+
+	// An md5 hash is the plain md5 sum of the content.
+	if got := MD5ContentHasher.Sum([]byte("a")).String(); got != "0cc175b9c0f1b6a831c399e269772661" {
+		t.Errorf("md5 hash = %s", got)
+	}
+	if _, err := ParseContentHasher("crc32"); err == nil {
+		t.Error("expected an error for an unknown hash")
+	}
+}
+
+func TestTileResponse_ContentHashCached(t *testing.T) {
+	r := &TileResponse{Data: []byte("tile")}
+	md5Hash := r.ContentHash(MD5ContentHasher)
+
+	r.Data = []byte("changed")
+	if r.ContentHash(MD5ContentHasher) != md5Hash {
+		t.Error("hash must be computed once per hasher")
+	}
+	if r.ContentHash(XXHashContentHasher) != XXHashContentHasher.Sum([]byte("changed")) {
+		t.Error("a different hasher must hash again")
+	}
+}
+
+func TestOutputters_DeduplicateByContentHash(t *testing.T) {
+	raw := []byte("tile content")
+	tiles := []struct {
+		tile maptile.Tile
+		data []byte
+	}{
+		{maptile.New(0, 0, 1), raw},
+		{maptile.New(1, 0, 1), gzipBytes(raw)},
+		{maptile.New(0, 1, 1), []byte("other")},
+		{maptile.New(1, 1, 1), gzipBytes(raw)},
+	}
+
+	mbtilesPath := filepath.Join(t.TempDir(), "dedup.mbtiles")
+	mbtiles, err := NewMbtilesOutputter(mbtilesPath, 10, false, NewMbtilesMetadata(map[string]string{"name": "dedup", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	mbtiles.SetContentHasher(XXHashContentHasher)
+
+	pmtiles, err := NewPmtilesOutputter(filepath.Join(t.TempDir(), "dedup.pmtiles"), "mvt", NewMbtilesMetadata(map[string]string{"name": "dedup"}))
+	if err != nil {
+		t.Fatalf("NewPmtilesOutputter: %v", err)
+	}
+	pmtiles.logger.SetOutput(testWriter{t})
+	pmtiles.SetContentHasher(XXHashContentHasher)
+
+	for _, outputter := range []TileOutputter{mbtiles, pmtiles} {
+		for _, tile := range tiles {
+			if err := SaveTileResponse(outputter, &TileResponse{Tile: tile.tile, Data: tile.data}); err != nil {
+				t.Fatalf("SaveTileResponse: %v", err)
+			}
+		}
+	}
+
+	if n := len(pmtiles.offsetMap); n != 2 {
+		t.Errorf("pmtiles stored %d tile contents, want 2", n)
+	}
+	if err := pmtiles.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := mbtiles.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// MBTiles stores tiles as they are given, so only identical bytes share
+	// an image.
+	if n := countRows(t, mbtilesPath, "images"); n != 3 {
+		t.Errorf("mbtiles stored %d images, want 3", n)
+	}
+	want := XXHashContentHasher.SumStored(gzipBytes(raw)).String()
+	if n := countRows(t, mbtilesPath, "map WHERE tile_id = '"+want+"'"); n != 2 {
+		t.Errorf("mbtiles images are not named by the xxhash %s of their bytes", want)
+	}
+}
+
+func TestMbtilesOutputter_TileIDsAreMD5OfStoredBytes(t *testing.T) {
+	// Archives built before the hash was configurable named images by the
+	// md5 of their bytes, and must keep deduplicating against new tiles.
+	data := gzipBytes([]byte("tile content"))
+	mbtilesPath := filepath.Join(t.TempDir(), "md5.mbtiles")
+	o, err := NewMbtilesOutputter(mbtilesPath, 10, false, NewMbtilesMetadata(map[string]string{"name": "md5", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	if err := o.Save(maptile.New(0, 0, 0), data); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	sum := md5.Sum(data)
+	if n := countRows(t, mbtilesPath, "images WHERE tile_id = '"+hex.EncodeToString(sum[:])+"'"); n != 1 {
+		t.Error("mbtiles image is not named by the md5 of its bytes")
+	}
+}
@@ -0,0 +1,410 @@
+package tilepack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// defaultDiskShardSize is the number of columns or rows sharing a shard
+// directory in the sharded disk layout.
+const defaultDiskShardSize = 1000
+
+// diskLayouts are the path templates of the named disk layouts. sharded
+// keeps directories small at very high zooms, where a zoom has millions of
+// columns and a column millions of rows.
+var diskLayouts = map[string]string{
+	"xyz":     "{z}/{x}/{y}.{format}",
+	"tms":     "{z}/{x}/{-y}.{format}",
+	"sharded": "{z}/{xshard}/{x}/{yshard}/{y}.{format}",
+}
+
+// diskLayout expands the path template of a tile below a disk outputter's
+// root:
+//
+//	{z}, {x}, {y}       tile coordinates, with {y} in XYZ row order
+//	{-y}                the row in TMS order
+//	{xshard}, {yshard}  the column and row divided by the shard size
+//	{format}            the tile format
+type diskLayout struct {
+	template string
+	shard    uint32
+}
+
+// newDiskLayout returns the layout of a named layout or a template. Only one
+// of them may be given; without either, tiles go in {z}/{x}/{y}.{format}.
+func newDiskLayout(name string, template string, shard uint32) (*diskLayout, error) {
+	if name != "" && template != "" {
+		return nil, fmt.Errorf("a disk layout and template cannot be used together")
+	}
+	if name == "" && template == "" {
+		name = "xyz"
+	}
+	if name != "" {
+		var ok bool
+		if template, ok = diskLayouts[name]; !ok {
+			return nil, fmt.Errorf("unknown disk layout %q: must be one of xyz, tms or sharded", name)
+		}
+	}
+
+	if !strings.Contains(template, "{z}") || !strings.Contains(template, "{x}") ||
+		(!strings.Contains(template, "{y}") && !strings.Contains(template, "{-y}")) {
+		return nil, fmt.Errorf("disk template %q must contain {z}, {x} and {y} or {-y}", template)
+	}
+	if strings.HasPrefix(template, "/") || strings.Contains("/"+template+"/", "/../") {
+		return nil, fmt.Errorf("disk template %q must stay below the root", template)
+	}
+	if shard < 1 {
+		shard = defaultDiskShardSize
+	}
+	return &diskLayout{template: template, shard: shard}, nil
+}
+
+// Path returns the slash separated path of tile below the root.
+func (l *diskLayout) Path(tile maptile.Tile, format string) string {
+	return strings.NewReplacer(
+		"{z}", strconv.FormatUint(uint64(tile.Z), 10),
+		"{x}", strconv.FormatUint(uint64(tile.X), 10),
+		"{y}", strconv.FormatUint(uint64(tile.Y), 10),
+		"{-y}", strconv.FormatUint(uint64(flipY(tile.Y, tile.Z)), 10),
+		"{xshard}", strconv.FormatUint(uint64(tile.X/l.shard), 10),
+		"{yshard}", strconv.FormatUint(uint64(tile.Y/l.shard), 10),
+		"{format}", format,
+	).Replace(l.template)
+}
+
+// usesShards reports whether the template holds {xshard} or {yshard}.
+func (l *diskLayout) usesShards() bool {
+	return strings.Contains(l.template, "{xshard}") || strings.Contains(l.template, "{yshard}")
+}
+
+// tileJSONTemplate returns the template as a TileJSON tiles URL relative to
+// the root, along with the TileJSON scheme of its rows.
+func (l *diskLayout) tileJSONTemplate(format string) (string, string) {
+	template := strings.ReplaceAll(l.template, "{format}", format)
+	if strings.Contains(template, "{-y}") {
+		return strings.ReplaceAll(template, "{-y}", "{y}"), "tms"
+	}
+	return template, "xyz"
+}
+
+// diskSidecars are the file names of the metadata sidecars a disk outputter
+// can write next to its tiles.
+var diskSidecars = map[string]string{
+	"metadata": "metadata.json",
+	"tilejson": "tilejson.json",
+}
+
+// sidecarJSON encodes the metadata as the sidecar file named sidecar, for
+// tiles of format. The sidecar records the layout, so that the tree can be
+// read back: metadata.json in template and shard keys, and tilejson.json in
+// its tiles URL and scheme, with a shard member for sharded templates.
+func (l *diskLayout) sidecarJSON(metadata *MbtilesMetadata, sidecar string, format string) ([]byte, error) {
+	if sidecar == diskSidecars["tilejson"] {
+		template, scheme := l.tileJSONTemplate(format)
+		return tileJSON(metadata, template, scheme, l.sidecarShard())
+	}
+
+	encoded, err := metadata.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	doc["template"] = l.template
+	if shard := l.sidecarShard(); shard != "" {
+		doc["shard"] = shard
+	}
+	return json.Marshal(doc)
+}
+
+// sidecarShard returns the shard size recorded in a sidecar, or "" when the
+// template has no shards.
+func (l *diskLayout) sidecarShard() string {
+	if !l.usesShards() {
+		return ""
+	}
+	return strconv.FormatUint(uint64(l.shard), 10)
+}
+
+// tileJSON returns the metadata as a TileJSON 3.0.0 document for tiles at
+// the relative URL template. The members of the json key, such as
+// vector_layers, are moved to the top level as TileJSON has them.
+func tileJSON(metadata *MbtilesMetadata, template string, scheme string, shard string) ([]byte, error) {
+	encoded, err := metadata.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+
+	if members, ok := doc["json"].(map[string]interface{}); ok {
+		for member, value := range members {
+			doc[member] = value
+		}
+		delete(doc, "json")
+	}
+	doc["tilejson"] = "3.0.0"
+	doc["tiles"] = []string{template}
+	doc["scheme"] = scheme
+	if shard != "" {
+		doc["shard"] = shard
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// readDiskSidecar reads the metadata sidecar of the tree at root, returning
+// the metadata without the keys that record the layout, and the layout. A
+// tree without a sidecar is taken to be in the xyz layout.
+func readDiskSidecar(root string) (*MbtilesMetadata, *diskLayout, error) {
+	metadata := NewMbtilesMetadata(map[string]string{})
+	template := ""
+	shard := ""
+
+	if data, err := os.ReadFile(filepath.Join(root, diskSidecars["metadata"])); err == nil {
+		if err := metadata.UnmarshalJSON(data); err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %w", diskSidecars["metadata"], err)
+		}
+		template, _ = metadata.Get("template")
+		shard, _ = metadata.Get("shard")
+		metadata.Delete("template")
+		metadata.Delete("shard")
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	} else if data, err := os.ReadFile(filepath.Join(root, diskSidecars["tilejson"])); err == nil {
+		if metadata, template, shard, err = parseTileJSON(data); err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %w", diskSidecars["tilejson"], err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	size := 0
+	if shard != "" {
+		var err error
+		if size, err = strconv.Atoi(shard); err != nil || size < 1 {
+			return nil, nil, fmt.Errorf("invalid shard %q in disk sidecar: must be a positive integer", shard)
+		}
+	}
+	layout, err := newDiskLayout("", template, uint32(size))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read disk tree %s: %w", root, err)
+	}
+	return metadata, layout, nil
+}
+
+// parseTileJSON decodes a TileJSON document written by tileJSON, returning
+// its metadata, with vector_layers and tilestats gathered back into the json
+// key, and the disk template and shard size of its tiles.
+func parseTileJSON(data []byte) (*MbtilesMetadata, string, string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, "", "", err
+	}
+
+	var tiles []string
+	var scheme, shard string
+	if raw, ok := doc["tiles"]; ok {
+		if err := json.Unmarshal(raw, &tiles); err != nil || len(tiles) != 1 {
+			return nil, "", "", errors.New("tiles must hold a single URL template")
+		}
+	}
+	if raw, ok := doc["scheme"]; ok {
+		if err := json.Unmarshal(raw, &scheme); err != nil {
+			return nil, "", "", fmt.Errorf("invalid scheme: %w", err)
+		}
+	}
+	if raw, ok := doc["shard"]; ok {
+		if err := json.Unmarshal(raw, &shard); err != nil {
+			return nil, "", "", fmt.Errorf("invalid shard: %w", err)
+		}
+	}
+
+	template := ""
+	if len(tiles) == 1 {
+		template = tiles[0]
+		switch scheme {
+		case "", "xyz":
+		case "tms":
+			template = strings.ReplaceAll(template, "{y}", "{-y}")
+		default:
+			return nil, "", "", fmt.Errorf("unknown scheme %q: must be xyz or tms", scheme)
+		}
+	}
+
+	members := map[string]json.RawMessage{}
+	for key := range pmtilesTopLevelJSONKeys {
+		if raw, ok := doc[key]; ok {
+			members[key] = raw
+			delete(doc, key)
+		}
+	}
+	for _, key := range []string{"tilejson", "tiles", "scheme", "shard"} {
+		delete(doc, key)
+	}
+
+	rest, err := json.Marshal(doc)
+	if err != nil {
+		return nil, "", "", err
+	}
+	metadata := NewMbtilesMetadata(map[string]string{})
+	if err := metadata.UnmarshalJSON(rest); err != nil {
+		return nil, "", "", err
+	}
+	if len(members) > 0 {
+		encoded, err := json.Marshal(members)
+		if err != nil {
+			return nil, "", "", err
+		}
+		metadata.Set("json", string(encoded))
+	}
+	return metadata, template, shard, nil
+}
+
+// diskPlaceholders are the placeholders of a disk template, in the order
+// their values are kept in a diskPathValues.
+var diskPlaceholders = []string{"z", "x", "y", "-y", "xshard", "yshard", "format"}
+
+// diskPlaceholder matches a placeholder of a disk template.
+var diskPlaceholder = regexp.MustCompile(`\{(z|x|y|-y|xshard|yshard|format)\}`)
+
+// diskPathValues holds the placeholder values parsed from a tile path, in
+// the order of diskPlaceholders, with set marking the ones found.
+type diskPathValues struct {
+	values [7]string
+	set    [7]bool
+}
+
+// diskSegment matches one slash separated segment of a disk template. The
+// groups of pattern are the values of the placeholders in fields, as indexes
+// into diskPlaceholders.
+type diskSegment struct {
+	pattern *regexp.Regexp
+	fields  []int
+}
+
+// segments returns a diskSegment for each segment of the template.
+func (l *diskLayout) segments() []diskSegment {
+	index := make(map[string]int, len(diskPlaceholders))
+	for i, name := range diskPlaceholders {
+		index[name] = i
+	}
+
+	var segments []diskSegment
+	for _, part := range strings.Split(l.template, "/") {
+		var pattern strings.Builder
+		var fields []int
+		pattern.WriteString("^")
+		last := 0
+		for _, match := range diskPlaceholder.FindAllStringSubmatchIndex(part, -1) {
+			pattern.WriteString(regexp.QuoteMeta(part[last:match[0]]))
+			name := part[match[2]:match[3]]
+			if name == "format" {
+				pattern.WriteString(`([^/]+?)`)
+			} else {
+				pattern.WriteString(`(\d+)`)
+			}
+			fields = append(fields, index[name])
+			last = match[1]
+		}
+		pattern.WriteString(regexp.QuoteMeta(part[last:]))
+		pattern.WriteString("$")
+		segments = append(segments, diskSegment{pattern: regexp.MustCompile(pattern.String()), fields: fields})
+	}
+	return segments
+}
+
+// match parses name with the segment, adding its placeholder values to
+// values. It fails if name does not match, or a placeholder seen before has
+// a different value.
+func (s diskSegment) match(name string, values diskPathValues) (diskPathValues, bool) {
+	groups := s.pattern.FindStringSubmatch(name)
+	if groups == nil {
+		return values, false
+	}
+	for i, field := range s.fields {
+		if values.set[field] && values.values[field] != groups[i+1] {
+			return values, false
+		}
+		values.values[field] = groups[i+1]
+		values.set[field] = true
+	}
+	return values, true
+}
+
+// number returns the value of the numeric placeholder field, if it is set.
+func (v diskPathValues) number(field int) (uint32, bool, error) {
+	if !v.set[field] {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(v.values[field], 10, 32)
+	return uint32(n), true, err
+}
+
+// inRange reports whether the values parsed so far may belong to a tile of
+// tileRange, so that directories outside it are not listed.
+func (l *diskLayout) inRange(values diskPathValues, tileRange TileRange) bool {
+	rowRange := func(y uint32) bool { return y >= tileRange.MinY && y <= tileRange.MaxY }
+	checks := []func(uint32) bool{
+		func(z uint32) bool { return z == uint32(tileRange.Z) },
+		func(x uint32) bool { return x >= tileRange.MinX && x <= tileRange.MaxX },
+		rowRange,
+		func(y uint32) bool { return y < 1<<tileRange.Z && rowRange(flipY(y, tileRange.Z)) },
+		func(s uint32) bool { return s >= tileRange.MinX/l.shard && s <= tileRange.MaxX/l.shard },
+		func(s uint32) bool { return s >= tileRange.MinY/l.shard && s <= tileRange.MaxY/l.shard },
+	}
+	for field, check := range checks {
+		n, ok, err := values.number(field)
+		if err != nil || (ok && !check(n)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tile returns the tile and format of a complete set of path values. It
+// fails if the coordinates are out of range for the zoom, or the shards do
+// not hold the tile.
+func (l *diskLayout) tile(values diskPathValues) (maptile.Tile, string, bool) {
+	z, _, errZ := values.number(0)
+	x, _, errX := values.number(1)
+	if errZ != nil || errX != nil || z > 32 {
+		return maptile.Tile{}, "", false
+	}
+	zoom := maptile.Zoom(z)
+
+	y, ok, err := values.number(2)
+	if !ok {
+		var flipped uint32
+		flipped, _, err = values.number(3)
+		if err == nil && uint64(flipped) >= uint64(1)<<z {
+			return maptile.Tile{}, "", false
+		}
+		y = flipY(flipped, zoom)
+	} else if flipped, ok, _ := values.number(3); ok && flipY(flipped, zoom) != y {
+		return maptile.Tile{}, "", false
+	}
+	if err != nil || uint64(x) >= uint64(1)<<z || uint64(y) >= uint64(1)<<z {
+		return maptile.Tile{}, "", false
+	}
+
+	if shard, ok, err := values.number(4); err != nil || (ok && shard != x/l.shard) {
+		return maptile.Tile{}, "", false
+	}
+	if shard, ok, err := values.number(5); err != nil || (ok && shard != y/l.shard) {
+		return maptile.Tile{}, "", false
+	}
+	return maptile.New(x, y, zoom), values.values[6], true
+}
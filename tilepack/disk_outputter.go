@@ -1,23 +1,72 @@
 package tilepack
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/aaronland/go-string/dsn"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+	"gocloud.dev/blob"
 )
 
+// defaultDiskUploadWorkers is the number of tiles uploaded at once when the
+// disk outputter's root is a bucket.
+const defaultDiskUploadWorkers = 16
+
 type diskOutputter struct {
 	TileOutputter
 	root     string
 	format   string
 	hasTiles bool
+
+	layout *diskLayout
+	// sidecar is the name of the metadata file written next to the tiles,
+	// if any, and metadata what it holds.
+	sidecar  string
+	metadata *MbtilesMetadata
+
+	skipEmpty bool
+	// links maps the content of the tiles saved so far to their paths when
+	// duplicate tiles are hardlinked.
+	links   map[ContentHash]string
+	linksMu sync.Mutex
+	hasher  *ContentHasher
+
+	// uploads is set when root is an object storage URL, and takes the
+	// tiles to put in the bucket.
+	uploads *diskUploader
 }
 
+// NewDiskOutputter creates an outputter that writes a tree of tile files
+// under a root. dsnStr holds space separated key=value pairs: root and
+// format are required, and the optional keys are
+//
+//	layout=xyz|tms|sharded  the path of each tile, {z}/{x}/{y}.{format} by
+//	                        default
+//	template={PATH}         a path template instead of a layout, e.g.
+//	                        {z}/{x}/{-y}.png
+//	shard={N}               the number of columns or rows in a shard
+//	                        directory, 1000 by default
+//	sidecar=metadata|tilejson
+//	                        writes metadata.json or tilejson.json, along
+//	                        with the layout; metadata.json is written by
+//	                        default for layouts other than xyz
+//	skip_empty=true         does not write empty tiles
+//	dedup=hardlink          hardlinks tiles with the content of an earlier one
+//	workers={N}             the number of parallel uploads to a bucket
+//
+// root may be an object storage URL such as s3://bucket/prefix, in which case
+// the tiles are uploaded in parallel instead. Tiles are written to a
+// temporary file and renamed into place, so a tile file is never partly
+// written.
 func NewDiskOutputter(dsnStr string) (*diskOutputter, error) {
 
 	dsnMap, err := dsn.StringToDSNWithKeys(dsnStr, "root", "format")
@@ -26,30 +75,127 @@ func NewDiskOutputter(dsnStr string) (*diskOutputter, error) {
 		return nil, err
 	}
 
-	abs_root, err := filepath.Abs(dsnMap["root"])
+	shard := 0
+
+	if value, ok := dsnMap["shard"]; ok {
+		shard, err = strconv.Atoi(value)
+
+		if err != nil || shard < 1 {
+			return nil, fmt.Errorf("invalid shard %q: must be a positive integer", value)
+		}
+	}
+
+	layout, err := newDiskLayout(dsnMap["layout"], dsnMap["template"], uint32(shard))
 
 	if err != nil {
 		return nil, err
 	}
 
 	o := diskOutputter{
-		root:   abs_root,
-		format: dsnMap["format"],
+		format:    dsnMap["format"],
+		layout:    layout,
+		skipEmpty: dsnMap["skip_empty"] == "true",
+	}
+
+	if value, ok := dsnMap["sidecar"]; ok {
+		if o.sidecar, ok = diskSidecars[value]; !ok {
+			return nil, fmt.Errorf("unknown sidecar %q: must be metadata or tilejson", value)
+		}
+	} else if layout.template != diskLayouts["xyz"] {
+		// The layout is recorded in the sidecar, which is how the tree is
+		// read back.
+		o.sidecar = diskSidecars["metadata"]
+	}
+
+	if value, ok := dsnMap["dedup"]; ok {
+		if value != "hardlink" {
+			return nil, fmt.Errorf("unknown dedup %q: must be hardlink", value)
+		}
+		if IsBucketURL(dsnMap["root"]) {
+			return nil, errors.New("dedup=hardlink is not supported for buckets")
+		}
+		o.links = make(map[ContentHash]string)
+	}
+
+	if IsBucketURL(dsnMap["root"]) {
+
+		workers := defaultDiskUploadWorkers
+
+		if value, ok := dsnMap["workers"]; ok {
+			workers, err = strconv.Atoi(value)
+
+			if err != nil || workers < 1 {
+				return nil, fmt.Errorf("invalid workers %q: must be a positive integer", value)
+			}
+		}
+
+		bucket, prefix, err := openBucketURL(context.Background(), dsnMap["root"], false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		o.root = dsnMap["root"]
+		o.uploads = newDiskUploader(bucket, prefix, dsnMap["format"], workers)
+
+		return &o, nil
+	}
+
+	abs_root, err := filepath.Abs(dsnMap["root"])
+
+	if err != nil {
+		return nil, err
 	}
 
+	o.root = abs_root
+
 	return &o, nil
 }
 
+// SetMetadata sets the metadata written to the sidecar. Its format key is
+// filled in from the DSN when it is not set.
+func (o *diskOutputter) SetMetadata(metadata *MbtilesMetadata) {
+	o.metadata = metadata
+}
+
+// SetContentHasher sets the hash duplicate tiles are found by.
+func (o *diskOutputter) SetContentHasher(hasher *ContentHasher) {
+	o.hasher = hasher
+}
+
 func (o *diskOutputter) AssignSpatialMetadata(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
-	return nil
+	if o.sidecar == "" {
+		return nil
+	}
+
+	metadata := o.sidecarMetadata()
+	metadata.SetBounds(bounds)
+	// Set default center zoom as minZoom level
+	metadata.SetCenter(bounds.Center(), minZoom)
+	metadata.SetMinZoom(minZoom)
+	metadata.SetMaxZoom(maxZoom)
+
+	return o.writeSidecar()
 }
 
 func (o *diskOutputter) Close() error {
-	return nil
+	var err error
+
+	if o.sidecar != "" {
+		err = o.writeSidecar()
+	}
+
+	if o.uploads != nil {
+		if closeErr := o.uploads.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
 }
 
 func (o *diskOutputter) CreateTiles() error {
-	if o.hasTiles {
+	if o.hasTiles || o.uploads != nil {
 		return nil
 	}
 
@@ -81,8 +227,17 @@ func (o *diskOutputter) CreateTiles() error {
 
 func (o *diskOutputter) Save(tile maptile.Tile, data []byte) error {
 
-	relPath := fmt.Sprintf("%d/%d/%d.%s", tile.Z, tile.X, tile.Y, o.format)
-	absPath := filepath.Join(o.root, relPath)
+	if o.skipEmpty && isEmptyTile(data) {
+		return nil
+	}
+
+	relPath := o.layout.Path(tile, o.format)
+
+	if o.uploads != nil {
+		return o.uploads.Upload(relPath, data)
+	}
+
+	absPath := filepath.Join(o.root, filepath.FromSlash(relPath))
 
 	root := filepath.Dir(absPath)
 
@@ -96,16 +251,266 @@ func (o *diskOutputter) Save(tile maptile.Tile, data []byte) error {
 		return err
 	}
 
-	fh, err := os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if o.links != nil {
+		hasher := o.hasher
+
+		if hasher == nil {
+			hasher = DefaultContentHasher
+		}
+
+		// Tiles are linked to files with the same bytes, as they are written
+		// as they are given.
+		hash := hasher.SumStored(data)
+
+		o.linksMu.Lock()
+		original, ok := o.links[hash]
+		o.linksMu.Unlock()
+
+		if ok && original != absPath {
+			return linkFile(original, absPath)
+		}
+
+		if err := writeFileAtomic(absPath, data); err != nil {
+			return err
+		}
+
+		// A tile is only linked to once it is written. Tiles with the same
+		// content saved meanwhile are written too.
+		o.linksMu.Lock()
+		if _, ok := o.links[hash]; !ok {
+			o.links[hash] = absPath
+		}
+		o.linksMu.Unlock()
+
+		return nil
+	}
+
+	return writeFileAtomic(absPath, data)
+}
+
+// SavesConcurrently returns true: tiles are written to files of their own,
+// or uploaded by a pool of workers.
+func (o *diskOutputter) SavesConcurrently() bool {
+	return true
+}
+
+// sidecarMetadata returns the metadata of the sidecar, creating it if none
+// was set, with the format of the tiles.
+func (o *diskOutputter) sidecarMetadata() *MbtilesMetadata {
+	if o.metadata == nil {
+		o.metadata = NewMbtilesMetadata(map[string]string{})
+	}
+	if _, ok := o.metadata.Get("format"); !ok {
+		o.metadata.Set("format", o.format)
+	}
+	return o.metadata
+}
+
+// writeSidecar writes the metadata sidecar, replacing the one written
+// before.
+func (o *diskOutputter) writeSidecar() error {
+	metadata := o.sidecarMetadata()
+
+	data, err := o.layout.sidecarJSON(metadata, o.sidecar, o.format)
+
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", o.sidecar, err)
+	}
+
+	if o.uploads != nil {
+		return o.uploads.Put(o.sidecar, data, "application/json")
+	}
+
+	if err := o.CreateTiles(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(o.root, o.sidecar), data)
+}
+
+// isEmptyTile reports whether a tile has no content, either uncompressed or
+// once decompressed. Compressed empty tiles are a few dozen bytes at most.
+func isEmptyTile(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if len(data) > 64 {
+		return false
+	}
+
+	compression := detectTileCompression(data, pmtiles.UnknownTileType)
+
+	if compression == pmtiles.NoCompression {
+		return false
+	}
+
+	decoded, err := decompressTile(data, compression)
+	return err == nil && len(decoded) == 0
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so that path never holds a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+
+	fh, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+
 	if err != nil {
 		return err
 	}
 
 	_, err = fh.Write(data)
+
+	if err == nil {
+		err = fh.Chmod(0644)
+	}
+
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(fh.Name(), path)
+	}
+
 	if err != nil {
-		fh.Close()
+		os.Remove(fh.Name())
+	}
+
+	return err
+}
+
+// linkFile hardlinks path to original, replacing any file at path.
+func linkFile(original string, path string) error {
+
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".link.tmp")
+
+	os.Remove(tmpPath)
+
+	if err := os.Link(original, tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	return fh.Close()
+	return nil
+}
+
+// diskUpload is a tile waiting to be uploaded.
+type diskUpload struct {
+	key  string
+	data []byte
+}
+
+// diskUploader uploads tiles to a bucket from a pool of workers, each with
+// the Content-Type of its format and the Content-Encoding of its compression.
+// The first upload error is returned by the next Upload or by Close.
+type diskUploader struct {
+	bucket      *blob.Bucket
+	prefix      string
+	tileType    pmtiles.TileType
+	contentType string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan diskUpload
+	wg     sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+func newDiskUploader(bucket *blob.Bucket, prefix string, format string, workers int) *diskUploader {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	tileType, _ := pmtilesTileType(format)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &diskUploader{
+		bucket:      bucket,
+		prefix:      prefix,
+		tileType:    tileType,
+		contentType: tileContentType(format),
+		ctx:         ctx,
+		cancel:      cancel,
+		queue:       make(chan diskUpload, workers),
+	}
+	for i := 0; i < workers; i++ {
+		u.wg.Add(1)
+		go u.work()
+	}
+	return u
+}
+
+// Upload queues a tile to be put at key under the prefix. It blocks while
+// every worker is busy and the queue is full.
+func (u *diskUploader) Upload(key string, data []byte) error {
+	if err := u.firstErr(); err != nil {
+		return err
+	}
+	// The caller may reuse data once Upload returns.
+	u.queue <- diskUpload{key: u.prefix + key, data: append([]byte(nil), data...)}
+	return nil
+}
+
+// Put uploads data to key under the prefix with contentType, without
+// queueing it behind the tiles.
+func (u *diskUploader) Put(key string, data []byte, contentType string) error {
+	if err := u.firstErr(); err != nil {
+		return err
+	}
+	options := &blob.WriterOptions{ContentType: contentType}
+	if err := u.bucket.WriteAll(u.ctx, u.prefix+key, data, options); err != nil {
+		return fmt.Errorf("error uploading %s: %w", u.prefix+key, err)
+	}
+	return nil
+}
+
+// Close waits for the queued tiles to be uploaded and closes the bucket.
+func (u *diskUploader) Close() error {
+	close(u.queue)
+	u.wg.Wait()
+	u.cancel()
+
+	err := u.firstErr()
+	if closeErr := u.bucket.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (u *diskUploader) work() {
+	defer u.wg.Done()
+
+	for upload := range u.queue {
+		// Drain the queue without uploading once an upload has failed.
+		if u.firstErr() != nil {
+			continue
+		}
+		options := &blob.WriterOptions{
+			ContentType:     u.contentType,
+			ContentEncoding: tileContentEncodings[detectTileCompression(upload.data, u.tileType)],
+		}
+		if err := u.bucket.WriteAll(u.ctx, upload.key, upload.data, options); err != nil {
+			u.setErr(fmt.Errorf("error uploading %s: %w", upload.key, err))
+		}
+	}
+}
+
+func (u *diskUploader) firstErr() error {
+	u.errMu.Lock()
+	defer u.errMu.Unlock()
+	return u.err
+}
+
+func (u *diskUploader) setErr(err error) {
+	u.errMu.Lock()
+	defer u.errMu.Unlock()
+	if u.err == nil {
+		u.err = err
+		u.cancel()
+	}
 }
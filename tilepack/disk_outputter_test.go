@@ -1,6 +1,9 @@
 package tilepack
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -142,8 +145,8 @@ func TestDiskOutputter_Save(t *testing.T) {
 }
 
 func TestDiskOutputter_AssignSpatialMetadata(t *testing.T) {
-	// AssignSpatialMetadata is a no-op for disk output (metadata is not stored
-	// in a flat-file tile tree), but must not return an error.
+	// AssignSpatialMetadata is a no-op for disk output without a sidecar, but
+	// must not return an error.
 	dir := t.TempDir()
 	o, err := NewDiskOutputter("root=" + dir + " format=pbf")
 	if err != nil {
@@ -197,3 +200,189 @@ func TestDiskOutputter_Save_OverwriteTruncates(t *testing.T) {
 		t.Errorf("expected %q after overwrite, got %q", "short", got)
 	}
 }
+
+func TestDiskOutputter_Layouts(t *testing.T) {
+	tile := maptile.New(1234, 3, 12)
+	tests := []struct {
+		options string
+		want    string
+	}{
+		{"", "12/1234/3.pbf"},
+		{"layout=tms", "12/1234/4092.pbf"},
+		{"layout=sharded shard=100", "12/12/1234/0/3.pbf"},
+		{"template={z}-{x}-{y}.{format}", "12-1234-3.pbf"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		o, err := NewDiskOutputter("root=" + dir + " format=pbf " + test.options)
+		if err != nil {
+			t.Fatalf("NewDiskOutputter(%s): %v", test.options, err)
+		}
+		if err := o.Save(tile, []byte("tile")); err != nil {
+			t.Fatalf("Save(%s): %v", test.options, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, test.want)); err != nil {
+			t.Errorf("%s: expected tile at %s: %v", test.options, test.want, err)
+		}
+	}
+}
+
+func TestNewDiskOutputter_BadOptions(t *testing.T) {
+	for _, options := range []string{
+		"layout=quadkey",
+		"layout=tms template={z}/{x}/{y}",
+		"template={z}/{y}.png",
+		"template=../{z}/{x}/{y}.png",
+		"shard=0",
+		"sidecar=yaml",
+		"dedup=symlink",
+	} {
+		if _, err := NewDiskOutputter("root=" + t.TempDir() + " format=pbf " + options); err == nil {
+			t.Errorf("expected an error for %s", options)
+		}
+	}
+}
+
+func TestDiskOutputter_Sidecars(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewDiskOutputter("root=" + dir + " format=pbf layout=tms sidecar=tilejson")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	o.SetMetadata(NewMbtilesMetadata(map[string]string{
+		"name": "test",
+		"json": `{"vector_layers":[{"id":"water","fields":{}}]}`,
+	}))
+	bounds := orb.Bound{Min: orb.Point{-10, -20}, Max: orb.Point{10, 20}}
+	if err := o.AssignSpatialMetadata(bounds, 2, 9); err != nil {
+		t.Fatalf("AssignSpatialMetadata: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "tilejson.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var doc struct {
+		TileJSON     string            `json:"tilejson"`
+		Tiles        []string          `json:"tiles"`
+		Scheme       string            `json:"scheme"`
+		Name         string            `json:"name"`
+		Format       string            `json:"format"`
+		Bounds       []float64         `json:"bounds"`
+		MinZoom      int               `json:"minzoom"`
+		MaxZoom      int               `json:"maxzoom"`
+		VectorLayers []json.RawMessage `json:"vector_layers"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if doc.TileJSON != "3.0.0" || len(doc.Tiles) != 1 || doc.Tiles[0] != "{z}/{x}/{y}.pbf" || doc.Scheme != "tms" {
+		t.Errorf("tilejson %s tiles %v scheme %s, want 3.0.0 [{z}/{x}/{y}.pbf] tms", doc.TileJSON, doc.Tiles, doc.Scheme)
+	}
+	if doc.Name != "test" || doc.Format != "pbf" || len(doc.Bounds) != 4 || doc.MinZoom != 2 || doc.MaxZoom != 9 {
+		t.Errorf("unexpected metadata in %s", data)
+	}
+	if len(doc.VectorLayers) != 1 {
+		t.Errorf("vector_layers = %d layers, want 1", len(doc.VectorLayers))
+	}
+
+	// The metadata.json sidecar round trips through MbtilesMetadata.
+	dir = t.TempDir()
+	o, err = NewDiskOutputter("root=" + dir + " format=png sidecar=metadata")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	metadata := NewMbtilesMetadata(nil)
+	if err := metadata.UnmarshalJSON(data); err != nil {
+		t.Fatalf("UnmarshalJSON: %v", err)
+	}
+	if format, _ := metadata.Format(); format != "png" {
+		t.Errorf("format = %q, want png", format)
+	}
+}
+
+func TestDiskOutputter_SkipEmptyAndHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewDiskOutputter("root=" + dir + " format=pbf skip_empty=true dedup=hardlink")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+
+	var emptyGzip bytes.Buffer
+	gzip.NewWriter(&emptyGzip).Close()
+
+	saves := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 1): {},
+		maptile.New(1, 0, 1): emptyGzip.Bytes(),
+		maptile.New(0, 1, 1): []byte("ocean"),
+		maptile.New(1, 1, 1): []byte("ocean"),
+	}
+	for _, tile := range []maptile.Tile{maptile.New(0, 0, 1), maptile.New(1, 0, 1), maptile.New(0, 1, 1), maptile.New(1, 1, 1)} {
+		if err := o.Save(tile, saves[tile]); err != nil {
+			t.Fatalf("Save %v: %v", tile, err)
+		}
+	}
+
+	for _, path := range []string{"1/0/0.pbf", "1/1/0.pbf"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("empty tile %s was written: %v", path, err)
+		}
+	}
+
+	first, err := os.Stat(filepath.Join(dir, "1/0/1.pbf"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	second, err := os.Stat(filepath.Join(dir, "1/1/1.pbf"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !os.SameFile(first, second) {
+		t.Errorf("duplicate tiles are not hardlinked")
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Join(dir, "1/1"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("1/1 holds %d files, want 1", len(entries))
+	}
+}
+
+func TestDiskOutputter_HardlinksOnlyIdenticalBytes(t *testing.T) {
+	// A tile with the same content as another but compressed differently is
+	// written as it was given, not linked to the other's bytes.
+	dir := t.TempDir()
+	o, err := NewDiskOutputter("root=" + dir + " format=pbf dedup=hardlink")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+
+	raw := []byte("ocean")
+	if err := o.Save(maptile.New(0, 0, 1), gzipBytes(raw)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Save(maptile.New(1, 0, 1), raw); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "1/1/0.pbf"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(data, raw) {
+		t.Errorf("1/1/0.pbf = %q, want %q", data, raw)
+	}
+}
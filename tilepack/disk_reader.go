@@ -0,0 +1,187 @@
+package tilepack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// NewDiskReader opens a tree written by the disk outputter. The layout and
+// metadata are read from the metadata.json or tilejson.json sidecar, and a
+// tree without one is read as {z}/{x}/{y}.{format}. Unless the sidecar
+// names it, the format is taken from the first tile file found.
+func NewDiskReader(root string) (TileReader, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("Root is not a directory")
+	}
+
+	metadata, layout, err := readDiskSidecar(root)
+	if err != nil {
+		return nil, err
+	}
+	r := &diskReader{root: root, layout: layout, segments: layout.segments(), metadata: metadata}
+	r.format, _ = metadata.Get("format")
+	return r, nil
+}
+
+type diskReader struct {
+	root     string
+	format   string
+	layout   *diskLayout
+	segments []diskSegment
+	metadata *MbtilesMetadata
+}
+
+func (r *diskReader) Close() error {
+	return nil
+}
+
+func (r *diskReader) GetTile(tile maptile.Tile) ([]byte, error) {
+	if r.format == "" {
+		if err := r.detectFormat(); err != nil {
+			return nil, err
+		}
+	}
+
+	path := filepath.Join(r.root, filepath.FromSlash(r.layout.Path(tile, r.format)))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// VisitAllTiles visits every tile of the tree. It fails on files and
+// directories the layout does not account for, other than the sidecars and
+// hidden files, rather than skip tiles it cannot place.
+func (r *diskReader) VisitAllTiles(visitor func(maptile.Tile, []byte) error) error {
+	return r.walk(nil, func(tile maptile.Tile, path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return visitor(tile, data)
+	})
+}
+
+// VisitTileRange lists only the directories that can hold tiles of
+// tileRange.
+func (r *diskReader) VisitTileRange(tileRange TileRange, visitor func(maptile.Tile, []byte) error) error {
+	return r.walk(&tileRange, func(tile maptile.Tile, path string) error {
+		if !tileRange.Contains(tile) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return visitor(tile, data)
+	})
+}
+
+// Metadata returns the metadata of the sidecar, with the format filled in
+// from the tiles when the sidecar does not set it.
+func (r *diskReader) Metadata() (*MbtilesMetadata, error) {
+	if r.format == "" {
+		if err := r.detectFormat(); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := map[string]string{}
+	for _, key := range r.metadata.Keys() {
+		metadata[key], _ = r.metadata.Get(key)
+	}
+	if _, ok := metadata["format"]; !ok && r.format != "" {
+		metadata["format"] = r.format
+	}
+	return NewMbtilesMetadata(metadata), nil
+}
+
+// errStopWalk ends a directory walk early without reporting an error.
+var errStopWalk = errors.New("stop walk")
+
+func (r *diskReader) detectFormat() error {
+	err := r.walk(nil, func(maptile.Tile, string) error {
+		return errStopWalk
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+// walk calls visit with the tile and path of each tile file, listing the
+// tree one template segment at a time. With a tileRange, only directories
+// that can hold its tiles are listed and other entries are skipped;
+// without one, entries that do not match the layout are an error.
+func (r *diskReader) walk(tileRange *TileRange, visit func(maptile.Tile, string) error) error {
+	return r.walkSegment(r.root, 0, diskPathValues{}, tileRange, visit)
+}
+
+func (r *diskReader) walkSegment(dir string, depth int, values diskPathValues, tileRange *TileRange, visit func(maptile.Tile, string) error) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && depth > 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	last := depth == len(r.segments)-1
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if strings.HasPrefix(name, ".") || (depth == 0 && isDiskSidecar(name)) {
+			continue
+		}
+
+		matched, ok := r.segments[depth].match(name, values)
+		if ok && tileRange != nil && !r.layout.inRange(matched, *tileRange) {
+			continue
+		}
+		if ok && entry.IsDir() != last {
+			if !last {
+				if err := r.walkSegment(path, depth+1, matched, tileRange, visit); err != nil {
+					return err
+				}
+				continue
+			}
+
+			tile, format, valid := r.layout.tile(matched)
+			if valid && (r.format == "" || format == "" || format == r.format) {
+				if r.format == "" {
+					r.format = format
+				}
+				if err := visit(tile, path); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if tileRange == nil {
+			rel, _ := filepath.Rel(r.root, path)
+			return fmt.Errorf("%s does not match the disk layout %s", filepath.ToSlash(rel), r.layout.template)
+		}
+	}
+	return nil
+}
+
+// isDiskSidecar reports whether name is the file name of a sidecar.
+func isDiskSidecar(name string) bool {
+	for _, sidecar := range diskSidecars {
+		if name == sidecar {
+			return true
+		}
+	}
+	return false
+}
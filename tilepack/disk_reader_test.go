@@ -0,0 +1,137 @@
+package tilepack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestDiskReader_Layouts(t *testing.T) {
+	tiles := gridTiles(4)
+
+	for _, options := range []string{
+		"",
+		"sidecar=metadata",
+		"layout=tms",
+		"layout=tms sidecar=tilejson",
+		"layout=sharded shard=3",
+		"layout=sharded shard=3 sidecar=tilejson",
+		"template={z}/{xshard}-{x}/{-y}.{format}.bin shard=5",
+	} {
+		dir := t.TempDir()
+		o, err := NewDiskOutputter("root=" + dir + " format=pbf " + options)
+		if err != nil {
+			t.Fatalf("NewDiskOutputter(%s): %v", options, err)
+		}
+		o.SetMetadata(NewMbtilesMetadata(map[string]string{"name": "grid"}))
+		for tile, data := range tiles {
+			if err := o.Save(tile, data); err != nil {
+				t.Fatalf("Save(%s): %v", options, err)
+			}
+		}
+		if err := o.AssignSpatialMetadata(orb.Bound{Min: orb.Point{-10, -10}, Max: orb.Point{10, 10}}, 0, 4); err != nil {
+			t.Fatalf("AssignSpatialMetadata(%s): %v", options, err)
+		}
+		if err := o.Close(); err != nil {
+			t.Fatalf("Close(%s): %v", options, err)
+		}
+
+		reader, err := OpenTileReader(dir)
+		if err != nil {
+			t.Fatalf("OpenTileReader(%s): %v", options, err)
+		}
+
+		got := map[maptile.Tile]string{}
+		err = reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+			got[tile] = string(data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("VisitAllTiles(%s): %v", options, err)
+		}
+		if len(got) != len(tiles) {
+			t.Errorf("%s: visited %d tiles, want %d", options, len(got), len(tiles))
+		}
+		for tile, data := range tiles {
+			if got[tile] != string(data) {
+				t.Errorf("%s: tile %v = %q, want %q", options, tile, got[tile], data)
+			}
+		}
+
+		tile := maptile.New(3, 12, 4)
+		if data, err := reader.GetTile(tile); err != nil || string(data) != string(tiles[tile]) {
+			t.Errorf("%s: GetTile(%v) = %q, %v, want %q", options, tile, data, err, tiles[tile])
+		}
+
+		tileRange := TileRange{Z: 4, MinX: 2, MaxX: 7, MinY: 10, MaxY: 15}
+		inRange := collectTileRange(t, reader, tileRange)
+		if len(inRange) != 6*6 {
+			t.Errorf("%s: VisitTileRange got %d tiles, want %d", options, len(inRange), 6*6)
+		}
+		for tile, data := range inRange {
+			if !tileRange.Contains(tile) || data != string(tiles[tile]) {
+				t.Errorf("%s: VisitTileRange gave tile %v = %q", options, tile, data)
+			}
+		}
+
+		metadata, err := reader.Metadata()
+		if err != nil {
+			t.Fatalf("Metadata(%s): %v", options, err)
+		}
+		if format, _ := metadata.Format(); format != "pbf" {
+			t.Errorf("%s: format = %q, want pbf", options, format)
+		}
+		if options != "" {
+			if name, _ := metadata.Name(); name != "grid" {
+				t.Errorf("%s: name = %q, want grid", options, name)
+			}
+			if z, err := metadata.MaxZoom(); err != nil || z != 4 {
+				t.Errorf("%s: maxzoom = %d, %v, want 4", options, z, err)
+			}
+		}
+		for _, key := range []string{"template", "shard", "tiles", "scheme", "tilejson"} {
+			if _, ok := metadata.Get(key); ok {
+				t.Errorf("%s: metadata has the sidecar key %s", options, key)
+			}
+		}
+	}
+}
+
+func TestDiskReader_UnknownLayout(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewDiskOutputter("root=" + dir + " format=pbf layout=sharded")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	if err := o.Save(maptile.New(1, 2, 3), []byte("tile")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Without the sidecar the tree is read as xyz, which its paths don't match.
+	if err := os.Remove(filepath.Join(dir, "metadata.json")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewDiskReader(dir)
+	if err != nil {
+		t.Fatalf("NewDiskReader: %v", err)
+	}
+	err = reader.VisitAllTiles(func(maptile.Tile, []byte) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "does not match the disk layout") {
+		t.Errorf("VisitAllTiles = %v, want a layout error", err)
+	}
+
+	// A sidecar with a template that can't be parsed is refused up front.
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(`{"template":"{z}/{q}.pbf"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskReader(dir); err == nil {
+		t.Error("expected NewDiskReader to fail on an unknown template")
+	}
+}
@@ -0,0 +1,210 @@
+package tilepack
+
+import (
+	"fmt"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/maptile/tilecover"
+)
+
+// geometryCoverMaxZoom is the deepest zoom a selection geometry is covered
+// with tiles. Deeper tiles are selected when their ancestor at this zoom is,
+// which keeps the cover of a large polygon small at the cost of including
+// tiles up to one zoom 12 tile beyond its edge.
+const geometryCoverMaxZoom = 12
+
+// TileRange is an inclusive range of XYZ tile coordinates at one zoom.
+type TileRange struct {
+	Z          maptile.Zoom
+	MinX, MaxX uint32
+	MinY, MaxY uint32
+}
+
+// Contains returns true if tile is in the range.
+func (r TileRange) Contains(tile maptile.Tile) bool {
+	return tile.Z == r.Z && tile.X >= r.MinX && tile.X <= r.MaxX && tile.Y >= r.MinY && tile.Y <= r.MaxY
+}
+
+// TileRangeReader is implemented by readers that can visit the tiles of a
+// TileRange without reading the whole archive.
+type TileRangeReader interface {
+	// VisitTileRange calls visitor for every tile in r. It stops and returns
+	// the first error visitor returns.
+	VisitTileRange(r TileRange, visitor func(maptile.Tile, []byte) error) error
+}
+
+// VisitTileRanges calls visitor for every tile of reader in ranges. Readers
+// that do not implement TileRangeReader are read in full and filtered.
+func VisitTileRanges(reader TileReader, ranges []TileRange, visitor func(maptile.Tile, []byte) error) error {
+	if rangeReader, ok := reader.(TileRangeReader); ok {
+		for _, r := range ranges {
+			if err := rangeReader.VisitTileRange(r, visitor); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visitFilteredTiles(reader, ranges, visitor)
+}
+
+// visitFilteredTiles visits all tiles of reader, calling visitor for those in
+// ranges.
+func visitFilteredTiles(reader TileReader, ranges []TileRange, visitor func(maptile.Tile, []byte) error) error {
+	return reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		for _, r := range ranges {
+			if r.Contains(tile) {
+				return visitor(tile, data)
+			}
+		}
+		return nil
+	})
+}
+
+// TileSelection is the set of tiles an extract copies: the tiles of a zoom
+// range within a bounding box or touching a polygon. It is not safe for
+// concurrent use.
+type TileSelection struct {
+	Bounds  orb.Bound
+	MinZoom maptile.Zoom
+	MaxZoom maptile.Zoom
+
+	geometry orb.Geometry
+	covers   map[maptile.Zoom]maptile.Set
+}
+
+// NewBoundsSelection selects the tiles from minZoom to maxZoom within bounds.
+// A bounds whose west edge is east of its east edge crosses the antimeridian.
+func NewBoundsSelection(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) *TileSelection {
+	return &TileSelection{Bounds: bounds, MinZoom: minZoom, MaxZoom: maxZoom}
+}
+
+// NewGeometrySelection selects the tiles from minZoom to maxZoom touching
+// geometry, which must be a Polygon, a MultiPolygon or a Collection of them.
+func NewGeometrySelection(geometry orb.Geometry, minZoom maptile.Zoom, maxZoom maptile.Zoom) (*TileSelection, error) {
+	if err := checkSelectionGeometry(geometry); err != nil {
+		return nil, err
+	}
+
+	return &TileSelection{
+		Bounds:   geometry.Bound(),
+		MinZoom:  minZoom,
+		MaxZoom:  maxZoom,
+		geometry: geometry,
+		covers:   map[maptile.Zoom]maptile.Set{},
+	}, nil
+}
+
+func checkSelectionGeometry(geometry orb.Geometry) error {
+	switch g := geometry.(type) {
+	case orb.Polygon, orb.MultiPolygon:
+		return nil
+	case orb.Collection:
+		if len(g) == 0 {
+			return fmt.Errorf("geometry collection is empty")
+		}
+		for _, member := range g {
+			if err := checkSelectionGeometry(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return fmt.Errorf("no geometry given")
+	default:
+		return fmt.Errorf("unsupported geometry type %s: must be a Polygon or MultiPolygon", geometry.GeoJSONType())
+	}
+}
+
+// Ranges returns the tile ranges covering the selection's bounds at each of
+// its zooms. The bounds are split in two when they cross the antimeridian.
+func (s *TileSelection) Ranges() []TileRange {
+	zooms := make([]maptile.Zoom, 0, s.MaxZoom-s.MinZoom+1)
+	for z := s.MinZoom; z <= s.MaxZoom; z++ {
+		zooms = append(zooms, z)
+	}
+
+	var ranges []TileRange
+	GenerateTileRanges(&GenerateRangesOptions{
+		Bounds: s.Bounds,
+		Zooms:  zooms,
+		ConsumerFunc: func(minTile maptile.Tile, maxTile maptile.Tile, z maptile.Zoom) {
+			ranges = append(ranges, TileRange{Z: z, MinX: minTile.X, MaxX: maxTile.X, MinY: minTile.Y, MaxY: maxTile.Y})
+		},
+	})
+	return ranges
+}
+
+// Contains returns true if tile is in the selection. Tiles of its Ranges are
+// always in a bounds selection; a geometry selection also checks that the
+// tile touches the geometry.
+func (s *TileSelection) Contains(tile maptile.Tile) (bool, error) {
+	if tile.Z < s.MinZoom || tile.Z > s.MaxZoom {
+		return false, nil
+	}
+	if s.geometry == nil {
+		return true, nil
+	}
+
+	coverTile := tile
+	if tile.Z > geometryCoverMaxZoom {
+		coverTile = tile.Parent()
+		for coverTile.Z > geometryCoverMaxZoom {
+			coverTile = coverTile.Parent()
+		}
+	}
+
+	cover, ok := s.covers[coverTile.Z]
+	if !ok {
+		var err error
+		cover, err = tilecover.Geometry(s.geometry, coverTile.Z)
+		if err != nil {
+			return false, fmt.Errorf("failed to cover geometry at zoom %d: %w", coverTile.Z, err)
+		}
+		s.covers[coverTile.Z] = cover
+	}
+	return cover[coverTile], nil
+}
+
+// ExtractResult summarizes the tiles ExtractTiles copied.
+type ExtractResult struct {
+	Tiles   int64
+	Bounds  orb.Bound
+	MinZoom maptile.Zoom
+	MaxZoom maptile.Zoom
+}
+
+// ExtractTiles copies the tiles of reader in selection to outputter. Tile
+// data is copied as stored. The outputter's tiles are created first, but its
+// spatial metadata is left for the caller to assign from the result.
+func ExtractTiles(reader TileReader, outputter TileOutputter, selection *TileSelection) (*ExtractResult, error) {
+	if err := outputter.CreateTiles(); err != nil {
+		return nil, err
+	}
+
+	result := &ExtractResult{}
+	err := VisitTileRanges(reader, selection.Ranges(), func(tile maptile.Tile, data []byte) error {
+		ok, err := selection.Contains(tile)
+		if err != nil || !ok {
+			return err
+		}
+
+		if err := outputter.Save(tile, data); err != nil {
+			return fmt.Errorf("failed to save tile %v: %w", tile, err)
+		}
+
+		if result.Tiles == 0 {
+			result.Bounds = tile.Bound()
+			result.MinZoom, result.MaxZoom = tile.Z, tile.Z
+		} else {
+			result.Bounds = result.Bounds.Union(tile.Bound())
+			result.MinZoom, result.MaxZoom = min(result.MinZoom, tile.Z), max(result.MaxZoom, tile.Z)
+		}
+		result.Tiles++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
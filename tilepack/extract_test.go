@@ -0,0 +1,229 @@
+package tilepack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// gridTiles returns every tile from zoom 0 to maxZoom with unique data. The
+// data varies in size, so that a PMTiles directory of the tiles does not
+// compress into the root.
+func gridTiles(maxZoom maptile.Zoom) map[maptile.Tile][]byte {
+	tiles := map[maptile.Tile][]byte{}
+	for z := maptile.Zoom(0); z <= maxZoom; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				padding := strings.Repeat("-", int((x*2654435761^y*40503)>>7%200))
+				tiles[maptile.New(x, y, z)] = []byte(fmt.Sprintf("%d/%d/%d%s", z, x, y, padding))
+			}
+		}
+	}
+	return tiles
+}
+
+func collectTileRange(t *testing.T, reader TileReader, r TileRange) map[maptile.Tile]string {
+	t.Helper()
+	got := map[maptile.Tile]string{}
+	err := VisitTileRanges(reader, []TileRange{r}, func(tile maptile.Tile, data []byte) error {
+		got[tile] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitTileRanges(%+v): %v", r, err)
+	}
+	return got
+}
+
+func TestTileRangeIDIntervals_MatchRange(t *testing.T) {
+	r := TileRange{Z: 5, MinX: 3, MaxX: 17, MinY: 9, MaxY: 30}
+	intervals := tileRangeIDIntervals(r)
+
+	first := pmtiles.ZxyToID(5, 0, 0)
+	for id := first; id < first+1<<10; id++ {
+		_, x, y := pmtiles.IDToZxy(id)
+		want := r.Contains(maptile.New(x, y, 5))
+		if got := overlapsTileIDIntervals(intervals, id, id+1); got != want {
+			t.Fatalf("tile %d/%d: in intervals = %v, want %v", x, y, got, want)
+		}
+	}
+	for i := 1; i < len(intervals); i++ {
+		if intervals[i-1].end >= intervals[i].first {
+			t.Fatalf("intervals not sorted and merged: %+v", intervals)
+		}
+	}
+}
+
+func TestVisitTileRanges_Readers(t *testing.T) {
+	tiles := gridTiles(7)
+
+	mbtilesReader, err := NewMbtilesTileReader(writeTestMbtiles(t, "grid.mbtiles", tiles))
+	if err != nil {
+		t.Fatalf("NewMbtilesTileReader: %v", err)
+	}
+	defer mbtilesReader.Close()
+
+	pmtilesReader, err := NewPmtilesReader(writeTestPmtiles(t, tiles))
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer pmtilesReader.Close()
+	if pmtilesReader.Header().LeafDirectoryLength == 0 {
+		t.Fatal("expected the test archive to have leaf directories")
+	}
+
+	dir := t.TempDir()
+	for tile, data := range tiles {
+		path := filepath.Join(dir, fmt.Sprintf("%d/%d/%d.pbf", tile.Z, tile.X, tile.Y))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskReader, err := NewDiskReader(dir)
+	if err != nil {
+		t.Fatalf("NewDiskReader: %v", err)
+	}
+
+	readers := map[string]TileReader{"mbtiles": mbtilesReader, "pmtiles": pmtilesReader, "disk": diskReader}
+	ranges := []TileRange{
+		{Z: 0, MinX: 0, MaxX: 0, MinY: 0, MaxY: 0},
+		{Z: 3, MinX: 1, MaxX: 2, MinY: 5, MaxY: 7},
+		{Z: 7, MinX: 10, MaxX: 100, MinY: 60, MaxY: 61},
+		{Z: 7, MinX: 127, MaxX: 127, MinY: 0, MaxY: 127},
+	}
+	for name, reader := range readers {
+		for _, r := range ranges {
+			got := collectTileRange(t, reader, r)
+
+			want := 0
+			for tile, data := range tiles {
+				if !r.Contains(tile) {
+					continue
+				}
+				want++
+				if got[tile] != string(data) {
+					t.Errorf("%s %+v: tile %v = %q, want %q", name, r, tile, got[tile], data)
+				}
+			}
+			if len(got) != want {
+				t.Errorf("%s %+v: got %d tiles, want %d", name, r, len(got), want)
+			}
+		}
+	}
+}
+
+func TestTileSelection_Geometry(t *testing.T) {
+	// A triangle in the north-west quadrant.
+	triangle := orb.Polygon{{{-170, 10}, {-10, 10}, {-170, 80}, {-170, 10}}}
+	selection, err := NewGeometrySelection(triangle, 0, 14)
+	if err != nil {
+		t.Fatalf("NewGeometrySelection: %v", err)
+	}
+
+	tests := []struct {
+		tile maptile.Tile
+		want bool
+	}{
+		{maptile.At(orb.Point{-160, 20}, 2), true},
+		{maptile.At(orb.Point{-160, 20}, 14), true},
+		{maptile.At(orb.Point{160, 20}, 2), false},
+		// Inside the bounding box but across the hypotenuse.
+		{maptile.At(orb.Point{-20, 75}, 10), false},
+		{maptile.At(orb.Point{-20, 75}, 14), false},
+		{maptile.At(orb.Point{-160, 20}, 15), false},
+	}
+	for _, test := range tests {
+		got, err := selection.Contains(test.tile)
+		if err != nil {
+			t.Fatalf("Contains(%v): %v", test.tile, err)
+		}
+		if got != test.want {
+			t.Errorf("Contains(%v) = %v, want %v", test.tile, got, test.want)
+		}
+	}
+
+	if _, err := NewGeometrySelection(orb.LineString{{0, 0}, {1, 1}}, 0, 1); err == nil {
+		t.Error("expected an error for a line string")
+	}
+}
+
+func TestTileSelection_RangesCrossAntimeridian(t *testing.T) {
+	selection := NewBoundsSelection(orb.Bound{Min: orb.Point{170, -10}, Max: orb.Point{-170, 10}}, 4, 4)
+
+	ranges := selection.Ranges()
+	if len(ranges) != 2 {
+		t.Fatalf("got %d ranges, want 2: %+v", len(ranges), ranges)
+	}
+	west, east := ranges[0], ranges[1]
+	if west.MinX != 0 || east.MaxX != 15 {
+		t.Errorf("ranges %+v do not reach the antimeridian from both sides", ranges)
+	}
+	if west.MaxX >= east.MinX {
+		t.Errorf("ranges %+v overlap", ranges)
+	}
+}
+
+func TestExtractTiles(t *testing.T) {
+	tiles := gridTiles(4)
+	reader, err := NewMbtilesTileReader(writeTestMbtiles(t, "grid.mbtiles", tiles))
+	if err != nil {
+		t.Fatalf("NewMbtilesTileReader: %v", err)
+	}
+	defer reader.Close()
+
+	// The tiles touching the north-east quadrant from zoom 2 to 3.
+	selection := NewBoundsSelection(orb.Bound{Min: orb.Point{1, 1}, Max: orb.Point{179, 80}}, 2, 3)
+
+	path := filepath.Join(t.TempDir(), "extract.mbtiles")
+	outputter, err := NewMbtilesOutputter(path, 10, false, NewMbtilesMetadata(map[string]string{"name": "extract", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	result, err := ExtractTiles(reader, outputter, selection)
+	if err != nil {
+		t.Fatalf("ExtractTiles: %v", err)
+	}
+	if err := outputter.AssignSpatialMetadata(result.Bounds, result.MinZoom, result.MaxZoom); err != nil {
+		t.Fatalf("AssignSpatialMetadata: %v", err)
+	}
+	if err := outputter.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// 2x2 tiles at zoom 2 and 4x4 at zoom 3.
+	if result.Tiles != 20 {
+		t.Errorf("extracted %d tiles, want 20", result.Tiles)
+	}
+	if result.MinZoom != 2 || result.MaxZoom != 3 {
+		t.Errorf("zooms = %d-%d, want 2-3", result.MinZoom, result.MaxZoom)
+	}
+	if result.Bounds.Min.X() != 0 || result.Bounds.Max.X() != 180 {
+		t.Errorf("bounds = %v, want the eastern hemisphere", result.Bounds)
+	}
+
+	extracted, err := NewMbtilesTileReader(path)
+	if err != nil {
+		t.Fatalf("NewMbtilesTileReader: %v", err)
+	}
+	defer extracted.Close()
+
+	data, err := extracted.GetTile(maptile.New(3, 1, 2))
+	if err != nil {
+		t.Fatalf("GetTile: %v", err)
+	}
+	if want := tiles[maptile.New(3, 1, 2)]; string(data) != string(want) {
+		t.Errorf("tile 2/3/1 = %q, want %q", data, want)
+	}
+	if data, _ := extracted.GetTile(maptile.New(0, 1, 2)); data != nil {
+		t.Errorf("tile 2/0/1 outside the bounds was extracted")
+	}
+}
@@ -0,0 +1,143 @@
+package tilepack
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envReferenceRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnvReferences replaces every ${NAME} in value with the contents of the
+// NAME environment variable. It returns the expanded value and the list of
+// substituted environment values, which callers should treat as secrets. An
+// unset variable is an error rather than an empty string, so a missing token
+// does not silently produce unauthenticated requests.
+func ExpandEnvReferences(value string) (string, []string, error) {
+	var secrets []string
+	var missing []string
+
+	expanded := envReferenceRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReferenceRegex.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			return ""
+		}
+		if v != "" {
+			secrets = append(secrets, v)
+		}
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", nil, fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return expanded, secrets, nil
+}
+
+// ParseHeaderLine parses a "Name: value" header line.
+func ParseHeaderLine(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid header %q: expected \"Name: value\"", line)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("invalid header name %q", name)
+	}
+
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+}
+
+// ReadHeaderFile reads headers from a file with one "Name: value" line per
+// header. Blank lines and lines starting with # are ignored. ${NAME}
+// environment references are expanded. Every value read from the file is
+// returned as a secret, since the file exists to keep credentials off the
+// command line.
+func ReadHeaderFile(path string) (http.Header, []string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fh.Close()
+
+	headers := http.Header{}
+	var secrets []string
+
+	scanner := bufio.NewScanner(fh)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, err := ParseHeaderLine(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		value, _, err = ExpandEnvReferences(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		headers.Add(name, value)
+		if value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return headers, secrets, nil
+}
+
+// newSecretRedactor returns a replacer that masks every secret value. Empty
+// secrets are ignored.
+func newSecretRedactor(secrets []string) *strings.Replacer {
+	// Replace longer secrets first so one that contains another is masked whole.
+	sorted := append([]string(nil), secrets...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, s := range sorted {
+		if s == "" {
+			continue
+		}
+		pairs = append(pairs, s, "REDACTED")
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// sensitiveHeaders are always redacted from logs, however they were configured.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+}
+
+func headerSecrets(headers http.Header) []string {
+	var secrets []string
+	for _, name := range sensitiveHeaders {
+		for _, v := range headers.Values(name) {
+			secrets = append(secrets, v)
+			// Also mask the credential alone, e.g. the token in "Bearer <token>",
+			// in case it is echoed back without the scheme.
+			if _, cred, ok := strings.Cut(v, " "); ok {
+				secrets = append(secrets, strings.TrimSpace(cred))
+			}
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,109 @@
+package tilepack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandEnvReferences(t *testing.T) {
+	// ${NAME} references are replaced by the environment value, and the value
+	// is reported back as a secret.
+	t.Setenv("TILEPACK_TEST_TOKEN", "s3cret")
+
+	got, secrets, err := ExpandEnvReferences("Bearer ${TILEPACK_TEST_TOKEN}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Bearer s3cret" {
+		t.Errorf("got %q", got)
+	}
+	if len(secrets) != 1 || secrets[0] != "s3cret" {
+		t.Errorf("expected secret s3cret, got %v", secrets)
+	}
+}
+
+func TestExpandEnvReferences_NoReference(t *testing.T) {
+	// Values without a reference are returned untouched, including a bare $.
+	got, secrets, err := ExpandEnvReferences("price $5")
+	if err != nil || got != "price $5" || len(secrets) != 0 {
+		t.Errorf("got %q %v %v", got, secrets, err)
+	}
+}
+
+func TestExpandEnvReferences_Unset(t *testing.T) {
+	// A missing variable must be an error, not an empty credential.
+	os.Unsetenv("TILEPACK_TEST_UNSET")
+	if _, _, err := ExpandEnvReferences("${TILEPACK_TEST_UNSET}"); err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+}
+
+func TestParseHeaderLine(t *testing.T) {
+	name, value, err := ParseHeaderLine("x-api-key:  abc:def ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "X-Api-Key" || value != "abc:def" {
+		t.Errorf("got %q %q", name, value)
+	}
+
+	for _, bad := range []string{"no colon", ": value", "bad name: value"} {
+		if _, _, err := ParseHeaderLine(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestReadHeaderFile(t *testing.T) {
+	// Comments and blank lines are skipped, every value is a secret, and
+	// environment references are expanded.
+	t.Setenv("TILEPACK_TEST_TOKEN", "tok")
+	path := filepath.Join(t.TempDir(), "headers")
+	content := "# credentials\n\nAuthorization: Bearer ${TILEPACK_TEST_TOKEN}\nX-Client: tilepack\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, secrets, err := ReadHeaderFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("Authorization: got %q", got)
+	}
+	if got := headers.Get("X-Client"); got != "tilepack" {
+		t.Errorf("X-Client: got %q", got)
+	}
+	if len(secrets) != 2 {
+		t.Errorf("expected 2 secrets, got %v", secrets)
+	}
+}
+
+func TestReadHeaderFile_BadLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers")
+	os.WriteFile(path, []byte("X-Ok: 1\nbroken\n"), 0600)
+
+	if _, _, err := ReadHeaderFile(path); err == nil {
+		t.Fatal("expected error for malformed line")
+	}
+}
+
+func TestNewSecretRedactor(t *testing.T) {
+	// The longest secret wins when one secret contains another.
+	r := newSecretRedactor([]string{"abc", "", "abcdef"})
+	if got := r.Replace("key=abcdef&other=abc"); got != "key=REDACTED&other=REDACTED" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestHeaderSecrets(t *testing.T) {
+	headers := map[string][]string{
+		"Authorization": {"Bearer tok"},
+		"X-Client":      {"tilepack"},
+	}
+	secrets := headerSecrets(headers)
+	if len(secrets) != 2 || secrets[0] != "Bearer tok" || secrets[1] != "tok" {
+		t.Errorf("got %v", secrets)
+	}
+}
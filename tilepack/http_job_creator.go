@@ -3,6 +3,7 @@ package tilepack
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -34,6 +35,43 @@ const (
 	httpUserAgent = "go-tilepacks/1.0"
 )
 
+// XYZJobGeneratorOptions configures a job generator created with
+// NewXYZJobGeneratorWithOptions.
+type XYZJobGeneratorOptions struct {
+	URLTemplate string
+	// FileTransportRoot, if set, registers a file:// transport rooted at this
+	// directory so URLTemplate may use the file:// scheme.
+	FileTransportRoot string
+	Bounds            orb.Bound
+	Zooms             []maptile.Zoom
+	HTTPTimeout       time.Duration
+	InvertedY         bool
+	EnsureGzip        bool
+	MbtilesFormat     string
+	// RetryPolicy controls retries of failed requests. Defaults to
+	// DefaultRetryPolicy when nil.
+	RetryPolicy *RetryPolicy
+	// Headers are added to every tile request, replacing the defaults of the
+	// same name.
+	Headers http.Header
+	// URLParams fill {name} placeholders in URLTemplate, e.g. an API key.
+	URLParams map[string]string
+	// Subdomains are rotated through for the {s} placeholder. Defaults to
+	// DefaultSubdomains.
+	Subdomains []string
+	// Scale fills the {ratio} and {scale} placeholders for high-DPI tiles.
+	// Defaults to 1.
+	Scale int
+	// Secrets are values that must never appear in log lines. Values of
+	// Authorization, Proxy-Authorization and Cookie headers are always treated
+	// as secrets.
+	Secrets []string
+	// Validators, if set, supplies stored ETag and Last-Modified values so
+	// tiles are requested conditionally. Tiles the server reports unchanged
+	// are returned with NotModified set instead of data.
+	Validators TileValidatorReader
+}
+
 func NewXYZJobGenerator(
 	urlTemplate string,
 	bounds orb.Bound,
@@ -43,218 +81,395 @@ func NewXYZJobGenerator(
 	ensureGzip bool,
 	mbtilesFormat string,
 ) (JobGenerator, error) {
+	return NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate:   urlTemplate,
+		Bounds:        bounds,
+		Zooms:         zooms,
+		HTTPTimeout:   httpTimeout,
+		InvertedY:     invertedY,
+		EnsureGzip:    ensureGzip,
+		MbtilesFormat: mbtilesFormat,
+	})
+}
+
+func NewFileTransportXYZJobGenerator(root string, urlTemplate string, bounds orb.Bound, zooms []maptile.Zoom, httpTimeout time.Duration, invertedY bool, ensureGzip bool) (JobGenerator, error) {
+	return NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate:       urlTemplate,
+		FileTransportRoot: root,
+		Bounds:            bounds,
+		Zooms:             zooms,
+		HTTPTimeout:       httpTimeout,
+		InvertedY:         invertedY,
+		EnsureGzip:        ensureGzip,
+	})
+}
+
+func NewXYZJobGeneratorWithOptions(opts *XYZJobGeneratorOptions) (JobGenerator, error) {
 	// Configure the HTTP client with a timeout and connection pools
 	httpClient := &http.Client{}
-	httpClient.Timeout = httpTimeout
+	httpClient.Timeout = opts.HTTPTimeout
 	httpTransport := &http.Transport{
 		MaxIdleConnsPerHost: 500,
 		DisableCompression:  true,
 	}
-	httpClient.Transport = httpTransport
 
-	return &xyzJobGenerator{
-		httpClient:    httpClient,
-		urlTemplate:   urlTemplate,
-		bounds:        bounds,
-		zooms:         zooms,
-		invertedY:     invertedY,
-		ensureGzip:    ensureGzip,
-		mbtilesFormat: mbtilesFormat,
-	}, nil
-}
+	if opts.FileTransportRoot != "" {
+		info, err := os.Stat(opts.FileTransportRoot)
 
-func NewFileTransportXYZJobGenerator(root string, urlTemplate string, bounds orb.Bound, zooms []maptile.Zoom, httpTimeout time.Duration, invertedY bool, ensureGzip bool) (JobGenerator, error) {
+		if err != nil {
+			return nil, err
+		}
 
-	info, err := os.Stat(root)
+		if !info.IsDir() {
+			return nil, errors.New("Invalid root directory")
+		}
 
-	if err != nil {
-		return nil, err
+		httpTransport.RegisterProtocol("file", http.NewFileTransport(http.Dir(opts.FileTransportRoot)))
 	}
 
-	if !info.IsDir() {
-		return nil, errors.New("Invalid root directory")
+	httpClient.Transport = httpTransport
+
+	retryPolicy := opts.RetryPolicy
+	if retryPolicy == nil {
+		retryPolicy = DefaultRetryPolicy()
 	}
 
-	httpClient := &http.Client{}
-	httpClient.Timeout = httpTimeout
+	// Configured parameters are constant for the run, so fill them in once
+	// and leave only the per-tile placeholders.
+	paramPairs := make([]string, 0, len(opts.URLParams)*2)
+	for name, value := range opts.URLParams {
+		if reservedURLParams[name] {
+			return nil, fmt.Errorf("URL parameter {%s} is reserved for tile coordinates", name)
+		}
+		paramPairs = append(paramPairs, "{"+name+"}", value)
+	}
+	urlTemplate := strings.NewReplacer(paramPairs...).Replace(opts.URLTemplate)
 
-	httpTransport := &http.Transport{}
-	httpTransport.RegisterProtocol("file", http.NewFileTransport(http.Dir(root)))
-	httpClient.Transport = httpTransport
+	headers := http.Header{}
+	headers.Set("User-Agent", httpUserAgent)
+	headers.Set("Accept-Encoding", "gzip")
+	for name, values := range opts.Headers {
+		headers[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	secrets := append(headerSecrets(headers), opts.Secrets...)
 
 	return &xyzJobGenerator{
-		httpClient:  httpClient,
-		urlTemplate: urlTemplate,
-		bounds:      bounds,
-		zooms:       zooms,
-		invertedY:   invertedY,
-		ensureGzip:  ensureGzip,
+		httpClient:    httpClient,
+		urlTemplate:   newTileURLTemplate(urlTemplate, opts.Subdomains, opts.Scale, opts.InvertedY),
+		bounds:        opts.Bounds,
+		zooms:         opts.Zooms,
+		invertedY:     opts.InvertedY,
+		ensureGzip:    opts.EnsureGzip,
+		mbtilesFormat: opts.MbtilesFormat,
+		retryPolicy:   retryPolicy,
+		headers:       headers,
+		redactor:      newSecretRedactor(secrets),
+		validators:    opts.Validators,
 	}, nil
 }
 
 type xyzJobGenerator struct {
 	httpClient    *http.Client
-	urlTemplate   string
+	urlTemplate   *tileURLTemplate
 	bounds        orb.Bound
 	zooms         []maptile.Zoom
 	invertedY     bool
 	ensureGzip    bool
 	mbtilesFormat string
+	retryPolicy   *RetryPolicy
+	headers       http.Header
+	redactor      *strings.Replacer
+	validators    TileValidatorReader
+}
+
+// redact masks any configured secrets in s.
+func (x *xyzJobGenerator) redact(s string) string {
+	if x.redactor == nil {
+		return s
+	}
+	return x.redactor.Replace(s)
+}
+
+// logf logs a message with any configured secrets masked out.
+func (x *xyzJobGenerator) logf(format string, args ...interface{}) {
+	log.Print(x.redact(fmt.Sprintf(format, args...)))
+}
+
+// errorf formats an error as fmt.Errorf does, with any configured secrets
+// masked out of its message.
+func (x *xyzJobGenerator) errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	return &redactedError{message: x.redact(err.Error()), err: errors.Unwrap(err)}
+}
+
+// redactedError is an error whose message has had secrets masked out of it,
+// while still unwrapping to the error it describes.
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
 }
 
-func doHTTPWithRetry(client *http.Client, request *http.Request, nRetries int) (*http.Response, error) {
-	sleep := 500 * time.Millisecond
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// doHTTPWithRetry performs request, retrying according to policy. It returns
+// the response only for a 200 or 304 status; any other final status is
+// returned as an *HTTPError, possibly wrapped. Waits between attempts are abandoned when
+// the request's context is cancelled.
+func doHTTPWithRetry(client *http.Client, request *http.Request, policy *RetryPolicy) (*http.Response, error) {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	ctx := request.Context()
+	start := time.Now()
+	var lastErr error
 
-	for i := 0; i < nRetries; i++ {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
 		resp, err := client.Do(request)
+
+		var cause string
+		var wait time.Duration
+		haveWait := false
+
 		if err != nil {
-			return nil, err
-		}
+			var retryable bool
+			cause, retryable = policy.classifyError(err)
+			if !retryable {
+				if cause == "canceled" {
+					policy.Stats.recordOutcome(RetryOutcomeCanceled)
+				} else {
+					policy.Stats.recordOutcome(RetryOutcomeNotRetryable)
+				}
+				return nil, err
+			}
+			lastErr = err
+		} else {
+			if resp.StatusCode == 200 {
+				policy.Stats.recordOutcome(RetryOutcomeSuccess)
+				return resp, nil
+			}
 
-		if resp.StatusCode == 200 {
-			return resp, nil
-		}
+			if resp.StatusCode == http.StatusNotModified {
+				policy.Stats.recordOutcome(RetryOutcomeNotModified)
+				return resp, nil
+			}
 
-		resp.Body.Close()
+			resp.Body.Close()
+			lastErr = &HTTPError{Code: resp.StatusCode, Status: resp.Status}
 
-		// log.Printf("Failed to GET (try %d) %+v: %+v", i, request.URL, resp.Status)
+			if !policy.RetryableStatuses[resp.StatusCode] {
+				policy.Stats.recordOutcome(RetryOutcomeNotRetryable)
+				return nil, lastErr
+			}
 
-		// was previously
-		// if resp.StatusCode > 500 && resp.StatusCode < 600 { sleep... }
+			cause = fmt.Sprintf("status %d", resp.StatusCode)
 
-		if resp.StatusCode <= 500 || resp.StatusCode >= 600 {
-			return nil, &HTTPError{Code: resp.StatusCode, Status: resp.Status}
+			if policy.RespectRetryAfter {
+				wait, haveWait = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			}
 		}
 
-		time.Sleep(sleep)
-		sleep *= 2.0
-		if sleep > 30*time.Second {
-			sleep = 30 * time.Second
+		if attempt == maxAttempts-1 {
+			break
 		}
-	}
 
-	return nil, fmt.Errorf("ran out of HTTP GET retries for %s", request.URL)
-}
+		if !haveWait {
+			wait = policy.backoff(attempt)
+		}
 
-func (x *xyzJobGenerator) CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error) {
-	f := func(id int, jobs chan *TileRequest, results chan *TileResponse) {
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			policy.Stats.recordOutcome(RetryOutcomeDeadline)
+			return nil, fmt.Errorf("gave up on %s after %s: %w", request.URL, time.Since(start).Round(time.Millisecond), lastErr)
+		}
 
-		// Instantiate the gzip support stuff once instead on every iteration
-		bodyBuffer := bytes.NewBuffer(nil)
-		bodyGzipper, err := gzip.NewWriterLevel(bodyBuffer, gzip.BestCompression)
-		if err != nil {
-			log.Fatalf("Couldn't create gzipper: %+v", err)
+		policy.Stats.recordRetry(cause)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			policy.Stats.recordOutcome(RetryOutcomeCanceled)
+			return nil, ctx.Err()
 		}
+	}
 
-		for request := range jobs {
-			start := time.Now()
+	policy.Stats.recordOutcome(RetryOutcomeExhausted)
+	return nil, fmt.Errorf("ran out of HTTP GET retries for %s: %w", request.URL, lastErr)
+}
 
-			httpReq, err := http.NewRequest("GET", request.URL, nil)
-			if err != nil {
-				log.Printf("Unable to create HTTP request: %+v", err)
-				continue
+func (x *xyzJobGenerator) CreateWorker() (TileWorker, error) {
+	// Instantiate the gzip support stuff once instead on every iteration
+	bodyBuffer := bytes.NewBuffer(nil)
+	bodyGzipper, err := gzip.NewWriterLevel(bodyBuffer, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create gzipper: %w", err)
+	}
+
+	f := func(ctx context.Context, id int, jobs <-chan *TileRequest, results chan<- *TileResponse) {
+		for {
+			request, ok := nextJob(ctx, jobs)
+			if !ok {
+				return
 			}
 
-			httpReq.Header.Add("User-Agent", httpUserAgent)
-			httpReq.Header.Add("Accept-Encoding", "gzip")
+			response := x.fetchTile(ctx, request, bodyBuffer, bodyGzipper)
+			if response.Err != nil && ctx.Err() != nil {
+				// Requests fail once the build is cancelled.
+				return
+			}
 
-			resp, err := doHTTPWithRetry(x.httpClient, httpReq, 30)
-			if err != nil {
-				log.Printf("Skipping %+v: %+v", request, err)
-				continue
+			if !sendResponse(ctx, results, response) {
+				return
 			}
 
-			var bodyData []byte
-			contentEncoding := resp.Header.Get("Content-Encoding")
+			if response.Err == nil && !response.NotModified {
+				// Sleep a tiny bit to try to prevent thundering herd
+				time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+			}
+		}
+	}
 
-			switch contentEncoding {
-			case "gzip":
-				if x.mbtilesFormat != "pbf" {
-					// Decompress the gzip response for non-vector formats
-					gzipReader, err := gzip.NewReader(resp.Body)
-					if err != nil {
-						log.Printf("Error creating gzip reader: %+v", err)
-						continue
-					}
+	return f, nil
+}
 
-					bodyData, err = io.ReadAll(gzipReader)
-					gzipReader.Close()
+// fetchTile requests the tile of request, gzipping the response with
+// bodyGzipper, which writes to bodyBuffer, when it should be and isn't
+// already. The error of a tile that can't be fetched is set on the response.
+func (x *xyzJobGenerator) fetchTile(ctx context.Context, request *TileRequest, bodyBuffer *bytes.Buffer, bodyGzipper *gzip.Writer) *TileResponse {
+	start := time.Now()
+	response := &TileResponse{Tile: request.Tile}
 
-					if err != nil {
-						log.Printf("Couldn't read decompressed bytes: %+v", err)
-						continue
-					}
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", request.URL, nil)
+	if err != nil {
+		response.Err = x.errorf("unable to create HTTP request: %w", err)
+		return response
+	}
 
-				} else {
-					// Keep gzipped response as-is for PBF
-					bodyData, err = io.ReadAll(resp.Body)
-				}
+	httpReq.Header = x.headers.Clone()
 
-			default:
+	if x.validators != nil {
+		stored, err := x.validators.GetValidators(request.Tile)
+		if err != nil {
+			x.logf("Unable to look up validators for %+v: %+v", request.Tile, err)
+		} else {
+			setConditionalHeaders(httpReq.Header, stored)
+		}
+	}
 
-				if !x.ensureGzip {
-					bodyData, err = io.ReadAll(resp.Body)
-				} else {
+	resp, err := doHTTPWithRetry(x.httpClient, httpReq, x.retryPolicy)
+	if err != nil {
+		response.Err = x.errorf("couldn't fetch %s: %w", request.URL, err)
+		return response
+	}
+	defer resp.Body.Close()
 
-					// Otherwise we'll gzip the data, so we should
-					// reset at the top in case we ran into a continue below
-					bodyBuffer.Reset()
-					bodyGzipper.Reset(bodyBuffer)
+	if resp.StatusCode == http.StatusNotModified {
+		response.Elapsed = time.Since(start).Seconds()
+		response.NotModified = true
+		return response
+	}
 
-					_, err = io.Copy(bodyGzipper, resp.Body)
-					if err != nil {
-						log.Printf("Couldn't copy to gzipper: %+v", err)
-						continue
-					}
+	var bodyData []byte
+	contentEncoding := resp.Header.Get("Content-Encoding")
 
-					err = bodyGzipper.Close()
-					if err != nil {
-						log.Printf("Couldn't close gzipper: %+v", err)
-						continue
-					}
+	switch contentEncoding {
+	case "gzip":
+		if x.mbtilesFormat != "pbf" {
+			// Decompress the gzip response for non-vector formats
+			gzipReader, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				response.Err = x.errorf("error creating gzip reader for %s: %w", request.URL, err)
+				return response
+			}
 
-					bodyData, err = io.ReadAll(bodyBuffer)
-				}
+			bodyData, err = io.ReadAll(gzipReader)
+			gzipReader.Close()
 
-				if err != nil {
-					log.Printf("Couldn't read bytes into byte array: %+v", err)
-					continue
-				}
+			if err != nil {
+				response.Err = x.errorf("couldn't read decompressed bytes of %s: %w", request.URL, err)
+				return response
 			}
-			resp.Body.Close()
 
+		} else {
+			// Keep gzipped response as-is for PBF
+			bodyData, err = io.ReadAll(resp.Body)
+		}
+
+	default:
+
+		if !x.ensureGzip {
+			bodyData, err = io.ReadAll(resp.Body)
+		} else {
+
+			// Otherwise we'll gzip the data, so we should
+			// reset at the top in case we ran into an error before
+			bodyBuffer.Reset()
+			bodyGzipper.Reset(bodyBuffer)
+
+			_, err = io.Copy(bodyGzipper, resp.Body)
 			if err != nil {
-				log.Printf("Error copying bytes from HTTP response: %+v", err)
-				continue
+				response.Err = x.errorf("couldn't copy %s to gzipper: %w", request.URL, err)
+				return response
 			}
 
-			secs := time.Since(start).Seconds()
-
-			results <- &TileResponse{
-				Tile:    request.Tile,
-				Data:    bodyData,
-				Elapsed: secs,
+			err = bodyGzipper.Close()
+			if err != nil {
+				response.Err = x.errorf("couldn't close gzipper: %w", err)
+				return response
 			}
 
-			// Sleep a tiny bit to try to prevent thundering herd
-			time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+			bodyData, err = io.ReadAll(bodyBuffer)
 		}
 	}
 
-	return f, nil
+	if err != nil {
+		response.Err = x.errorf("error copying bytes from HTTP response of %s: %w", request.URL, err)
+		return response
+	}
+
+	response.Data = bodyData
+	response.Elapsed = time.Since(start).Seconds()
+	response.Validators = &TileValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return response
 }
 
-func (x *xyzJobGenerator) CreateJobs(jobs chan *TileRequest) error {
+// setConditionalHeaders makes a request conditional on the stored validators.
+func setConditionalHeaders(header http.Header, validators *TileValidators) {
+	if validators == nil {
+		return
+	}
+	if validators.ETag != "" {
+		header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		header.Set("If-Modified-Since", validators.LastModified)
+	}
+}
+
+func (x *xyzJobGenerator) CreateJobs(ctx context.Context, jobs chan<- *TileRequest) error {
 	consumer := func(tile maptile.Tile) {
-		url := strings.NewReplacer(
-			"{x}", fmt.Sprintf("%d", tile.X),
-			"{y}", fmt.Sprintf("%d", tile.Y),
-			"{z}", fmt.Sprintf("%d", tile.Z)).Replace(x.urlTemplate)
+		url := x.urlTemplate.Expand(tile)
 
-		jobs <- &TileRequest{
+		sendJob(ctx, jobs, &TileRequest{
 			URL:  url,
 			Tile: tile,
-		}
+		})
 	}
 
 	opts := &GenerateTilesOptions{
@@ -262,9 +477,10 @@ func (x *xyzJobGenerator) CreateJobs(jobs chan *TileRequest) error {
 		Zooms:        x.zooms,
 		ConsumerFunc: consumer,
 		InvertedY:    x.invertedY,
+		Context:      ctx,
 	}
 
 	GenerateTiles(opts)
 
-	return nil
+	return ctx.Err()
 }
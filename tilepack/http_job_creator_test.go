@@ -3,11 +3,15 @@ package tilepack
 import (
 	"compress/gzip"
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,7 +48,7 @@ func TestDoHTTPWithRetry_Success(t *testing.T) {
 	defer srv.Close()
 
 	req, _ := http.NewRequest("GET", srv.URL, nil)
-	resp, err := doHTTPWithRetry(srv.Client(), req, 3)
+	resp, err := doHTTPWithRetry(srv.Client(), req, testRetryPolicy(3))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -63,7 +67,7 @@ func TestDoHTTPWithRetry_ClientError_NoRetry(t *testing.T) {
 	defer srv.Close()
 
 	req, _ := http.NewRequest("GET", srv.URL, nil)
-	_, err := doHTTPWithRetry(srv.Client(), req, 3)
+	_, err := doHTTPWithRetry(srv.Client(), req, testRetryPolicy(3))
 	if err == nil {
 		t.Fatal("expected error for 404 response")
 	}
@@ -76,7 +80,7 @@ func TestDoHTTPWithRetry_ClientError_NoRetry(t *testing.T) {
 
 func TestDoHTTPWithRetry_ServerError_ExhaustsRetries(t *testing.T) {
 	// 5xx responses are retried. When all retries are exhausted an HTTPError is returned.
-	// We use nRetries=1 so the server is called once, returns 503, and the function
+	// We use MaxAttempts=1 so the server is called once, returns 503, and the function
 	// gives up after the single attempt.
 	callCount := 0
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -87,12 +91,12 @@ func TestDoHTTPWithRetry_ServerError_ExhaustsRetries(t *testing.T) {
 
 	client := &http.Client{Timeout: 2 * time.Second}
 	req, _ := http.NewRequest("GET", srv.URL, nil)
-	_, err := doHTTPWithRetry(client, req, 1)
+	_, err := doHTTPWithRetry(client, req, testRetryPolicy(1))
 	if err == nil {
 		t.Fatal("expected error after exhausting retries")
 	}
 	if callCount != 1 {
-		t.Errorf("expected 1 server call with nRetries=1, got %d", callCount)
+		t.Errorf("expected 1 server call with MaxAttempts=1, got %d", callCount)
 	}
 }
 
@@ -151,7 +155,7 @@ func TestXYZJobGenerator_CreateJobs_URLTemplate(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 10)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -189,7 +193,7 @@ func TestXYZJobGenerator_CreateJobs_InvertedY(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 10)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -226,7 +230,7 @@ func runWorker(t *testing.T, gen JobGenerator, tileURL string, tile maptile.Tile
 	jobs <- &TileRequest{Tile: tile, URL: tileURL}
 	close(jobs)
 
-	go worker(0, jobs, results)
+	go worker(context.Background(), 0, jobs, results)
 
 	select {
 	case r := <-results:
@@ -365,3 +369,199 @@ func TestXYZWorker_EnsureGzip_ValidTrailer(t *testing.T) {
 		t.Errorf("decompressed mismatch: got %q, want %q", got, original)
 	}
 }
+
+func TestXYZWorker_CustomHeaders(t *testing.T) {
+	// Configured headers must be sent and may override the default User-Agent.
+	var gotAuth, gotAgent, gotEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotAgent = r.Header.Get("User-Agent")
+		gotEncoding = r.Header.Get("Accept-Encoding")
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	gen, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: srv.URL + "/{z}/{x}/{y}.pbf",
+		HTTPTimeout: 5 * time.Second,
+		Headers: http.Header{
+			"Authorization": {"Bearer tok"},
+			"User-Agent":    {"custom/1.0"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewXYZJobGeneratorWithOptions: %v", err)
+	}
+	runWorker(t, gen, srv.URL+"/0/0/0.pbf", maptile.New(0, 0, 0))
+
+	if gotAuth != "Bearer tok" {
+		t.Errorf("Authorization: got %q", gotAuth)
+	}
+	if gotAgent != "custom/1.0" {
+		t.Errorf("User-Agent: got %q", gotAgent)
+	}
+	if gotEncoding != "gzip" {
+		t.Errorf("Accept-Encoding default must be kept, got %q", gotEncoding)
+	}
+}
+
+func TestXYZJobGenerator_CreateJobs_URLParams(t *testing.T) {
+	// {name} placeholders are filled from URLParams alongside {z}/{x}/{y}.
+	gen, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "https://example.com/{style}/{z}/{x}/{y}.pbf?key={key}",
+		Bounds:      orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		Zooms:       []maptile.Zoom{0},
+		URLParams:   map[string]string{"key": "abc", "style": "dark"},
+	})
+	if err != nil {
+		t.Fatalf("NewXYZJobGeneratorWithOptions: %v", err)
+	}
+
+	jobs := make(chan *TileRequest, 10)
+	go func() {
+		gen.CreateJobs(context.Background(), jobs)
+		close(jobs)
+	}()
+
+	r := <-jobs
+	expected := "https://example.com/dark/0/0/0.pbf?key=abc"
+	if r.URL != expected {
+		t.Errorf("expected URL %q, got %q", expected, r.URL)
+	}
+}
+
+func TestNewXYZJobGeneratorWithOptions_ReservedURLParam(t *testing.T) {
+	// A URL parameter named like a tile coordinate would be ambiguous.
+	_, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: "https://example.com/{z}/{x}/{y}.pbf",
+		URLParams:   map[string]string{"z": "1"},
+	})
+	if err == nil {
+		t.Fatal("expected error for reserved URL parameter")
+	}
+}
+
+func TestXYZWorker_SecretsRedactedFromErrors(t *testing.T) {
+	// A failed request is reported with its URL; the API key in it must be
+	// masked, and must not be logged either.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer srv.Close()
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	gen, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: srv.URL + "/{z}/{x}/{y}.pbf?key={key}",
+		HTTPTimeout: 5 * time.Second,
+		URLParams:   map[string]string{"key": "topsecret"},
+		Secrets:     []string{"topsecret"},
+	})
+	if err != nil {
+		t.Fatalf("NewXYZJobGeneratorWithOptions: %v", err)
+	}
+
+	worker, _ := gen.CreateWorker()
+	jobs := make(chan *TileRequest, 1)
+	results := make(chan *TileResponse, 1)
+	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: srv.URL + "/0/0/0.pbf?key=topsecret"}
+	close(jobs)
+	worker(context.Background(), 0, jobs, results)
+	close(results)
+
+	r := <-results
+	if r == nil || r.Err == nil {
+		t.Fatal("expected a response with an error for the failed tile")
+	}
+	if strings.Contains(r.Err.Error(), "topsecret") {
+		t.Errorf("secret leaked into error: %v", r.Err)
+	}
+	if !strings.Contains(r.Err.Error(), "REDACTED") {
+		t.Errorf("expected redacted error, got: %v", r.Err)
+	}
+	var httpErr *HTTPError
+	if !errors.As(r.Err, &httpErr) || httpErr.Code != 404 {
+		t.Errorf("expected the error to wrap a 404 HTTPError, got: %v", r.Err)
+	}
+	if bytes.Contains(logBuf.Bytes(), []byte("topsecret")) {
+		t.Errorf("secret leaked into log: %s", logBuf.String())
+	}
+}
+
+// staticValidators is a TileValidatorReader returning the same validators
+// for every tile.
+type staticValidators struct {
+	v *TileValidators
+}
+
+func (s staticValidators) GetValidators(tile maptile.Tile) (*TileValidators, error) {
+	return s.v, nil
+}
+
+func TestXYZWorker_ConditionalRequest_NotModified(t *testing.T) {
+	// Stored validators must be sent and a 304 reported without data.
+	var gotIfNoneMatch, gotIfModifiedSince string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIfNoneMatch = r.Header.Get("If-None-Match")
+		gotIfModifiedSince = r.Header.Get("If-Modified-Since")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	stored := &TileValidators{ETag: `"abc"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}
+	gen, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: srv.URL + "/{z}/{x}/{y}.pbf",
+		HTTPTimeout: 5 * time.Second,
+		Validators:  staticValidators{stored},
+	})
+	if err != nil {
+		t.Fatalf("NewXYZJobGeneratorWithOptions: %v", err)
+	}
+	resp := runWorker(t, gen, srv.URL+"/0/0/0.pbf", maptile.New(0, 0, 0))
+
+	if gotIfNoneMatch != stored.ETag {
+		t.Errorf("If-None-Match: got %q", gotIfNoneMatch)
+	}
+	if gotIfModifiedSince != stored.LastModified {
+		t.Errorf("If-Modified-Since: got %q", gotIfModifiedSince)
+	}
+	if !resp.NotModified {
+		t.Error("expected NotModified response")
+	}
+	if len(resp.Data) != 0 {
+		t.Errorf("expected no data, got %d bytes", len(resp.Data))
+	}
+}
+
+func TestXYZWorker_CapturesValidators(t *testing.T) {
+	// A 200 response must carry the server's validators back to the outputter.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("unexpected conditional request without stored validators")
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Last-Modified", "Thu, 22 Oct 2015 07:28:00 GMT")
+		w.WriteHeader(200)
+		w.Write([]byte("tile"))
+	}))
+	defer srv.Close()
+
+	gen, err := NewXYZJobGeneratorWithOptions(&XYZJobGeneratorOptions{
+		URLTemplate: srv.URL + "/{z}/{x}/{y}.pbf",
+		HTTPTimeout: 5 * time.Second,
+		Validators:  staticValidators{nil},
+	})
+	if err != nil {
+		t.Fatalf("NewXYZJobGeneratorWithOptions: %v", err)
+	}
+	resp := runWorker(t, gen, srv.URL+"/0/0/0.pbf", maptile.New(0, 0, 0))
+
+	if resp.NotModified {
+		t.Fatal("200 response must not be NotModified")
+	}
+	if resp.Validators == nil || resp.Validators.ETag != `"v2"` || resp.Validators.LastModified != "Thu, 22 Oct 2015 07:28:00 GMT" {
+		t.Errorf("validators: got %+v", resp.Validators)
+	}
+}
@@ -0,0 +1,262 @@
+package tilepack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how doHTTPWithRetry decides whether a failed tile
+// request is worth trying again and how long to wait between attempts.
+//
+// Backoff is exponential with full jitter: before attempt n the worker sleeps
+// for a random duration in [0, min(MaxDelay, BaseDelay*2^n)). A Retry-After
+// header on a retryable response overrides the jittered delay when
+// RespectRetryAfter is set.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of requests made for one tile,
+	// including the first. Values below 1 are treated as 1.
+	MaxAttempts int
+	// RetryableStatuses lists the HTTP status codes that are retried.
+	RetryableStatuses map[int]bool
+	// RetryNetworkErrors retries transport failures such as timeouts,
+	// refused connections and resets.
+	RetryNetworkErrors bool
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	// MaxElapsed caps the total time spent on a single tile, including
+	// waits. Zero means no limit.
+	MaxElapsed        time.Duration
+	RespectRetryAfter bool
+	// Stats, if non-nil, receives one record per retry and per outcome.
+	Stats *RetryStats
+}
+
+// DefaultRetryStatuses are the status codes retried by DefaultRetryPolicy.
+var DefaultRetryStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:        30,
+		RetryableStatuses:  NewRetryableStatuses(DefaultRetryStatuses),
+		RetryNetworkErrors: true,
+		BaseDelay:          500 * time.Millisecond,
+		MaxDelay:           30 * time.Second,
+		MaxElapsed:         5 * time.Minute,
+		RespectRetryAfter:  true,
+	}
+}
+
+// NewRetryableStatuses converts a list of status codes into the set used by
+// RetryPolicy.RetryableStatuses.
+func NewRetryableStatuses(codes []int) map[int]bool {
+	s := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		s[c] = true
+	}
+	return s
+}
+
+// ParseRetryStatuses parses a comma-separated list of HTTP status codes such
+// as "429,500,502-504". Ranges are inclusive.
+func ParseRetryStatuses(str string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q: %w", part, err)
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q: %w", part, err)
+		}
+
+		if start < 100 || end > 599 || start > end {
+			return nil, fmt.Errorf("invalid status code range %q", part)
+		}
+
+		for c := start; c <= end; c++ {
+			codes[c] = true
+		}
+	}
+
+	return codes, nil
+}
+
+// backoff returns the jittered delay to wait before retry number attempt
+// (starting at 0).
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if p.BaseDelay > 0 && attempt < 32 {
+		exp := p.BaseDelay << uint(attempt)
+		if exp > 0 && (ceiling <= 0 || exp < ceiling) {
+			ceiling = exp
+		}
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// classifyError returns the retry cause for a transport error, and whether
+// the policy allows retrying it.
+func (p *RetryPolicy) classifyError(err error) (string, bool) {
+	if errors.Is(err, context.Canceled) {
+		return "canceled", false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout", p.RetryNetworkErrors
+	}
+
+	return "network", p.RetryNetworkErrors
+}
+
+// parseRetryAfter interprets a Retry-After header value, which is either a
+// number of seconds or an HTTP date. It returns false if the value is missing
+// or malformed.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	d := when.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// RetryStats counts retries by cause and final request outcomes. It is safe
+// for concurrent use by many workers.
+type RetryStats struct {
+	mu       sync.Mutex
+	retries  map[string]int64
+	outcomes map[string]int64
+}
+
+// Outcomes recorded by doHTTPWithRetry.
+const (
+	RetryOutcomeSuccess      = "success"
+	RetryOutcomeNotModified  = "not_modified"
+	RetryOutcomeNotRetryable = "not_retryable"
+	RetryOutcomeExhausted    = "exhausted"
+	RetryOutcomeDeadline     = "deadline"
+	RetryOutcomeCanceled     = "canceled"
+)
+
+// NewRetryStats returns empty RetryStats.
+func NewRetryStats() *RetryStats {
+	return &RetryStats{
+		retries:  make(map[string]int64),
+		outcomes: make(map[string]int64),
+	}
+}
+
+func (s *RetryStats) recordRetry(cause string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.retries[cause]++
+	s.mu.Unlock()
+}
+
+func (s *RetryStats) recordOutcome(outcome string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.outcomes[outcome]++
+	s.mu.Unlock()
+}
+
+// Retries returns a copy of the retry counts keyed by cause, e.g. "status 429",
+// "timeout" or "network".
+func (s *RetryStats) Retries() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyCounts(s.retries)
+}
+
+// Outcomes returns a copy of the per-request outcome counts.
+func (s *RetryStats) Outcomes() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyCounts(s.outcomes)
+}
+
+// String renders the counts as a single log-friendly line.
+func (s *RetryStats) String() string {
+	return fmt.Sprintf("outcomes: %s; retries: %s", formatCounts(s.Outcomes()), formatCounts(s.Retries()))
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func formatCounts(m map[string]int64) string {
+	if len(m) == 0 {
+		return "none"
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, m[k])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,256 @@
+package tilepack
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy returns the default policy with the given attempt budget and
+// delays short enough that tests never sleep noticeably.
+func testRetryPolicy(maxAttempts int) *RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.MaxAttempts = maxAttempts
+	p.BaseDelay = time.Millisecond
+	p.MaxDelay = 5 * time.Millisecond
+	p.Stats = NewRetryStats()
+	return p
+}
+
+func TestDoHTTPWithRetry_429_Retried(t *testing.T) {
+	// 429 Too Many Requests was never retried before the policy was added. It
+	// must now be retried and the eventual 200 returned.
+	callCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if callCount < 3 {
+			w.WriteHeader(429)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	policy := testRetryPolicy(5)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := doHTTPWithRetry(srv.Client(), req, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if callCount != 3 {
+		t.Errorf("expected 3 calls, got %d", callCount)
+	}
+	if got := policy.Stats.Retries()["status 429"]; got != 2 {
+		t.Errorf("expected 2 retries for status 429, got %d", got)
+	}
+	if got := policy.Stats.Outcomes()[RetryOutcomeSuccess]; got != 1 {
+		t.Errorf("expected 1 success outcome, got %d", got)
+	}
+}
+
+func TestDoHTTPWithRetry_500_Retried(t *testing.T) {
+	// 500 is in the default retryable set.
+	callCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if callCount == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := doHTTPWithRetry(srv.Client(), req, testRetryPolicy(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if callCount != 2 {
+		t.Errorf("expected 2 calls, got %d", callCount)
+	}
+}
+
+func TestDoHTTPWithRetry_StatusNotInPolicy(t *testing.T) {
+	// A status removed from the retryable set must fail on the first attempt.
+	callCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	policy := testRetryPolicy(5)
+	policy.RetryableStatuses = NewRetryableStatuses([]int{429})
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err := doHTTPWithRetry(srv.Client(), req, policy)
+
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != 503 {
+		t.Fatalf("expected HTTPError 503, got %v", err)
+	}
+	if callCount != 1 {
+		t.Errorf("expected 1 call, got %d", callCount)
+	}
+	if got := policy.Stats.Outcomes()[RetryOutcomeNotRetryable]; got != 1 {
+		t.Errorf("expected 1 not_retryable outcome, got %d", got)
+	}
+}
+
+func TestDoHTTPWithRetry_Exhausted_WrapsHTTPError(t *testing.T) {
+	// When attempts run out the last HTTPError must still be reachable with errors.As.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(502)
+	}))
+	defer srv.Close()
+
+	policy := testRetryPolicy(3)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err := doHTTPWithRetry(srv.Client(), req, policy)
+
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != 502 {
+		t.Fatalf("expected wrapped HTTPError 502, got %v", err)
+	}
+	if got := policy.Stats.Outcomes()[RetryOutcomeExhausted]; got != 1 {
+		t.Errorf("expected 1 exhausted outcome, got %d", got)
+	}
+	if got := policy.Stats.Retries()["status 502"]; got != 2 {
+		t.Errorf("expected 2 retries, got %d", got)
+	}
+}
+
+func TestDoHTTPWithRetry_NetworkError_Retried(t *testing.T) {
+	// Connection failures are retried when RetryNetworkErrors is set and
+	// returned immediately when it is not.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	policy := testRetryPolicy(3)
+	req, _ := http.NewRequest("GET", url, nil)
+	if _, err := doHTTPWithRetry(http.DefaultClient, req, policy); err == nil {
+		t.Fatal("expected error for closed server")
+	}
+	if got := policy.Stats.Retries()["network"]; got != 2 {
+		t.Errorf("expected 2 network retries, got %d", got)
+	}
+
+	policy = testRetryPolicy(3)
+	policy.RetryNetworkErrors = false
+	if _, err := doHTTPWithRetry(http.DefaultClient, req, policy); err == nil {
+		t.Fatal("expected error for closed server")
+	}
+	if got := len(policy.Stats.Retries()); got != 0 {
+		t.Errorf("expected no retries with RetryNetworkErrors=false, got %d causes", got)
+	}
+}
+
+func TestDoHTTPWithRetry_RetryAfterRespected(t *testing.T) {
+	// A Retry-After of 1 second must be waited out even though the jittered
+	// backoff would be a few milliseconds.
+	callCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if callCount == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	start := time.Now()
+	resp, err := doHTTPWithRetry(srv.Client(), req, testRetryPolicy(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait at least 1s for Retry-After, waited %s", elapsed)
+	}
+}
+
+func TestDoHTTPWithRetry_MaxElapsed(t *testing.T) {
+	// A Retry-After beyond the per-tile time budget must make the request give
+	// up immediately instead of sleeping.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(429)
+	}))
+	defer srv.Close()
+
+	policy := testRetryPolicy(10)
+	policy.MaxElapsed = 100 * time.Millisecond
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+
+	start := time.Now()
+	_, err := doHTTPWithRetry(srv.Client(), req, policy)
+	if err == nil {
+		t.Fatal("expected error when Retry-After exceeds MaxElapsed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to give up quickly, took %s", elapsed)
+	}
+	if got := policy.Stats.Outcomes()[RetryOutcomeDeadline]; got != 1 {
+		t.Errorf("expected 1 deadline outcome, got %d", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if d, ok := parseRetryAfter("120", now); !ok || d != 2*time.Minute {
+		t.Errorf("seconds: got %s %v", d, ok)
+	}
+	if d, ok := parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now); !ok || d != 30*time.Second {
+		t.Errorf("http date: got %s %v", d, ok)
+	}
+	if d, ok := parseRetryAfter(now.Add(-time.Hour).Format(http.TimeFormat), now); !ok || d != 0 {
+		t.Errorf("past date: got %s %v", d, ok)
+	}
+	for _, bad := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(bad, now); ok {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestParseRetryStatuses(t *testing.T) {
+	codes, err := ParseRetryStatuses("429, 500,502-504")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range []int{429, 500, 502, 503, 504} {
+		if !codes[c] {
+			t.Errorf("expected %d in set", c)
+		}
+	}
+	if codes[501] {
+		t.Error("501 must not be in set")
+	}
+
+	for _, bad := range []string{"abc", "600", "504-502"} {
+		if _, err := ParseRetryStatuses(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestRetryPolicy_BackoffBounded(t *testing.T) {
+	// The jittered delay must never exceed MaxDelay, even for large attempt numbers.
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 0; attempt < 100; attempt++ {
+		if d := p.backoff(attempt); d < 0 || d >= time.Second {
+			t.Fatalf("attempt %d: backoff %s out of range", attempt, d)
+		}
+	}
+}
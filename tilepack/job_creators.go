@@ -1,6 +1,52 @@
 package tilepack
 
+import (
+	"context"
+)
+
+// TileWorker fetches the requests it receives from jobs and sends a response
+// for each tile it produces to results, until jobs is closed or ctx is
+// cancelled. A request that can't be fetched is answered with a response
+// whose Err is set, so one bad tile doesn't stop the build.
+type TileWorker func(ctx context.Context, id int, jobs <-chan *TileRequest, results chan<- *TileResponse)
+
 type JobGenerator interface {
-	CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error)
-	CreateJobs(jobs chan *TileRequest) error
+	// CreateWorker returns a worker to run in a single goroutine. Call it
+	// once for each concurrent worker.
+	CreateWorker() (TileWorker, error)
+	// CreateJobs sends a request for every tile to fetch to jobs. It returns
+	// ctx.Err() if ctx is cancelled before every request was sent.
+	CreateJobs(ctx context.Context, jobs chan<- *TileRequest) error
+}
+
+// nextJob receives the next request from jobs, returning false once jobs is
+// closed or ctx is cancelled.
+func nextJob(ctx context.Context, jobs <-chan *TileRequest) (*TileRequest, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case request, ok := <-jobs:
+		return request, ok && ctx.Err() == nil
+	}
+}
+
+// sendJob sends request to jobs, returning false if ctx is cancelled first.
+func sendJob(ctx context.Context, jobs chan<- *TileRequest, request *TileRequest) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case jobs <- request:
+		return true
+	}
+}
+
+// sendResponse sends response to results, returning false if ctx is cancelled
+// first.
+func sendResponse(ctx context.Context, results chan<- *TileResponse, response *TileResponse) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case results <- response:
+		return true
+	}
 }
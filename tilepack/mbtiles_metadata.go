@@ -1,12 +1,17 @@
 package tilepack
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
 )
 
 type MbtilesMetadata struct {
@@ -106,25 +111,26 @@ func (m *MbtilesMetadata) Center() (orb.Point, maptile.Zoom, error) {
 		return pt, z, fmt.Errorf("Invalid center metadata")
 	}
 
-	x, err := strconv.ParseFloat(parts[0], 64)
+	x, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
 
 	if err != nil {
 		return pt, z, fmt.Errorf("Failed to parse x, %w", err)
 	}
 
-	y, err := strconv.ParseFloat(parts[1], 64)
+	y, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 
 	if err != nil {
 		return pt, z, fmt.Errorf("Failed to parse y, %w", err)
 	}
 
-	zFloat, err := strconv.ParseFloat(parts[2], 64)
-	z = maptile.Zoom(zFloat)
+	zInt, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 8)
 
 	if err != nil {
 		return pt, z, fmt.Errorf("Failed to parse zoom, %w", err)
 	}
 
+	z = maptile.Zoom(zInt)
+
 	pt = [2]float64{x, y}
 	return pt, z, nil
 }
@@ -137,7 +143,7 @@ func (m *MbtilesMetadata) MinZoom() (uint, error) {
 		return 0, fmt.Errorf("Metadata is missing minzoom")
 	}
 
-	i, err := strconv.Atoi(str_minzoom)
+	i, err := strconv.ParseUint(str_minzoom, 10, 8)
 
 	if err != nil {
 		return 0, fmt.Errorf("Failed to parse minzoom value, %w", err)
@@ -154,7 +160,7 @@ func (m *MbtilesMetadata) MaxZoom() (uint, error) {
 		return 0, fmt.Errorf("Metadata is missing maxzoom")
 	}
 
-	i, err := strconv.Atoi(str_maxzoom)
+	i, err := strconv.ParseUint(str_maxzoom, 10, 8)
 
 	if err != nil {
 		return 0, fmt.Errorf("Failed to parse maxzoom value, %w", err)
@@ -167,10 +173,516 @@ func (m *MbtilesMetadata) Set(key string, value string) {
 	m.metadata[key] = value
 }
 
+// Delete removes key.
+func (m *MbtilesMetadata) Delete(key string) {
+	delete(m.metadata, key)
+}
+
 func (m *MbtilesMetadata) Format() (string, error) {
-	return m.metadata["format"], nil
+	return m.required("format")
 }
 
 func (m *MbtilesMetadata) Name() (string, error) {
-	return m.metadata["name"], nil
+	return m.required("name")
+}
+
+func (m *MbtilesMetadata) required(key string) (string, error) {
+	v, exists := m.Get(key)
+	if !exists || v == "" {
+		return "", fmt.Errorf("Metadata is missing %s", key)
+	}
+	return v, nil
+}
+
+// Attribution returns the attribution HTML, or "" if it is not set.
+func (m *MbtilesMetadata) Attribution() string {
+	return m.metadata["attribution"]
+}
+
+// Description returns the description, or "" if it is not set.
+func (m *MbtilesMetadata) Description() string {
+	return m.metadata["description"]
+}
+
+// Version returns the version of the tileset, or "" if it is not set.
+func (m *MbtilesMetadata) Version() string {
+	return m.metadata["version"]
+}
+
+// Type returns the layer type, overlay or baselayer, or "" if it is not set.
+func (m *MbtilesMetadata) Type() (string, error) {
+	v, exists := m.Get("type")
+	if !exists {
+		return "", nil
+	}
+	if v != "overlay" && v != "baselayer" {
+		return "", fmt.Errorf("Invalid type %q, must be overlay or baselayer", v)
+	}
+	return v, nil
+}
+
+// JSON returns the members of the json key, or nil if it is not set.
+func (m *MbtilesMetadata) JSON() (map[string]json.RawMessage, error) {
+	v, exists := m.Get("json")
+	if !exists {
+		return nil, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(v), &doc); err != nil {
+		return nil, fmt.Errorf("Failed to parse json metadata, %w", err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("json metadata is not an object")
+	}
+	return doc, nil
+}
+
+// VectorLayers returns the vector_layers of the json key, or nil if there
+// are none.
+func (m *MbtilesMetadata) VectorLayers() ([]*VectorLayer, error) {
+	doc, err := m.JSON()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := doc["vector_layers"]
+	if !ok {
+		return nil, nil
+	}
+
+	var layers []*VectorLayer
+	if err := json.Unmarshal(raw, &layers); err != nil {
+		return nil, fmt.Errorf("Failed to parse vector_layers metadata, %w", err)
+	}
+	return layers, nil
+}
+
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// SetBounds sets the bounds key.
+func (m *MbtilesMetadata) SetBounds(bounds orb.Bound) {
+	m.Set("bounds", strings.Join([]string{
+		formatCoordinate(bounds.Min[0]), formatCoordinate(bounds.Min[1]),
+		formatCoordinate(bounds.Max[0]), formatCoordinate(bounds.Max[1]),
+	}, ","))
+}
+
+// SetCenter sets the center key.
+func (m *MbtilesMetadata) SetCenter(pt orb.Point, z maptile.Zoom) {
+	m.Set("center", fmt.Sprintf("%s,%s,%d", formatCoordinate(pt[0]), formatCoordinate(pt[1]), z))
+}
+
+// SetMinZoom sets the minzoom key.
+func (m *MbtilesMetadata) SetMinZoom(z maptile.Zoom) {
+	m.Set("minzoom", strconv.Itoa(int(z)))
+}
+
+// SetMaxZoom sets the maxzoom key.
+func (m *MbtilesMetadata) SetMaxZoom(z maptile.Zoom) {
+	m.Set("maxzoom", strconv.Itoa(int(z)))
+}
+
+// Validate checks the metadata against the MBTiles 1.3 spec: name and format
+// are required, and the other spec keys must be well formed when present.
+// It returns every problem found, joined.
+func (m *MbtilesMetadata) Validate() error {
+	var errs []error
+
+	if _, err := m.Name(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if format, err := m.Format(); err != nil {
+		errs = append(errs, err)
+	} else if _, ok := pmtilesTileType(format); !ok && !strings.Contains(format, "/") {
+		errs = append(errs, fmt.Errorf("Invalid format %q, must be pbf, mvt, mlt, png, jpg, jpeg, webp, avif or a media type", format))
+	}
+
+	var bounds *orb.Bound
+	if _, exists := m.Get("bounds"); exists {
+		b, err := m.Bounds()
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case b.Min[0] < -180 || b.Max[0] > 180 || b.Min[1] < -90 || b.Max[1] > 90:
+			errs = append(errs, fmt.Errorf("Bounds %v are outside of the world", b))
+		case b.Min[0] > b.Max[0] || b.Min[1] > b.Max[1]:
+			errs = append(errs, fmt.Errorf("Bounds minimum is greater than maximum in %v", b))
+		default:
+			bounds = &b
+		}
+	}
+
+	var minZoom, maxZoom *uint
+	if _, exists := m.Get("minzoom"); exists {
+		if z, err := m.MinZoom(); err != nil {
+			errs = append(errs, err)
+		} else {
+			minZoom = &z
+		}
+	}
+	if _, exists := m.Get("maxzoom"); exists {
+		if z, err := m.MaxZoom(); err != nil {
+			errs = append(errs, err)
+		} else {
+			maxZoom = &z
+		}
+	}
+	if minZoom != nil && maxZoom != nil && *minZoom > *maxZoom {
+		errs = append(errs, fmt.Errorf("minzoom %d is greater than maxzoom %d", *minZoom, *maxZoom))
+	}
+
+	if _, exists := m.Get("center"); exists {
+		pt, z, err := m.Center()
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case bounds != nil && !bounds.Contains(pt):
+			errs = append(errs, fmt.Errorf("Center %v is outside of the bounds %v", pt, *bounds))
+		case (minZoom != nil && uint(z) < *minZoom) || (maxZoom != nil && uint(z) > *maxZoom):
+			errs = append(errs, fmt.Errorf("Center zoom %d is outside of the zoom range", z))
+		}
+	}
+
+	if _, err := m.Type(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := m.VectorLayers(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// MarshalJSON encodes the metadata as a JSON object, with bounds and center
+// as arrays of numbers, the zooms as numbers and the json key as an object,
+// as TileJSON does. Values that cannot be parsed are kept as strings.
+func (m *MbtilesMetadata) MarshalJSON() ([]byte, error) {
+	doc := make(map[string]interface{}, len(m.metadata))
+	for key, value := range m.metadata {
+		doc[key] = value
+	}
+
+	if bounds, err := m.Bounds(); err == nil {
+		doc["bounds"] = []float64{bounds.Min[0], bounds.Min[1], bounds.Max[0], bounds.Max[1]}
+	}
+	if pt, z, err := m.Center(); err == nil {
+		doc["center"] = []float64{pt[0], pt[1], float64(z)}
+	}
+	if z, err := m.MinZoom(); err == nil {
+		doc["minzoom"] = z
+	}
+	if z, err := m.MaxZoom(); err == nil {
+		doc["maxzoom"] = z
+	}
+	if v, exists := m.Get("json"); exists {
+		if _, err := m.JSON(); err == nil {
+			doc["json"] = json.RawMessage(v)
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes metadata encoded by MarshalJSON, replacing the
+// current keys. Strings are taken as is; other values are stored as their
+// MBTiles string form.
+func (m *MbtilesMetadata) UnmarshalJSON(data []byte) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	m.metadata = make(map[string]string, len(doc))
+	for key, raw := range doc {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			m.metadata[key] = s
+			continue
+		}
+
+		var numbers []float64
+		switch {
+		case key == "bounds" && json.Unmarshal(raw, &numbers) == nil && len(numbers) == 4:
+			m.SetBounds(orb.Bound{Min: orb.Point{numbers[0], numbers[1]}, Max: orb.Point{numbers[2], numbers[3]}})
+		case key == "center" && json.Unmarshal(raw, &numbers) == nil && len(numbers) == 3:
+			m.SetCenter(orb.Point{numbers[0], numbers[1]}, maptile.Zoom(numbers[2]))
+		default:
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil {
+				return err
+			}
+			m.metadata[key] = compact.String()
+		}
+	}
+	return nil
+}
+
+// pmtilesTopLevelJSONKeys are the members of the json key that PMTiles keeps
+// at the top level of its JSON metadata, as the reference pmtiles tooling
+// does.
+var pmtilesTopLevelJSONKeys = map[string]bool{"vector_layers": true, "tilestats": true}
+
+// PmtilesJSON returns the metadata as PMTiles JSON metadata. The members of
+// the json key, such as vector_layers, are moved to the top level.
+func (m *MbtilesMetadata) PmtilesJSON() map[string]interface{} {
+	meta := make(map[string]interface{}, len(m.metadata))
+	for key, value := range m.metadata {
+		if key == "json" {
+			var doc map[string]interface{}
+			if err := json.Unmarshal([]byte(value), &doc); err == nil && doc != nil {
+				for member, v := range doc {
+					meta[member] = v
+				}
+				continue
+			}
+		}
+		meta[key] = value
+	}
+	return meta
+}
+
+// ApplyToPmtilesHeader sets the tile type, bounds, center and zoom range of
+// h from the metadata keys that are set. It fails without changing h if any
+// of them is invalid.
+func (m *MbtilesMetadata) ApplyToPmtilesHeader(h *pmtiles.HeaderV3) error {
+	t, err := m.Tileset()
+	if err != nil {
+		return err
+	}
+	return t.ApplyToPmtilesHeader(h)
+}
+
+func toE7(v float64) int32 {
+	return int32(math.Round(v * 1e7))
+}
+
+// pmtilesTileType returns the PMTiles tile type of an MBTiles format. The
+// formats it knows, those of pmtilesFormats plus the mvt and jpeg aliases,
+// are the ones Validate accepts besides media types.
+func pmtilesTileType(format string) (pmtiles.TileType, bool) {
+	if format == "mvt" {
+		return pmtiles.Mvt, true
+	}
+	if format == "jpeg" {
+		return pmtiles.Jpeg, true
+	}
+	for tileType, name := range pmtilesFormats {
+		if name == format {
+			return tileType, true
+		}
+	}
+	return pmtiles.UnknownTileType, false
+}
+
+// NewMbtilesMetadataFromPmtiles converts the header and JSON metadata of a
+// PMTiles archive into MBTiles metadata. The vector_layers and tilestats
+// values are gathered into the json key, and other values that are not
+// strings are JSON encoded. The format, zoom, bounds and center keys are
+// filled from the header when the JSON does not set them.
+func NewMbtilesMetadataFromPmtiles(h pmtiles.HeaderV3, jsonMetadata map[string]interface{}) (*MbtilesMetadata, error) {
+	m := NewMbtilesMetadata(make(map[string]string, len(jsonMetadata)))
+	doc := map[string]interface{}{}
+
+	for key, value := range jsonMetadata {
+		if s, ok := value.(string); ok {
+			m.Set(key, s)
+			continue
+		}
+		if pmtilesTopLevelJSONKeys[key] {
+			doc[key] = value
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s metadata key: %w", key, err)
+		}
+		m.Set(key, string(encoded))
+	}
+
+	if len(doc) > 0 {
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding json metadata key: %w", err)
+		}
+		m.Set("json", string(encoded))
+	}
+
+	// The header always holds these, so only unset headers are skipped.
+	if h.SpecVersion == 0 {
+		return m, nil
+	}
+
+	defaults := NewMbtilesMetadata(map[string]string{})
+	defaults.SetMinZoom(maptile.Zoom(h.MinZoom))
+	defaults.SetMaxZoom(maptile.Zoom(h.MaxZoom))
+	defaults.SetBounds(orb.Bound{
+		Min: orb.Point{float64(h.MinLonE7) / 1e7, float64(h.MinLatE7) / 1e7},
+		Max: orb.Point{float64(h.MaxLonE7) / 1e7, float64(h.MaxLatE7) / 1e7},
+	})
+	defaults.SetCenter(orb.Point{float64(h.CenterLonE7) / 1e7, float64(h.CenterLatE7) / 1e7}, maptile.Zoom(h.CenterZoom))
+	if format, ok := pmtilesFormats[h.TileType]; ok {
+		defaults.Set("format", format)
+	}
+
+	for key, value := range defaults.metadata {
+		if _, exists := m.Get(key); !exists {
+			m.Set(key, value)
+		}
+	}
+	return m, nil
+}
+
+// TilesetCenter is the center key: a point and the zoom to show it at.
+type TilesetCenter struct {
+	Point orb.Point
+	Zoom  maptile.Zoom
+}
+
+// TilesetMetadata holds the MBTiles 1.3 spec keys of an MbtilesMetadata as
+// typed fields. The spatial keys are nil when they are not set, and keys the
+// spec does not name are kept in Extra. Type and JSON are not checked here;
+// MbtilesMetadata.Validate does that.
+type TilesetMetadata struct {
+	Name        string
+	Format      string
+	Bounds      *orb.Bound
+	Center      *TilesetCenter
+	MinZoom     *maptile.Zoom
+	MaxZoom     *maptile.Zoom
+	Attribution string
+	Description string
+	Type        string
+	Version     string
+	JSON        json.RawMessage
+	Extra       map[string]string
+}
+
+// Tileset parses the metadata keys into a TilesetMetadata. It fails if the
+// bounds, center or a zoom is set but can't be parsed.
+func (m *MbtilesMetadata) Tileset() (*TilesetMetadata, error) {
+	t := &TilesetMetadata{Extra: map[string]string{}}
+
+	for key, value := range m.metadata {
+		switch key {
+		case "name":
+			t.Name = value
+		case "format":
+			t.Format = value
+		case "bounds":
+			bounds, err := m.Bounds()
+			if err != nil {
+				return nil, err
+			}
+			t.Bounds = &bounds
+		case "center":
+			pt, z, err := m.Center()
+			if err != nil {
+				return nil, err
+			}
+			t.Center = &TilesetCenter{Point: pt, Zoom: z}
+		case "minzoom":
+			z, err := m.MinZoom()
+			if err != nil {
+				return nil, err
+			}
+			minZoom := maptile.Zoom(z)
+			t.MinZoom = &minZoom
+		case "maxzoom":
+			z, err := m.MaxZoom()
+			if err != nil {
+				return nil, err
+			}
+			maxZoom := maptile.Zoom(z)
+			t.MaxZoom = &maxZoom
+		case "attribution":
+			t.Attribution = value
+		case "description":
+			t.Description = value
+		case "type":
+			t.Type = value
+		case "version":
+			t.Version = value
+		case "json":
+			t.JSON = json.RawMessage(value)
+		default:
+			t.Extra[key] = value
+		}
+	}
+
+	return t, nil
+}
+
+// MbtilesMetadata converts t back into metadata keys. String fields that are
+// empty and spatial fields that are nil are left out.
+func (t *TilesetMetadata) MbtilesMetadata() *MbtilesMetadata {
+	m := NewMbtilesMetadata(make(map[string]string, len(t.Extra)+11))
+	for key, value := range t.Extra {
+		m.Set(key, value)
+	}
+
+	for key, value := range map[string]string{
+		"name":        t.Name,
+		"format":      t.Format,
+		"attribution": t.Attribution,
+		"description": t.Description,
+		"type":        t.Type,
+		"version":     t.Version,
+		"json":        string(t.JSON),
+	} {
+		if value != "" {
+			m.Set(key, value)
+		}
+	}
+
+	if t.Bounds != nil {
+		m.SetBounds(*t.Bounds)
+	}
+	if t.Center != nil {
+		m.SetCenter(t.Center.Point, t.Center.Zoom)
+	}
+	if t.MinZoom != nil {
+		m.SetMinZoom(*t.MinZoom)
+	}
+	if t.MaxZoom != nil {
+		m.SetMaxZoom(*t.MaxZoom)
+	}
+	return m
+}
+
+// ApplyToPmtilesHeader sets the tile type, bounds, center and zoom range of
+// h from the fields that are set. It fails without changing h if the format
+// has no PMTiles tile type.
+func (t *TilesetMetadata) ApplyToPmtilesHeader(h *pmtiles.HeaderV3) error {
+	updated := *h
+
+	if t.Format != "" {
+		tileType, ok := pmtilesTileType(t.Format)
+		if !ok {
+			return fmt.Errorf("Format %q has no PMTiles tile type", t.Format)
+		}
+		updated.TileType = tileType
+	}
+	if t.Bounds != nil {
+		updated.MinLonE7, updated.MinLatE7 = toE7(t.Bounds.Min[0]), toE7(t.Bounds.Min[1])
+		updated.MaxLonE7, updated.MaxLatE7 = toE7(t.Bounds.Max[0]), toE7(t.Bounds.Max[1])
+	}
+	if t.Center != nil {
+		updated.CenterLonE7, updated.CenterLatE7 = toE7(t.Center.Point[0]), toE7(t.Center.Point[1])
+		updated.CenterZoom = uint8(t.Center.Zoom)
+	}
+	if t.MinZoom != nil {
+		updated.MinZoom = uint8(*t.MinZoom)
+	}
+	if t.MaxZoom != nil {
+		updated.MaxZoom = uint8(*t.MaxZoom)
+	}
+
+	*h = updated
+	return nil
 }
@@ -1,7 +1,12 @@
 package tilepack
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/protomaps/go-pmtiles/pmtiles"
 )
 
 func TestMbtilesMetadata_Get_Exists(t *testing.T) {
@@ -81,6 +86,16 @@ func TestMbtilesMetadata_Center_Valid(t *testing.T) {
 	}
 }
 
+func TestMbtilesMetadata_Center_Whitespace(t *testing.T) {
+	// Whitespace around any field is ignored.
+	for _, center := range []string{" -77.0, 38.9 ,5", "-77.0 ,38.9, 5 "} {
+		pt, z, err := NewMbtilesMetadata(map[string]string{"center": center}).Center()
+		if err != nil || pt != (orb.Point{-77.0, 38.9}) || z != 5 {
+			t.Errorf("%q: got %v, %d, %v", center, pt, z, err)
+		}
+	}
+}
+
 func TestMbtilesMetadata_Center_Missing(t *testing.T) {
 	// A missing 'center' key must return an error.
 	m := NewMbtilesMetadata(map[string]string{})
@@ -258,3 +273,251 @@ func TestMbtilesMetadata_Set(t *testing.T) {
 		t.Errorf("expected 'mvt', got %q (ok=%v)", f, ok)
 	}
 }
+
+func TestMbtilesMetadata_Center_FractionalZoom(t *testing.T) {
+	// The spec defines the center zoom as an integer.
+	m := NewMbtilesMetadata(map[string]string{"center": "-77.0,38.9,5.5"})
+	if _, _, err := m.Center(); err == nil {
+		t.Fatal("expected error for fractional center zoom")
+	}
+}
+
+func TestMbtilesMetadata_MinZoom_Negative(t *testing.T) {
+	m := NewMbtilesMetadata(map[string]string{"minzoom": "-1"})
+	if _, err := m.MinZoom(); err == nil {
+		t.Fatal("expected error for negative minzoom")
+	}
+}
+
+func TestMbtilesMetadata_FormatAndName_Missing(t *testing.T) {
+	m := NewMbtilesMetadata(map[string]string{"name": ""})
+	if _, err := m.Format(); err == nil {
+		t.Error("expected error for missing format")
+	}
+	if _, err := m.Name(); err == nil {
+		t.Error("expected error for empty name")
+	}
+}
+
+func TestMbtilesMetadata_Setters(t *testing.T) {
+	m := NewMbtilesMetadata(map[string]string{})
+	m.SetBounds(orb.Bound{Min: orb.Point{-122.5, 37}, Max: orb.Point{-122, 38.25}})
+	m.SetCenter(orb.Point{-122.25, 37.5}, 4)
+	m.SetMinZoom(2)
+	m.SetMaxZoom(14)
+
+	want := map[string]string{
+		"bounds":  "-122.5,37,-122,38.25",
+		"center":  "-122.25,37.5,4",
+		"minzoom": "2",
+		"maxzoom": "14",
+	}
+	for key, value := range want {
+		if got, _ := m.Get(key); got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+
+	m.Delete("center")
+	if _, ok := m.Get("center"); ok {
+		t.Error("center should have been deleted")
+	}
+}
+
+func TestMbtilesMetadata_Validate(t *testing.T) {
+	valid := NewMbtilesMetadata(map[string]string{
+		"name":    "test",
+		"format":  "pbf",
+		"bounds":  "-10,-10,10,10",
+		"center":  "0,0,2",
+		"minzoom": "0",
+		"maxzoom": "4",
+		"type":    "overlay",
+		"json":    `{"vector_layers":[{"id":"roads","fields":{}}]}`,
+	})
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected valid metadata, got %v", err)
+	}
+
+	if err := NewMbtilesMetadata(map[string]string{"name": "x", "format": "image/png"}).Validate(); err != nil {
+		t.Errorf("media type formats are allowed: %v", err)
+	}
+	for _, format := range []string{"pbf", "mvt", "mlt", "png", "jpg", "jpeg", "webp", "avif"} {
+		if err := NewMbtilesMetadata(map[string]string{"name": "x", "format": format}).Validate(); err != nil {
+			t.Errorf("format %s is allowed: %v", format, err)
+		}
+	}
+
+	invalid := NewMbtilesMetadata(map[string]string{
+		"format":  "gif",
+		"bounds":  "10,-10,-10,10",
+		"center":  "50,0,9",
+		"minzoom": "5",
+		"maxzoom": "4",
+		"type":    "underlay",
+		"json":    `[]`,
+	})
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"missing name", "format", "Bounds minimum", "minzoom 5", "type", "json"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestMbtilesMetadata_JSONRoundTrip(t *testing.T) {
+	m := NewMbtilesMetadata(map[string]string{
+		"name":    "test",
+		"format":  "pbf",
+		"bounds":  "-10.5,-10,10,10",
+		"center":  "0,0,2",
+		"minzoom": "0",
+		"maxzoom": "4",
+		"custom":  "value",
+		"json":    `{"vector_layers":[]}`,
+	})
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal(data, &doc)
+	if _, ok := doc["bounds"].([]interface{}); !ok {
+		t.Errorf("bounds should be an array: %s", data)
+	}
+	if doc["maxzoom"] != 4.0 {
+		t.Errorf("maxzoom should be a number: %s", data)
+	}
+	if _, ok := doc["json"].(map[string]interface{}); !ok {
+		t.Errorf("json should be an object: %s", data)
+	}
+
+	decoded := NewMbtilesMetadata(nil)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for _, key := range m.Keys() {
+		want, _ := m.Get(key)
+		if got, _ := decoded.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMbtilesMetadata_Pmtiles(t *testing.T) {
+	m := NewMbtilesMetadata(map[string]string{
+		"name":    "test",
+		"format":  "pbf",
+		"bounds":  "-10,-20,10,20",
+		"center":  "1,2,3",
+		"minzoom": "1",
+		"maxzoom": "9",
+		"json":    `{"vector_layers":[{"id":"roads"}]}`,
+	})
+
+	jsonMetadata := m.PmtilesJSON()
+	if _, ok := jsonMetadata["vector_layers"]; !ok {
+		t.Errorf("vector_layers should be at the top level: %+v", jsonMetadata)
+	}
+	if _, ok := jsonMetadata["json"]; ok {
+		t.Errorf("json key should have been expanded: %+v", jsonMetadata)
+	}
+
+	h := pmtiles.HeaderV3{SpecVersion: 3}
+	if err := m.ApplyToPmtilesHeader(&h); err != nil {
+		t.Fatalf("ApplyToPmtilesHeader: %v", err)
+	}
+	if h.TileType != pmtiles.Mvt || h.MinLatE7 != -200000000 || h.CenterZoom != 3 || h.MaxZoom != 9 {
+		t.Errorf("header: %+v", h)
+	}
+
+	bad := NewMbtilesMetadata(map[string]string{"format": "gif"})
+	if err := bad.ApplyToPmtilesHeader(&h); err == nil || h.TileType != pmtiles.Mvt {
+		t.Errorf("an invalid format must fail without changing the header: %v", err)
+	}
+
+	// Only the name and layers are in the JSON; the rest comes from the header.
+	back, err := NewMbtilesMetadataFromPmtiles(h, map[string]interface{}{
+		"name":          "test",
+		"vector_layers": jsonMetadata["vector_layers"],
+	})
+	if err != nil {
+		t.Fatalf("NewMbtilesMetadataFromPmtiles: %v", err)
+	}
+	for _, key := range []string{"name", "format", "bounds", "center", "minzoom", "maxzoom"} {
+		want, _ := m.Get(key)
+		if got, _ := back.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if layers, err := back.VectorLayers(); err != nil || len(layers) != 1 || layers[0].ID != "roads" {
+		t.Errorf("vector_layers: %+v, %v", layers, err)
+	}
+}
+
+func TestMbtilesMetadata_Tileset(t *testing.T) {
+	// Every key must survive a trip through the typed fields.
+	m := NewMbtilesMetadata(map[string]string{
+		"name":        "test",
+		"format":      "pbf",
+		"bounds":      "-10.5,-20,10,20.25",
+		"center":      "1,2,3",
+		"minzoom":     "1",
+		"maxzoom":     "9",
+		"attribution": "OSM",
+		"description": "roads",
+		"type":        "overlay",
+		"version":     "1.1",
+		"json":        `{"vector_layers":[{"id":"roads"}]}`,
+		"generator":   "tilepack",
+	})
+
+	tileset, err := m.Tileset()
+	if err != nil {
+		t.Fatalf("Tileset: %v", err)
+	}
+	if tileset.Bounds == nil || *tileset.Bounds != (orb.Bound{Min: orb.Point{-10.5, -20}, Max: orb.Point{10, 20.25}}) {
+		t.Errorf("bounds: got %v", tileset.Bounds)
+	}
+	if tileset.Center == nil || tileset.Center.Point != (orb.Point{1, 2}) || tileset.Center.Zoom != 3 {
+		t.Errorf("center: got %+v", tileset.Center)
+	}
+	if tileset.MinZoom == nil || *tileset.MinZoom != 1 || tileset.MaxZoom == nil || *tileset.MaxZoom != 9 {
+		t.Errorf("zooms: got %v-%v", tileset.MinZoom, tileset.MaxZoom)
+	}
+	if tileset.Name != "test" || tileset.Type != "overlay" || tileset.Extra["generator"] != "tilepack" {
+		t.Errorf("tileset: %+v", tileset)
+	}
+
+	back := tileset.MbtilesMetadata()
+	if len(back.Keys()) != len(m.Keys()) {
+		t.Errorf("got keys %v, want %v", back.Keys(), m.Keys())
+	}
+	for _, key := range m.Keys() {
+		want, _ := m.Get(key)
+		if got, _ := back.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	// Unset spatial keys stay unset.
+	empty, err := NewMbtilesMetadata(map[string]string{"name": "test"}).Tileset()
+	if err != nil {
+		t.Fatalf("Tileset: %v", err)
+	}
+	if empty.Bounds != nil || empty.Center != nil || empty.MinZoom != nil || empty.MaxZoom != nil {
+		t.Errorf("unset keys must be nil: %+v", empty)
+	}
+	if keys := empty.MbtilesMetadata().Keys(); len(keys) != 1 {
+		t.Errorf("got keys %v, want only name", keys)
+	}
+
+	if _, err := NewMbtilesMetadata(map[string]string{"minzoom": "z"}).Tileset(); err == nil {
+		t.Error("expected an error for an invalid minzoom")
+	}
+}
@@ -1,18 +1,25 @@
 package tilepack
 
 import (
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
-	"strconv"
 
 	_ "github.com/mattn/go-sqlite3" // Register sqlite3 database driver
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/maptile"
 )
 
+// The table layouts the mbtiles outputter can write. The dedup schema stores
+// each distinct tile once in an images table, with a map table pointing the
+// tile coordinates at it and a tiles view joining the two. The flat schema is
+// a single tiles table, which some consumers require.
+const (
+	MbtilesSchemaDedup = "dedup"
+	MbtilesSchemaFlat  = "flat"
+)
+
 func NewMbtilesOutputter(dsn string, batchSize int, invertedY bool, metadata *MbtilesMetadata) (*mbtilesOutputter, error) {
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
@@ -31,21 +38,99 @@ type mbtilesOutputter struct {
 	batchSize  int
 	metadata   *MbtilesMetadata
 	invertedY  bool
+	// storeValidators enables the tile_validators table, which keeps the
+	// HTTP ETag and Last-Modified values each tile was fetched with.
+	storeValidators bool
+	// hasher names the rows of the images table, deduplicating tiles.
+	// DefaultContentHasher is used when it is nil.
+	hasher *ContentHasher
+	// schema is MbtilesSchemaDedup or MbtilesSchemaFlat. It is resolved by
+	// CreateTiles when it is empty.
+	schema    string
+	wal       bool
+	exclusive bool
+	optimize  bool
+	// replacedImages is set once a tile is saved over a tile with different
+	// content, whose images row may no longer be referenced.
+	replacedImages bool
+
+	// The statements of Save, prepared in each batch transaction.
+	insertTile  *sql.Stmt
+	insertImage *sql.Stmt
+	insertMap   *sql.Stmt
+	selectMap   *sql.Stmt
 }
 
 func (o *mbtilesOutputter) SetInvertedY(v bool) {
 	o.invertedY = v
 }
 
+// SetStoreValidators enables storing per-tile HTTP cache validators. It must
+// be called before CreateTiles.
+func (o *mbtilesOutputter) SetStoreValidators(v bool) {
+	o.storeValidators = v
+}
+
+// SetContentHasher sets the hash tiles are deduplicated by. Tiles saved with
+// different hashers are never deduplicated against each other.
+func (o *mbtilesOutputter) SetContentHasher(hasher *ContentHasher) {
+	o.hasher = hasher
+}
+
+// ContentHasher returns the hash tiles are deduplicated by.
+func (o *mbtilesOutputter) ContentHasher() *ContentHasher {
+	if o.hasher == nil {
+		return DefaultContentHasher
+	}
+	return o.hasher
+}
+
+// SetSchema sets the table layout of a new archive, MbtilesSchemaDedup by
+// default. An existing archive must already have that layout. It must be
+// called before CreateTiles.
+func (o *mbtilesOutputter) SetSchema(schema string) error {
+	if schema != MbtilesSchemaDedup && schema != MbtilesSchemaFlat {
+		return fmt.Errorf("unknown mbtiles schema %q: must be %s or %s", schema, MbtilesSchemaDedup, MbtilesSchemaFlat)
+	}
+	o.schema = schema
+	return nil
+}
+
+// SetWAL writes the archive in write-ahead log mode, so it can be read while
+// it is written. The archive is switched back to a rollback journal on
+// Close, leaving a single file. It must be called before CreateTiles.
+func (o *mbtilesOutputter) SetWAL(v bool) {
+	o.wal = v
+}
+
+// SetExclusive holds an exclusive lock on the archive until Close, which
+// saves taking a lock for every batch but keeps other processes from reading
+// it. It cannot be used with stored validators. It must be called before
+// CreateTiles.
+func (o *mbtilesOutputter) SetExclusive(v bool) {
+	o.exclusive = v
+}
+
+// SetOptimize runs ANALYZE and VACUUM on Close, leaving a compact archive
+// with query planner statistics.
+func (o *mbtilesOutputter) SetOptimize(v bool) {
+	o.optimize = v
+}
+
 func (o *mbtilesOutputter) Close() error {
 	var err error
 
 	// Commit remaining tile transaction if it exists
 	if o.txn != nil {
-		if err = o.txn.Commit(); err != nil {
+		if err = o.commit(); err != nil {
 			return fmt.Errorf("failed to commit final tile batch: %w", err)
 		}
-		o.txn = nil
+	}
+
+	if o.replacedImages {
+		if _, err = o.db.Exec("DELETE FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)"); err != nil {
+			return fmt.Errorf("failed to remove unreferenced images: %w", err)
+		}
 	}
 
 	// Start a new transaction for metadata
@@ -67,6 +152,20 @@ func (o *mbtilesOutputter) Close() error {
 	// Commit the transaction
 	if o.txn != nil {
 		err = o.txn.Commit()
+		o.txn = nil
+	}
+
+	if err == nil && o.optimize {
+		if _, err = o.db.Exec("ANALYZE; VACUUM;"); err != nil {
+			err = fmt.Errorf("failed to optimize: %w", err)
+		}
+	}
+	if err == nil && o.wal {
+		// Readers of a WAL archive need to write next to it, which they
+		// may not be able to once it is published.
+		if _, err = o.db.Exec("PRAGMA journal_mode=DELETE"); err != nil {
+			err = fmt.Errorf("failed to leave WAL mode: %w", err)
+		}
 	}
 
 	// Close the database
@@ -83,8 +182,46 @@ func (o *mbtilesOutputter) CreateTiles() error {
 	if o.hasTiles {
 		return nil
 	}
-	if _, err := o.db.Exec(`
-		BEGIN TRANSACTION;
+
+	if o.exclusive {
+		if o.storeValidators {
+			return errors.New("exclusive locking cannot be used with stored validators, which are read while tiles are written")
+		}
+		// The lock belongs to the connection that takes it, so every
+		// statement must run on that one.
+		o.db.SetMaxOpenConns(1)
+		if _, err := o.db.Exec("PRAGMA locking_mode=EXCLUSIVE"); err != nil {
+			return fmt.Errorf("failed to set exclusive locking: %w", err)
+		}
+	}
+	if o.wal {
+		var mode string
+		if err := o.db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+			return fmt.Errorf("failed to set WAL mode: %w", err)
+		}
+		if mode != "wal" {
+			return fmt.Errorf("failed to set WAL mode: journal mode is %s", mode)
+		}
+	}
+
+	// An existing archive keeps its schema.
+	var tilesType string
+	err := o.db.QueryRow("SELECT type FROM sqlite_master WHERE name='tiles'").Scan(&tilesType)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	existing := map[string]string{"view": MbtilesSchemaDedup, "table": MbtilesSchemaFlat}[tilesType]
+	if existing != "" && o.schema != "" && existing != o.schema {
+		return fmt.Errorf("archive has the %s schema, not %s", existing, o.schema)
+	}
+	if existing != "" {
+		o.schema = existing
+	}
+	if o.schema == "" {
+		o.schema = MbtilesSchemaDedup
+	}
+
+	schema := `
 		CREATE TABLE IF NOT EXISTS map (
 			zoom_level INTEGER NOT NULL,
 			tile_column INTEGER NOT NULL,
@@ -97,11 +234,6 @@ func (o *mbtilesOutputter) CreateTiles() error {
 			tile_id TEXT NOT NULL
 		);
 		CREATE UNIQUE INDEX IF NOT EXISTS images_id ON images (tile_id);
-		CREATE TABLE IF NOT EXISTS metadata (
-			name TEXT,
-			value TEXT
-		);
-		CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
 		CREATE VIEW IF NOT EXISTS tiles AS
 		SELECT
 			map.zoom_level AS zoom_level,
@@ -109,87 +241,213 @@ func (o *mbtilesOutputter) CreateTiles() error {
 			map.tile_row AS tile_row,
 			images.tile_data AS tile_data
 		FROM map
-		JOIN images ON images.tile_id = map.tile_id;
+		JOIN images ON images.tile_id = map.tile_id;`
+	if o.schema == MbtilesSchemaFlat {
+		schema = `
+		CREATE TABLE IF NOT EXISTS tiles (
+			zoom_level INTEGER NOT NULL,
+			tile_column INTEGER NOT NULL,
+			tile_row INTEGER NOT NULL,
+			tile_data BLOB NOT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);`
+	}
+
+	if _, err := o.db.Exec(`
+		BEGIN TRANSACTION;` + schema + `
+		CREATE TABLE IF NOT EXISTS metadata (
+			name TEXT,
+			value TEXT
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name);
 		COMMIT;
 	    PRAGMA synchronous=OFF;
 	`); err != nil {
 		return err
 	}
+	if o.storeValidators {
+		if _, err := o.db.Exec(`
+			CREATE TABLE IF NOT EXISTS tile_validators (
+				zoom_level INTEGER NOT NULL,
+				tile_column INTEGER NOT NULL,
+				tile_row INTEGER NOT NULL,
+				etag TEXT,
+				last_modified TEXT
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS tile_validators_index ON tile_validators (zoom_level, tile_column, tile_row);
+		`); err != nil {
+			return fmt.Errorf("failed to create tile_validators table: %w", err)
+		}
+	}
 	o.hasTiles = true
 	return nil
 }
 
-func (o *mbtilesOutputter) AssignSpatialMetadata(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
+// begin starts a batch transaction if none is open, preparing the
+// statements of Save in it.
+func (o *mbtilesOutputter) begin() error {
+	if o.txn != nil {
+		return nil
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
 
-	// https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+	if o.schema == MbtilesSchemaFlat {
+		o.insertTile, err = tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);")
+	} else {
+		o.insertImage, err = tx.Prepare("INSERT OR REPLACE INTO images (tile_id, tile_data) VALUES (?, ?);")
+		if err == nil {
+			o.insertMap, err = tx.Prepare("INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?);")
+		}
+		if err == nil {
+			o.selectMap, err = tx.Prepare("SELECT tile_id FROM map WHERE zoom_level=? AND tile_column=? AND tile_row=?;")
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare tile statements: %w", err)
+	}
 
-	center := bounds.Center()
+	o.txn = tx
+	return nil
+}
 
-	strBounds := fmt.Sprintf("%f,%f,%f,%f", bounds.Min[0], bounds.Min[1], bounds.Max[0], bounds.Max[1])
-	// Set default center zoom as minZoom level
-	strCenter := fmt.Sprintf("%f,%f,%d", center[0], center[1], minZoom)
+// commit commits the batch transaction, which closes its statements.
+func (o *mbtilesOutputter) commit() error {
+	err := o.txn.Commit()
+	o.txn = nil
+	o.insertTile, o.insertImage, o.insertMap, o.selectMap = nil, nil, nil, nil
+	return err
+}
 
-	strMinzoom := strconv.Itoa(int(minZoom))
-	strMaxzoom := strconv.Itoa(int(maxZoom))
+// tileRow returns the row tile is stored under in the map table.
+func (o *mbtilesOutputter) tileRow(tile maptile.Tile) uint32 {
+	if o.invertedY {
+		return tile.Y
+	}
+	return uint32(math.Pow(2.0, float64(tile.Z))) - 1 - tile.Y
+}
 
-	metadata := map[string]string{
-		"bounds":  strBounds,
-		"center":  strCenter,
-		"minzoom": strMinzoom,
-		"maxzoom": strMaxzoom,
+// GetValidators returns the validators stored for tile, or nil if there are
+// none or validators are not enabled. It reads committed rows only, so it is
+// safe to call from tile workers while Save runs.
+func (o *mbtilesOutputter) GetValidators(tile maptile.Tile) (*TileValidators, error) {
+	if !o.storeValidators {
+		return nil, nil
 	}
 
-	for name, value := range metadata {
-		o.metadata.Set(name, value)
+	var etag, lastModified sql.NullString
+	err := o.db.QueryRow(
+		"SELECT etag, last_modified FROM tile_validators WHERE zoom_level=? AND tile_column=? AND tile_row=?;",
+		tile.Z, tile.X, o.tileRow(tile),
+	).Scan(&etag, &lastModified)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validators for %+v: %w", tile, err)
 	}
 
-	return nil
+	v := &TileValidators{ETag: etag.String, LastModified: lastModified.String}
+	if v.IsEmpty() {
+		return nil, nil
+	}
+	return v, nil
 }
 
-func (o *mbtilesOutputter) Save(tile maptile.Tile, data []byte) error {
+// SaveValidators stores the validators for tile, replacing any already
+// stored. Empty validators remove the stored row so a stale ETag is never
+// sent for a tile whose server stopped providing one.
+func (o *mbtilesOutputter) SaveValidators(tile maptile.Tile, validators *TileValidators) error {
+	if !o.storeValidators {
+		return nil
+	}
 	if err := o.CreateTiles(); err != nil {
 		return err
 	}
 
-	if o.txn == nil {
-		tx, err := o.db.Begin()
-		if err != nil {
-			return err
-		}
-		o.txn = tx
+	if err := o.begin(); err != nil {
+		return err
 	}
 
-	hash := md5.Sum(data)
-	tileID := hex.EncodeToString(hash[:])
+	if validators.IsEmpty() {
+		_, err := o.txn.Exec("DELETE FROM tile_validators WHERE zoom_level=? AND tile_column=? AND tile_row=?;", tile.Z, tile.X, o.tileRow(tile))
+		return err
+	}
 
-	tile_y := tile.Y
+	_, err := o.txn.Exec(
+		"INSERT OR REPLACE INTO tile_validators (zoom_level, tile_column, tile_row, etag, last_modified) VALUES (?, ?, ?, ?, ?);",
+		tile.Z, tile.X, o.tileRow(tile), validators.ETag, validators.LastModified,
+	)
+	return err
+}
 
-	if !o.invertedY {
-		tile_y = uint32(math.Pow(2.0, float64(tile.Z))) - 1 - tile.Y
-	}
+func (o *mbtilesOutputter) AssignSpatialMetadata(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
 
-	_, err := o.txn.Exec("INSERT OR REPLACE INTO images (tile_id, tile_data) VALUES (?, ?);", tileID, data)
-	if err != nil {
+	// https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+
+	o.metadata.SetBounds(bounds)
+	// Set default center zoom as minZoom level
+	o.metadata.SetCenter(bounds.Center(), minZoom)
+	o.metadata.SetMinZoom(minZoom)
+	o.metadata.SetMaxZoom(maxZoom)
+
+	return nil
+}
+
+func (o *mbtilesOutputter) Save(tile maptile.Tile, data []byte) error {
+	if err := o.CreateTiles(); err != nil {
 		return err
 	}
 
-	_, err = o.txn.Exec("INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?);", tile.Z, tile.X, tile_y, tileID)
-	if err != nil {
+	if err := o.begin(); err != nil {
 		return err
 	}
 
+	tile_y := o.tileRow(tile)
+
+	if o.schema == MbtilesSchemaFlat {
+		if _, err := o.insertTile.Exec(tile.Z, tile.X, tile_y, data); err != nil {
+			return err
+		}
+	} else {
+		// Images are named by the hash of the bytes stored, so archives
+		// built before tiles were hashed by their content still deduplicate
+		// against new tiles.
+		tileID := o.ContentHasher().SumStored(data).String()
+
+		// Replacing a tile may leave its image unreferenced. Once one has,
+		// Close removes them all, so there is no need to look further.
+		if !o.replacedImages {
+			var replacedID string
+			err := o.selectMap.QueryRow(tile.Z, tile.X, tile_y).Scan(&replacedID)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			o.replacedImages = err == nil && replacedID != tileID
+		}
+
+		if _, err := o.insertImage.Exec(tileID, data); err != nil {
+			return err
+		}
+
+		if _, err := o.insertMap.Exec(tile.Z, tile.X, tile_y, tileID); err != nil {
+			return err
+		}
+	}
+
 	o.batchCount++
 
 	if o.batchCount%o.batchSize == 0 {
-		err := o.txn.Commit()
-		if err != nil {
+		// NOTE if the total tiles to download are a multiple of batchSize,
+		// this will run and set o.txn to nil prior to .Close() being called
+		if err := o.commit(); err != nil {
 			return err
 		}
 		o.batchCount = 0
-		// NOTE if the total tiles to download are a multiple of batchSize,
-		// this will run and set o.txn to nil prior to .Close() being called
-		o.txn = nil
 	}
 
-	return err
+	return nil
 }
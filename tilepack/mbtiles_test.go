@@ -2,6 +2,7 @@ package tilepack
 
 import (
 	"database/sql"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -558,3 +559,226 @@ func TestMbtilesReader_GetTile_ClosedDB(t *testing.T) {
 		t.Error("expected error when getting tile from closed db")
 	}
 }
+
+func TestMbtilesOutputter_Validators(t *testing.T) {
+	// Validators are stored per tile, read back after commit, and cleared when
+	// a later response carries none.
+	path := filepath.Join(t.TempDir(), "validators.mbtiles")
+	o, err := NewMbtilesOutputter(path, 100, false, NewMbtilesMetadata(map[string]string{
+		"name": "test", "format": "pbf",
+	}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	o.SetStoreValidators(true)
+	if err := o.CreateTiles(); err != nil {
+		t.Fatalf("CreateTiles: %v", err)
+	}
+	defer o.Close()
+
+	tile := maptile.New(1, 0, 1)
+	want := &TileValidators{ETag: `"abc"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}
+	if err := o.Save(tile, []byte("data")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.SaveValidators(tile, want); err != nil {
+		t.Fatalf("SaveValidators: %v", err)
+	}
+	if err := o.txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	o.txn = nil
+
+	got, err := o.GetValidators(tile)
+	if err != nil {
+		t.Fatalf("GetValidators: %v", err)
+	}
+	if got == nil || *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Validators are keyed like the map table, on the TMS row.
+	var row uint32
+	if err := o.db.QueryRow("SELECT tile_row FROM tile_validators").Scan(&row); err != nil {
+		t.Fatalf("query tile_row: %v", err)
+	}
+	if row != 1 {
+		t.Errorf("tile_row: got %d, want 1", row)
+	}
+
+	if missing, err := o.GetValidators(maptile.New(0, 0, 1)); err != nil || missing != nil {
+		t.Errorf("unknown tile: got %+v, %v", missing, err)
+	}
+
+	if err := o.SaveValidators(tile, &TileValidators{}); err != nil {
+		t.Fatalf("SaveValidators empty: %v", err)
+	}
+	if err := o.txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	o.txn = nil
+
+	if cleared, err := o.GetValidators(tile); err != nil || cleared != nil {
+		t.Errorf("cleared: got %+v, %v", cleared, err)
+	}
+}
+
+func TestMbtilesOutputter_ValidatorsDisabled(t *testing.T) {
+	// Without SetStoreValidators no table is created and calls are no-ops.
+	o := newTestOutputter(t, false)
+	if err := o.SaveValidators(maptile.New(0, 0, 0), &TileValidators{ETag: "x"}); err != nil {
+		t.Fatalf("SaveValidators: %v", err)
+	}
+	if v, err := o.GetValidators(maptile.New(0, 0, 0)); err != nil || v != nil {
+		t.Errorf("got %+v, %v", v, err)
+	}
+	var n int
+	if err := o.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='tile_validators'").Scan(&n); err != nil {
+		t.Fatalf("query sqlite_master: %v", err)
+	}
+	if n != 0 {
+		t.Error("tile_validators table must not exist")
+	}
+}
+
+// readMbtilesTiles reads every tile of the archive at path through the tiles
+// table or view.
+func readMbtilesTiles(t *testing.T, path string) map[maptile.Tile]string {
+	t.Helper()
+	reader, err := NewMbtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewMbtilesReader: %v", err)
+	}
+	defer reader.Close()
+	got := map[maptile.Tile]string{}
+	if err := reader.VisitAllTiles(func(tile maptile.Tile, data []byte) {
+		got[tile] = string(data)
+	}); err != nil {
+		t.Fatalf("VisitAllTiles: %v", err)
+	}
+	return got
+}
+
+func TestMbtilesOutputter_FlatSchema(t *testing.T) {
+	// The flat schema must store tiles in a tiles table, and an existing
+	// archive must keep the schema it was created with.
+	path := filepath.Join(t.TempDir(), "flat.mbtiles")
+	o, err := NewMbtilesOutputter(path, 1, false, NewMbtilesMetadata(map[string]string{"name": "flat", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	if err := o.SetSchema(MbtilesSchemaFlat); err != nil {
+		t.Fatalf("SetSchema: %v", err)
+	}
+	o.Save(maptile.New(0, 0, 1), []byte("a"))
+	o.Save(maptile.New(1, 0, 1), []byte("a"))
+	o.Save(maptile.New(0, 0, 1), []byte("b"))
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got := readMbtilesTiles(t, path)
+	if len(got) != 2 || got[maptile.New(0, 1, 1)] != "b" || got[maptile.New(1, 1, 1)] != "a" {
+		t.Errorf("unexpected tiles %v", got)
+	}
+
+	db, _ := sql.Open("sqlite3", path)
+	var tablesType string
+	db.QueryRow("SELECT type FROM sqlite_master WHERE name='tiles'").Scan(&tablesType)
+	var mapTables int
+	db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name IN ('map', 'images')").Scan(&mapTables)
+	db.Close()
+	if tablesType != "table" || mapTables != 0 {
+		t.Errorf("tiles is a %q with %d map/images tables, want a table and none", tablesType, mapTables)
+	}
+
+	o, _ = NewMbtilesOutputter(path, 1, false, NewMbtilesMetadata(map[string]string{}))
+	o.SetSchema(MbtilesSchemaDedup)
+	if err := o.CreateTiles(); err == nil {
+		t.Error("expected an error writing the dedup schema into a flat archive")
+	}
+	o.db.Close()
+
+	if err := o.SetSchema("normalized"); err == nil {
+		t.Error("expected an error for an unknown schema")
+	}
+}
+
+func TestMbtilesOutputter_RemovesReplacedImages(t *testing.T) {
+	// Images no longer referenced once their tiles are replaced must be
+	// removed on Close, while images still referenced are kept.
+	path := filepath.Join(t.TempDir(), "replaced.mbtiles")
+	o, err := NewMbtilesOutputter(path, 2, false, NewMbtilesMetadata(map[string]string{"name": "replaced", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	o.Save(maptile.New(0, 0, 1), []byte("a"))
+	o.Save(maptile.New(1, 0, 1), []byte("a"))
+	o.Save(maptile.New(0, 1, 1), []byte("b"))
+	o.Save(maptile.New(0, 0, 1), []byte("c"))
+	o.Save(maptile.New(1, 0, 1), []byte("c"))
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db, _ := sql.Open("sqlite3", path)
+	defer db.Close()
+	var images int
+	db.QueryRow("SELECT count(*) FROM images").Scan(&images)
+	if images != 2 {
+		t.Errorf("expected 2 images, got %d", images)
+	}
+	if got := readMbtilesTiles(t, path); len(got) != 3 {
+		t.Errorf("expected 3 tiles, got %v", got)
+	}
+}
+
+func TestMbtilesOutputter_WALExclusiveOptimize(t *testing.T) {
+	// An archive written in WAL mode with an exclusive lock and optimized on
+	// Close must end up as a single file in rollback journal mode, with
+	// ANALYZE statistics.
+	path := filepath.Join(t.TempDir(), "tuned.mbtiles")
+	o, err := NewMbtilesOutputter(path, 3, false, NewMbtilesMetadata(map[string]string{"name": "tuned", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	o.SetWAL(true)
+	o.SetExclusive(true)
+	o.SetOptimize(true)
+	tiles := gridTiles(3)
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("expected no WAL file after Close, got %v", err)
+	}
+	db, _ := sql.Open("sqlite3", path)
+	defer db.Close()
+	var mode string
+	db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if mode != "delete" {
+		t.Errorf("journal mode is %q, want delete", mode)
+	}
+	var stats int
+	db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='sqlite_stat1'").Scan(&stats)
+	if stats != 1 {
+		t.Error("expected ANALYZE statistics")
+	}
+	if got := readMbtilesTiles(t, path); len(got) != len(tiles) {
+		t.Errorf("read %d tiles, want %d", len(got), len(tiles))
+	}
+
+	o, _ = NewMbtilesOutputter(filepath.Join(t.TempDir(), "validators.mbtiles"), 1, false, NewMbtilesMetadata(map[string]string{}))
+	o.SetExclusive(true)
+	o.SetStoreValidators(true)
+	if err := o.CreateTiles(); err == nil {
+		t.Error("expected an error for exclusive locking with stored validators")
+	}
+	o.db.Close()
+}
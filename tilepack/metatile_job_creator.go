@@ -4,13 +4,10 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"math"
-	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -23,7 +20,7 @@ import (
 // s3Downloader is the subset of s3manager.Downloader used by job generators,
 // allowing tests to inject a fake without hitting real S3.
 type s3Downloader interface {
-	Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error)
+	DownloadWithContext(ctx aws.Context, w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error)
 }
 
 const (
@@ -79,21 +76,27 @@ type metatileJobGenerator struct {
 	format        string
 }
 
-func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error) {
+func (x *metatileJobGenerator) CreateWorker() (TileWorker, error) {
 	// Build zoom set once per worker; guards against direct struct construction in tests.
 	zoomSet := x.zoomSet
 	if zoomSet == nil {
 		zoomSet = zoomSliceToSet(x.zooms)
 	}
-	f := func(id int, jobs chan *TileRequest, results chan *TileResponse) {
-		// Instantiate the gzip support stuff once instead on every iteration
-		bodyBuffer := bytes.NewBuffer(nil)
-		bodyGzipper, err := gzip.NewWriterLevel(bodyBuffer, gzip.BestCompression)
-		if err != nil {
-			log.Fatalf("Couldn't create gzipper: %+v", err)
-		}
 
-		for metaTileRequest := range jobs {
+	// Instantiate the gzip support stuff once instead on every iteration
+	bodyBuffer := bytes.NewBuffer(nil)
+	bodyGzipper, err := gzip.NewWriterLevel(bodyBuffer, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create gzipper: %w", err)
+	}
+
+	f := func(ctx context.Context, id int, jobs <-chan *TileRequest, results chan<- *TileResponse) {
+		for {
+			metaTileRequest, ok := nextJob(ctx, jobs)
+			if !ok {
+				return
+			}
+
 			// Download the metatile archive zip to a byte buffer
 			compressedBytes := &aws.WriteAtBuffer{}
 			input := &s3.GetObjectInput{
@@ -105,9 +108,15 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 				input.RequestPayer = aws.String("requester")
 			}
 
-			numBytes, err := x.s3Client.Download(compressedBytes, input)
+			numBytes, err := x.s3Client.DownloadWithContext(ctx, compressedBytes, input)
 			if err != nil {
-				log.Printf("Unable to download item s3://%s/%s: %+v", x.bucket, metaTileRequest.URL, err)
+				if ctx.Err() != nil {
+					return
+				}
+				sendResponse(ctx, results, &TileResponse{
+					Tile: metaTileRequest.Tile,
+					Err:  fmt.Errorf("unable to download item s3://%s/%s: %w", x.bucket, metaTileRequest.URL, err),
+				})
 				continue
 			}
 
@@ -116,7 +125,10 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 			readBytesReader := bytes.NewReader(readBytes)
 			zippedReader, err := zip.NewReader(readBytesReader, numBytes)
 			if err != nil {
-				log.Printf("Unable to unzip metatile archive %s: %+v", metaTileRequest.URL, err)
+				sendResponse(ctx, results, &TileResponse{
+					Tile: metaTileRequest.Tile,
+					Err:  fmt.Errorf("unable to unzip metatile archive %s: %w", metaTileRequest.URL, err),
+				})
 				continue
 			}
 
@@ -125,7 +137,13 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 				var offsetZ, offsetX, offsetY uint32
 				var format string
 				if n, err := fmt.Sscanf(zf.Name, "%d/%d/%d.%s", &offsetZ, &offsetX, &offsetY, &format); err != nil || n != 4 {
-					log.Fatalf("Couldn't scan metatile name")
+					if !sendResponse(ctx, results, &TileResponse{
+						Tile: metaTileRequest.Tile,
+						Err:  fmt.Errorf("couldn't scan metatile name %q in %s", zf.Name, metaTileRequest.URL),
+					}) {
+						return
+					}
+					continue
 				}
 
 				// Skip formats we don't care about
@@ -148,75 +166,55 @@ func (x *metatileJobGenerator) CreateWorker() (func(id int, jobs chan *TileReque
 					continue
 				}
 
-				// Read the data for the tile
-				zfReader, err := zf.Open()
-				if err != nil {
-					log.Fatalf("Couldn't read zf %s: %+v", zf.Name, err)
+				response := &TileResponse{Tile: t}
+				response.Data, response.Err = readMetatileEntry(zf, bodyBuffer, bodyGzipper)
+				if response.Err != nil {
+					response.Err = fmt.Errorf("couldn't read %s from %s: %w", zf.Name, metaTileRequest.URL, response.Err)
 				}
 
-				b, err := io.ReadAll(zfReader)
-				if err != nil {
-					log.Fatalf("Couldn't read zf %s: %+v", zf.Name, err)
+				if !sendResponse(ctx, results, response) {
+					return
 				}
+			}
+		}
+	}
 
-				// Gzip the data
-				bodyBuffer.Reset()
-				bodyGzipper.Reset(bodyBuffer)
+	return f, nil
+}
 
-				_, err = bodyGzipper.Write(b)
-				if err != nil {
-					log.Printf("Couldn't write to gzipper: %+v", err)
-					continue
-				}
+// readMetatileEntry reads a tile from a metatile archive and gzips it with
+// gzipper, which writes to buffer.
+func readMetatileEntry(zf *zip.File, buffer *bytes.Buffer, gzipper *gzip.Writer) ([]byte, error) {
+	zfReader, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer zfReader.Close()
 
-				err = bodyGzipper.Close()
-				if err != nil {
-					log.Printf("Couldn't flush gzipper: %+v", err)
-					continue
-				}
+	buffer.Reset()
+	gzipper.Reset(buffer)
 
-				bodyData, err := io.ReadAll(bodyBuffer)
-				if err != nil {
-					log.Printf("Couldn't read bytes into byte array: %+v", err)
-					continue
-				}
+	if _, err := io.Copy(gzipper, zfReader); err != nil {
+		return nil, err
+	}
 
-				results <- &TileResponse{
-					Data: bodyData,
-					Tile: t,
-				}
-			}
-		}
+	if err := gzipper.Close(); err != nil {
+		return nil, err
 	}
 
-	return f, nil
+	return bytes.Clone(buffer.Bytes()), nil
 }
 
-func (x *metatileJobGenerator) CreateJobs(jobs chan *TileRequest) error {
+func (x *metatileJobGenerator) CreateJobs(ctx context.Context, jobs chan<- *TileRequest) error {
 	// Convert the list of requested zooms into a deduplicated list of metatile zooms.
 	seenMetatileZooms := make(map[maptile.Zoom]struct{})
 	metatileZooms := []maptile.Zoom{}
 
-	metaZoom := maptile.Zoom(log2Uint(x.metatileSize))
-	tileZoom := maptile.Zoom(log2Uint(tileScale))
-	deltaZoom := metaZoom - tileZoom
-
 	for _, z := range x.zooms {
-		var metatileZoom maptile.Zoom
-		if z < deltaZoom {
-			metatileZoom = 0
-		} else {
-			metatileZoom = z - deltaZoom
-		}
-
-		// Beyond the "max detail zoom", all tiles are in the metatile
-		if x.maxDetailZoom > 0 && metatileZoom > x.maxDetailZoom {
-			metatileZoom = x.maxDetailZoom
-		}
-
-		if _, seen := seenMetatileZooms[metatileZoom]; !seen {
-			seenMetatileZooms[metatileZoom] = struct{}{}
-			metatileZooms = append(metatileZooms, metatileZoom)
+		metaZoom := metatileZoom(z, x.metatileSize, x.maxDetailZoom)
+		if _, seen := seenMetatileZooms[metaZoom]; !seen {
+			seenMetatileZooms[metaZoom] = struct{}{}
+			metatileZooms = append(metatileZooms, metaZoom)
 		}
 	}
 
@@ -225,23 +223,16 @@ func (x *metatileJobGenerator) CreateJobs(jobs chan *TileRequest) error {
 		Bounds:    x.bounds,
 		InvertedY: false,
 		Zooms:     metatileZooms,
+		Context:   ctx,
 		ConsumerFunc: func(t maptile.Tile) {
-			hash := md5.Sum([]byte(fmt.Sprintf("%d/%d/%d.zip", t.Z, t.X, t.Y)))
-			hashHex := hex.EncodeToString(hash[:])
+			path := tilezenArchivePath(x.pathTemplate, x.layerName, t)
 
-			path := strings.NewReplacer(
-				"{x}", fmt.Sprintf("%d", t.X),
-				"{y}", fmt.Sprintf("%d", t.Y),
-				"{z}", fmt.Sprintf("%d", t.Z),
-				"{l}", x.layerName,
-				"{h}", hashHex[:5]).Replace(x.pathTemplate)
-
-			jobs <- &TileRequest{
+			sendJob(ctx, jobs, &TileRequest{
 				Tile: t,
 				URL:  path,
-			}
+			})
 		},
 	})
 
-	return nil
+	return ctx.Err()
 }
@@ -0,0 +1,265 @@
+package tilepack
+
+import (
+	"fmt"
+
+	"github.com/protomaps/go-pmtiles/pmtiles"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Mapbox Vector Tile 2.1 protobuf schema.
+const (
+	mvtTileLayers = 3
+
+	mvtLayerName     = 1
+	mvtLayerFeatures = 2
+	mvtLayerKeys     = 3
+	mvtLayerValues   = 4
+	mvtLayerExtent   = 5
+	mvtLayerVersion  = 15
+
+	mvtFeatureTags     = 2
+	mvtFeatureType     = 3
+	mvtFeatureGeometry = 4
+
+	mvtValueString = 1
+	mvtValueFloat  = 2
+	mvtValueDouble = 3
+	mvtValueInt    = 4
+	mvtValueUint   = 5
+	mvtValueSint   = 6
+	mvtValueBool   = 7
+)
+
+// Attribute types as named by the vector_layers metadata of the MBTiles spec.
+const (
+	MVTFieldString  = "String"
+	MVTFieldNumber  = "Number"
+	MVTFieldBoolean = "Boolean"
+	MVTFieldMixed   = "Mixed"
+)
+
+// MVTLayer summarises one layer of a Mapbox Vector Tile.
+type MVTLayer struct {
+	Name    string
+	Version uint32
+	Extent  uint32
+	// Size is the encoded size of the layer in bytes.
+	Size     int
+	Features int
+	// Fields maps each attribute key used by a feature to the type of its
+	// values, one of the MVTField constants.
+	Fields map[string]string
+}
+
+// DecodeMVT decodes the layers of a Mapbox Vector Tile, decompressing it
+// first if it is gzip, brotli or zstd compressed. It checks the structure of
+// the tile, such as feature tags pointing at existing keys and values, but
+// does not decode geometries.
+func DecodeMVT(data []byte) ([]*MVTLayer, error) {
+	if c := detectTileCompression(data, pmtiles.Mvt); c != pmtiles.NoCompression {
+		decoded, err := decompressTile(data, c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s data: %w", tileCompressionName(c), err)
+		}
+		data = decoded
+	}
+
+	layers := []*MVTLayer{}
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+		if num != mvtTileLayers {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return fmt.Errorf("layer has wire type %d", typ)
+		}
+
+		layer, err := decodeMVTLayer(value)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, layer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// isGzipped returns true if data starts with the gzip magic bytes.
+func isGzipped(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func decodeMVTLayer(data []byte) (*MVTLayer, error) {
+	layer := &MVTLayer{Size: len(data), Version: 1, Extent: 4096, Fields: map[string]string{}}
+
+	var keys []string
+	var valueTypes []string
+	var features [][]byte
+
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case mvtLayerName:
+			layer.Name = string(value)
+		case mvtLayerVersion:
+			layer.Version = uint32(varint)
+		case mvtLayerExtent:
+			layer.Extent = uint32(varint)
+		case mvtLayerKeys:
+			keys = append(keys, string(value))
+		case mvtLayerValues:
+			valueType, err := decodeMVTValueType(value)
+			if err != nil {
+				return err
+			}
+			valueTypes = append(valueTypes, valueType)
+		case mvtLayerFeatures:
+			features = append(features, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if layer.Name == "" {
+		return nil, fmt.Errorf("layer has no name")
+	}
+
+	for i, feature := range features {
+		if err := decodeMVTFeature(layer, feature, keys, valueTypes); err != nil {
+			return nil, fmt.Errorf("layer %s feature %d: %w", layer.Name, i, err)
+		}
+	}
+	layer.Features = len(features)
+
+	return layer, nil
+}
+
+func decodeMVTFeature(layer *MVTLayer, data []byte, keys []string, valueTypes []string) error {
+	hasGeometry := false
+
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case mvtFeatureGeometry:
+			if len(value) == 0 {
+				return fmt.Errorf("empty geometry")
+			}
+			hasGeometry = true
+		case mvtFeatureType:
+			if varint > 3 {
+				return fmt.Errorf("unknown geometry type %d", varint)
+			}
+		case mvtFeatureTags:
+			tags, err := unpackVarints(value)
+			if err != nil {
+				return err
+			}
+			if len(tags)%2 != 0 {
+				return fmt.Errorf("odd number of tags")
+			}
+			for i := 0; i < len(tags); i += 2 {
+				k, v := tags[i], tags[i+1]
+				if k >= uint64(len(keys)) || v >= uint64(len(valueTypes)) {
+					return fmt.Errorf("tag refers to missing key %d or value %d", k, v)
+				}
+				mergeFieldType(layer.Fields, keys[k], valueTypes[v])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !hasGeometry {
+		return fmt.Errorf("feature has no geometry")
+	}
+	return nil
+}
+
+// mergeFieldType records that key has a value of valueType.
+func mergeFieldType(fields map[string]string, key string, valueType string) {
+	existing, ok := fields[key]
+	if !ok {
+		fields[key] = valueType
+	} else if existing != valueType {
+		fields[key] = MVTFieldMixed
+	}
+}
+
+func decodeMVTValueType(data []byte) (string, error) {
+	valueType := ""
+	err := walkMessage(data, func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error {
+		switch num {
+		case mvtValueString:
+			valueType = MVTFieldString
+		case mvtValueFloat, mvtValueDouble, mvtValueInt, mvtValueUint, mvtValueSint:
+			valueType = MVTFieldNumber
+		case mvtValueBool:
+			valueType = MVTFieldBoolean
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if valueType == "" {
+		return "", fmt.Errorf("value has no known type")
+	}
+	return valueType, nil
+}
+
+// walkMessage calls visit for each field of a protobuf message. Length
+// delimited fields are passed as value, varint and fixed width fields as
+// varint.
+func walkMessage(data []byte, visit func(num protowire.Number, typ protowire.Type, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf tag: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var value []byte
+		var varint uint64
+		switch typ {
+		case protowire.VarintType:
+			varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(data)
+			varint = uint64(v)
+		case protowire.Fixed64Type:
+			varint, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		if err := visit(num, typ, value, varint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpackVarints(data []byte) ([]uint64, error) {
+	values := make([]uint64, 0, len(data))
+	for len(data) > 0 {
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid packed varint: %w", protowire.ParseError(n))
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
@@ -0,0 +1,153 @@
+package tilepack
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testMVTFeature is a point feature with the given attributes.
+type testMVTFeature map[string]interface{}
+
+// encodeTestMVT encodes a vector tile with one point feature per entry of
+// each layer.
+func encodeTestMVT(layers map[string][]testMVTFeature) []byte {
+	var tile []byte
+	for name, features := range layers {
+		var layer []byte
+		layer = protowire.AppendTag(layer, mvtLayerVersion, protowire.VarintType)
+		layer = protowire.AppendVarint(layer, 2)
+		layer = protowire.AppendTag(layer, mvtLayerName, protowire.BytesType)
+		layer = protowire.AppendString(layer, name)
+
+		keyIndex := map[string]uint64{}
+		var keys []string
+		var values [][]byte
+
+		for _, attrs := range features {
+			var tags []byte
+			for k, v := range attrs {
+				if _, ok := keyIndex[k]; !ok {
+					keyIndex[k] = uint64(len(keys))
+					keys = append(keys, k)
+				}
+
+				var value []byte
+				switch v := v.(type) {
+				case string:
+					value = protowire.AppendTag(value, mvtValueString, protowire.BytesType)
+					value = protowire.AppendString(value, v)
+				case int:
+					value = protowire.AppendTag(value, mvtValueInt, protowire.VarintType)
+					value = protowire.AppendVarint(value, uint64(v))
+				case float64:
+					value = protowire.AppendTag(value, mvtValueDouble, protowire.Fixed64Type)
+					value = protowire.AppendFixed64(value, uint64(v))
+				case bool:
+					value = protowire.AppendTag(value, mvtValueBool, protowire.VarintType)
+					value = protowire.AppendVarint(value, protowire.EncodeBool(v))
+				}
+				tags = protowire.AppendVarint(tags, keyIndex[k])
+				tags = protowire.AppendVarint(tags, uint64(len(values)))
+				values = append(values, value)
+			}
+
+			var feature []byte
+			feature = protowire.AppendTag(feature, mvtFeatureTags, protowire.BytesType)
+			feature = protowire.AppendBytes(feature, tags)
+			feature = protowire.AppendTag(feature, mvtFeatureType, protowire.VarintType)
+			feature = protowire.AppendVarint(feature, 1)
+			// MoveTo(1) to (1, 1).
+			feature = protowire.AppendTag(feature, mvtFeatureGeometry, protowire.BytesType)
+			feature = protowire.AppendBytes(feature, []byte{9, 2, 2})
+
+			layer = protowire.AppendTag(layer, mvtLayerFeatures, protowire.BytesType)
+			layer = protowire.AppendBytes(layer, feature)
+		}
+
+		for _, k := range keys {
+			layer = protowire.AppendTag(layer, mvtLayerKeys, protowire.BytesType)
+			layer = protowire.AppendString(layer, k)
+		}
+		for _, v := range values {
+			layer = protowire.AppendTag(layer, mvtLayerValues, protowire.BytesType)
+			layer = protowire.AppendBytes(layer, v)
+		}
+		layer = protowire.AppendTag(layer, mvtLayerExtent, protowire.VarintType)
+		layer = protowire.AppendVarint(layer, 4096)
+
+		tile = protowire.AppendTag(tile, mvtTileLayers, protowire.BytesType)
+		tile = protowire.AppendBytes(tile, layer)
+	}
+	return tile
+}
+
+func TestDecodeMVT(t *testing.T) {
+	data := encodeTestMVT(map[string][]testMVTFeature{
+		"roads": {
+			{"name": "Main St", "lanes": 2},
+			{"name": "High St", "lanes": "two", "oneway": true},
+		},
+	})
+
+	for _, input := range [][]byte{data, gzipBytes(data)} {
+		layers, err := DecodeMVT(input)
+		if err != nil {
+			t.Fatalf("DecodeMVT: %v", err)
+		}
+		if len(layers) != 1 {
+			t.Fatalf("got %d layers, want 1", len(layers))
+		}
+
+		roads := layers[0]
+		if roads.Name != "roads" || roads.Features != 2 || roads.Version != 2 || roads.Extent != 4096 {
+			t.Errorf("layer: %+v", roads)
+		}
+		if roads.Size == 0 || roads.Size > len(data) {
+			t.Errorf("size: got %d", roads.Size)
+		}
+
+		want := map[string]string{"name": MVTFieldString, "lanes": MVTFieldMixed, "oneway": MVTFieldBoolean}
+		for k, v := range want {
+			if roads.Fields[k] != v {
+				t.Errorf("field %s: got %q, want %q", k, roads.Fields[k], v)
+			}
+		}
+	}
+}
+
+func TestDecodeMVT_Invalid(t *testing.T) {
+	valid := encodeTestMVT(map[string][]testMVTFeature{"water": {{"kind": "lake"}}})
+
+	cases := map[string][]byte{
+		"truncated": valid[:len(valid)-3],
+		"garbage":   []byte("this is not a vector tile"),
+		"bad gzip":  {0x1f, 0x8b, 0x00},
+	}
+	for name, data := range cases {
+		if _, err := DecodeMVT(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// A feature tag pointing past the layer's keys.
+	var feature []byte
+	feature = protowire.AppendTag(feature, mvtFeatureTags, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, []byte{5, 0})
+	feature = protowire.AppendTag(feature, mvtFeatureGeometry, protowire.BytesType)
+	feature = protowire.AppendBytes(feature, []byte{9, 2, 2})
+	var layer []byte
+	layer = protowire.AppendTag(layer, mvtLayerName, protowire.BytesType)
+	layer = protowire.AppendString(layer, "bad")
+	layer = protowire.AppendTag(layer, mvtLayerFeatures, protowire.BytesType)
+	layer = protowire.AppendBytes(layer, feature)
+	var tile []byte
+	tile = protowire.AppendTag(tile, mvtTileLayers, protowire.BytesType)
+	tile = protowire.AppendBytes(tile, layer)
+
+	_, err := DecodeMVT(tile)
+	if err == nil || !strings.Contains(err.Error(), "missing key") {
+		t.Errorf("expected a missing key error, got %v", err)
+	}
+}
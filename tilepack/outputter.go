@@ -11,3 +11,56 @@ type TileOutputter interface {
 	AssignSpatialMetadata(orb.Bound, maptile.Zoom, maptile.Zoom) error
 	Close() error
 }
+
+// TileValidatorReader looks up the HTTP cache validators stored for a tile.
+// It returns nil validators when none are stored.
+type TileValidatorReader interface {
+	GetValidators(tile maptile.Tile) (*TileValidators, error)
+}
+
+// TileValidatorStore is implemented by outputters that can keep per-tile HTTP
+// cache validators next to the tile data.
+type TileValidatorStore interface {
+	TileValidatorReader
+	SaveValidators(tile maptile.Tile, validators *TileValidators) error
+}
+
+// HashedTileSaver is implemented by outputters that deduplicate tiles by
+// content hash, so a hash computed earlier with their ContentHasher can be
+// passed along instead of hashing the tile again.
+type HashedTileSaver interface {
+	ContentHasher() *ContentHasher
+	SaveHashed(tile maptile.Tile, data []byte, hash ContentHash) error
+}
+
+// SaveTileResponse saves the tile of response with outputter, reusing the
+// response's content hash when the outputter deduplicates tiles.
+func SaveTileResponse(outputter TileOutputter, response *TileResponse) error {
+	if saver, ok := outputter.(HashedTileSaver); ok {
+		return saver.SaveHashed(response.Tile, response.Data, response.ContentHash(saver.ContentHasher()))
+	}
+	return outputter.Save(response.Tile, response.Data)
+}
+
+// ConcurrentSaver is implemented by outputters whose Save may be called from
+// several goroutines at once when SavesConcurrently returns true.
+type ConcurrentSaver interface {
+	SavesConcurrently() bool
+}
+
+// PreparedTile is a tile made ready to save by a TilePreparer.
+type PreparedTile struct {
+	tile maptile.Tile
+	data []byte
+	hash ContentHash
+}
+
+// TilePreparer is implemented by outputters that save tiles one at a time but
+// can do the costly part of saving, such as compressing a tile, from several
+// goroutines at once in PrepareTile. SavePrepared does the rest and must not
+// be called concurrently.
+type TilePreparer interface {
+	HashedTileSaver
+	PrepareTile(tile maptile.Tile, data []byte, hash ContentHash) (*PreparedTile, error)
+	SavePrepared(prepared *PreparedTile) error
+}
@@ -0,0 +1,267 @@
+package tilepack
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// A patch archive is an MBTiles file holding the tiles that were added or
+// changed between a base and a target archive, plus a deleted_tiles table
+// listing the tiles that were removed. Its metadata records the
+// ArchiveChecksum of the base it applies to and of the expected result, and
+// the name of the ContentHasher they were computed with. Patches without
+// PatchHashKey were made with MD5ContentHasher.
+const (
+	PatchBaseChecksumKey   = "patch_base_checksum"
+	PatchTargetChecksumKey = "patch_target_checksum"
+	PatchHashKey           = "patch_hash"
+)
+
+// PatchWriter writes a patch archive.
+type PatchWriter struct {
+	outputter *mbtilesOutputter
+}
+
+// NewPatchWriter creates a patch archive at dsn. metadata is written on
+// Close and should carry PatchBaseChecksumKey and PatchTargetChecksumKey
+// computed with hasher, which also deduplicates the patch's tiles.
+func NewPatchWriter(dsn string, batchSize int, hasher *ContentHasher, metadata *MbtilesMetadata) (*PatchWriter, error) {
+	outputter, err := NewMbtilesOutputter(dsn, batchSize, false, metadata)
+	if err != nil {
+		return nil, err
+	}
+	outputter.SetContentHasher(hasher)
+	metadata.Set(PatchHashKey, hasher.Name())
+
+	if err := outputter.CreateTiles(); err != nil {
+		return nil, err
+	}
+
+	if _, err := outputter.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deleted_tiles (
+			zoom_level INTEGER NOT NULL,
+			tile_column INTEGER NOT NULL,
+			tile_row INTEGER NOT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS deleted_tiles_index ON deleted_tiles (zoom_level, tile_column, tile_row);
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create deleted_tiles table: %w", err)
+	}
+
+	return &PatchWriter{outputter: outputter}, nil
+}
+
+// Save adds an added or changed tile to the patch.
+func (w *PatchWriter) Save(tile maptile.Tile, data []byte) error {
+	return w.outputter.Save(tile, data)
+}
+
+// Delete records that tile must be removed from the base.
+func (w *PatchWriter) Delete(tile maptile.Tile) error {
+	o := w.outputter
+	if err := o.begin(); err != nil {
+		return err
+	}
+
+	_, err := o.txn.Exec("INSERT OR REPLACE INTO deleted_tiles (zoom_level, tile_column, tile_row) VALUES (?, ?, ?);", tile.Z, tile.X, o.tileRow(tile))
+	return err
+}
+
+// Close commits outstanding tiles and writes the metadata.
+func (w *PatchWriter) Close() error {
+	return w.outputter.Close()
+}
+
+// ErrPatchChecksumMismatch is returned by ApplyMbtilesPatch when the archive
+// is not the base the patch was made from, or the result is not its target.
+var ErrPatchChecksumMismatch = errors.New("patch checksum mismatch")
+
+// PatchResult reports the changes made by ApplyMbtilesPatch.
+type PatchResult struct {
+	// Written is the number of tiles added or replaced.
+	Written int64
+	// Deleted is the number of tiles removed.
+	Deleted int64
+	// ImagesRemoved is the number of images rows no longer referenced by any
+	// tile after the patch, which were removed.
+	ImagesRemoved int64
+	// Checksum is the ArchiveChecksum of the patched archive.
+	Checksum string
+}
+
+// ApplyMbtilesPatch applies the patch archive at patchPath to the MBTiles
+// file at dsn in one transaction. Unless force is true the archive's
+// checksum must match the patch's base checksum, and the result must match
+// its target checksum, or nothing is changed. The archive must use the
+// deduplicated map/images schema written by the mbtiles outputter.
+func ApplyMbtilesPatch(dsn string, patchPath string, force bool) (*PatchResult, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	// ATTACH is per connection, so pin one for the whole update.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, table := range []string{"map", "images"} {
+		var n int
+		if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s has no %s table; only the map/images schema can be patched", dsn, table)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS patch", patchPath); err != nil {
+		return nil, fmt.Errorf("failed to attach patch: %w", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE patch")
+
+	var hasDeletions, hasValidators int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM patch.sqlite_master WHERE type='table' AND name='deleted_tiles'").Scan(&hasDeletions); err != nil {
+		return nil, fmt.Errorf("failed to read patch: %w", err)
+	}
+	if hasDeletions == 0 {
+		return nil, fmt.Errorf("%s is not a patch archive: it has no deleted_tiles table", patchPath)
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master WHERE type='table' AND name='tile_validators'").Scan(&hasValidators); err != nil {
+		return nil, err
+	}
+
+	patchChecksums := map[string]string{}
+	rows, err := conn.QueryContext(ctx, "SELECT name, value FROM patch.metadata WHERE name IN (?, ?, ?)", PatchBaseChecksumKey, PatchTargetChecksumKey, PatchHashKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patch metadata: %w", err)
+	}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		patchChecksums[name] = value
+	}
+	rows.Close()
+
+	hasher := MD5ContentHasher
+	if name, ok := patchChecksums[PatchHashKey]; ok {
+		if hasher, err = ParseContentHasher(name); err != nil {
+			return nil, fmt.Errorf("patch checksums: %w", err)
+		}
+	}
+
+	txn, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	if !force {
+		want, ok := patchChecksums[PatchBaseChecksumKey]
+		if !ok {
+			return nil, fmt.Errorf("patch has no %s metadata", PatchBaseChecksumKey)
+		}
+		got, err := checksumMbtilesRows(txn, hasher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum %s: %w", dsn, err)
+		}
+		if got.String() != want {
+			return nil, fmt.Errorf("%w: archive checksum is %s, patch applies to %s", ErrPatchChecksumMismatch, got, want)
+		}
+	}
+
+	result := &PatchResult{}
+
+	deleted, err := txn.Exec(`DELETE FROM main.map WHERE EXISTS (
+		SELECT 1 FROM patch.deleted_tiles d
+		WHERE d.zoom_level = map.zoom_level AND d.tile_column = map.tile_column AND d.tile_row = map.tile_row)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete tiles: %w", err)
+	}
+	result.Deleted, _ = deleted.RowsAffected()
+
+	if _, err := txn.Exec(`INSERT OR IGNORE INTO main.images (tile_id, tile_data)
+		SELECT tile_id, tile_data FROM patch.images`); err != nil {
+		return nil, fmt.Errorf("failed to copy images: %w", err)
+	}
+
+	written, err := txn.Exec(`INSERT OR REPLACE INTO main.map (zoom_level, tile_column, tile_row, tile_id)
+		SELECT zoom_level, tile_column, tile_row, tile_id FROM patch.map`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write tiles: %w", err)
+	}
+	result.Written, _ = written.RowsAffected()
+
+	// The validators of deleted and rewritten tiles describe content the
+	// archive no longer holds.
+	if hasValidators > 0 {
+		if _, err := txn.Exec(`DELETE FROM main.tile_validators WHERE EXISTS (
+			SELECT 1 FROM patch.deleted_tiles d
+			WHERE d.zoom_level = tile_validators.zoom_level AND d.tile_column = tile_validators.tile_column AND d.tile_row = tile_validators.tile_row
+		) OR EXISTS (
+			SELECT 1 FROM patch.map m
+			WHERE m.zoom_level = tile_validators.zoom_level AND m.tile_column = tile_validators.tile_column AND m.tile_row = tile_validators.tile_row)`); err != nil {
+			return nil, fmt.Errorf("failed to clear validators: %w", err)
+		}
+	}
+
+	removed, err := txn.Exec("DELETE FROM main.images WHERE tile_id NOT IN (SELECT tile_id FROM main.map)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove unreferenced images: %w", err)
+	}
+	result.ImagesRemoved, _ = removed.RowsAffected()
+
+	if _, err := txn.Exec(`INSERT OR REPLACE INTO main.metadata (name, value)
+		SELECT name, value FROM patch.metadata WHERE name NOT IN (?, ?, ?)`, PatchBaseChecksumKey, PatchTargetChecksumKey, PatchHashKey); err != nil {
+		return nil, fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	checksum, err := checksumMbtilesRows(txn, hasher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum patched archive: %w", err)
+	}
+	result.Checksum = checksum.String()
+
+	if want, ok := patchChecksums[PatchTargetChecksumKey]; ok && !force && result.Checksum != want {
+		return nil, fmt.Errorf("%w: patched archive checksum is %s, patch expected %s", ErrPatchChecksumMismatch, result.Checksum, want)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checksumMbtilesRows returns the ArchiveChecksum of the tiles visible to
+// txn in the main database, matching ChecksumTileReader on the same file.
+func checksumMbtilesRows(txn *sql.Tx, hasher *ContentHasher) (*ArchiveChecksum, error) {
+	rows, err := txn.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM main.tiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksum := &ArchiveChecksum{}
+	for rows.Next() {
+		var z maptile.Zoom
+		var x, y uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &y, &data); err != nil {
+			return nil, err
+		}
+		checksum.Add(maptile.New(x, flipY(y, z), z), hasher.Sum(data))
+	}
+	return checksum, rows.Err()
+}
@@ -0,0 +1,179 @@
+package tilepack
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// writeTestPatch diffs base and target into a new patch archive.
+func writeTestPatch(t *testing.T, basePath string, targetPath string, hasher *ContentHasher) string {
+	t.Helper()
+	base, err := OpenTileReader(basePath)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer base.Close()
+	target, err := OpenTileReader(targetPath)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer target.Close()
+
+	metadata, _ := target.Metadata()
+	path := filepath.Join(t.TempDir(), "patch.mbtiles")
+	patch, err := NewPatchWriter(path, 100, hasher, metadata)
+	if err != nil {
+		t.Fatalf("NewPatchWriter: %v", err)
+	}
+
+	diff, err := DiffTileReaders(base, target, hasher, func(c *TileChange) error {
+		if c.Kind == TileRemoved {
+			return patch.Delete(c.Tile)
+		}
+		return patch.Save(c.Tile, c.Data)
+	})
+	if err != nil {
+		t.Fatalf("DiffTileReaders: %v", err)
+	}
+	metadata.Set(PatchBaseChecksumKey, diff.BaseChecksum.String())
+	metadata.Set(PatchTargetChecksumKey, diff.TargetChecksum.String())
+	if err := patch.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func countRows(t *testing.T, path string, table string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return n
+}
+
+func TestApplyMbtilesPatch(t *testing.T) {
+	baseTiles := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): []byte("same"),
+		maptile.New(0, 0, 1): []byte("old"),
+		maptile.New(1, 0, 1): []byte("gone"),
+	}
+	targetTiles := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): []byte("same"),
+		maptile.New(0, 0, 1): []byte("new"),
+		maptile.New(1, 1, 1): []byte("added"),
+	}
+	basePath := writeTestMbtiles(t, "base.mbtiles", baseTiles)
+	targetPath := writeTestMbtiles(t, "target.mbtiles", targetTiles)
+	patchPath := writeTestPatch(t, basePath, targetPath, DefaultContentHasher)
+
+	if n := countRows(t, patchPath, "map"); n != 2 {
+		t.Errorf("patch holds %d tiles, want 2", n)
+	}
+
+	result, err := ApplyMbtilesPatch(basePath, patchPath, false)
+	if err != nil {
+		t.Fatalf("ApplyMbtilesPatch: %v", err)
+	}
+	if result.Written != 2 || result.Deleted != 1 {
+		t.Errorf("result: %+v", result)
+	}
+	// "old" and "gone" are no longer referenced.
+	if result.ImagesRemoved != 2 {
+		t.Errorf("images removed: got %d, want 2", result.ImagesRemoved)
+	}
+	if n := countRows(t, basePath, "images"); n != 3 {
+		t.Errorf("images: got %d rows, want 3", n)
+	}
+
+	reader, _ := OpenTileReader(basePath)
+	defer reader.Close()
+	for tile, want := range targetTiles {
+		got, err := reader.GetTile(tile)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("%v: got %q, %v; want %q", tile, got, err, want)
+		}
+	}
+	if got, _ := reader.GetTile(maptile.New(1, 0, 1)); got != nil {
+		t.Errorf("deleted tile still present: %q", got)
+	}
+
+	metadata, _ := reader.Metadata()
+	if name, _ := metadata.Name(); name != "target.mbtiles" {
+		t.Errorf("metadata not updated, name %q", name)
+	}
+	if _, ok := metadata.Get(PatchBaseChecksumKey); ok {
+		t.Error("patch checksum keys must not be copied")
+	}
+	if _, ok := metadata.Get(PatchHashKey); ok {
+		t.Error("patch hash key must not be copied")
+	}
+}
+
+func TestApplyMbtilesPatch_RecordedHash(t *testing.T) {
+	basePath := writeTestMbtiles(t, "base.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("a")})
+	targetPath := writeTestMbtiles(t, "target.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("b")})
+	patchPath := writeTestPatch(t, basePath, targetPath, XXHashContentHasher)
+
+	// The checksums only match when they are recomputed with the hash the
+	// patch records.
+	result, err := ApplyMbtilesPatch(basePath, patchPath, false)
+	if err != nil {
+		t.Fatalf("ApplyMbtilesPatch: %v", err)
+	}
+	reader, _ := OpenTileReader(basePath)
+	defer reader.Close()
+	checksum, err := ChecksumTileReader(reader, XXHashContentHasher)
+	if err != nil {
+		t.Fatalf("ChecksumTileReader: %v", err)
+	}
+	if result.Checksum != checksum.String() {
+		t.Errorf("result checksum %s, want the xxhash checksum %s", result.Checksum, checksum)
+	}
+}
+
+func TestApplyMbtilesPatch_BaseMismatch(t *testing.T) {
+	basePath := writeTestMbtiles(t, "base.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("a")})
+	targetPath := writeTestMbtiles(t, "target.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("b")})
+	patchPath := writeTestPatch(t, basePath, targetPath, DefaultContentHasher)
+
+	other := writeTestMbtiles(t, "other.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("c")})
+
+	_, err := ApplyMbtilesPatch(other, patchPath, false)
+	if !errors.Is(err, ErrPatchChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	// Nothing may change when the patch is refused.
+	reader, _ := OpenTileReader(other)
+	defer reader.Close()
+	if got, _ := reader.GetTile(maptile.New(0, 0, 0)); string(got) != "c" {
+		t.Errorf("archive changed to %q", got)
+	}
+
+	// With force the patch is applied regardless.
+	if _, err := ApplyMbtilesPatch(other, patchPath, true); err != nil {
+		t.Fatalf("forced ApplyMbtilesPatch: %v", err)
+	}
+	if got, _ := reader.GetTile(maptile.New(0, 0, 0)); string(got) != "b" {
+		t.Errorf("forced patch: got %q", got)
+	}
+}
+
+func TestApplyMbtilesPatch_NotAPatch(t *testing.T) {
+	basePath := writeTestMbtiles(t, "base.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("a")})
+	other := writeTestMbtiles(t, "other.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("b")})
+
+	if _, err := ApplyMbtilesPatch(basePath, other, false); err == nil {
+		t.Fatal("expected an error for an archive without deleted_tiles")
+	}
+}
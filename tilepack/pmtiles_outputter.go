@@ -1,16 +1,15 @@
 package tilepack
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"log"
 	"math"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/paulmach/orb"
@@ -28,7 +27,8 @@ type offsetLen struct {
 //
 // Tile data is accumulated in a temporary file during Save calls. On Close the
 // outputter sorts the directory entries by Hilbert tile ID, performs run-length
-// encoding on runs of consecutive identical tiles, builds the two-level
+// encoding on runs of consecutive identical tiles, rewrites the tile data in
+// tile ID order unless tiles were saved in that order, builds the two-level
 // (root + optional leaf) directory structure, and writes the final archive in
 // one sequential pass: header → root dir → metadata → leaf dirs → tile data.
 //
@@ -37,18 +37,62 @@ type offsetLen struct {
 //	[127-byte header][root directory][metadata][leaf directories][tile data]
 type pmtilesOutputter struct {
 	tileset        *roaring64.Bitmap    // set of all addressed tile IDs (for count reporting)
-	hashFunc       hash.Hash            // FNV-128a; reset per tile for deduplication
-	offsetMap      map[[16]byte]offsetLen // hash → position in tileData; drives dedup
+	hasher         *ContentHasher       // content hash for deduplication; DefaultContentHasher when nil
+	offsetMap      map[ContentHash]offsetLen // hash → position in tileData; drives dedup
+	contentMu      sync.Mutex                // guards offsetMap and the spill index, also read by PrepareTile
 	dataOffset     uint64               // running byte offset into tileData
 	tileData       *os.File             // temp file accumulating raw tile blobs
 	entries        []pmtiles.EntryV3    // one entry per Save call before RLE
-	compressBuffer *bytes.Buffer
-	compressor     *gzip.Writer
+	compressor     tileCompressor
+	compressors    sync.Pool // *tileCompressor of PrepareTile calls
 	header         pmtiles.HeaderV3
 	metadata       *MbtilesMetadata // written into the JSON metadata section on Close
-	centerSet      bool             // true once AssignSpatialMetadata has been called
-	outFile        *os.File
+	spatial        *TilesetMetadata // set by AssignSpatialMetadata
+	outFile        archiveFile
 	logger         *log.Logger
+	spill          *pmtilesSpill // set by SetMemoryBudget; entries and dedup index spill to disk
+	lastID         uint64        // tile ID of the last Save
+	unordered      bool          // true once a tile was saved before one with a lower ID
+}
+
+// SetMemoryBudget bounds the memory the outputter uses for directory entries
+// and content deduplication to about budget bytes, regardless of the number
+// of tiles. It must be called before the first Save.
+//
+// Entries are sorted in runs that fit the budget and spilled to temporary
+// files, which Close merges. Contents are deduplicated through an on-disk
+// index fronted by a Bloom filter and a cache of recently used contents, so
+// deduplication stays exact but is slower. Duplicate tiles are reported by
+// Close instead of Save.
+func (p *pmtilesOutputter) SetMemoryBudget(budget int64) error {
+	if len(p.entries) > 0 {
+		return fmt.Errorf("memory budget must be set before the first tile is saved")
+	}
+	spill, err := newPmtilesSpill(budget)
+	if err != nil {
+		return err
+	}
+	if p.spill != nil {
+		p.spill.Close()
+	}
+	p.spill = spill
+	p.tileset = nil
+	p.offsetMap = nil
+	return nil
+}
+
+// SetContentHasher sets the hash tiles are deduplicated by. It must be
+// called before the first Save.
+func (p *pmtilesOutputter) SetContentHasher(hasher *ContentHasher) {
+	p.hasher = hasher
+}
+
+// ContentHasher returns the hash tiles are deduplicated by.
+func (p *pmtilesOutputter) ContentHasher() *ContentHasher {
+	if p.hasher == nil {
+		return DefaultContentHasher
+	}
+	return p.hasher
 }
 
 func (p *pmtilesOutputter) CreateTiles() error {
@@ -57,49 +101,95 @@ func (p *pmtilesOutputter) CreateTiles() error {
 
 // Save records a tile in the archive.
 //
-// If the tile's content has been seen before (same FNV-128a hash) the blob is
+// If the tile's content has been seen before (same content hash) the blob is
 // reused and no bytes are written to the temp file. Otherwise the data is
 // optionally gzip-compressed and appended. Either way one directory entry is
 // appended; run-length encoding is applied later in Close once all entries are
 // sorted by tile ID.
 func (p *pmtilesOutputter) Save(tile maptile.Tile, data []byte) error {
+	return p.SaveHashed(tile, data, p.ContentHasher().Sum(data))
+}
+
+// SaveHashed is Save for a tile whose ContentHasher hash is already known.
+func (p *pmtilesOutputter) SaveHashed(tile maptile.Tile, data []byte, key ContentHash) error {
+	return p.save(tile, data, key, false)
+}
+
+// PrepareTile transcodes a tile to the archive's tile compression, which is
+// the costly part of saving it. A tile whose content is already stored is
+// not transcoded, as SavePrepared reuses the stored blob. It may be called
+// from several goroutines at once, and while SavePrepared runs.
+func (p *pmtilesOutputter) PrepareTile(tile maptile.Tile, data []byte, key ContentHash) (*PreparedTile, error) {
+	// Contents are never removed, so SavePrepared finds it too.
+	_, stored, err := p.lookupContent(key)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		return &PreparedTile{tile: tile, data: data, hash: key}, nil
+	}
+
+	compressor, _ := p.compressors.Get().(*tileCompressor)
+	if compressor == nil {
+		compressor = &tileCompressor{}
+	}
+	defer p.compressors.Put(compressor)
+
+	newData, err := compressor.transcodeTile(data, p.header.TileType, p.header.TileCompression)
+	if err != nil {
+		return nil, fmt.Errorf("tile %v: %w", tile, err)
+	}
+	if len(newData) > 0 && len(data) > 0 && &newData[0] != &data[0] {
+		// Unless the tile was passed through, it is in the compressor's
+		// buffer, which the next tile reuses.
+		newData = append([]byte(nil), newData...)
+	}
+	return &PreparedTile{tile: tile, data: newData, hash: key}, nil
+}
+
+// SavePrepared records a tile transcoded by PrepareTile in the archive.
+func (p *pmtilesOutputter) SavePrepared(prepared *PreparedTile) error {
+	return p.save(prepared.tile, prepared.data, prepared.hash, true)
+}
+
+// save records a tile in the archive. Its data is transcoded to the
+// archive's tile compression unless it already was.
+func (p *pmtilesOutputter) save(tile maptile.Tile, data []byte, key ContentHash, transcoded bool) error {
 	// Hilbert tile ID is the canonical ordering key used by the PMTiles spec.
 	id := pmtiles.ZxyToID(uint8(tile.Z), tile.X, tile.Y)
-	if p.tileset.Contains(id) {
-		// Duplicate tile IDs produce two directory entries for the same ID, making
-		// one unreachable via binary search. Reject early to keep the directory valid.
-		return fmt.Errorf("duplicate tile %v (Hilbert ID %d)", tile, id)
-	}
-	p.tileset.Add(id)
-
-	// Hash the raw (pre-compression) bytes for content-based deduplication.
-	// Write the FNV-128a sum into a stack-allocated [16]byte so the map key
-	// never escapes to the heap (one fewer allocation per tile vs. string(h.Sum(nil))).
-	p.hashFunc.Reset()
-	p.hashFunc.Write(data)
-	var key [16]byte
-	p.hashFunc.Sum(key[:0])
-	found, ok := p.offsetMap[key]
+	if id < p.lastID {
+		p.unordered = true
+	}
+	p.lastID = id
+
+	if p.spill == nil {
+		if p.tileset.Contains(id) {
+			// Duplicate tile IDs produce two directory entries for the same ID, making
+			// one unreachable via binary search. Reject early to keep the directory valid.
+			return fmt.Errorf("duplicate tile %v (Hilbert ID %d)", tile, id)
+		}
+		p.tileset.Add(id)
+	}
+
+	// The content hash ignores the compressions tiles are transcoded from, so
+	// a tile already stored compressed is reused for the same tile saved
+	// uncompressed and vice versa.
+	found, ok, err := p.lookupContent(key)
+	if err != nil {
+		return err
+	}
 
 	if !ok {
-		// New content: compress if needed, append to the temp data file.
-		var newData []byte
-		// Pass-through when the archive stores tiles uncompressed (e.g. PNG/JPEG),
-		// or when the data already carries the gzip magic bytes (0x1f 0x8b) so we
-		// do not double-compress.
-		if p.header.TileCompression == pmtiles.NoCompression ||
-			(len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b) {
-			newData = data
-		} else {
-			p.compressBuffer.Reset()
-			p.compressor.Reset(p.compressBuffer)
-			if _, err := p.compressor.Write(data); err != nil {
-				return fmt.Errorf("gzip write: %w", err)
+		// New content: transcode to the archive's tile compression, append to
+		// the temp data file. Data that already has that compression is passed
+		// through so it is not compressed twice.
+		newData := data
+		if !transcoded {
+			var err error
+			newData, err = p.compressor.transcodeTile(data, p.header.TileType, p.header.TileCompression)
+			if err != nil {
+				return fmt.Errorf("tile %v: %w", tile, err)
 			}
-			if err := p.compressor.Close(); err != nil {
-				return fmt.Errorf("gzip close: %w", err)
-			}
-			newData = p.compressBuffer.Bytes()
 		}
 
 		bytesWritten, err := p.tileData.Write(newData)
@@ -111,7 +201,9 @@ func (p *pmtilesOutputter) Save(tile maptile.Tile, data []byte) error {
 			offset: p.dataOffset,
 			length: uint32(bytesWritten),
 		}
-		p.offsetMap[key] = found
+		if err := p.storeContent(key, found); err != nil {
+			return err
+		}
 		p.dataOffset += uint64(bytesWritten)
 	}
 
@@ -122,21 +214,50 @@ func (p *pmtilesOutputter) Save(tile maptile.Tile, data []byte) error {
 		RunLength: 1,
 	})
 
+	if p.spill != nil && len(p.entries) >= p.spill.maxEntries {
+		if err := p.spill.writeRun(p.entries); err != nil {
+			return err
+		}
+		p.entries = p.entries[:0]
+	}
+
 	return nil
 }
 
-// AssignSpatialMetadata sets the geographic extent and zoom range in the header.
-// Coordinates are stored in the PMTiles binary format as integer values scaled
-// by 1e7 (i.e. degrees × 10 000 000). Center defaults to the midpoint of the
-// bounds at the minimum zoom if not overridden before Close.
+// lookupContent returns where content with the given hash was written.
+func (p *pmtilesOutputter) lookupContent(key ContentHash) (offsetLen, bool, error) {
+	p.contentMu.Lock()
+	defer p.contentMu.Unlock()
+	if p.spill != nil {
+		return p.spill.index.Get(key.Bytes())
+	}
+	found, ok := p.offsetMap[key]
+	return found, ok, nil
+}
+
+// storeContent records where new content with the given hash was written.
+func (p *pmtilesOutputter) storeContent(key ContentHash, found offsetLen) error {
+	p.contentMu.Lock()
+	defer p.contentMu.Unlock()
+	if p.spill != nil {
+		p.spill.contents++
+		return p.spill.index.Put(key.Bytes(), found)
+	}
+	p.offsetMap[key] = found
+	return nil
+}
+
+// AssignSpatialMetadata sets the bounds, zoom range and center that Close
+// writes into the header, over those of the metadata. The header stores
+// coordinates as integers scaled by 1e7 (i.e. degrees × 10 000 000). Center
+// is the midpoint of the bounds at the minimum zoom.
 func (p *pmtilesOutputter) AssignSpatialMetadata(bound orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
-	p.header.MinZoom = uint8(minZoom)
-	p.header.MaxZoom = uint8(maxZoom)
-	p.header.MinLonE7 = int32(bound.Min[0] * 1e7)
-	p.header.MinLatE7 = int32(bound.Min[1] * 1e7)
-	p.header.MaxLonE7 = int32(bound.Max[0] * 1e7)
-	p.header.MaxLatE7 = int32(bound.Max[1] * 1e7)
-	p.centerSet = true
+	p.spatial = &TilesetMetadata{
+		Bounds:  &bound,
+		Center:  &TilesetCenter{Point: bound.Center(), Zoom: minZoom},
+		MinZoom: &minZoom,
+		MaxZoom: &maxZoom,
+	}
 	return nil
 }
 
@@ -147,68 +268,108 @@ func (p *pmtilesOutputter) AssignSpatialMetadata(bound orb.Bound, minZoom maptil
 //     lookup and for the Clustered flag to be valid).
 //  2. Collapse runs of consecutive tiles that share the same offset (identical
 //     content, contiguous IDs) into single entries with RunLength > 1.
-//  3. Build the two-level directory (root + leaf pages) via optimizeDirectories.
-//  4. Derive center coordinates if AssignSpatialMetadata was called.
-//  5. Write: header → root dir → metadata JSON → leaf dirs → tile data blob.
+//  3. Rewrite the tile data in the order of the entries, so the archive is
+//     clustered, if tiles were not saved in tile ID order.
+//  4. Build the two-level directory (root + leaf pages) via optimizeDirectories.
+//  5. Fill the header's zoom range, bounds and center from the metadata.
+//  6. Write: header → root dir → metadata JSON → leaf dirs → tile data blob.
+//
+// With a memory budget, steps 1-4 merge the spilled entry runs and build the
+// directories from files instead (see pmtilesSpill.buildDirectories).
 func (p *pmtilesOutputter) Close() error {
-	p.logger.Printf("Writing %d tiles to pmtiles", p.tileset.GetCardinality())
+	// Remove the temp file once we have finished copying its contents; it is
+	// not needed after Close returns. Clustering replaces p.tileData, so it is
+	// read when Close returns.
+	defer func() {
+		name := p.tileData.Name()
+		p.tileData.Close()
+		os.Remove(name)
+	}()
 
-	// Step 1: sort by Hilbert tile ID so the directory is bsearch-able and the
-	// archive qualifies as "clustered" per the PMTiles v3 spec.
-	sort.Slice(p.entries, func(i, j int) bool {
-		return p.entries[i].TileID < p.entries[j].TileID
-	})
+	// Abort the output file on early error returns, so that a failed upload
+	// is not committed. The explicit Close at the end of the happy path
+	// commits the archive and captures any flush error.
+	committed := false
+	defer func() {
+		if !committed {
+			p.outFile.Abort()
+		}
+	}()
 
-	// Step 2: run-length encode consecutive entries that point to the same tile
-	// content blob (identical offset). After sorting, such runs are adjacent.
-	// A single entry with RunLength=N replaces N individual entries, shrinking
-	// the directory significantly for sparse or uniform tilesets.
-	p.entries = runLengthEncodeEntries(p.entries)
+	var dirs *pmtilesDirectoryResult
+	if p.spill != nil {
+		defer p.spill.Close()
 
-	p.header.AddressedTilesCount = p.tileset.GetCardinality()
-	p.header.TileEntriesCount = uint64(len(p.entries))
-	p.header.TileContentsCount = uint64(len(p.offsetMap))
+		var clusterer *pmtilesClusterer
+		if p.unordered {
+			moved, move, err := p.spill.clusterIndex()
+			if err != nil {
+				return fmt.Errorf("error creating pmtiles offset index: %w", err)
+			}
+			if clusterer, err = newPmtilesClusterer(p.tileData, moved, move); err != nil {
+				return err
+			}
+		}
 
-	// Step 3: pack the directory into root + optional leaf pages. The root must
-	// fit in 16384 - HeaderV3LenBytes bytes so it can be fetched together with
-	// the header in one HTTP range request.
-	rootBytes, leavesBytes, numLeaves := optimizeDirectories(p.entries, 16384-pmtiles.HeaderV3LenBytes, pmtiles.Gzip)
-
-	if numLeaves > 0 {
-		p.logger.Printf("Root dir bytes: %d", len(rootBytes))
-		p.logger.Printf("Leaves dir bytes: %d", len(leavesBytes))
-		p.logger.Printf("Num leaf dirs: %d", numLeaves)
-		p.logger.Printf("Total dir bytes: %d", len(rootBytes)+len(leavesBytes))
-		p.logger.Printf("Average leaf dir bytes: %d", len(leavesBytes)/numLeaves)
+		var err error
+		dirs, err = p.spill.buildDirectories(p.entries, 16384-pmtiles.HeaderV3LenBytes, pmtiles.Gzip, clusterer.clusterFunc())
+		if err == nil && clusterer != nil {
+			err = p.finishClustering(clusterer)
+		}
+		if err != nil {
+			return fmt.Errorf("error building pmtiles directories: %w", err)
+		}
+		p.entries = nil
+		p.logger.Printf("Writing %d tiles to pmtiles", dirs.addressed)
+		p.header.TileContentsCount = p.spill.contents
+	} else {
+		var err error
+		dirs, err = p.buildDirectories()
+		if err != nil {
+			return fmt.Errorf("error building pmtiles directories: %w", err)
+		}
+		p.header.TileContentsCount = uint64(len(p.offsetMap))
+	}
+
+	p.header.AddressedTilesCount = dirs.addressed
+	p.header.TileEntriesCount = dirs.entries
+
+	if dirs.numLeaves > 0 {
+		p.logger.Printf("Root dir bytes: %d", len(dirs.root))
+		p.logger.Printf("Leaves dir bytes: %d", dirs.leavesLength)
+		p.logger.Printf("Num leaf dirs: %d", dirs.numLeaves)
+		p.logger.Printf("Total dir bytes: %d", uint64(len(dirs.root))+dirs.leavesLength)
+		p.logger.Printf("Average leaf dir bytes: %d", dirs.leavesLength/uint64(dirs.numLeaves))
 		p.logger.Printf("Average bytes per addressed tile: %.2f",
-			float64(len(rootBytes)+len(leavesBytes))/float64(p.tileset.GetCardinality()))
+			float64(uint64(len(dirs.root))+dirs.leavesLength)/float64(dirs.addressed))
 	} else {
-		p.logger.Printf("Total dir bytes: %d", len(rootBytes))
-		if p.tileset.GetCardinality() > 0 {
+		p.logger.Printf("Total dir bytes: %d", len(dirs.root))
+		if dirs.addressed > 0 {
 			p.logger.Printf("Average bytes per addressed tile: %.2f",
-				float64(len(rootBytes))/float64(p.tileset.GetCardinality()))
+				float64(len(dirs.root))/float64(dirs.addressed))
 		}
 	}
 
-	// Step 4: derive center and zoom range.
+	// Step 5: fill the header from the metadata.
 	//
-	// When AssignSpatialMetadata was called, the caller has supplied explicit
-	// zoom and bounds — use them verbatim and derive center from the midpoint.
-	// When it was not called, infer MinZoom/MaxZoom from the actual tile data
-	// (matching the reference setZoomCenterDefaults behavior) so that readers
-	// see an accurate zoom range even without explicit metadata.
-	if p.centerSet {
-		p.header.CenterZoom = p.header.MinZoom
-		// Compute midpoint in int64 to avoid int32 overflow for western/southern
-		// hemispheres where two large-magnitude negative E7 values sum below -2^31.
-		p.header.CenterLonE7 = int32((int64(p.header.MinLonE7) + int64(p.header.MaxLonE7)) / 2)
-		p.header.CenterLatE7 = int32((int64(p.header.MinLatE7) + int64(p.header.MaxLatE7)) / 2)
-	} else if len(p.entries) > 0 {
-		minZ, _, _ := pmtiles.IDToZxy(p.entries[0].TileID)
-		maxZ, _, _ := pmtiles.IDToZxy(p.entries[len(p.entries)-1].TileID)
+	// The zoom range is first inferred from the actual tile data (matching the
+	// reference setZoomCenterDefaults behavior), so that readers see an
+	// accurate zoom range even without explicit metadata. The spatial keys of
+	// the metadata, then those given to AssignSpatialMetadata, override it.
+	if dirs.addressed > 0 {
+		minZ, _, _ := pmtiles.IDToZxy(dirs.firstID)
+		maxZ, _, _ := pmtiles.IDToZxy(dirs.lastID)
 		p.header.MinZoom = minZ
 		p.header.MaxZoom = maxZ
 	}
+	if err := p.metadata.ApplyToPmtilesHeader(&p.header); err != nil {
+		return fmt.Errorf("error applying metadata to pmtiles header: %w", err)
+	}
+	if p.spatial != nil {
+		if err := p.spatial.ApplyToPmtilesHeader(&p.header); err != nil {
+			return err
+		}
+	}
 
 	// Build JSON metadata from the MbtilesMetadata fields. The PMTiles spec does
 	// not prescribe a schema for the JSON blob; we mirror the keys used by the
@@ -221,44 +382,31 @@ func (p *pmtilesOutputter) Close() error {
 		return fmt.Errorf("error serializing pmtiles metadata: %w", err)
 	}
 
-	// Step 5: assemble the final file layout.
+	// Step 6: assemble the final file layout.
 	// The spec mandates this exact section order so readers can fetch the header
 	// and root directory in a single range request ([0, 16384)).
 	p.header.SpecVersion = 3
-	p.header.Clustered = true // entries are sorted by tile ID (Step 1)
+	p.header.Clustered = true // tile data is in tile ID order (Step 3)
 	p.header.InternalCompression = pmtiles.Gzip
 	p.header.RootOffset = pmtiles.HeaderV3LenBytes
-	p.header.RootLength = uint64(len(rootBytes))
+	p.header.RootLength = uint64(len(dirs.root))
 	p.header.MetadataOffset = p.header.RootOffset + p.header.RootLength
 	p.header.MetadataLength = uint64(len(metadataBytes))
 	p.header.LeafDirectoryOffset = p.header.MetadataOffset + p.header.MetadataLength
-	p.header.LeafDirectoryLength = uint64(len(leavesBytes))
+	p.header.LeafDirectoryLength = dirs.leavesLength
 	p.header.TileDataOffset = p.header.LeafDirectoryOffset + p.header.LeafDirectoryLength
 	p.header.TileDataLength = p.dataOffset
 
-	// Remove the temp file once we have finished copying its contents; it is
-	// not needed after Close returns.
-	defer func() {
-		name := p.tileData.Name()
-		p.tileData.Close()
-		os.Remove(name)
-	}()
-
-	// Ensure the output file is always closed even on early error returns.
-	// The explicit Close at the end of the happy path captures any flush error;
-	// this defer is a safety net for the error paths.
-	defer p.outFile.Close()
-
 	if _, err = p.outFile.Write(pmtiles.SerializeHeader(p.header)); err != nil {
 		return fmt.Errorf("error writing pmtiles header: %w", err)
 	}
-	if _, err = p.outFile.Write(rootBytes); err != nil {
+	if _, err = p.outFile.Write(dirs.root); err != nil {
 		return fmt.Errorf("error writing pmtiles root directory: %w", err)
 	}
 	if _, err = p.outFile.Write(metadataBytes); err != nil {
 		return fmt.Errorf("error writing pmtiles metadata: %w", err)
 	}
-	if _, err = p.outFile.Write(leavesBytes); err != nil {
+	if _, err = io.Copy(p.outFile, dirs.leaves); err != nil {
 		return fmt.Errorf("error writing pmtiles leaf directories: %w", err)
 	}
 	if _, err = p.tileData.Seek(0, io.SeekStart); err != nil {
@@ -269,26 +417,161 @@ func (p *pmtilesOutputter) Close() error {
 	}
 
 	// Flush and close the output file explicitly so we can return any error.
-	// The deferred Close is still registered but will be a no-op on a closed file.
+	committed = true
 	if err = p.outFile.Close(); err != nil {
 		return fmt.Errorf("error closing output file: %w", err)
 	}
 	return nil
 }
 
+// buildDirectories performs steps 1-4 of Close on the entries in memory.
+func (p *pmtilesOutputter) buildDirectories() (*pmtilesDirectoryResult, error) {
+	// Step 1: sort by Hilbert tile ID so the directory is bsearch-able and the
+	// archive qualifies as "clustered" per the PMTiles v3 spec.
+	sort.Slice(p.entries, func(i, j int) bool {
+		return p.entries[i].TileID < p.entries[j].TileID
+	})
+
+	dirs := &pmtilesDirectoryResult{addressed: p.tileset.GetCardinality()}
+	if len(p.entries) > 0 {
+		dirs.firstID = p.entries[0].TileID
+		dirs.lastID = p.entries[len(p.entries)-1].TileID
+	}
+	p.logger.Printf("Writing %d tiles to pmtiles", dirs.addressed)
+
+	// Step 2: run-length encode consecutive entries that point to the same tile
+	// content blob (identical offset). After sorting, such runs are adjacent.
+	// A single entry with RunLength=N replaces N individual entries, shrinking
+	// the directory significantly for sparse or uniform tilesets.
+	p.entries = runLengthEncodeEntries(p.entries)
+	dirs.entries = uint64(len(p.entries))
+
+	// Step 3: copy the tile data in entry order. Contents keep the offset
+	// they were first copied to, so later entries sharing them point back.
+	if p.unordered {
+		offsets := make(map[uint64]uint64, len(p.offsetMap))
+		clusterer, err := newPmtilesClusterer(p.tileData,
+			func(old uint64) (uint64, bool, error) {
+				offset, ok := offsets[old]
+				return offset, ok, nil
+			},
+			func(old uint64, new uint64) error {
+				offsets[old] = new
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		for i := range p.entries {
+			if err := clusterer.cluster(&p.entries[i]); err != nil {
+				clusterer.abort()
+				return nil, err
+			}
+		}
+		if err := p.finishClustering(clusterer); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 4: pack the directory into root + optional leaf pages. The root must
+	// fit in 16384 - HeaderV3LenBytes bytes so it can be fetched together with
+	// the header in one HTTP range request.
+	root, leaves, numLeaves := optimizeDirectories(p.entries, 16384-pmtiles.HeaderV3LenBytes, pmtiles.Gzip)
+	dirs.root, dirs.leaves, dirs.leavesLength, dirs.numLeaves = root, bytes.NewReader(leaves), uint64(len(leaves)), numLeaves
+	return dirs, nil
+}
+
+// pmtilesClusterer copies tile contents from the temporary tile data file to
+// a new one in the order of the entries it is given.
+type pmtilesClusterer struct {
+	src    *os.File
+	dst    *os.File
+	w      *bufio.Writer
+	offset uint64
+	buf    []byte
+	// moved returns the new offset of the content at an old offset, if it
+	// was copied already, and move records it.
+	moved func(old uint64) (uint64, bool, error)
+	move  func(old uint64, new uint64) error
+}
+
+func newPmtilesClusterer(src *os.File, moved func(uint64) (uint64, bool, error), move func(uint64, uint64) error) (*pmtilesClusterer, error) {
+	dst, err := os.CreateTemp("", "pmtiles-tiledata-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %w", err)
+	}
+	return &pmtilesClusterer{src: src, dst: dst, w: bufio.NewWriter(dst), moved: moved, move: move}, nil
+}
+
+// cluster points entry at its content in the new tile data file, copying the
+// content there first if no earlier entry did.
+func (c *pmtilesClusterer) cluster(entry *pmtiles.EntryV3) error {
+	offset, ok, err := c.moved(entry.Offset)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if cap(c.buf) < int(entry.Length) {
+			c.buf = make([]byte, entry.Length)
+		}
+		data := c.buf[:entry.Length]
+		if _, err := c.src.ReadAt(data, int64(entry.Offset)); err != nil {
+			return fmt.Errorf("error reading tile data at offset %d: %w", entry.Offset, err)
+		}
+		if _, err := c.w.Write(data); err != nil {
+			return fmt.Errorf("error writing clustered tile data: %w", err)
+		}
+		offset = c.offset
+		c.offset += uint64(entry.Length)
+		if err := c.move(entry.Offset, offset); err != nil {
+			return err
+		}
+	}
+	entry.Offset = offset
+	return nil
+}
+
+// clusterFunc returns c.cluster, or nil when c is nil.
+func (c *pmtilesClusterer) clusterFunc() func(*pmtiles.EntryV3) error {
+	if c == nil {
+		return nil
+	}
+	return c.cluster
+}
+
+// abort removes the new tile data file.
+func (c *pmtilesClusterer) abort() {
+	c.dst.Close()
+	os.Remove(c.dst.Name())
+}
+
+// finishClustering replaces the tile data with the clustered copy.
+func (p *pmtilesOutputter) finishClustering(c *pmtilesClusterer) error {
+	if err := c.w.Flush(); err != nil {
+		c.abort()
+		return fmt.Errorf("error writing clustered tile data: %w", err)
+	}
+	// Every content is referenced by an entry, so all of it was copied.
+	if c.offset != p.dataOffset {
+		c.abort()
+		return fmt.Errorf("clustered tile data is %d bytes, want %d", c.offset, p.dataOffset)
+	}
+
+	name := p.tileData.Name()
+	p.tileData.Close()
+	os.Remove(name)
+	p.tileData = c.dst
+	return nil
+}
+
 // buildJSONMetadata converts the MbtilesMetadata key/value pairs into the
 // map[string]interface{} that pmtiles.SerializeMetadata expects. Keys known to
 // the PMTiles ecosystem (name, description, attribution, format, version) are
 // passed through directly; unknown keys are included as-is so callers can embed
-// custom fields.
+// custom fields. The members of the json key, such as vector_layers, are
+// moved to the top level.
 func (p *pmtilesOutputter) buildJSONMetadata() map[string]interface{} {
-	meta := make(map[string]interface{})
-	for _, key := range p.metadata.Keys() {
-		if v, ok := p.metadata.Get(key); ok {
-			meta[key] = v
-		}
-	}
-	return meta
+	return p.metadata.PmtilesJSON()
 }
 
 // runLengthEncodeEntries collapses runs of consecutive entries whose tile IDs
@@ -328,6 +611,10 @@ func runLengthEncodeEntries(entries []pmtiles.EntryV3) []pmtiles.EntryV3 {
 	return out
 }
 
+// maxRootTileEntries is the most tile entries a root directory that also
+// points to leaf directories holds.
+const maxRootTileEntries = 16384
+
 // optimizeDirectories decides whether all entries fit in a single root page or
 // require a two-level (root + leaf) layout.
 //
@@ -336,12 +623,13 @@ func runLengthEncodeEntries(entries []pmtiles.EntryV3) []pmtiles.EntryV3 {
 // range request. targetRootLen is that budget minus the header size.
 //
 // Case 1: all entries serialise to ≤ targetRootLen → root-only, no leaves.
-// Case 3: entries are split into equally-sized leaf pages; the root holds only
-//
-//	leaf-directory pointers. Leaf page size grows by 20 % each iteration
-//	until the root fits within the budget.
+// Case 2: the root mixes tile entries and leaf-directory pointers. The first
 //
-// (Case 2 — mixed tile entries and leaf pointers — is not yet implemented.)
+//	entries, which are the lowest zooms and the most requested tiles, go
+//	in the root while they take at most half of targetRootLen, so they
+//	can be read without fetching a leaf. The remaining entries are split
+//	into equally-sized leaf pages whose size grows by 20 % each
+//	iteration until the root fits within the budget.
 func optimizeDirectories(entries []pmtiles.EntryV3, targetRootLen int, compression pmtiles.Compression) ([]byte, []byte, int) {
 	// Case 1: attempt to fit everything into the root. Try regardless of entry
 	// count — after RLE a large addressed-tile set may compress to well under the
@@ -352,14 +640,15 @@ func optimizeDirectories(entries []pmtiles.EntryV3, targetRootLen int, compressi
 		return testRootBytes, make([]byte, 0), 0
 	}
 
-	// Case 3: root contains only leaf-directory pointers.
-	leafSize := float32(len(entries)) / 3500
+	// Case 2: root contains tile entries followed by leaf-directory pointers.
+	prefix := rootPrefixLen(entries, targetRootLen/2, compression)
+	leafSize := float32(len(entries)-prefix) / 3500
 	if leafSize < 4096 {
 		leafSize = 4096
 	}
 
 	for {
-		rootBytes, leavesBytes, numLeaves := buildRootsLeaves(entries, int(leafSize), compression)
+		rootBytes, leavesBytes, numLeaves := buildRootsLeaves(entries[:prefix], entries[prefix:], int(leafSize), compression)
 		if len(rootBytes) <= targetRootLen {
 			return rootBytes, leavesBytes, numLeaves
 		}
@@ -367,14 +656,25 @@ func optimizeDirectories(entries []pmtiles.EntryV3, targetRootLen int, compressi
 	}
 }
 
+// rootPrefixLen returns the number of leading entries, up to
+// maxRootTileEntries, that serialise to at most limit bytes.
+func rootPrefixLen(entries []pmtiles.EntryV3, limit int, compression pmtiles.Compression) int {
+	n := min(len(entries), maxRootTileEntries)
+	return sort.Search(n+1, func(k int) bool {
+		return len(pmtiles.SerializeEntries(entries[:k], compression)) > limit
+	}) - 1
+}
+
 // buildRootsLeaves partitions entries into leaf pages of leafSize entries each
-// and builds a root directory whose entries point to those leaf pages.
+// and builds a root directory holding the prefix tile entries followed by
+// entries that point to those leaf pages.
 //
-// Each root entry has RunLength=0, which signals to readers that the entry is a
-// leaf-directory pointer rather than a tile-data pointer.
-func buildRootsLeaves(entries []pmtiles.EntryV3, leafSize int, compression pmtiles.Compression) ([]byte, []byte, int) {
+// Each pointer entry has RunLength=0, which signals to readers that the entry
+// is a leaf-directory pointer rather than a tile-data pointer.
+func buildRootsLeaves(prefix []pmtiles.EntryV3, entries []pmtiles.EntryV3, leafSize int, compression pmtiles.Compression) ([]byte, []byte, int) {
 	estLeaves := (len(entries) + leafSize - 1) / leafSize
-	rootEntries := make([]pmtiles.EntryV3, 0, estLeaves)
+	rootEntries := make([]pmtiles.EntryV3, 0, len(prefix)+estLeaves)
+	rootEntries = append(rootEntries, prefix...)
 	leavesBytes := make([]byte, 0)
 	numLeaves := 0
 
@@ -400,11 +700,32 @@ func buildRootsLeaves(entries []pmtiles.EntryV3, leafSize int, compression pmtil
 	return rootBytes, leavesBytes, numLeaves
 }
 
-// NewPmtilesOutputter creates a new pmtiles outputter that writes to dsn.
+// SetTileCompression sets the compression tiles are stored with, which
+// defaults to gzip for vector tiles and none for raster tiles. It must be
+// called before the first Save.
+func (p *pmtilesOutputter) SetTileCompression(compression pmtiles.Compression) error {
+	if p.dataOffset > 0 {
+		return fmt.Errorf("tile compression must be set before the first tile is saved")
+	}
+	if _, err := ParseTileCompression(tileCompressionName(compression)); err != nil {
+		return err
+	}
+	p.header.TileCompression = compression
+	return nil
+}
+
+// NewPmtilesOutputter creates a new pmtiles outputter that writes to dsn,
+// which is a local path or an object storage URL such as
+// s3://bucket/planet.pmtiles. An archive in a bucket is uploaded in parts as
+// Close writes it, and only appears once Close succeeds.
+//
+// outputType controls the tile type stored in the header:
+//   - "mvt" or its MBTiles name "pbf": vector tiles (TileType=Mvt)
+//   - "mlt": MapLibre vector tiles (TileType=6)
+//   - "png", "jpg" or "jpeg", "webp", "avif": raster tiles
 //
-// outputType controls the tile type and compression stored in the header:
-//   - "mvt": vector tiles (TileType=Mvt, TileCompression=Gzip)
-//   - "png": PNG raster tiles (TileType=Png, TileCompression=NoCompression)
+// Vector tiles are stored gzip-compressed and raster tiles uncompressed,
+// unless SetTileCompression says otherwise.
 //
 // metadata is written into the archive's JSON metadata section on Close.
 func NewPmtilesOutputter(dsn string, outputType string, metadata *MbtilesMetadata) (*pmtilesOutputter, error) {
@@ -413,48 +734,33 @@ func NewPmtilesOutputter(dsn string, outputType string, metadata *MbtilesMetadat
 		return nil, fmt.Errorf("error creating temp file: %w", err)
 	}
 
-	outFile, err := os.Create(dsn)
+	outFile, err := createArchiveFile(dsn, "application/vnd.pmtiles")
 	if err != nil {
 		tmpFile.Close()
 		os.Remove(tmpFile.Name())
 		return nil, fmt.Errorf("error creating pmtiles output file: %w", err)
 	}
 
-	compressBuf := &bytes.Buffer{}
-	compressor, err := gzip.NewWriterLevel(compressBuf, gzip.BestCompression)
-	if err != nil {
+	tileType, ok := pmtilesTileType(outputType)
+	if !ok {
 		tmpFile.Close()
 		os.Remove(tmpFile.Name())
-		outFile.Close()
-		return nil, fmt.Errorf("error creating gzip compressor: %w", err)
+		outFile.Abort()
+		return nil, fmt.Errorf("unsupported outputType %q: must be one of mvt, pbf, mlt, png, jpg, jpeg, webp or avif", outputType)
 	}
 
 	outputter := &pmtilesOutputter{
-		outFile:        outFile,
-		tileset:        roaring64.New(),
-		hashFunc:       fnv.New128a(),
-		tileData:       tmpFile,
-		offsetMap:      make(map[[16]byte]offsetLen),
-		entries:        make([]pmtiles.EntryV3, 0),
-		header:         pmtiles.HeaderV3{},
-		compressBuffer: compressBuf,
-		compressor:     compressor,
-		metadata:       metadata,
-		logger:         log.New(os.Stderr, "pmtiles: ", 0),
-	}
-
-	switch outputType {
-	case "mvt":
-		outputter.header.TileType = pmtiles.Mvt
+		outFile:   outFile,
+		tileset:   roaring64.New(),
+		tileData:  tmpFile,
+		offsetMap: make(map[ContentHash]offsetLen),
+		entries:   make([]pmtiles.EntryV3, 0),
+		header:    pmtiles.HeaderV3{TileType: tileType, TileCompression: pmtiles.NoCompression},
+		metadata:  metadata,
+		logger:    log.New(os.Stderr, "pmtiles: ", 0),
+	}
+	if tileType == pmtiles.Mvt || tileType == pmtilesMlt {
 		outputter.header.TileCompression = pmtiles.Gzip
-	case "png":
-		outputter.header.TileType = pmtiles.Png
-		outputter.header.TileCompression = pmtiles.NoCompression
-	default:
-		tmpFile.Close()
-		os.Remove(tmpFile.Name())
-		outFile.Close()
-		return nil, fmt.Errorf("unsupported outputType %q: must be \"mvt\" or \"png\"", outputType)
 	}
 
 	return outputter, nil
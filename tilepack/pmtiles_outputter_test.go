@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
@@ -88,20 +89,25 @@ func TestPmtilesOutputter_CreateTiles_IsNoop(t *testing.T) {
 func TestPmtilesOutputter_AssignSpatialMetadata(t *testing.T) {
 	// AssignSpatialMetadata must store min/max zoom and bounding box in the header
 	// in units of 1e-7 degrees (as required by the pmtiles spec).
-	o, _ := newTestPmtilesOutputter(t, "mvt")
+	o, path := newTestPmtilesOutputter(t, "mvt")
 	bounds := orb.Bound{Min: orb.Point{-180.0, -85.0}, Max: orb.Point{180.0, 85.0}}
 	if err := o.AssignSpatialMetadata(bounds, 0, 14); err != nil {
 		t.Fatalf("AssignSpatialMetadata: %v", err)
 	}
+	o.Save(maptile.New(0, 0, 0), []byte("d"))
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
 
-	if o.header.MinZoom != 0 || o.header.MaxZoom != 14 {
-		t.Errorf("zoom range: got %d-%d, want 0-14", o.header.MinZoom, o.header.MaxZoom)
+	header, _, _ := readPmtilesFile(t, path)
+	if header.MinZoom != 0 || header.MaxZoom != 14 {
+		t.Errorf("zoom range: got %d-%d, want 0-14", header.MinZoom, header.MaxZoom)
 	}
-	if o.header.MinLonE7 != int32(-180.0*1e7) {
-		t.Errorf("MinLonE7: got %d, want %d", o.header.MinLonE7, int32(-180.0*1e7))
+	if header.MinLonE7 != int32(-180.0*1e7) {
+		t.Errorf("MinLonE7: got %d, want %d", header.MinLonE7, int32(-180.0*1e7))
 	}
-	if o.header.MaxLatE7 != int32(85.0*1e7) {
-		t.Errorf("MaxLatE7: got %d, want %d", o.header.MaxLatE7, int32(85.0*1e7))
+	if header.MaxLatE7 != int32(85.0*1e7) {
+		t.Errorf("MaxLatE7: got %d, want %d", header.MaxLatE7, int32(85.0*1e7))
 	}
 }
 
@@ -117,6 +123,76 @@ func TestPmtilesOutputter_TileTypeHeader_MVT(t *testing.T) {
 	}
 }
 
+func TestPmtilesOutputter_TileTypeHeader_Aliases(t *testing.T) {
+	for outputType, want := range map[string]struct {
+		tileType    pmtiles.TileType
+		compression pmtiles.Compression
+	}{
+		"pbf":  {pmtiles.Mvt, pmtiles.Gzip},
+		"mlt":  {pmtilesMlt, pmtiles.Gzip},
+		"jpg":  {pmtiles.Jpeg, pmtiles.NoCompression},
+		"jpeg": {pmtiles.Jpeg, pmtiles.NoCompression},
+		"webp": {pmtiles.Webp, pmtiles.NoCompression},
+		"avif": {pmtiles.Avif, pmtiles.NoCompression},
+	} {
+		o, _ := newTestPmtilesOutputter(t, outputType)
+		if o.header.TileType != want.tileType || o.header.TileCompression != want.compression {
+			t.Errorf("%s: TileType=%d TileCompression=%d, want %d and %d",
+				outputType, o.header.TileType, o.header.TileCompression, want.tileType, want.compression)
+		}
+		o.Close()
+	}
+}
+
+func TestPmtilesOutputter_SetTileCompression_Transcodes(t *testing.T) {
+	// Tiles arriving gzipped, zstd-compressed or uncompressed must all be
+	// stored with the archive's compression.
+	mvt := []byte{0x1a, 0x02, 0x78, 0x01}
+	var compressor tileCompressor
+	inputs := [][]byte{mvt}
+	for _, c := range []pmtiles.Compression{pmtiles.Gzip, pmtiles.Zstd} {
+		compressed, err := compressor.compress(mvt, c)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+		inputs = append(inputs, append([]byte{}, compressed...))
+	}
+
+	for _, c := range []pmtiles.Compression{pmtiles.NoCompression, pmtiles.Gzip, pmtiles.Brotli, pmtiles.Zstd} {
+		o, path := newTestPmtilesOutputter(t, "pbf")
+		if err := o.SetTileCompression(c); err != nil {
+			t.Fatalf("SetTileCompression: %v", err)
+		}
+		for i, data := range inputs {
+			if err := o.Save(maptile.New(uint32(i), 0, 2), data); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		if err := o.SetTileCompression(pmtiles.Gzip); err == nil {
+			t.Errorf("expected an error setting the compression after Save")
+		}
+		if err := o.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		header, _, readTile := readPmtilesFile(t, path)
+		if header.TileCompression != c {
+			t.Errorf("TileCompression = %d, want %d", header.TileCompression, c)
+		}
+		// The same tile in any compression is stored once.
+		if header.TileContentsCount != 1 {
+			t.Errorf("%s: TileContentsCount = %d, want 1", tileCompressionName(c), header.TileContentsCount)
+		}
+		stored := readTile(pmtiles.ZxyToID(2, 1, 0))
+		if detected := detectTileCompression(stored, pmtiles.Mvt); detected != c {
+			t.Errorf("stored tile compression = %s, want %s", tileCompressionName(detected), tileCompressionName(c))
+		}
+		if decoded, err := decompressTile(stored, c); err != nil || !bytes.Equal(decoded, mvt) {
+			t.Errorf("%s: stored tile decodes to %x, %v", tileCompressionName(c), decoded, err)
+		}
+	}
+}
+
 func TestPmtilesOutputter_TileTypeHeader_PNG(t *testing.T) {
 	// When outputType is "png", the header must declare TileType=Png and
 	// TileCompression=NoCompression (raster tiles are not gzip-compressed).
@@ -395,6 +471,89 @@ func TestPmtilesOutputter_Close_ClusteredFlagSet(t *testing.T) {
 	}
 }
 
+func TestPmtilesOutputter_Close_ClustersOutOfOrderTiles(t *testing.T) {
+	// Tiles saved in reverse tile ID order must have their data rewritten in
+	// tile ID order, with repeated content pointing back to its first copy.
+	o, path := newTestPmtilesOutputter(t, "png")
+	tiles := []maptile.Tile{maptile.New(1, 1, 1), maptile.New(0, 1, 1), maptile.New(1, 0, 1), maptile.New(0, 0, 1), maptile.New(0, 0, 0)}
+	content := map[maptile.Tile]string{}
+	for i, tile := range tiles {
+		content[tile] = string(rune('a' + i%3))
+		if err := o.Save(tile, []byte(content[tile])); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	header, entries, readTile := readPmtilesFile(t, path)
+	if !header.Clustered {
+		t.Error("expected Clustered=true in header")
+	}
+
+	var dataEnd uint64
+	seen := map[uint64]bool{}
+	for _, e := range entries {
+		if !seen[e.Offset] {
+			if e.Offset != dataEnd {
+				t.Errorf("tile ID %d: new content at offset %d, want %d", e.TileID, e.Offset, dataEnd)
+			}
+			seen[e.Offset] = true
+			dataEnd = e.Offset + uint64(e.Length)
+		}
+	}
+	for tile, want := range content {
+		if got := readTile(pmtiles.ZxyToID(uint8(tile.Z), tile.X, tile.Y)); string(got) != want {
+			t.Errorf("tile %v = %q, want %q", tile, got, want)
+		}
+	}
+}
+
+func TestOptimizeDirectories_MixedRoot(t *testing.T) {
+	// Irregular lengths keep the entries from compressing into the root.
+	random := rand.New(rand.NewSource(1))
+	entries := make([]pmtiles.EntryV3, 100000)
+	var offset uint64
+	for i := range entries {
+		length := uint32(random.Intn(200) + 1)
+		entries[i] = pmtiles.EntryV3{TileID: uint64(i), Offset: offset, Length: length, RunLength: 1}
+		offset += uint64(length)
+	}
+
+	targetRootLen := 16384 - pmtiles.HeaderV3LenBytes
+	rootBytes, leavesBytes, numLeaves := optimizeDirectories(entries, targetRootLen, pmtiles.Gzip)
+	if len(rootBytes) > targetRootLen {
+		t.Errorf("root is %d bytes, want at most %d", len(rootBytes), targetRootLen)
+	}
+	if numLeaves == 0 || len(leavesBytes) == 0 {
+		t.Fatal("expected leaf directories")
+	}
+
+	root := pmtiles.DeserializeEntries(bytes.NewBuffer(rootBytes), pmtiles.Gzip)
+	tileEntries := 0
+	for tileEntries < len(root) && root[tileEntries].RunLength > 0 {
+		if root[tileEntries] != entries[tileEntries] {
+			t.Fatalf("root entry %d = %+v, want %+v", tileEntries, root[tileEntries], entries[tileEntries])
+		}
+		tileEntries++
+	}
+	if tileEntries == 0 {
+		t.Error("expected tile entries in the root")
+	}
+	if len(root)-tileEntries != numLeaves {
+		t.Errorf("root has %d leaf pointers, want %d", len(root)-tileEntries, numLeaves)
+	}
+	for _, e := range root[tileEntries:] {
+		if e.RunLength != 0 {
+			t.Fatalf("tile entry %+v after the leaf pointers", e)
+		}
+	}
+	if root[tileEntries].TileID != uint64(tileEntries) {
+		t.Errorf("first leaf starts at tile ID %d, want %d", root[tileEntries].TileID, tileEntries)
+	}
+}
+
 func TestPmtilesOutputter_Close_RunLengthEncoding(t *testing.T) {
 	// Consecutive tiles with identical content and contiguous Hilbert IDs must
 	// be collapsed into a single directory entry with RunLength > 1.  This
@@ -583,7 +742,7 @@ func TestNewPmtilesOutputter_CleansUpTempFileOnOutputError(t *testing.T) {
 func TestPmtilesOutputter_Close_NoSpatialMetadata(t *testing.T) {
 	// If AssignSpatialMetadata is never called, Close must still produce a valid
 	// archive. Spatial bounds remain zero. MinZoom/MaxZoom are inferred from the
-	// actual tile data. Center fields remain zero (centerSet is false).
+	// actual tile data. Center fields remain zero.
 	o, path := newTestPmtilesOutputter(t, "mvt")
 	o.CreateTiles()
 	o.Save(maptile.New(0, 0, 0), []byte("d"))
@@ -682,9 +841,9 @@ func TestNewPmtilesOutputter_UnknownOutputType(t *testing.T) {
 	// than silently producing an archive with TileType=0 (UnknownTileType), which
 	// would be rejected or misidentified by pmtiles readers.
 	path := filepath.Join(t.TempDir(), "test.pmtiles")
-	_, err := NewPmtilesOutputter(path, "jpeg", NewMbtilesMetadata(map[string]string{}))
+	_, err := NewPmtilesOutputter(path, "tiff", NewMbtilesMetadata(map[string]string{}))
 	if err == nil {
-		t.Fatal("expected error for unknown outputType \"jpeg\", got nil")
+		t.Fatal("expected error for unknown outputType \"tiff\", got nil")
 	}
 }
 
@@ -751,3 +910,44 @@ func TestPmtilesOutputter_Close_AssignSpatialMetadataZoomTakesPrecedence(t *test
 }
 
 
+
+func TestPmtilesOutputter_PrepareTile_SkipsStoredContent(t *testing.T) {
+	// Content already in the archive must not be compressed again.
+	o, path := newTestPmtilesOutputter(t, "mvt")
+	hasher := o.ContentHasher()
+	if err := o.Save(maptile.New(0, 0, 0), []byte("ocean")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data := []byte("ocean")
+	prepared, err := o.PrepareTile(maptile.New(0, 0, 1), data, hasher.Sum(data))
+	if err != nil {
+		t.Fatalf("PrepareTile: %v", err)
+	}
+	if &prepared.data[0] != &data[0] {
+		t.Error("stored content should be passed through untranscoded")
+	}
+	if err := o.SavePrepared(prepared); err != nil {
+		t.Fatalf("SavePrepared: %v", err)
+	}
+
+	land := []byte("land")
+	prepared, err = o.PrepareTile(maptile.New(1, 0, 1), land, hasher.Sum(land))
+	if err != nil {
+		t.Fatalf("PrepareTile: %v", err)
+	}
+	if bytes.Equal(prepared.data, land) {
+		t.Error("new content should be gzipped")
+	}
+	if err := o.SavePrepared(prepared); err != nil {
+		t.Fatalf("SavePrepared: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	header, _, _ := readPmtilesFile(t, path)
+	if header.AddressedTilesCount != 3 || header.TileContentsCount != 2 {
+		t.Errorf("addressed %d tiles with %d contents, want 3 with 2", header.AddressedTilesCount, header.TileContentsCount)
+	}
+}
@@ -0,0 +1,376 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// pmtilesFormats maps PMTiles tile types to MBTiles format names.
+var pmtilesFormats = map[pmtiles.TileType]string{
+	pmtiles.Mvt:  "pbf",
+	pmtiles.Png:  "png",
+	pmtiles.Jpeg: "jpg",
+	pmtiles.Webp: "webp",
+	pmtiles.Avif: "avif",
+	pmtilesMlt:   "mlt",
+}
+
+// NewPmtilesReader opens a local PMTiles v3 archive. Tiles are returned as
+// stored, without undoing the archive's tile compression.
+func NewPmtilesReader(path string) (*pmtilesReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	headerBytes := make([]byte, pmtiles.HeaderV3LenBytes)
+	if _, err := f.ReadAt(headerBytes, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading pmtiles header: %w", err)
+	}
+
+	header, err := pmtiles.DeserializeHeader(headerBytes)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error parsing pmtiles header: %w", err)
+	}
+
+	return &pmtilesReader{file: f, header: header}, nil
+}
+
+type pmtilesReader struct {
+	file   *os.File
+	header pmtiles.HeaderV3
+}
+
+// Header returns the archive's header.
+func (r *pmtilesReader) Header() pmtiles.HeaderV3 {
+	return r.header
+}
+
+func (r *pmtilesReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *pmtilesReader) readAt(offset uint64, length uint64) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := r.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readDirectory reads the root directory, or the leaf directory at offset in
+// the leaf section when leaf is true.
+func (r *pmtilesReader) readDirectory(offset uint64, length uint64, leaf bool) ([]pmtiles.EntryV3, error) {
+	if leaf {
+		offset += r.header.LeafDirectoryOffset
+	}
+
+	data, err := r.readAt(offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pmtiles directory at %d: %w", offset, err)
+	}
+
+	entries, err := decodePmtilesDirectory(data, r.header.InternalCompression)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pmtiles directory at %d: %w", offset, err)
+	}
+	return entries, nil
+}
+
+// decodePmtilesDirectory decodes a serialized directory. Unlike
+// pmtiles.DeserializeEntries it reports corrupt input as an error instead of
+// panicking or returning garbage.
+func decodePmtilesDirectory(data []byte, compression pmtiles.Compression) ([]pmtiles.EntryV3, error) {
+	switch compression {
+	case pmtiles.NoCompression:
+	case pmtiles.Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported directory compression %d", compression)
+	}
+
+	buf := bytes.NewReader(data)
+	readUvarint := func() (uint64, error) {
+		return binary.ReadUvarint(buf)
+	}
+
+	numEntries, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	// Every entry takes at least one byte for each of its four fields.
+	if numEntries > uint64(buf.Len())/4 {
+		return nil, fmt.Errorf("directory claims %d entries in %d bytes", numEntries, buf.Len())
+	}
+
+	entries := make([]pmtiles.EntryV3, numEntries)
+
+	lastID := uint64(0)
+	for i := range entries {
+		delta, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		lastID += delta
+		entries[i].TileID = lastID
+	}
+
+	for i := range entries {
+		runLength, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(runLength)
+	}
+
+	for i := range entries {
+		length, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(length)
+	}
+
+	for i := range entries {
+		offset, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && offset == 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else if offset == 0 {
+			return nil, fmt.Errorf("first entry has no offset")
+		} else {
+			entries[i].Offset = offset - 1
+		}
+	}
+
+	return entries, nil
+}
+
+func (r *pmtilesReader) GetTile(tile maptile.Tile) ([]byte, error) {
+	id := pmtiles.ZxyToID(uint8(tile.Z), tile.X, tile.Y)
+
+	entries, err := r.readDirectory(r.header.RootOffset, r.header.RootLength, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The spec allows at most three levels of leaf directories.
+	for depth := 0; depth <= 3; depth++ {
+		// Find the last entry starting at or before id.
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].TileID > id }) - 1
+		if i < 0 {
+			return nil, nil
+		}
+		entry := entries[i]
+
+		if entry.RunLength == 0 {
+			entries, err = r.readDirectory(entry.Offset, uint64(entry.Length), true)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if id >= entry.TileID+uint64(entry.RunLength) {
+			return nil, nil
+		}
+		return r.readAt(r.header.TileDataOffset+entry.Offset, uint64(entry.Length))
+	}
+
+	return nil, fmt.Errorf("pmtiles directory for %v is nested too deeply", tile)
+}
+
+// VisitAllTiles visits tiles in tile ID order. Every tile of a run is visited
+// with the same data.
+func (r *pmtilesReader) VisitAllTiles(visitor func(maptile.Tile, []byte) error) error {
+	return r.visitEntries(r.header.RootOffset, r.header.RootLength, false, func(entry pmtiles.EntryV3) error {
+		data, err := r.readAt(r.header.TileDataOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return fmt.Errorf("error reading tile %d: %w", entry.TileID, err)
+		}
+
+		for id := entry.TileID; id < entry.TileID+uint64(entry.RunLength); id++ {
+			z, x, y := pmtiles.IDToZxy(id)
+			if err := visitor(maptile.New(x, y, maptile.Zoom(z)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// visitEntries calls visit for each tile entry below the directory at offset,
+// descending into leaf directories.
+func (r *pmtilesReader) visitEntries(offset uint64, length uint64, leaf bool, visit func(pmtiles.EntryV3) error) error {
+	entries, err := r.readDirectory(offset, length, leaf)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.RunLength == 0 {
+			err = r.visitEntries(entry.Offset, uint64(entry.Length), true, visit)
+		} else {
+			err = visit(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSONMetadata returns the archive's JSON metadata as stored.
+func (r *pmtilesReader) JSONMetadata() (map[string]interface{}, error) {
+	data, err := r.readAt(r.header.MetadataOffset, r.header.MetadataLength)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pmtiles metadata: %w", err)
+	}
+
+	jsonMetadata, err := pmtiles.DeserializeMetadata(bytes.NewReader(data), r.header.InternalCompression)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing pmtiles metadata: %w", err)
+	}
+	return jsonMetadata, nil
+}
+
+// Metadata returns the archive's header and JSON metadata as MBTiles
+// metadata, see NewMbtilesMetadataFromPmtiles.
+func (r *pmtilesReader) Metadata() (*MbtilesMetadata, error) {
+	jsonMetadata, err := r.JSONMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return NewMbtilesMetadataFromPmtiles(r.header, jsonMetadata)
+}
+
+// tileIDInterval is a half-open range of tile IDs.
+type tileIDInterval struct {
+	first, end uint64
+}
+
+// tileRangeIDIntervals returns the sorted, merged tile ID intervals of the
+// tiles in r. Every aligned square block of tiles, the descendants of one
+// tile, is a contiguous run of the Hilbert curve, so r is split into the
+// largest blocks inside it.
+func tileRangeIDIntervals(r TileRange) []tileIDInterval {
+	zoomFirst := pmtiles.ZxyToID(uint8(r.Z), 0, 0)
+
+	var intervals []tileIDInterval
+	var addBlock func(parent maptile.Tile)
+	addBlock = func(parent maptile.Tile) {
+		shift := uint(r.Z - parent.Z)
+		minX, minY := parent.X<<shift, parent.Y<<shift
+		maxX, maxY := minX+(1<<shift)-1, minY+(1<<shift)-1
+		if maxX < r.MinX || minX > r.MaxX || maxY < r.MinY || minY > r.MaxY {
+			return
+		}
+
+		if minX >= r.MinX && maxX <= r.MaxX && minY >= r.MinY && maxY <= r.MaxY {
+			index := pmtiles.ZxyToID(uint8(parent.Z), parent.X, parent.Y) - pmtiles.ZxyToID(uint8(parent.Z), 0, 0)
+			first := zoomFirst + index<<(2*shift)
+			intervals = append(intervals, tileIDInterval{first, first + 1<<(2*shift)})
+			return
+		}
+
+		for _, child := range parent.Children() {
+			addBlock(child)
+		}
+	}
+	addBlock(maptile.New(0, 0, 0))
+
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].first < intervals[j].first })
+	merged := intervals[:0]
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && merged[n-1].end == interval.first {
+			merged[n-1].end = interval.end
+		} else {
+			merged = append(merged, interval)
+		}
+	}
+	return merged
+}
+
+// overlapsTileIDIntervals returns true if [first, end) overlaps one of the
+// sorted intervals.
+func overlapsTileIDIntervals(intervals []tileIDInterval, first uint64, end uint64) bool {
+	i := sort.Search(len(intervals), func(i int) bool { return intervals[i].end > first })
+	return i < len(intervals) && intervals[i].first < end
+}
+
+// VisitTileRange visits the tiles of tileRange in tile ID order. Leaf
+// directories and tile data outside the range are not read.
+func (r *pmtilesReader) VisitTileRange(tileRange TileRange, visitor func(maptile.Tile, []byte) error) error {
+	intervals := tileRangeIDIntervals(tileRange)
+	if len(intervals) == 0 {
+		return nil
+	}
+	return r.visitTileIDIntervals(r.header.RootOffset, r.header.RootLength, false, math.MaxUint64, intervals, visitor)
+}
+
+// visitTileIDIntervals visits the tiles in intervals below the directory at
+// offset, whose entries all start before end.
+func (r *pmtilesReader) visitTileIDIntervals(offset uint64, length uint64, leaf bool, end uint64, intervals []tileIDInterval, visitor func(maptile.Tile, []byte) error) error {
+	entries, err := r.readDirectory(offset, length, leaf)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if entry.RunLength == 0 {
+			// A leaf directory holds the tiles up to the next entry.
+			leafEnd := end
+			if i+1 < len(entries) {
+				leafEnd = entries[i+1].TileID
+			}
+			if !overlapsTileIDIntervals(intervals, entry.TileID, leafEnd) {
+				continue
+			}
+			if err := r.visitTileIDIntervals(entry.Offset, uint64(entry.Length), true, leafEnd, intervals, visitor); err != nil {
+				return err
+			}
+			continue
+		}
+
+		runEnd := entry.TileID + uint64(entry.RunLength)
+		if !overlapsTileIDIntervals(intervals, entry.TileID, runEnd) {
+			continue
+		}
+
+		data, err := r.readAt(r.header.TileDataOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return fmt.Errorf("error reading tile %d: %w", entry.TileID, err)
+		}
+		for id := entry.TileID; id < runEnd; id++ {
+			if !overlapsTileIDIntervals(intervals, id, id+1) {
+				continue
+			}
+			z, x, y := pmtiles.IDToZxy(id)
+			if err := visitor(maptile.New(x, y, maptile.Zoom(z)), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
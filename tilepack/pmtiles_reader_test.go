@@ -0,0 +1,162 @@
+package tilepack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// writeTestPmtiles writes tiles to a new png PMTiles archive and returns its path.
+func writeTestPmtiles(t *testing.T, tiles map[maptile.Tile][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	o, err := NewPmtilesOutputter(path, "png", NewMbtilesMetadata(map[string]string{"name": "test"}))
+	if err != nil {
+		t.Fatalf("NewPmtilesOutputter: %v", err)
+	}
+	o.logger.SetOutput(testWriter{t})
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.AssignSpatialMetadata(orb.Bound{Min: orb.Point{-10, -20}, Max: orb.Point{10, 20}}, 0, 3); err != nil {
+		t.Fatalf("AssignSpatialMetadata: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+// testWriter sends log output to the test log.
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
+
+func TestPmtilesReader_GetAndVisit(t *testing.T) {
+	tiles := map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): []byte("z0"),
+		maptile.New(1, 0, 1): []byte("z1"),
+		// Two tiles with the same content next to each other become a run.
+		maptile.New(0, 0, 1): []byte("same"),
+		maptile.New(0, 1, 1): []byte("same"),
+	}
+	path := writeTestPmtiles(t, tiles)
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+
+	for tile, want := range tiles {
+		got, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatalf("GetTile %v: %v", tile, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("GetTile %v: got %q, want %q", tile, got, want)
+		}
+	}
+
+	if got, err := reader.GetTile(maptile.New(1, 1, 1)); err != nil || got != nil {
+		t.Errorf("missing tile: got %q, %v", got, err)
+	}
+
+	visited := map[maptile.Tile]string{}
+	err = reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		visited[tile] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitAllTiles: %v", err)
+	}
+	if len(visited) != len(tiles) {
+		t.Errorf("visited %d tiles, want %d", len(visited), len(tiles))
+	}
+	for tile, want := range tiles {
+		if visited[tile] != string(want) {
+			t.Errorf("visited %v: got %q, want %q", tile, visited[tile], want)
+		}
+	}
+}
+
+func TestPmtilesReader_LeafDirectories(t *testing.T) {
+	// Enough distinct tiles to push the directory into leaves. The tile sizes
+	// vary, as clustered tiles of the same size compress to a tiny directory.
+	tiles := map[maptile.Tile][]byte{}
+	for x := uint32(0); x < 256; x++ {
+		for y := uint32(0); y < 256; y++ {
+			padding := strings.Repeat("-", int((x*2654435761^y*40503)>>7%200))
+			tiles[maptile.New(x, y, 8)] = []byte(fmt.Sprintf("%d/%d%s", x, y, padding))
+		}
+	}
+	path := writeTestPmtiles(t, tiles)
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+
+	if reader.Header().LeafDirectoryLength == 0 {
+		t.Fatal("expected leaf directories")
+	}
+
+	for _, tile := range []maptile.Tile{maptile.New(0, 0, 8), maptile.New(255, 255, 8), maptile.New(64, 3, 8)} {
+		got, err := reader.GetTile(tile)
+		if err != nil {
+			t.Fatalf("GetTile %v: %v", tile, err)
+		}
+		if string(got) != string(tiles[tile]) {
+			t.Errorf("GetTile %v: got %q", tile, got)
+		}
+	}
+
+	count := 0
+	if err := reader.VisitAllTiles(func(maptile.Tile, []byte) error { count++; return nil }); err != nil {
+		t.Fatalf("VisitAllTiles: %v", err)
+	}
+	if count != len(tiles) {
+		t.Errorf("visited %d tiles, want %d", count, len(tiles))
+	}
+}
+
+func TestPmtilesReader_Metadata(t *testing.T) {
+	path := writeTestPmtiles(t, map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("x")})
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer reader.Close()
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+
+	if name, _ := metadata.Name(); name != "test" {
+		t.Errorf("name: got %q", name)
+	}
+	if format, _ := metadata.Format(); format != "png" {
+		t.Errorf("format from header: got %q", format)
+	}
+	if maxZoom, err := metadata.MaxZoom(); err != nil || maxZoom != 3 {
+		t.Errorf("maxzoom: got %d, %v", maxZoom, err)
+	}
+	bounds, err := metadata.Bounds()
+	if err != nil || bounds.Min[0] != -10 || bounds.Max[1] != 20 {
+		t.Errorf("bounds: got %v, %v", bounds, err)
+	}
+}
@@ -0,0 +1,638 @@
+package tilepack
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// MinPmtilesMemoryBudget is the smallest memory budget a pmtiles outputter
+// accepts.
+const MinPmtilesMemoryBudget = 16 << 20
+
+const (
+	// pmtilesEntryBytes is the size of an entry in memory and in run files.
+	pmtilesEntryBytes = 24
+	// pmtilesCachedContentBytes estimates the memory one content of the hot
+	// cache takes, including map overhead.
+	pmtilesCachedContentBytes = 128
+	// pmtilesIndexBatchSize is the number of contents added to the on-disk
+	// index per transaction.
+	pmtilesIndexBatchSize = 10000
+)
+
+// errStopRead ends readMerged early without reporting an error.
+var errStopRead = errors.New("stop read")
+
+// pmtilesSpill keeps the state of a pmtiles outputter with a memory budget.
+// Entries are sorted in runs of at most maxEntries and spilled to files in
+// dir, to be merged on Close, and tile contents are deduplicated with a
+// pmtilesDiskIndex instead of a map of every content.
+type pmtilesSpill struct {
+	dir        string
+	maxEntries int
+	runs       []string
+	// index maps content hashes to tile data while tiles are saved, and old
+	// to new tile data offsets while the data is clustered on Close.
+	index       *pmtilesDiskIndex
+	indexMemory int64
+	leaves      *os.File
+	// contents is the number of unique tile contents written.
+	contents uint64
+}
+
+// newPmtilesSpill splits budget between the entry buffer, which gets half,
+// and the hot cache and Bloom filter of the content index, which get a
+// quarter each.
+func newPmtilesSpill(budget int64) (*pmtilesSpill, error) {
+	if budget < MinPmtilesMemoryBudget {
+		return nil, fmt.Errorf("pmtiles memory budget of %d bytes is below the minimum of %d", budget, MinPmtilesMemoryBudget)
+	}
+
+	dir, err := os.MkdirTemp("", "pmtiles-spill-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating spill directory: %w", err)
+	}
+
+	index, err := newPmtilesDiskIndex(filepath.Join(dir, "contents.db"), budget/4)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &pmtilesSpill{
+		dir:         dir,
+		maxEntries:  int(budget / 2 / pmtilesEntryBytes),
+		index:       index,
+		indexMemory: budget / 4,
+	}, nil
+}
+
+// clusterIndex replaces the content index, which is not needed once all
+// tiles are saved, with an index of moved tile data offsets.
+func (s *pmtilesSpill) clusterIndex() (moved func(uint64) (uint64, bool, error), move func(uint64, uint64) error, err error) {
+	if err := s.index.Close(); err != nil {
+		return nil, nil, err
+	}
+	s.index, err = newPmtilesDiskIndex(filepath.Join(s.dir, "offsets.db"), s.indexMemory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	moved = func(old uint64) (uint64, bool, error) {
+		found, ok, err := s.index.Get(binary.BigEndian.AppendUint64(nil, old))
+		return found.offset, ok, err
+	}
+	move = func(old uint64, new uint64) error {
+		return s.index.Put(binary.BigEndian.AppendUint64(nil, old), offsetLen{offset: new})
+	}
+	return moved, move, nil
+}
+
+// Close removes the spill files.
+func (s *pmtilesSpill) Close() error {
+	err := s.index.Close()
+	if s.leaves != nil {
+		s.leaves.Close()
+	}
+	return errors.Join(err, os.RemoveAll(s.dir))
+}
+
+// writeRun sorts entries and writes them to a new run file.
+func (s *pmtilesSpill) writeRun(entries []pmtiles.EntryV3) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+
+	path := filepath.Join(s.dir, fmt.Sprintf("run-%d", len(s.runs)))
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating entry run: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		if err := writePmtilesEntry(w, entry); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing entry run: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing entry run: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, path)
+	return nil
+}
+
+func writePmtilesEntry(w io.Writer, entry pmtiles.EntryV3) error {
+	var buf [pmtilesEntryBytes]byte
+	binary.LittleEndian.PutUint64(buf[0:], entry.TileID)
+	binary.LittleEndian.PutUint64(buf[8:], entry.Offset)
+	binary.LittleEndian.PutUint32(buf[16:], entry.Length)
+	binary.LittleEndian.PutUint32(buf[20:], entry.RunLength)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// readPmtilesEntry reads an entry written by writePmtilesEntry. It returns
+// io.EOF at the end of r.
+func readPmtilesEntry(r io.Reader) (pmtiles.EntryV3, error) {
+	var buf [pmtilesEntryBytes]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return pmtiles.EntryV3{}, fmt.Errorf("truncated pmtiles entry: %w", err)
+		}
+		return pmtiles.EntryV3{}, err
+	}
+	return pmtiles.EntryV3{
+		TileID:    binary.LittleEndian.Uint64(buf[0:]),
+		Offset:    binary.LittleEndian.Uint64(buf[8:]),
+		Length:    binary.LittleEndian.Uint32(buf[16:]),
+		RunLength: binary.LittleEndian.Uint32(buf[20:]),
+	}, nil
+}
+
+// pmtilesEntrySource is one sorted input of mergeEntryRuns.
+type pmtilesEntrySource struct {
+	current pmtiles.EntryV3
+	next    func() (pmtiles.EntryV3, error)
+}
+
+type pmtilesEntryHeap []*pmtilesEntrySource
+
+func (h pmtilesEntryHeap) Len() int { return len(h) }
+func (h pmtilesEntryHeap) Less(i, j int) bool {
+	return h[i].current.TileID < h[j].current.TileID
+}
+func (h pmtilesEntryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pmtilesEntryHeap) Push(x any)   { *h = append(*h, x.(*pmtilesEntrySource)) }
+func (h *pmtilesEntryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergeEntryRuns calls visit for the entries of the run files and of the
+// sorted entries still in memory, in tile ID order.
+func (s *pmtilesSpill) mergeEntryRuns(entries []pmtiles.EntryV3, visit func(pmtiles.EntryV3) error) error {
+	sources := &pmtilesEntryHeap{}
+
+	addSource := func(next func() (pmtiles.EntryV3, error)) error {
+		first, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(sources, &pmtilesEntrySource{current: first, next: next})
+		return nil
+	}
+
+	for _, path := range s.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening entry run: %w", err)
+		}
+		defer f.Close()
+
+		r := bufio.NewReader(f)
+		if err := addSource(func() (pmtiles.EntryV3, error) { return readPmtilesEntry(r) }); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+	if err := addSource(func() (pmtiles.EntryV3, error) {
+		if len(entries) == 0 {
+			return pmtiles.EntryV3{}, io.EOF
+		}
+		entry := entries[0]
+		entries = entries[1:]
+		return entry, nil
+	}); err != nil {
+		return err
+	}
+
+	for sources.Len() > 0 {
+		source := (*sources)[0]
+		if err := visit(source.current); err != nil {
+			return err
+		}
+
+		next, err := source.next()
+		if err == io.EOF {
+			heap.Pop(sources)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		source.current = next
+		heap.Fix(sources, 0)
+	}
+	return nil
+}
+
+// pmtilesDirectoryResult holds the directories and counts Close writes to
+// the archive.
+type pmtilesDirectoryResult struct {
+	root         []byte
+	leaves       io.Reader
+	leavesLength uint64
+	numLeaves    int
+	entries      uint64
+	addressed    uint64
+	firstID      uint64
+	lastID       uint64
+}
+
+// buildDirectories merges the entry runs, run-length encodes them and builds
+// the directories, holding at most maxEntries entries in memory. The merged
+// entries and the leaf directories are written to files in the spill
+// directory. Unless it is nil, cluster is called for each merged entry in
+// tile ID order before it is written.
+func (s *pmtilesSpill) buildDirectories(entries []pmtiles.EntryV3, targetRootLen int, compression pmtiles.Compression, cluster func(*pmtiles.EntryV3) error) (*pmtilesDirectoryResult, error) {
+	merged, err := os.Create(filepath.Join(s.dir, "merged"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating merged entries: %w", err)
+	}
+	defer merged.Close()
+
+	result := &pmtilesDirectoryResult{}
+	w := bufio.NewWriter(merged)
+	var cur pmtiles.EntryV3
+	var lastID uint64
+	flush := func() error {
+		result.entries++
+		if cluster != nil {
+			if err := cluster(&cur); err != nil {
+				return err
+			}
+		}
+		return writePmtilesEntry(w, cur)
+	}
+
+	err = s.mergeEntryRuns(entries, func(e pmtiles.EntryV3) error {
+		if result.addressed == 0 {
+			cur = e
+			result.firstID, lastID = e.TileID, e.TileID
+			result.addressed++
+			return nil
+		}
+		// Outputters with a budget do not keep the set of saved tile IDs, so
+		// duplicates are found here, next to each other in the merge.
+		if e.TileID == lastID {
+			z, x, y := pmtiles.IDToZxy(e.TileID)
+			return fmt.Errorf("duplicate tile %d/%d/%d (Hilbert ID %d)", z, x, y, e.TileID)
+		}
+		lastID = e.TileID
+		result.addressed++
+
+		// The same runs as runLengthEncodeEntries collapses.
+		if e.Offset == cur.Offset && e.TileID == cur.TileID+uint64(cur.RunLength) && uint64(cur.RunLength)+1 <= math.MaxUint32 {
+			cur.RunLength++
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		cur = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.addressed > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		result.lastID = lastID
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("error writing merged entries: %w", err)
+	}
+
+	// Few enough entries are built in memory like an outputter without a
+	// budget would.
+	if result.entries <= uint64(s.maxEntries) {
+		all := make([]pmtiles.EntryV3, 0, result.entries)
+		if err := s.readMerged(merged, func(e pmtiles.EntryV3) error {
+			all = append(all, e)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		root, leaves, numLeaves := optimizeDirectories(all, targetRootLen, compression)
+		result.root, result.leaves, result.leavesLength, result.numLeaves = root, bytes.NewReader(leaves), uint64(len(leaves)), numLeaves
+		return result, nil
+	}
+
+	// The first entries go in the root as in optimizeDirectories.
+	first := make([]pmtiles.EntryV3, 0, maxRootTileEntries)
+	if err := s.readMerged(merged, func(e pmtiles.EntryV3) error {
+		if len(first) == maxRootTileEntries {
+			return errStopRead
+		}
+		first = append(first, e)
+		return nil
+	}); err != nil && err != errStopRead {
+		return nil, err
+	}
+	prefix := first[:rootPrefixLen(first, targetRootLen/2, compression)]
+
+	leafSize := float32(result.entries-uint64(len(prefix))) / 3500
+	if leafSize < 4096 {
+		leafSize = 4096
+	}
+	for {
+		root, leavesLength, numLeaves, err := s.buildLeaves(merged, prefix, int(leafSize), compression)
+		if err != nil {
+			return nil, err
+		}
+		if len(root) <= targetRootLen {
+			s.leaves, err = os.Open(filepath.Join(s.dir, "leaves"))
+			if err != nil {
+				return nil, err
+			}
+			result.root, result.leaves, result.leavesLength, result.numLeaves = root, s.leaves, leavesLength, numLeaves
+			return result, nil
+		}
+		leafSize *= 1.2
+	}
+}
+
+// readMerged visits the merged entries from the start of the file.
+func (s *pmtilesSpill) readMerged(merged *os.File, visit func(pmtiles.EntryV3) error) error {
+	if _, err := merged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(merged)
+	for {
+		entry, err := readPmtilesEntry(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := visit(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// buildLeaves is buildRootsLeaves for the merged entries file, writing the
+// leaf directories to the leaves file instead of memory. prefix holds the
+// first merged entries, which go in the root.
+func (s *pmtilesSpill) buildLeaves(merged *os.File, prefix []pmtiles.EntryV3, leafSize int, compression pmtiles.Compression) ([]byte, uint64, int, error) {
+	leaves, err := os.Create(filepath.Join(s.dir, "leaves"))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("error creating leaf directories: %w", err)
+	}
+	defer leaves.Close()
+	w := bufio.NewWriter(leaves)
+
+	rootEntries := append([]pmtiles.EntryV3{}, prefix...)
+	var leavesLength uint64
+	numLeaves := 0
+	skip := len(prefix)
+	leaf := make([]pmtiles.EntryV3, 0, leafSize)
+	writeLeaf := func() error {
+		serialized := pmtiles.SerializeEntries(leaf, compression)
+		rootEntries = append(rootEntries, pmtiles.EntryV3{
+			TileID:    leaf[0].TileID,
+			Offset:    leavesLength,
+			Length:    uint32(len(serialized)),
+			RunLength: 0,
+		})
+		leavesLength += uint64(len(serialized))
+		numLeaves++
+		leaf = leaf[:0]
+		_, err := w.Write(serialized)
+		return err
+	}
+
+	err = s.readMerged(merged, func(e pmtiles.EntryV3) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		leaf = append(leaf, e)
+		if len(leaf) == leafSize {
+			return writeLeaf()
+		}
+		return nil
+	})
+	if err == nil && len(leaf) > 0 {
+		err = writeLeaf()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("error writing leaf directories: %w", err)
+	}
+
+	return pmtiles.SerializeEntries(rootEntries, compression), leavesLength, numLeaves, nil
+}
+
+// pmtilesDiskIndex maps keys to a place in the tile data within a fixed
+// amount of memory. Every key is kept in an on-disk SQLite table. A Bloom
+// filter answers most lookups of new keys without reading the table, and a
+// hot cache of recently used keys answers the lookups of frequent ones, such
+// as the hash of ocean tiles.
+type pmtilesDiskIndex struct {
+	db         *sql.DB
+	insertStmt *sql.Stmt
+	lookupStmt *sql.Stmt
+	txn        *sql.Tx
+	insert     *sql.Stmt
+	lookup     *sql.Stmt
+	batch      int
+
+	bloom *bloomFilter
+
+	// The hot cache holds two generations of at most cacheSize keys. When
+	// the current one is full it becomes the previous one, so keys used in
+	// either generation stay cached.
+	cacheSize int
+	current   map[string]offsetLen
+	previous  map[string]offsetLen
+}
+
+// newPmtilesDiskIndex creates an index at path whose hot cache and Bloom
+// filter each take about memory bytes.
+func newPmtilesDiskIndex(path string, memory int64) (*pmtilesDiskIndex, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// Statements must run on the connection holding the transaction.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		PRAGMA journal_mode = OFF;
+		PRAGMA synchronous = OFF;
+		CREATE TABLE entries (key BLOB PRIMARY KEY, offset INTEGER NOT NULL, length INTEGER NOT NULL) WITHOUT ROWID;
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating index: %w", err)
+	}
+
+	insertStmt, err := db.Prepare("INSERT INTO entries (key, offset, length) VALUES (?, ?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error preparing index insert: %w", err)
+	}
+	lookupStmt, err := db.Prepare("SELECT offset, length FROM entries WHERE key = ?")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error preparing index lookup: %w", err)
+	}
+
+	return &pmtilesDiskIndex{
+		db:         db,
+		insertStmt: insertStmt,
+		lookupStmt: lookupStmt,
+		bloom:      newBloomFilter(uint64(memory)*8, 7),
+		cacheSize:  max(int(memory/pmtilesCachedContentBytes/2), 1),
+		current:    map[string]offsetLen{},
+		previous:   map[string]offsetLen{},
+	}, nil
+}
+
+// begin starts the transaction keys are added and looked up in.
+func (x *pmtilesDiskIndex) begin() error {
+	if x.txn != nil {
+		return nil
+	}
+	txn, err := x.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting index transaction: %w", err)
+	}
+	x.txn = txn
+	x.insert = txn.Stmt(x.insertStmt)
+	x.lookup = txn.Stmt(x.lookupStmt)
+	return nil
+}
+
+func (x *pmtilesDiskIndex) cache(key string, found offsetLen) {
+	if len(x.current) >= x.cacheSize {
+		x.previous, x.current = x.current, make(map[string]offsetLen, x.cacheSize)
+	}
+	x.current[key] = found
+}
+
+// Get returns the value recorded for key, if there is one.
+func (x *pmtilesDiskIndex) Get(key []byte) (offsetLen, bool, error) {
+	if found, ok := x.current[string(key)]; ok {
+		return found, true, nil
+	}
+	if found, ok := x.previous[string(key)]; ok {
+		x.cache(string(key), found)
+		return found, true, nil
+	}
+	if !x.bloom.MayContain(key) {
+		return offsetLen{}, false, nil
+	}
+
+	if err := x.begin(); err != nil {
+		return offsetLen{}, false, err
+	}
+	var found offsetLen
+	err := x.lookup.QueryRow(key).Scan(&found.offset, &found.length)
+	if err == sql.ErrNoRows {
+		return offsetLen{}, false, nil
+	}
+	if err != nil {
+		return offsetLen{}, false, fmt.Errorf("error reading index: %w", err)
+	}
+	x.cache(string(key), found)
+	return found, true, nil
+}
+
+// Put records the value for a key that is not in the index yet.
+func (x *pmtilesDiskIndex) Put(key []byte, found offsetLen) error {
+	if err := x.begin(); err != nil {
+		return err
+	}
+	if _, err := x.insert.Exec(key, found.offset, found.length); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	x.bloom.Add(key)
+	x.cache(string(key), found)
+
+	x.batch++
+	if x.batch >= pmtilesIndexBatchSize {
+		x.batch = 0
+		err := x.txn.Commit()
+		x.txn = nil
+		if err != nil {
+			return fmt.Errorf("error committing index: %w", err)
+		}
+	}
+	return nil
+}
+
+func (x *pmtilesDiskIndex) Close() error {
+	if x.txn != nil {
+		x.txn.Rollback()
+		x.txn = nil
+	}
+	return x.db.Close()
+}
+
+// bloomFilter is a Bloom filter of byte strings.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+func newBloomFilter(size uint64, hashes int) *bloomFilter {
+	size = max(size, 64)
+	return &bloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// positions derives the filter's bit positions of key from two hashes.
+func (f *bloomFilter) positions(key []byte, visit func(bit uint64) bool) bool {
+	h1 := xxhash.Sum64(key)
+	h2 := h1>>33 | h1<<31 | 1
+	for i := 0; i < f.hashes; i++ {
+		if !visit((h1 + uint64(i)*h2) % f.size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) Add(key []byte) {
+	f.positions(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// MayContain returns false if key was never added.
+func (f *bloomFilter) MayContain(key []byte) bool {
+	return f.positions(key, func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
@@ -0,0 +1,177 @@
+package tilepack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// writeBudgetTestPmtiles saves tiles in order to a png PMTiles archive. With
+// spill set, the outputter has a memory budget whose entry buffer and hot
+// cache are shrunk so the test spills several runs and reads the on-disk
+// content index.
+func writeBudgetTestPmtiles(t *testing.T, tiles []maptile.Tile, content func(maptile.Tile) []byte, spill bool) (string, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	o, err := NewPmtilesOutputter(path, "png", NewMbtilesMetadata(map[string]string{"name": "test"}))
+	if err != nil {
+		t.Fatalf("NewPmtilesOutputter: %v", err)
+	}
+	o.logger.SetOutput(testWriter{t})
+
+	if spill {
+		if err := o.SetMemoryBudget(MinPmtilesMemoryBudget); err != nil {
+			t.Fatalf("SetMemoryBudget: %v", err)
+		}
+		o.spill.maxEntries = 1000
+		o.spill.index.cacheSize = 2
+	}
+
+	for _, tile := range tiles {
+		if err := o.Save(tile, content(tile)); err != nil {
+			t.Fatalf("Save %v: %v", tile, err)
+		}
+	}
+	return path, o.Close()
+}
+
+func TestPmtilesOutputter_MemoryBudget_MatchesInMemory(t *testing.T) {
+	// Saved in reverse Hilbert order, so every run covers scattered tile IDs.
+	var tiles []maptile.Tile
+	for z := maptile.Zoom(7); ; z-- {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles = append(tiles, maptile.New(x, y, z))
+			}
+		}
+		if z == 0 {
+			break
+		}
+	}
+	// A quarter of the tiles share content, some of it in runs.
+	content := func(tile maptile.Tile) []byte {
+		if tile.Y%4 == 0 {
+			return []byte("ocean")
+		}
+		return []byte(fmt.Sprintf("tile %d/%d/%d", tile.Z, tile.X, tile.Y))
+	}
+
+	memoryPath, err := writeBudgetTestPmtiles(t, tiles, content, false)
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	spillPath, err := writeBudgetTestPmtiles(t, tiles, content, true)
+	if err != nil {
+		t.Fatalf("Close with memory budget: %v", err)
+	}
+
+	memory, err := NewPmtilesReader(memoryPath)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer memory.Close()
+	spilled, err := NewPmtilesReader(spillPath)
+	if err != nil {
+		t.Fatalf("NewPmtilesReader: %v", err)
+	}
+	defer spilled.Close()
+
+	want, got := memory.Header(), spilled.Header()
+	if got.AddressedTilesCount != uint64(len(tiles)) {
+		t.Errorf("AddressedTilesCount = %d, want %d", got.AddressedTilesCount, len(tiles))
+	}
+	if got.AddressedTilesCount != want.AddressedTilesCount || got.TileEntriesCount != want.TileEntriesCount ||
+		got.TileContentsCount != want.TileContentsCount || got.TileDataLength != want.TileDataLength {
+		t.Errorf("counts with budget = %d/%d/%d/%d, want %d/%d/%d/%d",
+			got.AddressedTilesCount, got.TileEntriesCount, got.TileContentsCount, got.TileDataLength,
+			want.AddressedTilesCount, want.TileEntriesCount, want.TileContentsCount, want.TileDataLength)
+	}
+	if got.MinZoom != 0 || got.MaxZoom != 7 {
+		t.Errorf("zoom range = %d-%d, want 0-7", got.MinZoom, got.MaxZoom)
+	}
+	if got.LeafDirectoryLength == 0 {
+		t.Errorf("expected leaf directories")
+	}
+
+	// Tiles were saved out of order, so the data was clustered on Close.
+	for _, path := range []string{memoryPath, spillPath} {
+		report, err := VerifyPmtiles(path)
+		if err != nil {
+			t.Fatalf("VerifyPmtiles: %v", err)
+		}
+		if hasIssue(report, "clustered") {
+			t.Errorf("%s is not clustered: %+v", filepath.Base(path), report.Issues)
+		}
+	}
+
+	visited := 0
+	err = spilled.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		visited++
+		if string(data) != string(content(tile)) {
+			return fmt.Errorf("tile %v = %q, want %q", tile, data, content(tile))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visited != len(tiles) {
+		t.Errorf("visited %d tiles, want %d", visited, len(tiles))
+	}
+}
+
+func TestPmtilesOutputter_MemoryBudget_DuplicateTile(t *testing.T) {
+	tiles := make([]maptile.Tile, 0, 2001)
+	for y := uint32(0); y < 2000; y++ {
+		tiles = append(tiles, maptile.New(0, y, 11))
+	}
+	// The duplicate lands in a different run than the original.
+	tiles = append(tiles, maptile.New(0, 5, 11))
+
+	_, err := writeBudgetTestPmtiles(t, tiles, func(tile maptile.Tile) []byte { return []byte("x") }, true)
+	if err == nil || !strings.Contains(err.Error(), "duplicate tile 11/0/5") {
+		t.Fatalf("Close error = %v, want duplicate tile", err)
+	}
+}
+
+func TestPmtilesOutputter_SetMemoryBudget_Errors(t *testing.T) {
+	o, _ := newTestPmtilesOutputter(t, "png")
+	defer o.Close()
+
+	if err := o.SetMemoryBudget(MinPmtilesMemoryBudget - 1); err == nil {
+		t.Errorf("expected error for a budget below the minimum")
+	}
+
+	if err := o.Save(maptile.New(0, 0, 0), []byte("a")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.SetMemoryBudget(MinPmtilesMemoryBudget); err == nil {
+		t.Errorf("expected error for a budget set after Save")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1<<16, 7)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(fmt.Sprintf("added %d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f.MayContain([]byte(fmt.Sprintf("added %d", i))) {
+			t.Fatalf("added key %d not found", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if f.MayContain([]byte(fmt.Sprintf("absent %d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 10 {
+		t.Errorf("%d false positives in 1000, want about 0", falsePositives)
+	}
+}
@@ -0,0 +1,71 @@
+package tilepack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// QueueStats samples the depth of the queues between the stages of a
+// pipeline, to show which stage holds the others up: a queue that stays full
+// waits on the stage reading it, and one that stays empty on the stage
+// writing it. It is safe for concurrent use.
+type QueueStats struct {
+	mu     sync.Mutex
+	queues []*queueDepth
+}
+
+type queueDepth struct {
+	name     string
+	depth    func() int
+	capacity int
+
+	last    int
+	max     int
+	total   int64
+	samples int64
+}
+
+func NewQueueStats() *QueueStats {
+	return &QueueStats{}
+}
+
+// Add adds a queue whose depth, at most capacity, is returned by depth, such
+// as the len of a channel.
+func (s *QueueStats) Add(name string, depth func() int, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues = append(s.queues, &queueDepth{name: name, depth: depth, capacity: capacity})
+}
+
+// Sample records the current depth of every queue.
+func (s *QueueStats) Sample() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		q.last = q.depth()
+		q.max = max(q.max, q.last)
+		q.total += int64(q.last)
+		q.samples++
+	}
+}
+
+// String renders the last, mean and maximum depth of each queue as a single
+// log-friendly line.
+func (s *QueueStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queues) == 0 {
+		return "none"
+	}
+
+	parts := make([]string, len(s.queues))
+	for i, q := range s.queues {
+		mean := 0.0
+		if q.samples > 0 {
+			mean = float64(q.total) / float64(q.samples)
+		}
+		parts[i] = fmt.Sprintf("%s %d/%d (mean %.1f, max %d)", q.name, q.last, q.capacity, mean, q.max)
+	}
+	return strings.Join(parts, ", ")
+}
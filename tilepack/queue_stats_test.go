@@ -0,0 +1,23 @@
+package tilepack
+
+import "testing"
+
+func TestQueueStats(t *testing.T) {
+	queue := make(chan int, 10)
+	stats := NewQueueStats()
+	stats.Add("results", func() int { return len(queue) }, cap(queue))
+
+	for _, depth := range []int{2, 6, 1} {
+		for len(queue) < depth {
+			queue <- 0
+		}
+		for len(queue) > depth {
+			<-queue
+		}
+		stats.Sample()
+	}
+
+	if got, want := stats.String(), "results 1/10 (mean 3.0, max 6)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
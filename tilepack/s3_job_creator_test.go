@@ -4,9 +4,12 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"io"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/paulmach/orb"
@@ -20,7 +23,7 @@ type fakeS3Downloader struct {
 	objects map[string][]byte
 }
 
-func (f *fakeS3Downloader) Download(w io.WriterAt, input *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
+func (f *fakeS3Downloader) DownloadWithContext(_ aws.Context, w io.WriterAt, input *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
 	data, ok := f.objects[*input.Key]
 	if !ok {
 		return 0, nil
@@ -107,7 +110,7 @@ func TestMetatileJobGenerator_CreateJobs_ZoomMapping(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 100)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -143,7 +146,7 @@ func TestMetatileJobGenerator_CreateJobs_MaxDetailZoom(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 100)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -172,7 +175,7 @@ func TestMetatileJobGenerator_CreateJobs_LowZoom(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 100)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -211,7 +214,7 @@ func TestMetatileWorker_ExtractsTile(t *testing.T) {
 
 	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
 	close(jobs)
-	worker(0, jobs, results)
+	worker(context.Background(), 0, jobs, results)
 	close(results)
 
 	var responses []*TileResponse
@@ -259,7 +262,7 @@ func TestMetatileWorker_SkipsWrongFormat(t *testing.T) {
 
 	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
 	close(jobs)
-	worker(0, jobs, results)
+	worker(context.Background(), 0, jobs, results)
 	close(results)
 
 	var count int
@@ -287,7 +290,7 @@ func TestT2JobGenerator_CreateJobs_URLTemplate(t *testing.T) {
 
 	jobs := make(chan *TileRequest, 10)
 	go func() {
-		gen.CreateJobs(jobs)
+		gen.CreateJobs(context.Background(), jobs)
 		close(jobs)
 	}()
 
@@ -325,7 +328,7 @@ func TestT2Worker_ExtractsTile(t *testing.T) {
 
 	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
 	close(jobs)
-	worker(0, jobs, results)
+	worker(context.Background(), 0, jobs, results)
 	close(results)
 
 	var responses []*TileResponse
@@ -371,7 +374,7 @@ func TestT2Worker_SkipsOutOfBounds(t *testing.T) {
 
 	jobs <- &TileRequest{Tile: maptile.New(1, 1, 1), URL: "1/1/1.zip"}
 	close(jobs)
-	worker(0, jobs, results)
+	worker(context.Background(), 0, jobs, results)
 	close(results)
 
 	var count int
@@ -409,7 +412,7 @@ func TestMetatileWorker_SkipsWrongZoom(t *testing.T) {
 
 	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
 	close(jobs)
-	worker(0, jobs, results)
+	worker(context.Background(), 0, jobs, results)
 	close(results)
 
 	var count int
@@ -420,3 +423,148 @@ func TestMetatileWorker_SkipsWrongZoom(t *testing.T) {
 		t.Errorf("expected 0 responses for out-of-zoom-list tile, got %d", count)
 	}
 }
+
+func TestMetatileWorker_ReportsBadArchives(t *testing.T) {
+	// An archive that can't be read must be reported on a response for its
+	// tile, and the worker must carry on with the next request.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.Create("not-a-tile")
+	fw.Write([]byte("junk"))
+	zw.Close()
+
+	fake := &fakeS3Downloader{objects: map[string][]byte{
+		"0/0/0.zip": []byte("not a zip"),
+		"1/0/0.zip": buf.Bytes(),
+		"1/1/0.zip": buildMetatileZip(t, 0, 0, 0, "mvt", []byte("tile")),
+	}}
+	gen := &metatileJobGenerator{
+		s3Client:      fake,
+		bucket:        "b",
+		pathTemplate:  "{z}/{x}/{y}.zip",
+		layerName:     "all",
+		format:        "mvt",
+		metatileSize:  1,
+		maxDetailZoom: 1,
+		bounds:        orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:         []maptile.Zoom{0, 1},
+	}
+
+	jobs := make(chan *TileRequest, 3)
+	results := make(chan *TileResponse, 10)
+	worker, _ := gen.CreateWorker()
+
+	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
+	jobs <- &TileRequest{Tile: maptile.New(0, 0, 1), URL: "1/0/0.zip"}
+	jobs <- &TileRequest{Tile: maptile.New(1, 0, 1), URL: "1/1/0.zip"}
+	close(jobs)
+	worker(context.Background(), 0, jobs, results)
+	close(results)
+
+	var responses []*TileResponse
+	for r := range results {
+		responses = append(responses, r)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(responses))
+	}
+	for i, tile := range []maptile.Tile{maptile.New(0, 0, 0), maptile.New(0, 0, 1)} {
+		if responses[i].Tile != tile || responses[i].Err == nil {
+			t.Errorf("response %d: expected an error for %v, got %+v", i, tile, responses[i])
+		}
+	}
+	if r := responses[2]; r.Tile != maptile.New(1, 0, 1) || r.Err != nil {
+		t.Errorf("expected tile 1/1/0 after the errors, got %+v", r)
+	}
+}
+
+func TestT2Worker_ReportsBadArchives(t *testing.T) {
+	// A failed download must be reported on a response rather than stopping
+	// the build.
+	fake := &failingS3Downloader{err: errors.New("access denied")}
+	gen := &tapalcatl2JobGenerator{
+		s3Client:          fake,
+		bucket:            "b",
+		pathTemplate:      "{z}/{x}/{y}.zip",
+		materializedZooms: []maptile.Zoom{0},
+		bounds:            orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:             []maptile.Zoom{0},
+	}
+
+	jobs := make(chan *TileRequest, 1)
+	results := make(chan *TileResponse, 10)
+	worker, _ := gen.CreateWorker()
+
+	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
+	close(jobs)
+	worker(context.Background(), 0, jobs, results)
+	close(results)
+
+	r := <-results
+	if r == nil || !errors.Is(r.Err, fake.err) {
+		t.Fatalf("expected a response wrapping the download error, got %+v", r)
+	}
+}
+
+func TestT2Worker_StopsWhenCancelled(t *testing.T) {
+	// A cancelled worker must return without waiting for jobs to be closed,
+	// and without reporting the downloads cancellation interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := &failingS3Downloader{err: context.Canceled, cancel: cancel}
+	gen := &tapalcatl2JobGenerator{
+		s3Client:          fake,
+		pathTemplate:      "{z}/{x}/{y}.zip",
+		materializedZooms: []maptile.Zoom{0},
+		bounds:            orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:             []maptile.Zoom{0},
+	}
+
+	jobs := make(chan *TileRequest, 1)
+	results := make(chan *TileResponse, 10)
+	worker, _ := gen.CreateWorker()
+
+	jobs <- &TileRequest{Tile: maptile.New(0, 0, 0), URL: "0/0/0.zip"}
+	worker(ctx, 0, jobs, results)
+	close(results)
+
+	if r, ok := <-results; ok {
+		t.Errorf("expected no responses after cancellation, got %+v", r)
+	}
+}
+
+func TestT2JobGenerator_CreateJobs_Cancelled(t *testing.T) {
+	// CreateJobs must stop sending jobs once cancelled, and say so.
+	gen := &tapalcatl2JobGenerator{
+		pathTemplate:      "{z}/{x}/{y}.zip",
+		materializedZooms: []maptile.Zoom{4},
+		bounds:            orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:             []maptile.Zoom{4},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan *TileRequest, 1)
+	done := make(chan error)
+	go func() {
+		done <- gen.CreateJobs(ctx, jobs)
+	}()
+
+	<-jobs
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// failingS3Downloader fails every download with err, after calling cancel if
+// it is set.
+type failingS3Downloader struct {
+	err    error
+	cancel context.CancelFunc
+}
+
+func (f *failingS3Downloader) DownloadWithContext(_ aws.Context, _ io.WriterAt, _ *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	return 0, f.err
+}
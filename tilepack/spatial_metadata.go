@@ -0,0 +1,275 @@
+package tilepack
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// centerSearchLimit is the most tiles searched for the populated tile
+// nearest the middle of an archive.
+const centerSearchLimit = 1 << 16
+
+// SpatialMetadata is the extent of the tiles of an archive.
+type SpatialMetadata struct {
+	Bounds  orb.Bound
+	MinZoom maptile.Zoom
+	MaxZoom maptile.Zoom
+	// Center is the middle of the populated tile nearest the middle of the
+	// archive, at the deepest zoom with few enough tiles to search. It is
+	// shown at MinZoom.
+	Center orb.Point
+	// Tiles is the number of addressed tiles.
+	Tiles int64
+}
+
+// Apply sets the bounds, center and zoom keys of metadata.
+func (s *SpatialMetadata) Apply(metadata *MbtilesMetadata) {
+	metadata.SetBounds(s.Bounds)
+	metadata.SetCenter(s.Center, s.MinZoom)
+	metadata.SetMinZoom(s.MinZoom)
+	metadata.SetMaxZoom(s.MaxZoom)
+}
+
+// zoomExtent is the range of XYZ tile coordinates present at one zoom.
+type zoomExtent struct {
+	minX, maxX, minY, maxY uint32
+	count                  int64
+}
+
+// addSquare adds the size by size square of tiles whose top left tile is x,
+// y.
+func (e *zoomExtent) addSquare(x uint32, y uint32, size uint32) {
+	if e.count == 0 {
+		e.minX, e.maxX, e.minY, e.maxY = x, x+size-1, y, y+size-1
+	} else {
+		e.minX, e.maxX = min(e.minX, x), max(e.maxX, x+size-1)
+		e.minY, e.maxY = min(e.minY, y), max(e.maxY, y+size-1)
+	}
+	e.count += int64(size) * int64(size)
+}
+
+// distance2 returns four times the squared distance of x, y from the middle
+// of the extent, which keeps it an integer.
+func (e *zoomExtent) distance2(x uint32, y uint32) int64 {
+	dx := 2*int64(x) - int64(e.minX) - int64(e.maxX)
+	dy := 2*int64(y) - int64(e.minY) - int64(e.maxY)
+	return dx*dx + dy*dy
+}
+
+// spatialMetadataFromExtents builds the SpatialMetadata of per-zoom extents.
+// nearest must return the populated tile nearest the middle of extent at z.
+func spatialMetadataFromExtents(extents map[maptile.Zoom]*zoomExtent, nearest func(z maptile.Zoom, extent *zoomExtent) (maptile.Tile, error)) (*SpatialMetadata, error) {
+	if len(extents) == 0 {
+		return nil, fmt.Errorf("archive has no tiles")
+	}
+
+	zooms := make([]maptile.Zoom, 0, len(extents))
+	for z := range extents {
+		zooms = append(zooms, z)
+	}
+	sort.Slice(zooms, func(i, j int) bool { return zooms[i] < zooms[j] })
+
+	s := &SpatialMetadata{MinZoom: zooms[0], MaxZoom: zooms[len(zooms)-1]}
+
+	centerZoom := zooms[0]
+	for i, z := range zooms {
+		e := extents[z]
+		s.Tiles += e.count
+
+		bound := maptile.New(e.minX, e.minY, z).Bound().Union(maptile.New(e.maxX, e.maxY, z).Bound())
+		if i == 0 {
+			s.Bounds = bound
+		} else {
+			s.Bounds = s.Bounds.Union(bound)
+		}
+
+		if e.count <= centerSearchLimit {
+			centerZoom = z
+		}
+	}
+
+	tile, err := nearest(centerZoom, extents[centerZoom])
+	if err != nil {
+		return nil, err
+	}
+	s.Center = tile.Bound().Center()
+
+	return s, nil
+}
+
+// ComputeSpatialMetadata computes the SpatialMetadata of the MBTiles or
+// PMTiles archive at path without reading any tile data.
+func ComputeSpatialMetadata(path string) (*SpatialMetadata, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".pmtiles") {
+		return computePmtilesSpatialMetadata(path)
+	}
+	return computeMbtilesSpatialMetadata(path)
+}
+
+// computeMbtilesSpatialMetadata aggregates the tile coordinates per zoom in
+// SQL, which SQLite answers from the map or tiles index alone.
+func computeMbtilesSpatialMetadata(path string) (*SpatialMetadata, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// The deduplicated schema is queried without joining the images table.
+	table := "tiles"
+	var hasMap int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='map'").Scan(&hasMap); err != nil {
+		return nil, err
+	}
+	if hasMap > 0 {
+		table = "map"
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT zoom_level, MIN(tile_column), MAX(tile_column), MIN(tile_row), MAX(tile_row), COUNT(*)
+		FROM %s GROUP BY zoom_level`, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate tiles: %w", err)
+	}
+
+	extents := map[maptile.Zoom]*zoomExtent{}
+	for rows.Next() {
+		var z maptile.Zoom
+		var minRow, maxRow uint32
+		e := &zoomExtent{}
+		if err := rows.Scan(&z, &e.minX, &e.maxX, &minRow, &maxRow, &e.count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// TMS rows count from the south.
+		e.minY, e.maxY = flipY(maxRow, z), flipY(minRow, z)
+		extents[z] = e
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return spatialMetadataFromExtents(extents, func(z maptile.Zoom, e *zoomExtent) (maptile.Tile, error) {
+		midX := int64(e.minX) + int64(e.maxX)
+		midRow := int64(flipY(e.minY, z)) + int64(flipY(e.maxY, z))
+
+		var x, row uint32
+		err := db.QueryRow(fmt.Sprintf(`SELECT tile_column, tile_row FROM %s WHERE zoom_level = ?
+			ORDER BY (2 * tile_column - ?) * (2 * tile_column - ?) + (2 * tile_row - ?) * (2 * tile_row - ?) LIMIT 1`, table),
+			z, midX, midX, midRow, midRow).Scan(&x, &row)
+		if err != nil {
+			return maptile.Tile{}, fmt.Errorf("failed to find center tile: %w", err)
+		}
+		return maptile.New(x, flipY(row, z), z), nil
+	})
+}
+
+// tileSquare is a square of tiles, size tiles wide, whose top left tile is
+// x, y.
+type tileSquare struct {
+	x, y, size uint32
+}
+
+// hilbertSquares calls visit with the squares of tiles covering the tile IDs
+// from first up to last at zoom z. A range of 4^j IDs starting at a multiple
+// of 4^j from the first ID of a zoom follows the Hilbert curve through one
+// aligned square, so a range needs at most a few squares per zoom level,
+// however many tiles it holds.
+func hilbertSquares(z uint8, first uint64, last uint64, visit func(tileSquare)) {
+	base := pmtiles.ZxyToID(z, 0, 0)
+	for pos, end := first-base, last-base; pos < end; {
+		j := uint(0)
+		for j < uint(z) && pos%(uint64(1)<<(2*(j+1))) == 0 && pos+uint64(1)<<(2*(j+1)) <= end {
+			j++
+		}
+		_, x, y := pmtiles.IDToZxy(base + pos)
+		visit(tileSquare{x: x >> j << j, y: y >> j << j, size: 1 << j})
+		pos += uint64(1) << (2 * j)
+	}
+}
+
+// nearestInSquare returns the tile of sq nearest the middle of e, and its
+// distance2.
+func nearestInSquare(e *zoomExtent, sq tileSquare) (uint32, uint32, int64) {
+	clamp := func(v uint32, lo uint32) uint32 {
+		return min(max(v, lo), lo+sq.size-1)
+	}
+	// The middle may fall between two tiles, so both are tried.
+	midX, midY := (e.minX+e.maxX)/2, (e.minY+e.maxY)/2
+	bestX, bestY, best := uint32(0), uint32(0), int64(-1)
+	for _, x := range []uint32{clamp(midX, sq.x), clamp(midX+1, sq.x)} {
+		for _, y := range []uint32{clamp(midY, sq.y), clamp(midY+1, sq.y)} {
+			if d := e.distance2(x, y); best < 0 || d < best {
+				bestX, bestY, best = x, y, d
+			}
+		}
+	}
+	return bestX, bestY, best
+}
+
+// computePmtilesSpatialMetadata walks the directories of a PMTiles archive
+// once. The extent of each zoom is taken from the squares the runs of its
+// entries cover, without visiting their tiles one by one, and the squares of
+// zooms with few enough tiles to search for the center are kept.
+func computePmtilesSpatialMetadata(path string) (*SpatialMetadata, error) {
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	extents := map[maptile.Zoom]*zoomExtent{}
+	squares := map[maptile.Zoom][]tileSquare{}
+	err = reader.visitEntries(reader.header.RootOffset, reader.header.RootLength, false, func(entry pmtiles.EntryV3) error {
+		// A run may cross into the next zoom.
+		for first, end := entry.TileID, entry.TileID+uint64(entry.RunLength); first < end; {
+			z, _, _ := pmtiles.IDToZxy(first)
+			last := min(end, pmtiles.ZxyToID(z+1, 0, 0))
+
+			e, ok := extents[maptile.Zoom(z)]
+			if !ok {
+				e = &zoomExtent{}
+				extents[maptile.Zoom(z)] = e
+			}
+			hilbertSquares(z, first, last, func(sq tileSquare) {
+				e.addSquare(sq.x, sq.y, sq.size)
+				if e.count <= centerSearchLimit {
+					squares[maptile.Zoom(z)] = append(squares[maptile.Zoom(z)], sq)
+				} else {
+					delete(squares, maptile.Zoom(z))
+				}
+			})
+
+			first = last
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return spatialMetadataFromExtents(extents, func(z maptile.Zoom, e *zoomExtent) (maptile.Tile, error) {
+		var best maptile.Tile
+		bestDistance := int64(-1)
+		for _, sq := range squares[z] {
+			if x, y, d := nearestInSquare(e, sq); bestDistance < 0 || d < bestDistance {
+				best, bestDistance = maptile.New(x, y, z), d
+			}
+		}
+		if bestDistance < 0 {
+			return best, fmt.Errorf("failed to find center tile at zoom %d", z)
+		}
+		return best, nil
+	})
+}
@@ -0,0 +1,165 @@
+package tilepack
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// spatialTestTiles cover the north-west quarter of the world at z1, plus a
+// populated tile far from the middle of the z2 extent.
+var spatialTestTiles = map[maptile.Tile][]byte{
+	maptile.New(0, 0, 1): []byte("a"),
+	maptile.New(0, 0, 2): []byte("b"),
+	maptile.New(1, 0, 2): []byte("c"),
+	maptile.New(0, 1, 2): []byte("d"),
+	maptile.New(1, 1, 2): []byte("e"),
+	maptile.New(3, 3, 2): []byte("f"),
+}
+
+func checkSpatialMetadata(t *testing.T, s *SpatialMetadata) {
+	t.Helper()
+
+	if s.MinZoom != 1 || s.MaxZoom != 2 || s.Tiles != 6 {
+		t.Errorf("zooms %d-%d, tiles %d", s.MinZoom, s.MaxZoom, s.Tiles)
+	}
+
+	// z1 (0,0) is the north-west quarter; z2 (3,3) reaches the south-east
+	// corner, so the bounds are the whole world.
+	if s.Bounds.Min[0] != -180 || s.Bounds.Max[0] != 180 || s.Bounds.Max[1] < 85 || s.Bounds.Min[1] > -85 {
+		t.Errorf("bounds: %v", s.Bounds)
+	}
+
+	// The middle of the z2 extent is the corner between (1,1) and (2,2), so
+	// the nearest populated tile is (1,1), just north-west of 0,0.
+	want := maptile.New(1, 1, 2).Bound().Center()
+	if math.Abs(s.Center[0]-want[0]) > 1e-9 || math.Abs(s.Center[1]-want[1]) > 1e-9 {
+		t.Errorf("center: got %v, want %v", s.Center, want)
+	}
+}
+
+func TestComputeSpatialMetadata_Mbtiles(t *testing.T) {
+	path := writeTestMbtiles(t, "spatial.mbtiles", spatialTestTiles)
+
+	s, err := ComputeSpatialMetadata(path)
+	if err != nil {
+		t.Fatalf("ComputeSpatialMetadata: %v", err)
+	}
+	checkSpatialMetadata(t, s)
+}
+
+func TestComputeSpatialMetadata_MbtilesTMS(t *testing.T) {
+	// A single tile in the south-east: TMS row 0 at z2 is the southern row.
+	path := writeTestMbtiles(t, "tms.mbtiles", map[maptile.Tile][]byte{maptile.New(3, 3, 2): []byte("a")})
+
+	s, err := ComputeSpatialMetadata(path)
+	if err != nil {
+		t.Fatalf("ComputeSpatialMetadata: %v", err)
+	}
+	if s.Bounds != maptile.New(3, 3, 2).Bound() {
+		t.Errorf("bounds: got %v, want %v", s.Bounds, maptile.New(3, 3, 2).Bound())
+	}
+}
+
+func TestComputeSpatialMetadata_Pmtiles(t *testing.T) {
+	path := writeTestPmtiles(t, spatialTestTiles)
+
+	s, err := ComputeSpatialMetadata(path)
+	if err != nil {
+		t.Fatalf("ComputeSpatialMetadata: %v", err)
+	}
+	checkSpatialMetadata(t, s)
+}
+
+func TestHilbertSquares(t *testing.T) {
+	// The squares of a range of tile IDs must cover exactly its tiles.
+	for z := uint8(0); z <= 4; z++ {
+		base := pmtiles.ZxyToID(z, 0, 0)
+		n := uint64(1) << (2 * z)
+		for first := base; first < base+n; first++ {
+			for last := first + 1; last <= base+n; last += 3 {
+				want := map[maptile.Tile]bool{}
+				for id := first; id < last; id++ {
+					_, x, y := pmtiles.IDToZxy(id)
+					want[maptile.New(x, y, maptile.Zoom(z))] = true
+				}
+
+				got := map[maptile.Tile]bool{}
+				squares := 0
+				hilbertSquares(z, first, last, func(sq tileSquare) {
+					squares++
+					for x := sq.x; x < sq.x+sq.size; x++ {
+						for y := sq.y; y < sq.y+sq.size; y++ {
+							got[maptile.New(x, y, maptile.Zoom(z))] = true
+						}
+					}
+				})
+
+				if len(got) != len(want) || squares > 6*int(z)+1 {
+					t.Fatalf("z%d [%d, %d): %d squares cover %d tiles, want %d", z, first, last, squares, len(got), len(want))
+				}
+				for tile := range want {
+					if !got[tile] {
+						t.Fatalf("z%d [%d, %d): %v is not covered", z, first, last, tile)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestComputeSpatialMetadata_PmtilesRuns(t *testing.T) {
+	// A world of identical tiles is a single run across every zoom.
+	tiles := map[maptile.Tile][]byte{}
+	for z := maptile.Zoom(0); z <= 6; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles[maptile.New(x, y, z)] = []byte("ocean")
+			}
+		}
+	}
+	path := writeTestPmtiles(t, tiles)
+
+	s, err := ComputeSpatialMetadata(path)
+	if err != nil {
+		t.Fatalf("ComputeSpatialMetadata: %v", err)
+	}
+	if s.MinZoom != 0 || s.MaxZoom != 6 || s.Tiles != int64(len(tiles)) {
+		t.Errorf("zooms %d-%d, tiles %d, want 0-6 and %d", s.MinZoom, s.MaxZoom, s.Tiles, len(tiles))
+	}
+	if world := maptile.New(0, 0, 0).Bound(); s.Bounds != world {
+		t.Errorf("bounds: got %v, want %v", s.Bounds, world)
+	}
+	// The middle of z6 is the corner of (31,31) and (32,32); the first tile
+	// tried nearest it is (31,31).
+	if want := maptile.New(31, 31, 6).Bound().Center(); s.Center != want {
+		t.Errorf("center: got %v, want %v", s.Center, want)
+	}
+}
+
+func TestComputeSpatialMetadata_Empty(t *testing.T) {
+	path := writeTestMbtiles(t, "empty.mbtiles", map[maptile.Tile][]byte{maptile.New(0, 0, 0): []byte("a")})
+	execSQL(t, path, "DELETE FROM map")
+	if _, err := ComputeSpatialMetadata(path); err == nil {
+		t.Error("expected an error for an archive without tiles")
+	}
+}
+
+func TestSpatialMetadata_Apply(t *testing.T) {
+	path := writeTestMbtiles(t, "apply.mbtiles", spatialTestTiles)
+	s, err := ComputeSpatialMetadata(path)
+	if err != nil {
+		t.Fatalf("ComputeSpatialMetadata: %v", err)
+	}
+
+	m := NewMbtilesMetadata(map[string]string{"name": "x", "format": "pbf"})
+	s.Apply(m)
+	if err := m.Validate(); err != nil {
+		t.Errorf("applied metadata is invalid: %v", err)
+	}
+	if _, z, _ := m.Center(); z != 1 {
+		t.Errorf("center zoom: got %d, want 1", z)
+	}
+}
@@ -0,0 +1,226 @@
+package tilepack
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// ZoomStats describes the tiles of an archive at one zoom.
+type ZoomStats struct {
+	Tiles int64
+	Bytes int64
+	// sizes holds the stored size of every tile, for the distribution.
+	sizes []int
+}
+
+// SizePercentile returns the stored size below or at which p percent of the
+// tiles fall, using the nearest-rank method. It returns 0 if there are no
+// tiles.
+func (s *ZoomStats) SizePercentile(p float64) int {
+	if len(s.sizes) == 0 {
+		return 0
+	}
+	if !sort.IntsAreSorted(s.sizes) {
+		sort.Ints(s.sizes)
+	}
+
+	rank := int(p/100*float64(len(s.sizes))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(s.sizes) {
+		rank = len(s.sizes) - 1
+	}
+	return s.sizes[rank]
+}
+
+// TileSize is the stored size of a tile.
+type TileSize struct {
+	Tile maptile.Tile
+	Size int
+}
+
+// LayerStats describes one MVT layer across the tiles of an archive.
+type LayerStats struct {
+	// Tiles is the number of tiles holding the layer.
+	Tiles    int64
+	Features int64
+	// Bytes is the encoded size of the layer before compression, summed over
+	// all tiles.
+	Bytes   int64
+	MinZoom maptile.Zoom
+	MaxZoom maptile.Zoom
+}
+
+// ArchiveStats describes the tiles of an archive.
+type ArchiveStats struct {
+	Zooms map[maptile.Zoom]*ZoomStats
+	// Addressed is the number of tiles, Unique the number of distinct tile
+	// contents among them.
+	Addressed int64
+	Unique    int64
+	// Largest holds the biggest tiles, largest first.
+	Largest []TileSize
+	// Layers is only filled for MVT archives.
+	Layers map[string]*LayerStats
+	// UndecodableTiles counts the MVT tiles that could not be decoded and are
+	// missing from Layers.
+	UndecodableTiles int64
+}
+
+// DedupRatio returns how many tiles are addressed per stored tile content.
+func (s *ArchiveStats) DedupRatio() float64 {
+	if s.Unique == 0 {
+		return 0
+	}
+	return float64(s.Addressed) / float64(s.Unique)
+}
+
+// SortedZooms returns the zooms holding tiles, in order.
+func (s *ArchiveStats) SortedZooms() []maptile.Zoom {
+	zooms := make([]maptile.Zoom, 0, len(s.Zooms))
+	for z := range s.Zooms {
+		zooms = append(zooms, z)
+	}
+	sort.Slice(zooms, func(i, j int) bool { return zooms[i] < zooms[j] })
+	return zooms
+}
+
+// SortedLayers returns the layer names, in order.
+func (s *ArchiveStats) SortedLayers() []string {
+	names := make([]string, 0, len(s.Layers))
+	for name := range s.Layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LayerByteShare returns the fraction of the MVT bytes of all layers taken by
+// the named layer.
+func (s *ArchiveStats) LayerByteShare(name string) float64 {
+	var total int64
+	for _, layer := range s.Layers {
+		total += layer.Bytes
+	}
+	layer, ok := s.Layers[name]
+	if !ok || total == 0 {
+		return 0
+	}
+	return float64(layer.Bytes) / float64(total)
+}
+
+// Total returns the counts and size distribution of all zooms together.
+func (s *ArchiveStats) Total() *ZoomStats {
+	total := &ZoomStats{}
+	for _, z := range s.Zooms {
+		total.Tiles += z.Tiles
+		total.Bytes += z.Bytes
+		total.sizes = append(total.sizes, z.sizes...)
+	}
+	return total
+}
+
+// tileSizeHeap is a min-heap of tile sizes, so the smallest of the largest
+// tiles seen so far can be replaced.
+type tileSizeHeap []TileSize
+
+func (h tileSizeHeap) Len() int            { return len(h) }
+func (h tileSizeHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h tileSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tileSizeHeap) Push(x interface{}) { *h = append(*h, x.(TileSize)) }
+func (h *tileSizeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// CollectStats reads every tile of reader and gathers its ArchiveStats,
+// keeping the largest tiles. Tiles are deduplicated by their hasher content
+// hash. MVT layers are decoded when the archive's format metadata is pbf or
+// mvt.
+func CollectStats(reader TileReader, hasher *ContentHasher, largest int) (*ArchiveStats, error) {
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	format, _ := metadata.Get("format")
+	decodeLayers := format == "pbf" || format == "mvt"
+
+	stats := &ArchiveStats{Zooms: map[maptile.Zoom]*ZoomStats{}}
+	if decodeLayers {
+		stats.Layers = map[string]*LayerStats{}
+	}
+
+	seen := map[ContentHash]struct{}{}
+	biggest := &tileSizeHeap{}
+
+	err = reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		zs, ok := stats.Zooms[tile.Z]
+		if !ok {
+			zs = &ZoomStats{}
+			stats.Zooms[tile.Z] = zs
+		}
+		zs.Tiles++
+		zs.Bytes += int64(len(data))
+		zs.sizes = append(zs.sizes, len(data))
+
+		stats.Addressed++
+		hash := hasher.Sum(data)
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = struct{}{}
+			stats.Unique++
+		}
+
+		if largest > 0 {
+			if biggest.Len() < largest {
+				heap.Push(biggest, TileSize{Tile: tile, Size: len(data)})
+			} else if (*biggest)[0].Size < len(data) {
+				(*biggest)[0] = TileSize{Tile: tile, Size: len(data)}
+				heap.Fix(biggest, 0)
+			}
+		}
+
+		if decodeLayers {
+			stats.addLayers(tile, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Largest = make([]TileSize, biggest.Len())
+	for i := len(stats.Largest) - 1; i >= 0; i-- {
+		stats.Largest[i] = heap.Pop(biggest).(TileSize)
+	}
+
+	return stats, nil
+}
+
+func (s *ArchiveStats) addLayers(tile maptile.Tile, data []byte) {
+	layers, err := DecodeMVT(data)
+	if err != nil {
+		s.UndecodableTiles++
+		return
+	}
+
+	for _, layer := range layers {
+		ls, ok := s.Layers[layer.Name]
+		if !ok {
+			ls = &LayerStats{MinZoom: tile.Z, MaxZoom: tile.Z}
+			s.Layers[layer.Name] = ls
+		}
+		ls.Tiles++
+		ls.Features += int64(layer.Features)
+		ls.Bytes += int64(layer.Size)
+		if tile.Z < ls.MinZoom {
+			ls.MinZoom = tile.Z
+		}
+		if tile.Z > ls.MaxZoom {
+			ls.MaxZoom = tile.Z
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tilepack
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+func TestCollectStats(t *testing.T) {
+	ocean := encodeTestMVT(map[string][]testMVTFeature{"water": {{"kind": "ocean"}}})
+	land := encodeTestMVT(map[string][]testMVTFeature{
+		"water": {{"kind": "lake"}},
+		"roads": {{"kind": "major"}, {"kind": "minor"}, {"kind": "path"}},
+	})
+
+	path := writeTestMbtiles(t, "stats.mbtiles", map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): land,
+		maptile.New(0, 0, 1): ocean,
+		maptile.New(1, 0, 1): ocean,
+		maptile.New(0, 1, 1): ocean,
+		maptile.New(1, 1, 1): land,
+	})
+	reader, err := OpenTileReader(path)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer reader.Close()
+
+	stats, err := CollectStats(reader, DefaultContentHasher, 2)
+	if err != nil {
+		t.Fatalf("CollectStats: %v", err)
+	}
+
+	if stats.Addressed != 5 || stats.Unique != 2 || stats.DedupRatio() != 2.5 {
+		t.Errorf("addressed %d, unique %d, ratio %f", stats.Addressed, stats.Unique, stats.DedupRatio())
+	}
+
+	z1 := stats.Zooms[1]
+	if z1 == nil || z1.Tiles != 4 {
+		t.Fatalf("z1 stats: %+v", z1)
+	}
+	if z1.SizePercentile(0) != len(ocean) || z1.SizePercentile(50) != len(ocean) || z1.SizePercentile(100) != len(land) {
+		t.Errorf("z1 sizes: min %d, median %d, max %d", z1.SizePercentile(0), z1.SizePercentile(50), z1.SizePercentile(100))
+	}
+
+	if len(stats.Largest) != 2 || stats.Largest[0].Size != len(land) || stats.Largest[1].Size != len(land) {
+		t.Errorf("largest: %+v", stats.Largest)
+	}
+
+	roads := stats.Layers["roads"]
+	if roads == nil || roads.Tiles != 2 || roads.Features != 6 || roads.MinZoom != 0 || roads.MaxZoom != 1 {
+		t.Errorf("roads: %+v", roads)
+	}
+	water := stats.Layers["water"]
+	if water == nil || water.Tiles != 5 || water.Features != 5 {
+		t.Errorf("water: %+v", water)
+	}
+	if share := stats.LayerByteShare("roads") + stats.LayerByteShare("water"); share < 0.999 || share > 1.001 {
+		t.Errorf("layer byte shares add up to %f", share)
+	}
+	if stats.UndecodableTiles != 0 {
+		t.Errorf("undecodable tiles: %d", stats.UndecodableTiles)
+	}
+}
+
+func TestCollectStats_PmtilesCompressions(t *testing.T) {
+	// Vector tiles are decoded whatever compression the archive stores them
+	// with.
+	tile := encodeTestMVT(map[string][]testMVTFeature{"roads": {{"kind": "major"}, {"kind": "minor"}}})
+	for _, c := range []pmtiles.Compression{pmtiles.Gzip, pmtiles.Brotli, pmtiles.Zstd} {
+		o, path := newTestPmtilesOutputter(t, "mvt")
+		if err := o.SetTileCompression(c); err != nil {
+			t.Fatalf("SetTileCompression: %v", err)
+		}
+		if err := o.Save(maptile.New(0, 0, 0), tile); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := o.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		reader, err := OpenTileReader(path)
+		if err != nil {
+			t.Fatalf("OpenTileReader: %v", err)
+		}
+		stats, err := CollectStats(reader, DefaultContentHasher, 1)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("CollectStats: %v", err)
+		}
+
+		name := tileCompressionName(c)
+		if stats.UndecodableTiles != 0 {
+			t.Errorf("%s: undecodable tiles: %d", name, stats.UndecodableTiles)
+		}
+		if roads := stats.Layers["roads"]; roads == nil || roads.Features != 2 {
+			t.Errorf("%s: roads: %+v", name, roads)
+		}
+	}
+}
+
+func TestCollectStats_Raster(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	path := writeTestPmtiles(t, map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): png,
+		maptile.New(0, 0, 1): bytes.Repeat(png, 2),
+	})
+	reader, err := OpenTileReader(path)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer reader.Close()
+
+	stats, err := CollectStats(reader, DefaultContentHasher, 10)
+	if err != nil {
+		t.Fatalf("CollectStats: %v", err)
+	}
+	if stats.Layers != nil {
+		t.Errorf("raster archives have no layers: %+v", stats.Layers)
+	}
+	if len(stats.Largest) != 2 || stats.Largest[0].Tile != maptile.New(0, 0, 1) {
+		t.Errorf("largest: %+v", stats.Largest)
+	}
+	if total := stats.Total(); total.Tiles != 2 || total.Bytes != 24 {
+		t.Errorf("total: %+v", total)
+	}
+}
+
+func TestSizePercentile(t *testing.T) {
+	s := &ZoomStats{sizes: []int{5, 1, 4, 2, 3, 6, 7, 8, 9, 10}}
+	for p, want := range map[float64]int{0: 1, 50: 5, 99: 10, 100: 10} {
+		if got := s.SizePercentile(p); got != want {
+			t.Errorf("p%v: got %d, want %d", p, got, want)
+		}
+	}
+	if (&ZoomStats{}).SizePercentile(50) != 0 {
+		t.Error("empty stats should have a zero percentile")
+	}
+}
@@ -3,12 +3,9 @@ package tilepack
 import (
 	"archive/zip"
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -18,7 +15,9 @@ import (
 	"github.com/paulmach/orb/maptile"
 )
 
-func NewTapalcatl2JobGenerator(bucket string, requesterPays bool, pathTemplate string, layerName string, materializedZooms []maptile.Zoom, zooms []maptile.Zoom, bounds orb.Bound) (JobGenerator, error) {
+// NewTapalcatl2JobGenerator creates a generator that reads the tiles of format,
+// such as png or mvt, out of Tapalcatl 2 archives in an S3 bucket.
+func NewTapalcatl2JobGenerator(bucket string, requesterPays bool, pathTemplate string, layerName string, format string, materializedZooms []maptile.Zoom, zooms []maptile.Zoom, bounds orb.Bound) (JobGenerator, error) {
 	sess, err := session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	})
@@ -34,6 +33,7 @@ func NewTapalcatl2JobGenerator(bucket string, requesterPays bool, pathTemplate s
 		requesterPays:     requesterPays,
 		pathTemplate:      pathTemplate,
 		layerName:         layerName,
+		format:            format,
 		materializedZooms: materializedZooms,
 		bounds:            bounds,
 		zooms:             zooms,
@@ -47,6 +47,7 @@ type tapalcatl2JobGenerator struct {
 	requesterPays     bool
 	pathTemplate      string
 	layerName         string
+	format            string
 	materializedZooms []maptile.Zoom
 	bounds            orb.Bound
 	zooms             []maptile.Zoom
@@ -70,14 +71,25 @@ func zoomSliceToSet(zooms []maptile.Zoom) map[maptile.Zoom]struct{} {
 	return s
 }
 
-func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileRequest, results chan *TileResponse), error) {
+func (x *tapalcatl2JobGenerator) CreateWorker() (TileWorker, error) {
 	// Build zoom set once per worker; guards against direct struct construction in tests.
 	zoomSet := x.zoomSet
 	if zoomSet == nil {
 		zoomSet = zoomSliceToSet(x.zooms)
 	}
-	f := func(id int, jobs chan *TileRequest, results chan *TileResponse) {
-		for request := range jobs {
+	// Tilezen's t2 archives were read for their png tiles before the format
+	// could be picked.
+	wantFormat := x.format
+	if wantFormat == "" {
+		wantFormat = "png"
+	}
+	f := func(ctx context.Context, id int, jobs <-chan *TileRequest, results chan<- *TileResponse) {
+		for {
+			request, ok := nextJob(ctx, jobs)
+			if !ok {
+				return
+			}
+
 			// Download the Tapalcatl2 archive zip to a byte buffer
 			compressedBytes := &aws.WriteAtBuffer{}
 			input := &s3.GetObjectInput{
@@ -89,9 +101,16 @@ func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileReq
 				input.RequestPayer = aws.String("requester")
 			}
 
-			numBytes, err := x.s3Client.Download(compressedBytes, input)
+			numBytes, err := x.s3Client.DownloadWithContext(ctx, compressedBytes, input)
 			if err != nil {
-				log.Fatalf("Unable to download item %s: %+v", request.URL, err)
+				if ctx.Err() != nil {
+					return
+				}
+				sendResponse(ctx, results, &TileResponse{
+					Tile: request.Tile,
+					Err:  fmt.Errorf("unable to download item %s: %w", request.URL, err),
+				})
+				continue
 			}
 
 			// Uncompress the archive
@@ -99,15 +118,31 @@ func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileReq
 			readBytesReader := bytes.NewReader(readBytes)
 			zippedReader, err := zip.NewReader(readBytesReader, numBytes)
 			if err != nil {
-				log.Fatalf("Unable to unzip t2 archive %s: %+v", request.URL, err)
+				sendResponse(ctx, results, &TileResponse{
+					Tile: request.Tile,
+					Err:  fmt.Errorf("unable to unzip t2 archive %s: %w", request.URL, err),
+				})
+				continue
 			}
 
 			// Iterate over the contents of the zip and add them as TileResponses
 			for _, zf := range zippedReader.File {
 				var tileX, tileY uint32
 				var tileZ maptile.Zoom
-				if n, err := fmt.Sscanf(zf.Name, "%d/%d/%d@2x.png", &tileZ, &tileX, &tileY); err != nil || n != 3 {
-					log.Fatalf("Couldn't scan t2 name")
+				var format string
+				if n, err := fmt.Sscanf(zf.Name, "%d/%d/%d@2x.%s", &tileZ, &tileX, &tileY, &format); err != nil || n != 4 {
+					if !sendResponse(ctx, results, &TileResponse{
+						Tile: request.Tile,
+						Err:  fmt.Errorf("couldn't scan t2 name %q in %s", zf.Name, request.URL),
+					}) {
+						return
+					}
+					continue
+				}
+
+				// Skip formats we don't care about
+				if format != wantFormat {
+					continue
 				}
 
 				t := maptile.New(tileX, tileY, tileZ)
@@ -120,20 +155,14 @@ func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileReq
 					continue
 				}
 
-				// Read the data for the tile
-				zfReader, err := zf.Open()
-				if err != nil {
-					log.Fatalf("Couldn't read zf %s: %+v", zf.Name, err)
+				response := &TileResponse{Tile: t}
+				response.Data, response.Err = readZipEntry(zf)
+				if response.Err != nil {
+					response.Err = fmt.Errorf("couldn't read %s from %s: %w", zf.Name, request.URL, response.Err)
 				}
 
-				b, err := io.ReadAll(zfReader)
-				if err != nil {
-					log.Fatalf("Couldn't read zf %s: %+v", zf.Name, err)
-				}
-
-				results <- &TileResponse{
-					Data: b,
-					Tile: t,
+				if !sendResponse(ctx, results, response) {
+					return
 				}
 			}
 		}
@@ -142,7 +171,18 @@ func (x *tapalcatl2JobGenerator) CreateWorker() (func(id int, jobs chan *TileReq
 	return f, nil
 }
 
-func (x *tapalcatl2JobGenerator) CreateJobs(jobs chan *TileRequest) error {
+// readZipEntry reads the contents of a file in a zip archive.
+func readZipEntry(zf *zip.File) ([]byte, error) {
+	zfReader, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer zfReader.Close()
+
+	return io.ReadAll(zfReader)
+}
+
+func (x *tapalcatl2JobGenerator) CreateJobs(ctx context.Context, jobs chan<- *TileRequest) error {
 	// Iterate over the list of materialized zooms
 	for _, materializedZoom := range x.materializedZooms {
 		// Generate requests for tiles in the bounding box at this materialized zoom
@@ -150,24 +190,17 @@ func (x *tapalcatl2JobGenerator) CreateJobs(jobs chan *TileRequest) error {
 			Bounds:    x.bounds,
 			InvertedY: false,
 			Zooms:     []maptile.Zoom{materializedZoom},
+			Context:   ctx,
 			ConsumerFunc: func(t maptile.Tile) {
-				hash := md5.Sum([]byte(fmt.Sprintf("%d/%d/%d.zip", t.Z, t.X, t.Y)))
-				hashHex := hex.EncodeToString(hash[:])
+				path := tilezenArchivePath(x.pathTemplate, x.layerName, t)
 
-				path := strings.NewReplacer(
-					"{x}", fmt.Sprintf("%d", t.X),
-					"{y}", fmt.Sprintf("%d", t.Y),
-					"{z}", fmt.Sprintf("%d", t.Z),
-					"{l}", x.layerName,
-					"{h}", hashHex[:5]).Replace(x.pathTemplate)
-
-				jobs <- &TileRequest{
+				sendJob(ctx, jobs, &TileRequest{
 					Tile: t,
 					URL:  path,
-				}
+				})
 			},
 		})
 	}
 
-	return nil
+	return ctx.Err()
 }
@@ -1,6 +1,7 @@
 package tilepack
 
 import (
+	"context"
 	"math"
 
 	"github.com/paulmach/orb"
@@ -24,6 +25,8 @@ type GenerateTilesOptions struct {
 	Zooms        []maptile.Zoom
 	ConsumerFunc GenerateTilesConsumerFunc
 	InvertedY    bool
+	// Context, if set, stops the generation once it is cancelled.
+	Context context.Context
 }
 
 func GenerateTileRanges(opts *GenerateRangesOptions) {
@@ -78,12 +81,23 @@ func GenerateTiles(opts *GenerateTilesOptions) {
 		Zooms:  opts.Zooms,
 	}
 
+	var done <-chan struct{}
+	if opts.Context != nil {
+		done = opts.Context.Done()
+	}
+
 	rangeOpts.ConsumerFunc = func(minTile maptile.Tile, maxTile maptile.Tile, z maptile.Zoom) {
 
 		for x := minTile.X; x <= maxTile.X; x++ {
 
 			for y := minTile.Y; y <= maxTile.Y; y++ {
 
+				select {
+				case <-done:
+					return
+				default:
+				}
+
 				tile_y := y
 
 				if opts.InvertedY {
@@ -0,0 +1,177 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// pmtilesMlt is the PMTiles tile type of MapLibre Tiles, which the pmtiles
+// package does not define yet.
+const pmtilesMlt pmtiles.TileType = 6
+
+// tileCompressions maps the names ParseTileCompression accepts to PMTiles
+// compressions.
+var tileCompressions = map[string]pmtiles.Compression{
+	"none":   pmtiles.NoCompression,
+	"gzip":   pmtiles.Gzip,
+	"brotli": pmtiles.Brotli,
+	"zstd":   pmtiles.Zstd,
+}
+
+// TileCompressionNames returns the names ParseTileCompression accepts.
+func TileCompressionNames() []string {
+	names := make([]string, 0, len(tileCompressions))
+	for name := range tileCompressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTileCompression returns the PMTiles tile compression with the given
+// name.
+func ParseTileCompression(name string) (pmtiles.Compression, error) {
+	c, ok := tileCompressions[name]
+	if !ok {
+		return pmtiles.UnknownCompression, fmt.Errorf("unknown tile compression %q: must be one of %v", name, TileCompressionNames())
+	}
+	return c, nil
+}
+
+// tileCompressionName returns the name ParseTileCompression accepts for c.
+func tileCompressionName(c pmtiles.Compression) string {
+	for name, compression := range tileCompressions {
+		if compression == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown (%d)", c)
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdDecoder decodes zstd tiles. A nil reader makes it usable with
+// DecodeAll from several goroutines.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// detectTileCompression returns the compression of a tile of tileType. Gzip
+// and zstd are recognised by their magic numbers. Brotli streams have none, so
+// only MVT tiles, whose uncompressed data starts with a layer field, are
+// taken to be brotli when they don't and decompress to data that does.
+// Anything else is taken to be uncompressed.
+func detectTileCompression(data []byte, tileType pmtiles.TileType) pmtiles.Compression {
+	if isGzipped(data) {
+		return pmtiles.Gzip
+	}
+	if bytes.HasPrefix(data, zstdMagic) {
+		return pmtiles.Zstd
+	}
+
+	if tileType == pmtiles.Mvt && !isMVTLayerField(data) {
+		if decoded, err := decompressTile(data, pmtiles.Brotli); err == nil && isMVTLayerField(decoded) {
+			return pmtiles.Brotli
+		}
+	}
+	return pmtiles.NoCompression
+}
+
+// isMVTLayerField reports whether data starts with field 3 of a vector tile
+// with wire type 2, as every field of a tile is a layer.
+func isMVTLayerField(data []byte) bool {
+	return len(data) > 0 && data[0] == 0x1a
+}
+
+// decompressTile undoes compression c of a tile.
+func decompressTile(data []byte, c pmtiles.Compression) ([]byte, error) {
+	switch c {
+	case pmtiles.NoCompression:
+		return data, nil
+	case pmtiles.Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case pmtiles.Brotli:
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	case pmtiles.Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unsupported tile compression %s", tileCompressionName(c))
+}
+
+// tileCompressor compresses tiles, reusing its buffer and encoders between
+// tiles. It is not safe for concurrent use.
+type tileCompressor struct {
+	buf    bytes.Buffer
+	gzip   *gzip.Writer
+	brotli *brotli.Writer
+	zstd   *zstd.Encoder
+	zbuf   []byte
+}
+
+// compress applies compression c to data. The result is only valid until the
+// next call.
+func (t *tileCompressor) compress(data []byte, c pmtiles.Compression) ([]byte, error) {
+	t.buf.Reset()
+
+	var w io.WriteCloser
+	switch c {
+	case pmtiles.NoCompression:
+		return data, nil
+	case pmtiles.Gzip:
+		if t.gzip == nil {
+			t.gzip, _ = gzip.NewWriterLevel(&t.buf, gzip.BestCompression)
+		}
+		t.gzip.Reset(&t.buf)
+		w = t.gzip
+	case pmtiles.Brotli:
+		if t.brotli == nil {
+			t.brotli = brotli.NewWriterLevel(&t.buf, brotli.DefaultCompression)
+		}
+		t.brotli.Reset(&t.buf)
+		w = t.brotli
+	case pmtiles.Zstd:
+		if t.zstd == nil {
+			var err error
+			if t.zstd, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression)); err != nil {
+				return nil, err
+			}
+		}
+		t.zbuf = t.zstd.EncodeAll(data, t.zbuf[:0])
+		return t.zbuf, nil
+	default:
+		return nil, fmt.Errorf("unsupported tile compression %s", tileCompressionName(c))
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("%s write: %w", tileCompressionName(c), err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("%s close: %w", tileCompressionName(c), err)
+	}
+	return t.buf.Bytes(), nil
+}
+
+// transcodeTile returns a tile of tileType with compression c, detecting the
+// compression it has and undoing it if it differs.
+func (t *tileCompressor) transcodeTile(data []byte, tileType pmtiles.TileType, c pmtiles.Compression) ([]byte, error) {
+	from := detectTileCompression(data, tileType)
+	if from == c {
+		return data, nil
+	}
+
+	decoded, err := decompressTile(data, from)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s tile: %w", tileCompressionName(from), err)
+	}
+	return t.compress(decoded, c)
+}
@@ -0,0 +1,60 @@
+package tilepack
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+func TestParseTileCompression(t *testing.T) {
+	for _, name := range TileCompressionNames() {
+		c, err := ParseTileCompression(name)
+		if err != nil {
+			t.Fatalf("ParseTileCompression(%q): %v", name, err)
+		}
+		if got := tileCompressionName(c); got != name {
+			t.Errorf("tileCompressionName(%d) = %q, want %q", c, got, name)
+		}
+	}
+	if _, err := ParseTileCompression("lz4"); err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+}
+
+func TestDetectTileCompression(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nrest of the image")
+	mvt := []byte{0x1a, 0x02, 0x78, 0x01}
+
+	var compressor tileCompressor
+	for _, tileType := range []pmtiles.TileType{pmtiles.Mvt, pmtiles.Png} {
+		plain := mvt
+		if tileType == pmtiles.Png {
+			plain = png
+		}
+		for _, c := range []pmtiles.Compression{pmtiles.NoCompression, pmtiles.Gzip, pmtiles.Brotli, pmtiles.Zstd} {
+			if tileType == pmtiles.Png && c == pmtiles.Brotli {
+				continue
+			}
+			compressed, err := compressor.compress(plain, c)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if got := detectTileCompression(compressed, tileType); got != c {
+				t.Errorf("tile type %d compressed with %s detected as %s", tileType, tileCompressionName(c), tileCompressionName(got))
+			}
+
+			decoded, err := decompressTile(compressed, c)
+			if err != nil || !bytes.Equal(decoded, plain) {
+				t.Errorf("%s round trip = %x, %v", tileCompressionName(c), decoded, err)
+			}
+		}
+	}
+
+	// Brotli streams have no magic number, so only MVT tiles are checked for
+	// it and other tiles are taken as they are.
+	compressed, _ := compressor.compress(png, pmtiles.Brotli)
+	if got := detectTileCompression(compressed, pmtiles.Png); got != pmtiles.NoCompression {
+		t.Errorf("brotli png tile detected as %s, want none", tileCompressionName(got))
+	}
+}
@@ -0,0 +1,291 @@
+package tilepack
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// ArchiveChecksum is an order-independent checksum of the tiles of an archive,
+// computed from each tile's coordinates and content hash. Archives holding the
+// same content have the same checksum whatever their format or tile order, as
+// long as it is computed with the same ContentHasher.
+type ArchiveChecksum struct {
+	sum   [sha256.Size]byte
+	count uint64
+}
+
+// Add adds a tile with the given content hash to the checksum.
+func (c *ArchiveChecksum) Add(tile maptile.Tile, contentHash ContentHash) {
+	var buf [9 + sha256.Size]byte
+	buf[0] = byte(tile.Z)
+	binary.BigEndian.PutUint32(buf[1:], tile.X)
+	binary.BigEndian.PutUint32(buf[5:], tile.Y)
+	n := 9 + copy(buf[9:], contentHash.Bytes())
+
+	tileSum := sha256.Sum256(buf[:n])
+	for i := range c.sum {
+		c.sum[i] ^= tileSum[i]
+	}
+	c.count++
+}
+
+// Count returns the number of tiles added.
+func (c *ArchiveChecksum) Count() uint64 {
+	return c.count
+}
+
+func (c *ArchiveChecksum) String() string {
+	return hex.EncodeToString(c.sum[:])
+}
+
+// ChecksumTileReader returns the ArchiveChecksum of every tile in reader.
+func ChecksumTileReader(reader TileReader, hasher *ContentHasher) (*ArchiveChecksum, error) {
+	checksum := &ArchiveChecksum{}
+	err := reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		checksum.Add(tile, hasher.Sum(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checksum, nil
+}
+
+// TileChangeKind describes how a tile differs between two archives.
+type TileChangeKind int
+
+const (
+	TileAdded TileChangeKind = iota
+	TileRemoved
+	TileChanged
+)
+
+func (k TileChangeKind) String() string {
+	switch k {
+	case TileAdded:
+		return "added"
+	case TileRemoved:
+		return "removed"
+	case TileChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// TileChange is a tile that differs between a base and a target archive.
+type TileChange struct {
+	Tile maptile.Tile
+	Kind TileChangeKind
+	// OldSize and NewSize are the stored sizes in bytes in the base and target
+	// archives, zero where the tile is missing.
+	OldSize int
+	NewSize int
+	// Data is the target's data for added and changed tiles.
+	Data []byte
+}
+
+// ZoomDiff counts the differences between two archives at one zoom.
+type ZoomDiff struct {
+	Added     int64
+	Removed   int64
+	Changed   int64
+	Unchanged int64
+	// AddedBytes is the size of added tiles, RemovedBytes the size of removed
+	// tiles and ChangedBytes the net size change of changed tiles.
+	AddedBytes   int64
+	RemovedBytes int64
+	ChangedBytes int64
+}
+
+// ByteDelta returns the net change in stored bytes.
+func (d *ZoomDiff) ByteDelta() int64 {
+	return d.AddedBytes - d.RemovedBytes + d.ChangedBytes
+}
+
+// ArchiveDiff summarises the differences between two archives.
+type ArchiveDiff struct {
+	Zooms          map[maptile.Zoom]*ZoomDiff
+	BaseChecksum   *ArchiveChecksum
+	TargetChecksum *ArchiveChecksum
+}
+
+// SortedZooms returns the zooms with differences or unchanged tiles, in order.
+func (d *ArchiveDiff) SortedZooms() []maptile.Zoom {
+	zooms := make([]maptile.Zoom, 0, len(d.Zooms))
+	for z := range d.Zooms {
+		zooms = append(zooms, z)
+	}
+	sort.Slice(zooms, func(i, j int) bool { return zooms[i] < zooms[j] })
+	return zooms
+}
+
+// Total returns the sum of the per-zoom counts.
+func (d *ArchiveDiff) Total() *ZoomDiff {
+	total := &ZoomDiff{}
+	for _, z := range d.Zooms {
+		total.Added += z.Added
+		total.Removed += z.Removed
+		total.Changed += z.Changed
+		total.Unchanged += z.Unchanged
+		total.AddedBytes += z.AddedBytes
+		total.RemovedBytes += z.RemovedBytes
+		total.ChangedBytes += z.ChangedBytes
+	}
+	return total
+}
+
+func (d *ArchiveDiff) zoom(z maptile.Zoom) *ZoomDiff {
+	zd, ok := d.Zooms[z]
+	if !ok {
+		zd = &ZoomDiff{}
+		d.Zooms[z] = zd
+	}
+	return zd
+}
+
+type diffBaseTile struct {
+	hash ContentHash
+	size int
+}
+
+// diffBlockTiles is the most base tiles DiffTileReaders holds at once.
+const diffBlockTiles = 1 << 16
+
+// diffMaxZoom is the deepest zoom DiffTileReaders compares, the deepest a
+// PMTiles tile ID can address.
+const diffMaxZoom = 31
+
+// errDiffBlockFull stops reading a block with too many base tiles.
+var errDiffBlockFull = errors.New("diff block full")
+
+// DiffTileReaders compares base and target tile by tile, calling onChange
+// for every added, changed and removed tile. Tiles are compared by their
+// hasher content hash, so recompressing a tile does not count as a change.
+//
+// Each zoom is compared in aligned square blocks of tiles read with
+// VisitTileRanges, so only the base tiles of one block are held at once. A
+// block with more than diffBlockTiles base tiles is split into its quarters.
+// The removed tiles of a block are reported after its other changes, in tile
+// order.
+func DiffTileReaders(base TileReader, target TileReader, hasher *ContentHasher, onChange func(*TileChange) error) (*ArchiveDiff, error) {
+	return diffTileReaders(base, target, hasher, diffBlockTiles, onChange)
+}
+
+func diffTileReaders(base TileReader, target TileReader, hasher *ContentHasher, blockTiles int, onChange func(*TileChange) error) (*ArchiveDiff, error) {
+	d := &tileDiffer{
+		base:       base,
+		target:     target,
+		hasher:     hasher,
+		blockTiles: blockTiles,
+		onChange:   onChange,
+		diff: &ArchiveDiff{
+			Zooms:          map[maptile.Zoom]*ZoomDiff{},
+			BaseChecksum:   &ArchiveChecksum{},
+			TargetChecksum: &ArchiveChecksum{},
+		},
+	}
+
+	for z := maptile.Zoom(0); z <= diffMaxZoom; z++ {
+		if err := d.diffBlock(maptile.New(0, 0, 0), z); err != nil {
+			return nil, err
+		}
+	}
+	return d.diff, nil
+}
+
+// tileDiffer holds the state of a DiffTileReaders call.
+type tileDiffer struct {
+	base, target TileReader
+	hasher       *ContentHasher
+	blockTiles   int
+	onChange     func(*TileChange) error
+	diff         *ArchiveDiff
+}
+
+// diffBlock compares the tiles at zoom z below block.
+func (d *tileDiffer) diffBlock(block maptile.Tile, z maptile.Zoom) error {
+	shift := uint(z - block.Z)
+	minX, minY := block.X<<shift, block.Y<<shift
+	r := TileRange{
+		Z:    z,
+		MinX: minX, MaxX: minX + uint32(uint64(1)<<shift-1),
+		MinY: minY, MaxY: minY + uint32(uint64(1)<<shift-1),
+	}
+
+	baseTiles := map[maptile.Tile]diffBaseTile{}
+	err := VisitTileRanges(d.base, []TileRange{r}, func(tile maptile.Tile, data []byte) error {
+		if len(baseTiles) == d.blockTiles {
+			return errDiffBlockFull
+		}
+		baseTiles[tile] = diffBaseTile{hash: d.hasher.Sum(data), size: len(data)}
+		return nil
+	})
+	if errors.Is(err, errDiffBlockFull) {
+		// A block of one tile holds at most one, so this stops at zoom z.
+		for _, child := range block.Children() {
+			if err := d.diffBlock(child, z); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for tile, old := range baseTiles {
+		d.diff.BaseChecksum.Add(tile, old.hash)
+	}
+
+	err = VisitTileRanges(d.target, []TileRange{r}, func(tile maptile.Tile, data []byte) error {
+		hash := d.hasher.Sum(data)
+		d.diff.TargetChecksum.Add(tile, hash)
+		zd := d.diff.zoom(tile.Z)
+
+		old, ok := baseTiles[tile]
+		if ok {
+			delete(baseTiles, tile)
+			if old.hash == hash {
+				zd.Unchanged++
+				return nil
+			}
+			zd.Changed++
+			zd.ChangedBytes += int64(len(data) - old.size)
+			return d.onChange(&TileChange{Tile: tile, Kind: TileChanged, OldSize: old.size, NewSize: len(data), Data: data})
+		}
+
+		zd.Added++
+		zd.AddedBytes += int64(len(data))
+		return d.onChange(&TileChange{Tile: tile, Kind: TileAdded, NewSize: len(data), Data: data})
+	})
+	if err != nil {
+		return err
+	}
+
+	removed := make([]maptile.Tile, 0, len(baseTiles))
+	for tile := range baseTiles {
+		removed = append(removed, tile)
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		a, b := removed[i], removed[j]
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+
+	for _, tile := range removed {
+		old := baseTiles[tile]
+		zd := d.diff.zoom(tile.Z)
+		zd.Removed++
+		zd.RemovedBytes += int64(old.size)
+		if err := d.onChange(&TileChange{Tile: tile, Kind: TileRemoved, OldSize: old.size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package tilepack
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// writeTestMbtiles writes tiles to a new MBTiles file and returns its path.
+func writeTestMbtiles(t *testing.T, name string, tiles map[maptile.Tile][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	o, err := NewMbtilesOutputter(path, 100, false, NewMbtilesMetadata(map[string]string{"name": name, "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func TestArchiveChecksum_OrderIndependent(t *testing.T) {
+	a, b := &ArchiveChecksum{}, &ArchiveChecksum{}
+	t1, t2 := maptile.New(0, 0, 1), maptile.New(1, 0, 1)
+	h1, h2 := DefaultContentHasher.Sum([]byte("1")), DefaultContentHasher.Sum([]byte("2"))
+
+	a.Add(t1, h1)
+	a.Add(t2, h2)
+	b.Add(t2, h2)
+	b.Add(t1, h1)
+	if a.String() != b.String() {
+		t.Error("checksum must not depend on tile order")
+	}
+
+	c := &ArchiveChecksum{}
+	c.Add(t1, h2)
+	c.Add(t2, h1)
+	if a.String() == c.String() {
+		t.Error("swapping content between tiles must change the checksum")
+	}
+}
+
+func TestDiffTileReaders(t *testing.T) {
+	unchanged := maptile.New(0, 0, 0)
+	changed := maptile.New(0, 0, 1)
+	removed := maptile.New(1, 0, 1)
+	added := maptile.New(1, 1, 1)
+	recompressed := maptile.New(0, 1, 1)
+
+	basePath := writeTestMbtiles(t, "base.mbtiles", map[maptile.Tile][]byte{
+		unchanged:    []byte("same"),
+		changed:      []byte("old"),
+		removed:      []byte("gone"),
+		recompressed: []byte("plain"),
+	})
+	targetPath := writeTestMbtiles(t, "target.mbtiles", map[maptile.Tile][]byte{
+		unchanged:    []byte("same"),
+		changed:      []byte("newer"),
+		added:        []byte("fresh"),
+		recompressed: gzipBytes([]byte("plain")),
+	})
+
+	base, _ := OpenTileReader(basePath)
+	defer base.Close()
+	target, _ := OpenTileReader(targetPath)
+	defer target.Close()
+
+	changes := map[maptile.Tile]TileChangeKind{}
+	diff, err := DiffTileReaders(base, target, DefaultContentHasher, func(c *TileChange) error {
+		changes[c.Tile] = c.Kind
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DiffTileReaders: %v", err)
+	}
+
+	want := map[maptile.Tile]TileChangeKind{changed: TileChanged, removed: TileRemoved, added: TileAdded}
+	if len(changes) != len(want) {
+		t.Errorf("got changes %v, want %v", changes, want)
+	}
+	for tile, kind := range want {
+		if changes[tile] != kind {
+			t.Errorf("%v: got %v, want %v", tile, changes[tile], kind)
+		}
+	}
+
+	z1 := diff.Zooms[1]
+	if z1.Added != 1 || z1.Removed != 1 || z1.Changed != 1 || z1.Unchanged != 1 {
+		t.Errorf("z1 counts: %+v", z1)
+	}
+	if z1.AddedBytes != 5 || z1.RemovedBytes != 4 || z1.ChangedBytes != 2 {
+		t.Errorf("z1 bytes: %+v", z1)
+	}
+	if diff.Zooms[0].Unchanged != 1 {
+		t.Errorf("z0 counts: %+v", diff.Zooms[0])
+	}
+	if diff.BaseChecksum.Count() != 4 || diff.TargetChecksum.Count() != 4 {
+		t.Errorf("checksum counts: %d, %d", diff.BaseChecksum.Count(), diff.TargetChecksum.Count())
+	}
+
+	checksum, err := ChecksumTileReader(base, DefaultContentHasher)
+	if err != nil {
+		t.Fatalf("ChecksumTileReader: %v", err)
+	}
+	if checksum.String() != diff.BaseChecksum.String() {
+		t.Error("ChecksumTileReader must match the diff's base checksum")
+	}
+}
+
+func TestDiffTileReaders_SmallBlocks(t *testing.T) {
+	// Blocks with more base tiles than fit are split until they fit, and the
+	// diff must come out the same, including between formats.
+	baseTiles := gridTiles(4)
+	targetTiles := gridTiles(4)
+	want := map[maptile.Tile]TileChangeKind{}
+	for tile := range targetTiles {
+		switch (tile.X + 3*tile.Y + uint32(tile.Z)) % 7 {
+		case 0:
+			delete(targetTiles, tile)
+			want[tile] = TileRemoved
+		case 1:
+			targetTiles[tile] = []byte("changed")
+			want[tile] = TileChanged
+		}
+	}
+	added := maptile.New(17, 5, 5)
+	targetTiles[added] = []byte("added")
+	want[added] = TileAdded
+
+	base, _ := OpenTileReader(writeTestMbtiles(t, "base.mbtiles", baseTiles))
+	defer base.Close()
+	target, _ := OpenTileReader(writeTestPmtiles(t, targetTiles))
+	defer target.Close()
+
+	checksum, err := ChecksumTileReader(base, DefaultContentHasher)
+	if err != nil {
+		t.Fatalf("ChecksumTileReader: %v", err)
+	}
+
+	for _, blockTiles := range []int{1, 3, diffBlockTiles} {
+		changes := map[maptile.Tile]TileChangeKind{}
+		diff, err := diffTileReaders(base, target, DefaultContentHasher, blockTiles, func(c *TileChange) error {
+			if _, ok := changes[c.Tile]; ok {
+				t.Errorf("blocks of %d: %v reported twice", blockTiles, c.Tile)
+			}
+			changes[c.Tile] = c.Kind
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("diffTileReaders: %v", err)
+		}
+
+		if len(changes) != len(want) {
+			t.Errorf("blocks of %d: got %d changes, want %d", blockTiles, len(changes), len(want))
+		}
+		for tile, kind := range want {
+			if changes[tile] != kind {
+				t.Errorf("blocks of %d: %v: got %v, want %v", blockTiles, tile, changes[tile], kind)
+			}
+		}
+		if total := diff.Total(); total.Unchanged != int64(len(baseTiles)-len(want)+1) {
+			t.Errorf("blocks of %d: %d unchanged tiles", blockTiles, total.Unchanged)
+		}
+		if diff.BaseChecksum.String() != checksum.String() {
+			t.Errorf("blocks of %d: base checksum must match ChecksumTileReader", blockTiles)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tilepack
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// TileReader reads the tiles of an archive of any supported format. Unlike
+// MbtilesReader, tiles are always addressed with XYZ rows, so readers of
+// different formats can be compared tile for tile.
+type TileReader interface {
+	Close() error
+	// GetTile returns the stored bytes of tile, or nil if it is not present.
+	GetTile(tile maptile.Tile) ([]byte, error)
+	// VisitAllTiles calls visitor for every tile. It stops and returns the
+	// first error visitor returns.
+	VisitAllTiles(visitor func(maptile.Tile, []byte) error) error
+	Metadata() (*MbtilesMetadata, error)
+}
+
+// OpenTileReader opens the archive at path, picking the format from the path:
+// a directory is read as a disk outputter tree, a .pmtiles file as PMTiles and
+// anything else as MBTiles.
+func OpenTileReader(path string) (TileReader, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return NewDiskReader(path)
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".pmtiles") {
+		reader, err := NewPmtilesReader(path)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+
+	return NewMbtilesTileReader(path)
+}
+
+// NewMbtilesTileReader opens an MBTiles file as a TileReader, converting its
+// TMS rows to XYZ.
+func NewMbtilesTileReader(dsn string) (TileReader, error) {
+	reader, err := NewMbtilesReader(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &mbtilesTileReader{reader: reader}, nil
+}
+
+type mbtilesTileReader struct {
+	reader MbtilesReader
+}
+
+func (r *mbtilesTileReader) Close() error {
+	return r.reader.Close()
+}
+
+func (r *mbtilesTileReader) GetTile(tile maptile.Tile) ([]byte, error) {
+	tile.Y = flipY(tile.Y, tile.Z)
+
+	data, err := r.reader.GetTile(tile)
+	if err != nil {
+		return nil, err
+	}
+	if data.Data == nil {
+		return nil, nil
+	}
+	return *data.Data, nil
+}
+
+func (r *mbtilesTileReader) VisitAllTiles(visitor func(maptile.Tile, []byte) error) error {
+	var visitErr error
+
+	err := r.reader.VisitAllTiles(func(tile maptile.Tile, data []byte) {
+		if visitErr != nil {
+			return
+		}
+		tile.Y = flipY(tile.Y, tile.Z)
+		visitErr = visitor(tile, data)
+	})
+	if err != nil {
+		return err
+	}
+	return visitErr
+}
+
+func (r *mbtilesTileReader) Metadata() (*MbtilesMetadata, error) {
+	return r.reader.Metadata()
+}
+
+// VisitTileRange reads the tiles of r with an indexed query when the archive
+// is an MBTiles file, and filters all tiles otherwise.
+func (r *mbtilesTileReader) VisitTileRange(tileRange TileRange, visitor func(maptile.Tile, []byte) error) error {
+	reader, ok := r.reader.(*mbtilesReader)
+	if !ok {
+		return visitFilteredTiles(r, []TileRange{tileRange}, visitor)
+	}
+
+	// TMS rows count from the south, so the range's rows swap ends.
+	rows, err := reader.db.Query(`SELECT tile_column, tile_row, tile_data FROM tiles
+		WHERE zoom_level = ? AND tile_column BETWEEN ? AND ? AND tile_row BETWEEN ? AND ?`,
+		tileRange.Z, tileRange.MinX, tileRange.MaxX, flipY(tileRange.MaxY, tileRange.Z), flipY(tileRange.MinY, tileRange.Z))
+	if err != nil {
+		return fmt.Errorf("failed to query tiles of zoom %d: %w", tileRange.Z, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var x, row uint32
+		var data []byte
+		if err := rows.Scan(&x, &row, &data); err != nil {
+			return err
+		}
+		if err := visitor(maptile.New(x, flipY(row, tileRange.Z), tileRange.Z), data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
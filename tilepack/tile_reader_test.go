@@ -0,0 +1,93 @@
+package tilepack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestOpenTileReader_MbtilesUsesXYZRows(t *testing.T) {
+	// MBTiles stores TMS rows; the TileReader must hand back XYZ tiles.
+	path := filepath.Join(t.TempDir(), "test.mbtiles")
+	o, err := NewMbtilesOutputter(path, 100, false, NewMbtilesMetadata(map[string]string{"format": "png"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	tile := maptile.New(1, 0, 1)
+	if err := o.Save(tile, []byte("data")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reader, err := OpenTileReader(path)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer reader.Close()
+
+	got, err := reader.GetTile(tile)
+	if err != nil || string(got) != "data" {
+		t.Errorf("GetTile: got %q, %v", got, err)
+	}
+
+	var visited []maptile.Tile
+	reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		visited = append(visited, tile)
+		return nil
+	})
+	if len(visited) != 1 || visited[0] != tile {
+		t.Errorf("visited %v, want [%v]", visited, tile)
+	}
+}
+
+func TestOpenTileReader_Disk(t *testing.T) {
+	root := t.TempDir()
+	o, err := NewDiskOutputter("root=" + root + " format=png")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	tile := maptile.New(2, 1, 3)
+	if err := o.Save(tile, []byte("png")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// Files that are not tiles are ignored.
+	os.WriteFile(filepath.Join(root, "README"), []byte("hi"), 0644)
+
+	reader, err := OpenTileReader(root)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer reader.Close()
+
+	got, err := reader.GetTile(tile)
+	if err != nil || string(got) != "png" {
+		t.Errorf("GetTile: got %q, %v", got, err)
+	}
+	if missing, err := reader.GetTile(maptile.New(0, 0, 0)); err != nil || missing != nil {
+		t.Errorf("missing tile: got %q, %v", missing, err)
+	}
+
+	metadata, err := reader.Metadata()
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if format, _ := metadata.Format(); format != "png" {
+		t.Errorf("format: got %q", format)
+	}
+
+	count := 0
+	reader.VisitAllTiles(func(visited maptile.Tile, data []byte) error {
+		count++
+		if visited != tile {
+			t.Errorf("visited %v", visited)
+		}
+		return nil
+	})
+	if count != 1 {
+		t.Errorf("visited %d tiles, want 1", count)
+	}
+}
@@ -0,0 +1,54 @@
+package tilepack
+
+import (
+	"sync"
+)
+
+// TileSaver saves tile responses with an outputter from any number of
+// goroutines. Outputters that save concurrently are called directly, the
+// costly part of saving with a TilePreparer runs concurrently before the
+// rest is done one tile at a time, and other outputters save one tile at a
+// time.
+type TileSaver struct {
+	outputter  TileOutputter
+	preparer   TilePreparer
+	concurrent bool
+	mu         sync.Mutex
+}
+
+func NewTileSaver(outputter TileOutputter) *TileSaver {
+	s := &TileSaver{outputter: outputter}
+	if saver, ok := outputter.(ConcurrentSaver); ok && saver.SavesConcurrently() {
+		s.concurrent = true
+	} else if preparer, ok := outputter.(TilePreparer); ok {
+		s.preparer = preparer
+	}
+	return s
+}
+
+// Concurrent returns true if saving from several goroutines is faster than
+// saving from one.
+func (s *TileSaver) Concurrent() bool {
+	return s.concurrent || s.preparer != nil
+}
+
+// Save saves the tile of response, as SaveTileResponse does.
+func (s *TileSaver) Save(response *TileResponse) error {
+	if s.concurrent {
+		return SaveTileResponse(s.outputter, response)
+	}
+
+	if s.preparer != nil {
+		prepared, err := s.preparer.PrepareTile(response.Tile, response.Data, response.ContentHash(s.preparer.ContentHasher()))
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.preparer.SavePrepared(prepared)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SaveTileResponse(s.outputter, response)
+}
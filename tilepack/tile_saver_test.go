@@ -0,0 +1,143 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// saveConcurrently saves tiles with saver from several goroutines.
+func saveConcurrently(t *testing.T, saver *TileSaver, tiles map[maptile.Tile][]byte) {
+	t.Helper()
+	responses := make(chan *TileResponse, len(tiles))
+	for tile, data := range tiles {
+		responses <- &TileResponse{Tile: tile, Data: data}
+	}
+	close(responses)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for response := range responses {
+				if err := saver.Save(response); err != nil {
+					t.Errorf("Save %v: %v", response.Tile, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// duplicatedGridTiles returns gridTiles with every other tile of the highest
+// zoom sharing one content.
+func duplicatedGridTiles(maxZoom maptile.Zoom) map[maptile.Tile][]byte {
+	tiles := gridTiles(maxZoom)
+	for tile := range tiles {
+		if tile.Z == maxZoom && (tile.X+tile.Y)%2 == 0 {
+			tiles[tile] = []byte("ocean")
+		}
+	}
+	return tiles
+}
+
+func TestTileSaver_Pmtiles(t *testing.T) {
+	// Tiles compressed in parallel must end up in the archive as they would
+	// when saved one at a time, with duplicate content stored once.
+	o, path := newTestPmtilesOutputter(t, "mvt")
+	saver := NewTileSaver(o)
+	if !saver.Concurrent() {
+		t.Error("expected pmtiles tiles to be saved concurrently")
+	}
+
+	tiles := duplicatedGridTiles(4)
+	saveConcurrently(t, saver, tiles)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	header, _, _ := readPmtilesFile(t, path)
+	if header.AddressedTilesCount != uint64(len(tiles)) {
+		t.Errorf("addressed %d tiles, want %d", header.AddressedTilesCount, len(tiles))
+	}
+	if want := uint64(len(tiles)) - 128 + 1; header.TileContentsCount != want {
+		t.Errorf("stored %d tile contents, want %d", header.TileContentsCount, want)
+	}
+
+	reader, err := OpenTileReader(path)
+	if err != nil {
+		t.Fatalf("OpenTileReader: %v", err)
+	}
+	defer reader.Close()
+	err = reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("tile %v is not gzipped: %v", tile, err)
+		}
+		decoded, _ := io.ReadAll(gz)
+		if !bytes.Equal(decoded, tiles[tile]) {
+			t.Errorf("tile %v: got %q, want %q", tile, decoded, tiles[tile])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitAllTiles: %v", err)
+	}
+}
+
+func TestTileSaver_DiskHardlinks(t *testing.T) {
+	// Concurrent saves to a disk tree must write every tile, linking only to
+	// tiles already written.
+	root := t.TempDir()
+	o, err := NewDiskOutputter("root=" + root + " format=pbf dedup=hardlink")
+	if err != nil {
+		t.Fatalf("NewDiskOutputter: %v", err)
+	}
+	saver := NewTileSaver(o)
+	if !saver.Concurrent() {
+		t.Error("expected disk tiles to be saved concurrently")
+	}
+
+	tiles := duplicatedGridTiles(4)
+	saveConcurrently(t, saver, tiles)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for tile, data := range tiles {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(o.layout.Path(tile, "pbf"))))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("tile %v: got %q (%v), want %q", tile, got, err, data)
+		}
+	}
+}
+
+func TestTileSaver_Serial(t *testing.T) {
+	// Outputters that can't save concurrently must still be safe to call
+	// from several goroutines.
+	path := filepath.Join(t.TempDir(), "serial.mbtiles")
+	o, err := NewMbtilesOutputter(path, 10, false, NewMbtilesMetadata(map[string]string{"name": "serial", "format": "pbf"}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	saver := NewTileSaver(o)
+	if saver.Concurrent() {
+		t.Error("expected mbtiles tiles to be saved one at a time")
+	}
+
+	tiles := gridTiles(4)
+	saveConcurrently(t, saver, tiles)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := readMbtilesTiles(t, path); len(got) != len(tiles) {
+		t.Errorf("read %d tiles, want %d", len(got), len(tiles))
+	}
+}
@@ -1,6 +1,7 @@
 package tilepack
 
 import (
+	"context"
 	"testing"
 
 	"github.com/paulmach/orb"
@@ -164,3 +165,23 @@ func TestGenerateTiles_Antimeridian_NoDuplicates(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateTiles_Context(t *testing.T) {
+	// A cancelled context must stop the generation.
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	GenerateTiles(&GenerateTilesOptions{
+		Bounds:  orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		Zooms:   []maptile.Zoom{4, 5},
+		Context: ctx,
+		ConsumerFunc: func(t maptile.Tile) {
+			count++
+			if count == 10 {
+				cancel()
+			}
+		},
+	})
+	if count != 10 {
+		t.Errorf("expected generation to stop after 10 tiles, got %d", count)
+	}
+}
@@ -0,0 +1,328 @@
+package tilepack
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaronland/go-string/dsn"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// tilezenArchivePath expands the path template of the metatile or t2
+// archive of tile: {z}, {x} and {y} are its coordinates, {l} the layer name
+// and {h} the hash prefix, the first 5 hex digits of the MD5 sum of
+// "{z}/{x}/{y}.zip".
+func tilezenArchivePath(pathTemplate string, layerName string, t maptile.Tile) string {
+	hash := md5.Sum([]byte(fmt.Sprintf("%d/%d/%d.zip", t.Z, t.X, t.Y)))
+	hashHex := hex.EncodeToString(hash[:])
+
+	return strings.NewReplacer(
+		"{x}", fmt.Sprintf("%d", t.X),
+		"{y}", fmt.Sprintf("%d", t.Y),
+		"{z}", fmt.Sprintf("%d", t.Z),
+		"{l}", layerName,
+		"{h}", hashHex[:5]).Replace(pathTemplate)
+}
+
+// metatileZoom returns the zoom of the metatile holding tiles of zoom z, as
+// metatileJobGenerator requests them.
+func metatileZoom(z maptile.Zoom, metatileSize uint, maxDetailZoom maptile.Zoom) maptile.Zoom {
+	metaZoom := maptile.Zoom(log2Uint(metatileSize))
+	tileZoom := maptile.Zoom(log2Uint(tileScale))
+	deltaZoom := metaZoom - tileZoom
+
+	var metatileZoom maptile.Zoom
+	if z < deltaZoom {
+		metatileZoom = 0
+	} else {
+		metatileZoom = z - deltaZoom
+	}
+
+	// Beyond the "max detail zoom", all tiles are in the metatile
+	if maxDetailZoom > 0 && metatileZoom > maxDetailZoom {
+		metatileZoom = maxDetailZoom
+	}
+	return metatileZoom
+}
+
+// tilezenEntryFunc returns the archive a tile belongs in and the name of its
+// entry there.
+type tilezenEntryFunc func(tile maptile.Tile) (maptile.Tile, string, error)
+
+// spooledTile is a tile waiting in the spool file for its archive to be
+// written.
+type spooledTile struct {
+	name   string
+	offset int64
+	length int
+}
+
+// tilezenOutputter groups saved tiles into the zip archives of the Tilezen
+// metatile and t2 layouts. Tiles arrive in any order, so they are spooled to
+// a temporary file and the archives are written on Close, to a directory or
+// a bucket, at the paths of a template.
+type tilezenOutputter struct {
+	TileOutputter
+	root         string
+	uploads      *diskUploader
+	pathTemplate string
+	layerName    string
+	tileType     pmtiles.TileType
+	entry        tilezenEntryFunc
+
+	spool       *os.File
+	spoolOffset int64
+	archives    map[maptile.Tile][]spooledTile
+	compressor  tileCompressor
+}
+
+// NewMetatileOutputter creates an outputter that writes tiles into Tilezen
+// metatile zips, which metatileJobGenerator reads back. dsnStr holds space
+// separated key=value pairs:
+//
+//	root           a directory or a bucket URL, required
+//	format         the format of the tiles, required
+//	path_template  the path of each metatile below the root, using {z},
+//	               {x}, {y}, {l} and {h} as the metatile generator does,
+//	               required
+//	layer          the layer name of {l}
+//	metatile_size  the size of a metatile in 256 pixel tiles, 8 by default
+//	max_detail_zoom
+//	               the zoom of the metatiles holding all higher zooms, 13 by
+//	               default
+//	workers        the number of parallel uploads to a bucket
+//
+// A tile of zoom z is stored in the metatile of zoom z - log2(metatile_size)
+// + 1 as {offsetZ}/{offsetX}/{offsetY}.{format}, relative to the metatile.
+func NewMetatileOutputter(dsnStr string) (*tilezenOutputter, error) {
+	dsnMap, err := dsn.StringToDSNWithKeys(dsnStr, "root", "format", "path_template")
+	if err != nil {
+		return nil, err
+	}
+
+	metatileSize := uint64(8)
+	if value, ok := dsnMap["metatile_size"]; ok {
+		metatileSize, err = strconv.ParseUint(value, 10, 32)
+		if err != nil || metatileSize < tileScale || metatileSize&(metatileSize-1) != 0 {
+			return nil, fmt.Errorf("invalid metatile_size %q: must be a power of two of at least %d", value, tileScale)
+		}
+	}
+	maxDetailZoom := uint64(13)
+	if value, ok := dsnMap["max_detail_zoom"]; ok {
+		if maxDetailZoom, err = strconv.ParseUint(value, 10, 8); err != nil {
+			return nil, fmt.Errorf("invalid max_detail_zoom %q: %w", value, err)
+		}
+	}
+
+	format := dsnMap["format"]
+	entry := func(tile maptile.Tile) (maptile.Tile, string, error) {
+		metaZ := metatileZoom(tile.Z, uint(metatileSize), maptile.Zoom(maxDetailZoom))
+		offsetZ := tile.Z - metaZ
+		meta := maptile.New(tile.X>>offsetZ, tile.Y>>offsetZ, metaZ)
+		name := fmt.Sprintf("%d/%d/%d.%s", offsetZ, tile.X-meta.X<<offsetZ, tile.Y-meta.Y<<offsetZ, format)
+		return meta, name, nil
+	}
+	return newTilezenOutputter(dsnMap, entry)
+}
+
+// NewTapalcatl2Outputter creates an outputter that writes tiles into
+// Tapalcatl 2 archives, which tapalcatl2JobGenerator reads back given the
+// same format. dsnStr takes the keys of NewMetatileOutputter, with:
+//
+//	materialized_zooms
+//	               a comma separated list of the zooms that have archives,
+//	               required, instead of metatile_size and max_detail_zoom
+//
+// A tile of zoom z is stored in the archive of the highest materialized zoom
+// at or below z as {z}/{x}/{y}@2x.{format}.
+func NewTapalcatl2Outputter(dsnStr string) (*tilezenOutputter, error) {
+	dsnMap, err := dsn.StringToDSNWithKeys(dsnStr, "root", "format", "path_template", "materialized_zooms")
+	if err != nil {
+		return nil, err
+	}
+
+	var materializedZooms []maptile.Zoom
+	for _, value := range strings.Split(dsnMap["materialized_zooms"], ",") {
+		z, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid materialized_zooms %q: %w", dsnMap["materialized_zooms"], err)
+		}
+		materializedZooms = append(materializedZooms, maptile.Zoom(z))
+	}
+	sort.Slice(materializedZooms, func(i, j int) bool { return materializedZooms[i] < materializedZooms[j] })
+
+	format := dsnMap["format"]
+	entry := func(tile maptile.Tile) (maptile.Tile, string, error) {
+		i := sort.Search(len(materializedZooms), func(i int) bool { return materializedZooms[i] > tile.Z }) - 1
+		if i < 0 {
+			return maptile.Tile{}, "", fmt.Errorf("tile %d/%d/%d is below the lowest materialized zoom %d", tile.Z, tile.X, tile.Y, materializedZooms[0])
+		}
+		offsetZ := tile.Z - materializedZooms[i]
+		archive := maptile.New(tile.X>>offsetZ, tile.Y>>offsetZ, materializedZooms[i])
+		return archive, fmt.Sprintf("%d/%d/%d@2x.%s", tile.Z, tile.X, tile.Y, format), nil
+	}
+	return newTilezenOutputter(dsnMap, entry)
+}
+
+func newTilezenOutputter(dsnMap map[string]string, entry tilezenEntryFunc) (*tilezenOutputter, error) {
+	pathTemplate := dsnMap["path_template"]
+	if strings.HasPrefix(pathTemplate, "/") || strings.Contains("/"+pathTemplate+"/", "/../") {
+		return nil, fmt.Errorf("path_template %q must stay below the root", pathTemplate)
+	}
+
+	tileType, _ := pmtilesTileType(dsnMap["format"])
+	o := &tilezenOutputter{
+		pathTemplate: pathTemplate,
+		layerName:    dsnMap["layer"],
+		tileType:     tileType,
+		entry:        entry,
+		archives:     make(map[maptile.Tile][]spooledTile),
+	}
+
+	if IsBucketURL(dsnMap["root"]) {
+		workers := defaultDiskUploadWorkers
+		if value, ok := dsnMap["workers"]; ok {
+			var err error
+			if workers, err = strconv.Atoi(value); err != nil || workers < 1 {
+				return nil, fmt.Errorf("invalid workers %q: must be a positive integer", value)
+			}
+		}
+
+		bucket, prefix, err := openBucketURL(context.Background(), dsnMap["root"], false)
+		if err != nil {
+			return nil, err
+		}
+		o.root = dsnMap["root"]
+		o.uploads = newDiskUploader(bucket, prefix, "zip", workers)
+	} else {
+		root, err := filepath.Abs(dsnMap["root"])
+		if err != nil {
+			return nil, err
+		}
+		o.root = root
+	}
+
+	spool, err := os.CreateTemp("", "tilezen-spool-*")
+	if err != nil {
+		if o.uploads != nil {
+			o.uploads.Close()
+		}
+		return nil, fmt.Errorf("error creating spool file: %w", err)
+	}
+	o.spool = spool
+	return o, nil
+}
+
+func (o *tilezenOutputter) CreateTiles() error {
+	return nil
+}
+
+func (o *tilezenOutputter) AssignSpatialMetadata(bounds orb.Bound, minZoom maptile.Zoom, maxZoom maptile.Zoom) error {
+	return nil
+}
+
+// Save spools a tile for its archive. Tiles are stored uncompressed inside
+// the archives, as the Tilezen tiler writes them, so compressed tiles are
+// decompressed first.
+func (o *tilezenOutputter) Save(tile maptile.Tile, data []byte) error {
+	archive, name, err := o.entry(tile)
+	if err != nil {
+		return err
+	}
+
+	data, err = o.compressor.transcodeTile(data, o.tileType, pmtiles.NoCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.spool.Write(data); err != nil {
+		return fmt.Errorf("error spooling tile: %w", err)
+	}
+	o.archives[archive] = append(o.archives[archive], spooledTile{name: name, offset: o.spoolOffset, length: len(data)})
+	o.spoolOffset += int64(len(data))
+	return nil
+}
+
+// Close writes the archives and removes the spool file.
+func (o *tilezenOutputter) Close() error {
+	defer func() {
+		o.spool.Close()
+		os.Remove(o.spool.Name())
+	}()
+
+	archives := make([]maptile.Tile, 0, len(o.archives))
+	for archive := range o.archives {
+		archives = append(archives, archive)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return pmtiles.ZxyToID(uint8(archives[i].Z), archives[i].X, archives[i].Y) <
+			pmtiles.ZxyToID(uint8(archives[j].Z), archives[j].X, archives[j].Y)
+	})
+
+	var err error
+	modified := time.Now()
+	for _, archive := range archives {
+		if err = o.writeArchive(archive, o.archives[archive], modified); err != nil {
+			break
+		}
+		delete(o.archives, archive)
+	}
+
+	if o.uploads != nil {
+		if closeErr := o.uploads.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (o *tilezenOutputter) writeArchive(archive maptile.Tile, tiles []spooledTile, modified time.Time) error {
+	// A tile saved twice keeps the data it was saved with last.
+	sort.SliceStable(tiles, func(i, j int) bool { return tiles[i].name < tiles[j].name })
+
+	var buf bytes.Buffer
+	z := newZipWriter(&buf, zip.Deflate, modified)
+	for i, tile := range tiles {
+		if i+1 < len(tiles) && tiles[i+1].name == tile.name {
+			continue
+		}
+
+		data := make([]byte, tile.length)
+		if _, err := o.spool.ReadAt(data, tile.offset); err != nil {
+			return fmt.Errorf("error reading spooled tile: %w", err)
+		}
+		if _, err := z.Create(tile.name, data); err != nil {
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	path := tilezenArchivePath(o.pathTemplate, o.layerName, archive)
+	if o.uploads != nil {
+		return o.uploads.Upload(path, buf.Bytes())
+	}
+
+	// The layer name may still lead outside the root.
+	absPath := filepath.Join(o.root, filepath.FromSlash(path))
+	if !strings.HasPrefix(absPath, o.root+string(filepath.Separator)) {
+		return fmt.Errorf("archive path %s is not below the root", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(absPath, buf.Bytes())
+}
@@ -0,0 +1,250 @@
+package tilepack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// readTilezenArchives runs the worker of a job generator over every job it
+// creates, serving the archives written below root, and returns the tiles
+// it produced, decompressed.
+func readTilezenArchives(t *testing.T, root string, gen JobGenerator, fake *fakeS3Downloader) map[maptile.Tile]string {
+	t.Helper()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, _ := filepath.Rel(root, path)
+		fake.objects[filepath.ToSlash(key)] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading archives: %v", err)
+	}
+
+	jobs := make(chan *TileRequest, 1000)
+	if err := gen.CreateJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("CreateJobs: %v", err)
+	}
+	close(jobs)
+
+	results := make(chan *TileResponse, 1000)
+	worker, _ := gen.CreateWorker()
+	worker(context.Background(), 0, jobs, results)
+	close(results)
+
+	got := map[maptile.Tile]string{}
+	for r := range results {
+		if r.Err != nil {
+			t.Errorf("reading tile %v: %v", r.Tile, r.Err)
+			continue
+		}
+		data := r.Data
+		if gz, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			data, _ = io.ReadAll(gz)
+		}
+		got[r.Tile] = string(data)
+	}
+	return got
+}
+
+func TestMetatileOutputter_RoundTrip(t *testing.T) {
+	// Tiles written into metatiles must be read back by the metatile job
+	// generator, including the zooms past max_detail_zoom that share the
+	// metatiles of max_detail_zoom.
+	root := t.TempDir()
+	o, err := NewMetatileOutputter("root=" + root + " format=mvt path_template={l}/{h}/{z}/{x}/{y}.zip layer=all metatile_size=4 max_detail_zoom=2")
+	if err != nil {
+		t.Fatalf("NewMetatileOutputter: %v", err)
+	}
+	tiles := gridTiles(4)
+	for tile, data := range tiles {
+		// Compressed tiles are stored uncompressed.
+		if tile.X%2 == 0 {
+			data = gzipBytes(data)
+		}
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	path := filepath.Join(root, filepath.FromSlash(tilezenArchivePath("{l}/{h}/{z}/{x}/{y}.zip", "all", maptile.New(3, 1, 2))))
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected metatile 2/3/1 at %s: %v", path, err)
+	}
+
+	gen := &metatileJobGenerator{
+		s3Client:      &fakeS3Downloader{objects: map[string][]byte{}},
+		pathTemplate:  "{l}/{h}/{z}/{x}/{y}.zip",
+		layerName:     "all",
+		format:        "mvt",
+		metatileSize:  4,
+		maxDetailZoom: 2,
+		bounds:        orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:         []maptile.Zoom{0, 1, 2, 3, 4},
+	}
+	got := readTilezenArchives(t, root, gen, gen.s3Client.(*fakeS3Downloader))
+	if len(got) != len(tiles) {
+		t.Errorf("read %d tiles, want %d", len(got), len(tiles))
+	}
+	for tile, data := range tiles {
+		if got[tile] != string(data) {
+			t.Errorf("tile %v: got %q, want %q", tile, got[tile], data)
+		}
+	}
+}
+
+func TestTapalcatl2Outputter_RoundTrip(t *testing.T) {
+	// Tiles written into t2 archives must be read back by the t2 job
+	// generator, each from the archive of the materialized zoom below it.
+	root := t.TempDir()
+	o, err := NewTapalcatl2Outputter("root=" + root + " format=png path_template={z}/{x}/{y}.zip materialized_zooms=2,0")
+	if err != nil {
+		t.Fatalf("NewTapalcatl2Outputter: %v", err)
+	}
+	tiles := gridTiles(3)
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	// A tile saved again replaces the earlier one.
+	tiles[maptile.New(0, 0, 1)] = []byte("replaced")
+	if err := o.Save(maptile.New(0, 0, 1), []byte("replaced")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var archives []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			archives = append(archives, path)
+		}
+		return err
+	})
+	// One archive at zoom 0 and 16 at zoom 2.
+	if len(archives) != 17 {
+		t.Errorf("wrote %d archives, want 17", len(archives))
+	}
+
+	gen := &tapalcatl2JobGenerator{
+		s3Client:          &fakeS3Downloader{objects: map[string][]byte{}},
+		pathTemplate:      "{z}/{x}/{y}.zip",
+		materializedZooms: []maptile.Zoom{0, 2},
+		bounds:            orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+		zooms:             []maptile.Zoom{0, 1, 2, 3},
+	}
+	got := readTilezenArchives(t, root, gen, gen.s3Client.(*fakeS3Downloader))
+	if len(got) != len(tiles) {
+		t.Errorf("read %d tiles, want %d", len(got), len(tiles))
+	}
+	for tile, data := range tiles {
+		if got[tile] != string(data) {
+			t.Errorf("tile %v: got %q, want %q", tile, got[tile], data)
+		}
+	}
+}
+
+func TestTapalcatl2Outputter_RoundTripMvt(t *testing.T) {
+	// Vector tiles are read back by a t2 job generator of their format, and
+	// skipped by one of another.
+	root := t.TempDir()
+	o, err := NewTapalcatl2Outputter("root=" + root + " format=mvt path_template={z}/{x}/{y}.zip materialized_zooms=0")
+	if err != nil {
+		t.Fatalf("NewTapalcatl2Outputter: %v", err)
+	}
+	tiles := gridTiles(2)
+	for tile, data := range tiles {
+		if err := o.Save(tile, data); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, format := range []string{"mvt", "png"} {
+		gen := &tapalcatl2JobGenerator{
+			s3Client:          &fakeS3Downloader{objects: map[string][]byte{}},
+			pathTemplate:      "{z}/{x}/{y}.zip",
+			format:            format,
+			materializedZooms: []maptile.Zoom{0},
+			bounds:            orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+			zooms:             []maptile.Zoom{0, 1, 2},
+		}
+		got := readTilezenArchives(t, root, gen, gen.s3Client.(*fakeS3Downloader))
+		if format == "png" {
+			if len(got) != 0 {
+				t.Errorf("png generator read %d mvt tiles", len(got))
+			}
+			continue
+		}
+		if len(got) != len(tiles) {
+			t.Errorf("read %d tiles, want %d", len(got), len(tiles))
+		}
+		for tile, data := range tiles {
+			if got[tile] != string(data) {
+				t.Errorf("tile %v: got %q, want %q", tile, got[tile], data)
+			}
+		}
+	}
+}
+
+func TestTilezenOutputter_Errors(t *testing.T) {
+	root := t.TempDir()
+	for _, dsnStr := range []string{
+		"root=" + root + " format=mvt",
+		"root=" + root + " format=mvt path_template={z}/{x}/{y}.zip metatile_size=3",
+		"root=" + root + " format=mvt path_template={z}/{x}/{y}.zip max_detail_zoom=z",
+		"root=mem:// format=mvt path_template={z}/{x}/{y}.zip workers=0",
+	} {
+		if _, err := NewMetatileOutputter(dsnStr); err == nil {
+			t.Errorf("NewMetatileOutputter(%q): expected an error", dsnStr)
+		}
+	}
+
+	if _, err := NewTapalcatl2Outputter("root=" + root + " format=png path_template={z}/{x}/{y}.zip materialized_zooms=0,x"); err == nil {
+		t.Error("expected an error for an invalid materialized zoom")
+	}
+
+	// Tiles below the lowest materialized zoom have no archive.
+	o, err := NewTapalcatl2Outputter("root=" + root + " format=png path_template={z}/{x}/{y}.zip materialized_zooms=3")
+	if err != nil {
+		t.Fatalf("NewTapalcatl2Outputter: %v", err)
+	}
+	if err := o.Save(maptile.New(0, 0, 2), []byte("tile")); err == nil {
+		t.Error("expected an error saving a tile below the materialized zooms")
+	}
+	o.Close()
+
+	// Archives must stay below the root.
+	if _, err := NewMetatileOutputter("root=" + root + " format=mvt path_template=../{z}/{x}/{y}.zip"); err == nil {
+		t.Error("expected an error for a path_template escaping the root")
+	}
+	o, err = NewMetatileOutputter("root=" + root + " format=mvt path_template={l}/{z}/{x}/{y}.zip layer=..")
+	if err != nil {
+		t.Fatalf("NewMetatileOutputter: %v", err)
+	}
+	o.Save(maptile.New(0, 0, 0), []byte("tile"))
+	if err := o.Close(); err == nil {
+		t.Error("expected an error for a layer escaping the root")
+	}
+}
@@ -0,0 +1,146 @@
+package tilepack
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// webMercatorOrigin is half the circumference of the earth in EPSG:3857
+// metres, i.e. the x (and y) coordinate of the edge of the projected world.
+const webMercatorOrigin float64 = 20037508.342789244
+
+// DefaultSubdomains are used for the {s} placeholder when none are configured.
+var DefaultSubdomains = []string{"a", "b", "c"}
+
+// reservedURLParams are placeholders filled per tile, which a configured URL
+// parameter may not shadow.
+var reservedURLParams = map[string]bool{
+	"x":     true,
+	"y":     true,
+	"z":     true,
+	"-y":    true,
+	"s":     true,
+	"q":     true,
+	"bbox":  true,
+	"ratio": true,
+	"scale": true,
+}
+
+// tileURLTemplate expands the per-tile placeholders of an xyz URL template:
+//
+//	{z}, {x}, {y}  tile coordinates, with {y} in the row order of the request
+//	{-y}           {y} flipped between XYZ and TMS row order
+//	{s}            a subdomain, chosen from the tile coordinates so a tile
+//	               always maps to the same host
+//	{q}            Bing-style quadkey
+//	{bbox}         tile bounds in EPSG:3857 as minx,miny,maxx,maxy, for WMS
+//	{ratio}        "@2x" style suffix for scales above 1, empty otherwise
+//	{scale}        the scale as a number
+type tileURLTemplate struct {
+	template   string
+	subdomains []string
+	scale      int
+	// invertedY is true when request tiles carry TMS rows, so {q} and {bbox}
+	// must flip them back to XYZ.
+	invertedY bool
+	hasQuad   bool
+	hasBbox   bool
+}
+
+func newTileURLTemplate(template string, subdomains []string, scale int, invertedY bool) *tileURLTemplate {
+	if len(subdomains) == 0 {
+		subdomains = DefaultSubdomains
+	}
+	if scale < 1 {
+		scale = 1
+	}
+
+	return &tileURLTemplate{
+		template:   template,
+		subdomains: subdomains,
+		scale:      scale,
+		invertedY:  invertedY,
+		hasQuad:    strings.Contains(template, "{q}"),
+		hasBbox:    strings.Contains(template, "{bbox}"),
+	}
+}
+
+// Expand returns the URL for tile.
+func (t *tileURLTemplate) Expand(tile maptile.Tile) string {
+	flippedY := flipY(tile.Y, tile.Z)
+
+	ratio := ""
+	if t.scale > 1 {
+		ratio = "@" + strconv.Itoa(t.scale) + "x"
+	}
+
+	pairs := []string{
+		"{x}", strconv.FormatUint(uint64(tile.X), 10),
+		"{y}", strconv.FormatUint(uint64(tile.Y), 10),
+		"{-y}", strconv.FormatUint(uint64(flippedY), 10),
+		"{z}", strconv.FormatUint(uint64(tile.Z), 10),
+		"{s}", t.subdomains[int((uint64(tile.X)+uint64(tile.Y))%uint64(len(t.subdomains)))],
+		"{ratio}", ratio,
+		"{scale}", strconv.Itoa(t.scale),
+	}
+
+	xyzTile := tile
+	if t.invertedY {
+		xyzTile.Y = flippedY
+	}
+
+	if t.hasQuad {
+		pairs = append(pairs, "{q}", quadkey(xyzTile))
+	}
+
+	if t.hasBbox {
+		pairs = append(pairs, "{bbox}", mercatorBboxString(xyzTile))
+	}
+
+	return strings.NewReplacer(pairs...).Replace(t.template)
+}
+
+// flipY converts a row between the XYZ and TMS numbering schemes.
+func flipY(y uint32, z maptile.Zoom) uint32 {
+	return uint32(1<<uint(z)) - 1 - y
+}
+
+// quadkey returns the Bing Maps quadkey for an XYZ tile.
+func quadkey(tile maptile.Tile) string {
+	var b strings.Builder
+	b.Grow(int(tile.Z))
+
+	for i := int(tile.Z); i > 0; i-- {
+		digit := byte('0')
+		mask := uint32(1) << uint(i-1)
+		if tile.X&mask != 0 {
+			digit++
+		}
+		if tile.Y&mask != 0 {
+			digit += 2
+		}
+		b.WriteByte(digit)
+	}
+
+	return b.String()
+}
+
+// mercatorBboxString returns the EPSG:3857 bounds of an XYZ tile formatted as
+// "minx,miny,maxx,maxy", the axis order WMS 1.1.1 and 1.3.0 both use for that CRS.
+func mercatorBboxString(tile maptile.Tile) string {
+	size := 2 * webMercatorOrigin / math.Exp2(float64(tile.Z))
+
+	minX := -webMercatorOrigin + float64(tile.X)*size
+	maxX := minX + size
+	maxY := webMercatorOrigin - float64(tile.Y)*size
+	minY := maxY - size
+
+	parts := make([]string, 4)
+	for i, v := range []float64{minX, minY, maxX, maxY} {
+		parts[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,96 @@
+package tilepack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestTileURLTemplate_XYZAndFlippedY(t *testing.T) {
+	// {y} is passed through and {-y} is the TMS row of the same tile.
+	tmpl := newTileURLTemplate("{z}/{x}/{y}/{-y}", nil, 1, false)
+	if got := tmpl.Expand(maptile.New(1, 0, 2)); got != "2/1/0/3" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTileURLTemplate_Subdomains(t *testing.T) {
+	// {s} must rotate through the configured subdomains and be stable per tile.
+	tmpl := newTileURLTemplate("https://{s}.tiles.example.com/{z}/{x}/{y}.png", nil, 1, false)
+
+	seen := map[string]bool{}
+	for x := uint32(0); x < 3; x++ {
+		u := tmpl.Expand(maptile.New(x, 0, 2))
+		seen[strings.SplitN(strings.TrimPrefix(u, "https://"), ".", 2)[0]] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected 3 distinct subdomains, got %v", seen)
+	}
+
+	a := tmpl.Expand(maptile.New(5, 7, 4))
+	b := tmpl.Expand(maptile.New(5, 7, 4))
+	if a != b {
+		t.Errorf("subdomain choice must be deterministic: %q vs %q", a, b)
+	}
+
+	custom := newTileURLTemplate("{s}", []string{"t0", "t1"}, 1, false)
+	if got := custom.Expand(maptile.New(1, 0, 1)); got != "t1" {
+		t.Errorf("custom subdomains: got %q", got)
+	}
+}
+
+func TestTileURLTemplate_Quadkey(t *testing.T) {
+	// Reference values from the Bing Maps tile system documentation.
+	tmpl := newTileURLTemplate("{q}", nil, 1, false)
+	cases := []struct {
+		tile maptile.Tile
+		want string
+	}{
+		{maptile.New(0, 0, 0), ""},
+		{maptile.New(3, 5, 3), "213"},
+		{maptile.New(1, 0, 1), "1"},
+		{maptile.New(0, 1, 1), "2"},
+	}
+	for _, c := range cases {
+		if got := tmpl.Expand(c.tile); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.tile, got, c.want)
+		}
+	}
+}
+
+func TestTileURLTemplate_QuadkeyInvertedY(t *testing.T) {
+	// With TMS rows in the request, {q} must still describe the XYZ tile.
+	tmpl := newTileURLTemplate("{q}", nil, 1, true)
+	// TMS row 2 at z3 is XYZ row 5.
+	if got := tmpl.Expand(maptile.New(3, 2, 3)); got != "213" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTileURLTemplate_Bbox(t *testing.T) {
+	tmpl := newTileURLTemplate("BBOX={bbox}", nil, 1, false)
+
+	world := "BBOX=-20037508.342789244,-20037508.342789244,20037508.342789244,20037508.342789244"
+	if got := tmpl.Expand(maptile.New(0, 0, 0)); got != world {
+		t.Errorf("z0: got %q", got)
+	}
+
+	// The north-east quadrant at z1.
+	ne := "BBOX=0,0,20037508.342789244,20037508.342789244"
+	if got := tmpl.Expand(maptile.New(1, 0, 1)); got != ne {
+		t.Errorf("z1 NE: got %q", got)
+	}
+}
+
+func TestTileURLTemplate_Ratio(t *testing.T) {
+	retina := newTileURLTemplate("{z}/{x}/{y}{ratio}.png?scale={scale}", nil, 2, false)
+	if got := retina.Expand(maptile.New(0, 0, 0)); got != "0/0/0@2x.png?scale=2" {
+		t.Errorf("scale 2: got %q", got)
+	}
+
+	normal := newTileURLTemplate("{z}/{x}/{y}{ratio}.png", nil, 0, false)
+	if got := normal.Expand(maptile.New(0, 0, 0)); got != "0/0/0.png" {
+		t.Errorf("scale 1: got %q", got)
+	}
+}
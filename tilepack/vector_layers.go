@@ -0,0 +1,153 @@
+package tilepack
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// VectorLayer is one entry of the vector_layers list in the json metadata
+// key of the MBTiles spec.
+type VectorLayer struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// MinZoom and MaxZoom are the zooms of the first and last tiles holding
+	// the layer.
+	MinZoom maptile.Zoom `json:"minzoom"`
+	MaxZoom maptile.Zoom `json:"maxzoom"`
+	// Fields maps attribute keys to one of the MVTField types.
+	Fields map[string]string `json:"fields"`
+}
+
+// VectorLayerCollector gathers the vector_layers of an archive by decoding
+// its MVT tiles. It is safe for concurrent use.
+type VectorLayerCollector struct {
+	mu     sync.Mutex
+	layers map[string]*VectorLayer
+	// undecodable counts the tiles Add could not decode.
+	undecodable int64
+}
+
+func NewVectorLayerCollector() *VectorLayerCollector {
+	return &VectorLayerCollector{layers: map[string]*VectorLayer{}}
+}
+
+// Add decodes tile and records its layers, their fields and its zoom. Tiles
+// that do not decode are counted and their error returned.
+func (c *VectorLayerCollector) Add(tile maptile.Tile, data []byte) error {
+	layers, err := DecodeMVT(data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.undecodable++
+		return err
+	}
+
+	for _, layer := range layers {
+		c.merge(&VectorLayer{ID: layer.Name, MinZoom: tile.Z, MaxZoom: tile.Z, Fields: layer.Fields})
+	}
+	return nil
+}
+
+// merge widens the recorded layer of the same ID to cover layer.
+func (c *VectorLayerCollector) merge(layer *VectorLayer) {
+	existing, ok := c.layers[layer.ID]
+	if !ok {
+		existing = &VectorLayer{ID: layer.ID, MinZoom: layer.MinZoom, MaxZoom: layer.MaxZoom, Fields: map[string]string{}}
+		c.layers[layer.ID] = existing
+	}
+
+	if existing.Description == "" {
+		existing.Description = layer.Description
+	}
+	if layer.MinZoom < existing.MinZoom {
+		existing.MinZoom = layer.MinZoom
+	}
+	if layer.MaxZoom > existing.MaxZoom {
+		existing.MaxZoom = layer.MaxZoom
+	}
+	for key, valueType := range layer.Fields {
+		mergeFieldType(existing.Fields, key, valueType)
+	}
+}
+
+// UndecodableTiles returns the number of tiles Add could not decode.
+func (c *VectorLayerCollector) UndecodableTiles() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.undecodable
+}
+
+// VectorLayers returns the collected layers ordered by ID.
+func (c *VectorLayerCollector) VectorLayers() []*VectorLayer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	layers := make([]*VectorLayer, 0, len(c.layers))
+	for _, layer := range c.layers {
+		layers = append(layers, layer)
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].ID < layers[j].ID })
+	return layers
+}
+
+// Apply writes the collected layers into the vector_layers of metadata's
+// json key. Layers already listed there are merged with the collected ones,
+// keeping their descriptions, so an archive refreshed from a subset of its
+// tiles keeps the layers of the others. Other members of the json key, such
+// as tilestats, are kept.
+func (c *VectorLayerCollector) Apply(metadata *MbtilesMetadata) error {
+	doc := map[string]json.RawMessage{}
+	if existing, ok := metadata.Get("json"); ok && existing != "" {
+		if err := json.Unmarshal([]byte(existing), &doc); err != nil {
+			return fmt.Errorf("failed to parse json metadata: %w", err)
+		}
+	}
+
+	if raw, ok := doc["vector_layers"]; ok {
+		var existing []*VectorLayer
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return fmt.Errorf("failed to parse vector_layers metadata: %w", err)
+		}
+		c.mu.Lock()
+		for _, layer := range existing {
+			if layer.Fields == nil {
+				layer.Fields = map[string]string{}
+			}
+			c.merge(layer)
+		}
+		c.mu.Unlock()
+	}
+
+	layers, err := json.Marshal(c.VectorLayers())
+	if err != nil {
+		return err
+	}
+	doc["vector_layers"] = layers
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	metadata.Set("json", string(encoded))
+	return nil
+}
+
+// CollectVectorLayers decodes every tile of reader. Tiles that do not decode
+// are skipped and counted by UndecodableTiles.
+func CollectVectorLayers(reader TileReader) (*VectorLayerCollector, error) {
+	c := NewVectorLayerCollector()
+	err := reader.VisitAllTiles(func(tile maptile.Tile, data []byte) error {
+		c.Add(tile, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
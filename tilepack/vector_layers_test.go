@@ -0,0 +1,94 @@
+package tilepack
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+func TestVectorLayerCollector(t *testing.T) {
+	c := NewVectorLayerCollector()
+
+	c.Add(maptile.New(0, 0, 2), encodeTestMVT(map[string][]testMVTFeature{
+		"roads": {{"kind": "major", "lanes": 2}},
+	}))
+	c.Add(maptile.New(0, 0, 6), encodeTestMVT(map[string][]testMVTFeature{
+		"roads": {{"kind": "minor", "lanes": "two"}},
+		"water": {{"name": "lake"}},
+	}))
+	if err := c.Add(maptile.New(0, 0, 9), []byte("junk")); err == nil {
+		t.Error("expected an error for an undecodable tile")
+	}
+
+	layers := c.VectorLayers()
+	if len(layers) != 2 || layers[0].ID != "roads" || layers[1].ID != "water" {
+		t.Fatalf("layers: %+v", layers)
+	}
+	roads := layers[0]
+	if roads.MinZoom != 2 || roads.MaxZoom != 6 {
+		t.Errorf("roads zooms: %d-%d", roads.MinZoom, roads.MaxZoom)
+	}
+	if roads.Fields["kind"] != MVTFieldString || roads.Fields["lanes"] != MVTFieldMixed {
+		t.Errorf("roads fields: %+v", roads.Fields)
+	}
+	if c.UndecodableTiles() != 1 {
+		t.Errorf("undecodable tiles: %d", c.UndecodableTiles())
+	}
+}
+
+func TestVectorLayerCollector_Compressed(t *testing.T) {
+	// Tiles are decoded whatever they are compressed with.
+	tile := encodeTestMVT(map[string][]testMVTFeature{"roads": {{"kind": "major"}}})
+	var compressor tileCompressor
+	for _, c := range []pmtiles.Compression{pmtiles.Gzip, pmtiles.Brotli, pmtiles.Zstd} {
+		compressed, err := compressor.compress(tile, c)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+
+		collector := NewVectorLayerCollector()
+		if err := collector.Add(maptile.New(0, 0, 3), compressed); err != nil {
+			t.Errorf("%s: Add: %v", tileCompressionName(c), err)
+		}
+		if layers := collector.VectorLayers(); len(layers) != 1 || layers[0].ID != "roads" {
+			t.Errorf("%s: layers: %+v", tileCompressionName(c), layers)
+		}
+	}
+}
+
+func TestVectorLayerCollector_Apply(t *testing.T) {
+	metadata := NewMbtilesMetadata(map[string]string{
+		"json": `{"vector_layers":[{"id":"roads","description":"Streets","minzoom":0,"maxzoom":4,"fields":{"ref":"String"}}],"tilestats":{"layerCount":1}}`,
+	})
+
+	c := NewVectorLayerCollector()
+	c.Add(maptile.New(0, 0, 8), encodeTestMVT(map[string][]testMVTFeature{"roads": {{"kind": "major"}}}))
+	if err := c.Apply(metadata); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	value, _ := metadata.Get("json")
+	var doc struct {
+		VectorLayers []*VectorLayer         `json:"vector_layers"`
+		Tilestats    map[string]interface{} `json:"tilestats"`
+	}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		t.Fatalf("json metadata: %v", err)
+	}
+
+	if doc.Tilestats == nil {
+		t.Error("tilestats must be kept")
+	}
+	if len(doc.VectorLayers) != 1 {
+		t.Fatalf("vector_layers: %+v", doc.VectorLayers)
+	}
+	roads := doc.VectorLayers[0]
+	if roads.Description != "Streets" || roads.MinZoom != 0 || roads.MaxZoom != 8 {
+		t.Errorf("roads: %+v", roads)
+	}
+	if roads.Fields["ref"] != MVTFieldString || roads.Fields["kind"] != MVTFieldString {
+		t.Errorf("roads fields: %+v", roads.Fields)
+	}
+}
@@ -0,0 +1,489 @@
+package tilepack
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// Severities of a VerifyIssue. Only errors make a report fail.
+const (
+	VerifyError   = "error"
+	VerifyWarning = "warning"
+)
+
+// maxIssuesPerCheck limits how many issues of one check are listed in a
+// report; the rest are only counted.
+const maxIssuesPerCheck = 100
+
+// VerifyIssue is a problem found while verifying an archive.
+type VerifyIssue struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	// Tile is the z/x/y (XYZ) of the tile the issue concerns, if any.
+	Tile    string `json:"tile,omitempty"`
+	Message string `json:"message"`
+}
+
+// VerifyReport is the result of verifying an archive.
+type VerifyReport struct {
+	Archive      string         `json:"archive"`
+	Type         string         `json:"type"`
+	TilesChecked int64          `json:"tiles_checked"`
+	Errors       int64          `json:"errors"`
+	Warnings     int64          `json:"warnings"`
+	Issues       []*VerifyIssue `json:"issues"`
+	// OmittedIssues counts the issues beyond maxIssuesPerCheck per check that
+	// are not listed in Issues.
+	OmittedIssues int64 `json:"omitted_issues"`
+
+	checkCounts map[string]int
+}
+
+// OK returns true if no errors were found.
+func (r *VerifyReport) OK() bool {
+	return r.Errors == 0
+}
+
+func newVerifyReport(archive string, archiveType string) *VerifyReport {
+	return &VerifyReport{
+		Archive:     archive,
+		Type:        archiveType,
+		Issues:      []*VerifyIssue{},
+		checkCounts: map[string]int{},
+	}
+}
+
+func (r *VerifyReport) add(severity string, check string, tile *maptile.Tile, format string, args ...interface{}) {
+	if severity == VerifyError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+
+	r.checkCounts[check]++
+	if r.checkCounts[check] > maxIssuesPerCheck {
+		r.OmittedIssues++
+		return
+	}
+
+	issue := &VerifyIssue{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)}
+	if tile != nil {
+		issue.Tile = fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// VerifyArchive verifies the MBTiles or PMTiles archive at path, picking the
+// format from the file extension like OpenTileReader.
+func VerifyArchive(path string) (*VerifyReport, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".pmtiles") {
+		return VerifyPmtiles(path)
+	}
+	return VerifyMbtiles(path)
+}
+
+// CheckTileData checks that data is a valid tile of the given MBTiles format:
+// a decodable, optionally gzipped, MVT for pbf, or the right magic bytes for
+// png, jpg and webp. Other formats are not checked.
+func CheckTileData(format string, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("tile is empty")
+	}
+
+	switch format {
+	case "pbf", "mvt":
+		_, err := DecodeMVT(data)
+		return err
+	case "png":
+		if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			return fmt.Errorf("missing PNG signature")
+		}
+	case "jpg", "jpeg":
+		if !bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}) {
+			return fmt.Errorf("missing JPEG signature")
+		}
+	case "webp":
+		if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+			return fmt.Errorf("missing WebP signature")
+		}
+	}
+	return nil
+}
+
+// tileExtent is the zoom range and bounds a tile must fall within.
+type tileExtent struct {
+	minZoom, maxZoom maptile.Zoom
+	hasZooms         bool
+	bounds           orb.Bound
+	hasBounds        bool
+}
+
+func (e *tileExtent) check(report *VerifyReport, tile maptile.Tile) {
+	if tile.Z > 30 || uint64(tile.X) >= 1<<tile.Z || uint64(tile.Y) >= 1<<tile.Z {
+		report.add(VerifyError, "tile_coordinates", &tile, "tile is outside the tile grid of its zoom")
+		return
+	}
+	if e.hasZooms && (tile.Z < e.minZoom || tile.Z > e.maxZoom) {
+		report.add(VerifyError, "zoom_range", &tile, "tile is outside the advertised zooms %d-%d", e.minZoom, e.maxZoom)
+	}
+	if e.hasBounds && !tile.Bound().Intersects(e.bounds) {
+		report.add(VerifyError, "bounds", &tile, "tile is outside the advertised bounds %v", e.bounds)
+	}
+}
+
+// VerifyMbtiles checks the schema, metadata and tiles of an MBTiles file.
+func VerifyMbtiles(path string) (*VerifyReport, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	report := newVerifyReport(path, "mbtiles")
+
+	var integrity string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&integrity); err != nil {
+		report.add(VerifyError, "sqlite", nil, "couldn't check the database: %v", err)
+		return report, nil
+	}
+	if integrity != "ok" {
+		report.add(VerifyError, "sqlite", nil, "database is corrupt: %s", integrity)
+	}
+
+	if _, err := db.Exec("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles LIMIT 0"); err != nil {
+		report.add(VerifyError, "schema", nil, "no usable tiles table or view: %v", err)
+		return report, nil
+	}
+
+	extent, format := verifyMbtilesMetadata(db, report)
+	verifyMbtilesImages(db, report)
+
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z maptile.Zoom
+		var x, y uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &y, &data); err != nil {
+			report.add(VerifyError, "tile_data", nil, "couldn't read tile row: %v", err)
+			continue
+		}
+		report.TilesChecked++
+
+		tile := maptile.New(x, y, z)
+		if z <= 30 && uint64(y) < 1<<z {
+			tile.Y = flipY(y, z)
+		}
+		extent.check(report, tile)
+
+		if err := CheckTileData(format, data); err != nil {
+			report.add(VerifyError, "tile_data", &tile, "%v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		report.add(VerifyError, "tile_data", nil, "couldn't read tiles: %v", err)
+	}
+
+	return report, nil
+}
+
+// verifyMbtilesMetadata checks the metadata table and returns the extent
+// tiles must fall within and the tile format.
+func verifyMbtilesMetadata(db *sql.DB, report *VerifyReport) (*tileExtent, string) {
+	extent := &tileExtent{}
+
+	metadata, err := NewMbtilesReaderWithDatabase(db)
+	if err != nil {
+		report.add(VerifyError, "metadata", nil, "%v", err)
+		return extent, ""
+	}
+	m, err := metadata.Metadata()
+	if err != nil {
+		report.add(VerifyError, "metadata", nil, "couldn't read metadata table: %v", err)
+		return extent, ""
+	}
+
+	if err := m.Validate(); err != nil {
+		for _, problem := range splitJoinedErrors(err) {
+			report.add(VerifyError, "metadata", nil, "%v", problem)
+		}
+	}
+
+	format, _ := m.Get("format")
+	if format == "pbf" {
+		if _, ok := m.Get("json"); !ok {
+			report.add(VerifyWarning, "metadata", nil, "json key with vector_layers is missing, which the spec requires for pbf tiles")
+		}
+	}
+
+	// Validate reported unusable values; only check tiles against the
+	// consistent ones.
+	if bounds, err := m.Bounds(); err == nil && bounds.Min[0] <= bounds.Max[0] && bounds.Min[1] <= bounds.Max[1] {
+		extent.bounds = bounds
+		extent.hasBounds = true
+	}
+
+	minZoom, minErr := m.MinZoom()
+	maxZoom, maxErr := m.MaxZoom()
+	if minErr == nil && maxErr == nil && minZoom <= maxZoom {
+		extent.minZoom, extent.maxZoom, extent.hasZooms = maptile.Zoom(minZoom), maptile.Zoom(maxZoom), true
+	}
+
+	return extent, format
+}
+
+// splitJoinedErrors returns the errors joined by errors.Join, or err itself.
+func splitJoinedErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// verifyMbtilesImages checks that every map row of the deduplicated schema
+// points at an images row.
+func verifyMbtilesImages(db *sql.DB, report *VerifyReport) {
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name IN ('map', 'images')").Scan(&tables); err != nil || tables != 2 {
+		return
+	}
+
+	rows, err := db.Query(`SELECT map.zoom_level, map.tile_column, map.tile_row, map.tile_id
+		FROM map LEFT JOIN images ON images.tile_id = map.tile_id
+		WHERE images.tile_id IS NULL`)
+	if err != nil {
+		report.add(VerifyError, "schema", nil, "couldn't check map against images: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z maptile.Zoom
+		var x, y uint32
+		var tileID string
+		if err := rows.Scan(&z, &x, &y, &tileID); err != nil {
+			report.add(VerifyError, "missing_image", nil, "couldn't read map row: %v", err)
+			continue
+		}
+		tile := maptile.New(x, y, z)
+		if z <= 30 && uint64(y) < 1<<z {
+			tile.Y = flipY(y, z)
+		}
+		report.add(VerifyError, "missing_image", &tile, "map row refers to missing tile_id %s", tileID)
+	}
+}
+
+// VerifyPmtiles checks the header, directories, metadata and tiles of a
+// PMTiles v3 archive.
+func VerifyPmtiles(path string) (*VerifyReport, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	fileSize := uint64(info.Size())
+
+	report := newVerifyReport(path, "pmtiles")
+
+	if fileSize < pmtiles.HeaderV3LenBytes {
+		report.add(VerifyError, "header", nil, "file is shorter than a PMTiles header")
+		return report, nil
+	}
+
+	reader, err := NewPmtilesReader(path)
+	if err != nil {
+		report.add(VerifyError, "header", nil, "%v", err)
+		return report, nil
+	}
+	defer reader.Close()
+	h := reader.header
+
+	if h.SpecVersion != 3 {
+		report.add(VerifyError, "header", nil, "spec version is %d, not 3", h.SpecVersion)
+	}
+
+	sections := []struct {
+		name           string
+		offset, length uint64
+	}{
+		{"root directory", h.RootOffset, h.RootLength},
+		{"metadata", h.MetadataOffset, h.MetadataLength},
+		{"leaf directories", h.LeafDirectoryOffset, h.LeafDirectoryLength},
+		{"tile data", h.TileDataOffset, h.TileDataLength},
+	}
+	sectionsOK := true
+	for _, s := range sections {
+		if s.offset < pmtiles.HeaderV3LenBytes || s.offset+s.length < s.offset || s.offset+s.length > fileSize {
+			report.add(VerifyError, "header", nil, "%s section [%d, +%d) is outside the file of %d bytes", s.name, s.offset, s.length, fileSize)
+			sectionsOK = false
+		}
+	}
+	if h.RootOffset+h.RootLength > 16384 {
+		report.add(VerifyError, "header", nil, "root directory ends at byte %d, past the first 16384 bytes", h.RootOffset+h.RootLength)
+	}
+	if !sectionsOK {
+		return report, nil
+	}
+
+	if _, err := reader.Metadata(); err != nil {
+		report.add(VerifyError, "metadata", nil, "%v", err)
+	}
+
+	extent := &tileExtent{
+		minZoom:  maptile.Zoom(h.MinZoom),
+		maxZoom:  maptile.Zoom(h.MaxZoom),
+		hasZooms: h.MinZoom <= h.MaxZoom,
+		bounds: orb.Bound{
+			Min: orb.Point{float64(h.MinLonE7) / 1e7, float64(h.MinLatE7) / 1e7},
+			Max: orb.Point{float64(h.MaxLonE7) / 1e7, float64(h.MaxLatE7) / 1e7},
+		},
+	}
+	extent.hasBounds = extent.bounds.Min[0] <= extent.bounds.Max[0] && extent.bounds.Min[1] <= extent.bounds.Max[1]
+	if !extent.hasZooms {
+		report.add(VerifyError, "header", nil, "min zoom %d is greater than max zoom %d", h.MinZoom, h.MaxZoom)
+	}
+	if !extent.hasBounds {
+		report.add(VerifyError, "header", nil, "bounds minimum is greater than maximum: %v", extent.bounds)
+	}
+
+	format := pmtilesFormats[h.TileType]
+
+	v := &pmtilesVerifier{
+		reader:  reader,
+		report:  report,
+		extent:  extent,
+		format:  format,
+		checked: map[uint64]bool{},
+	}
+	v.walk(h.RootOffset, h.RootLength, false, 0)
+
+	if h.AddressedTilesCount != 0 && h.AddressedTilesCount != v.addressed {
+		report.add(VerifyError, "directory", nil, "header counts %d addressed tiles, directories hold %d", h.AddressedTilesCount, v.addressed)
+	}
+	if h.TileEntriesCount != 0 && h.TileEntriesCount != v.entries {
+		report.add(VerifyError, "directory", nil, "header counts %d tile entries, directories hold %d", h.TileEntriesCount, v.entries)
+	}
+
+	return report, nil
+}
+
+// pmtilesVerifier walks the directories of a PMTiles archive in order.
+type pmtilesVerifier struct {
+	reader *pmtilesReader
+	report *VerifyReport
+	extent *tileExtent
+	format string
+	// nextID is the lowest tile ID the next entry may have.
+	nextID    uint64
+	addressed uint64
+	entries   uint64
+	// checked holds the data offsets whose tile data was already checked.
+	checked map[uint64]bool
+	// dataEnd is where the next new tile data starts in a clustered archive.
+	dataEnd     uint64
+	unclustered bool
+}
+
+func (v *pmtilesVerifier) walk(offset uint64, length uint64, leaf bool, depth int) {
+	h := v.reader.header
+
+	if depth > 3 {
+		v.report.add(VerifyError, "directory", nil, "leaf directories are nested more than 3 deep")
+		return
+	}
+
+	if leaf && offset+length > h.LeafDirectoryLength {
+		v.report.add(VerifyError, "directory", nil, "leaf directory [%d, +%d) is outside the leaf section", offset, length)
+		return
+	}
+
+	entries, err := v.reader.readDirectory(offset, length, leaf)
+	if err != nil {
+		v.report.add(VerifyError, "directory", nil, "%v", err)
+		return
+	}
+	if leaf && len(entries) == 0 {
+		v.report.add(VerifyError, "directory", nil, "leaf directory at %d is empty", offset)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.TileID < v.nextID {
+			v.report.add(VerifyError, "directory", nil, "entry for tile ID %d is out of order or overlaps the previous entry", entry.TileID)
+		}
+
+		if entry.RunLength == 0 {
+			v.walk(entry.Offset, uint64(entry.Length), true, depth+1)
+			continue
+		}
+
+		v.entries++
+		v.addressed += uint64(entry.RunLength)
+		v.nextID = entry.TileID + uint64(entry.RunLength)
+		v.checkEntry(entry)
+	}
+}
+
+func (v *pmtilesVerifier) checkEntry(entry pmtiles.EntryV3) {
+	h := v.reader.header
+
+	z, x, y := pmtiles.IDToZxy(entry.TileID)
+	first := maptile.New(x, y, maptile.Zoom(z))
+	v.extent.check(v.report, first)
+	if entry.RunLength > 1 {
+		z, x, y := pmtiles.IDToZxy(entry.TileID + uint64(entry.RunLength) - 1)
+		v.extent.check(v.report, maptile.New(x, y, maptile.Zoom(z)))
+	}
+
+	if entry.Length == 0 || entry.Offset+uint64(entry.Length) > h.TileDataLength {
+		v.report.add(VerifyError, "tile_offset", &first, "tile data [%d, +%d) is outside the tile data section", entry.Offset, entry.Length)
+		return
+	}
+
+	if v.checked[entry.Offset] {
+		return
+	}
+	v.checked[entry.Offset] = true
+	v.report.TilesChecked++
+
+	if h.Clustered && !v.unclustered && entry.Offset != v.dataEnd {
+		v.unclustered = true
+		v.report.add(VerifyWarning, "clustered", &first, "header says tile data is clustered, but the tile's data is at offset %d instead of %d", entry.Offset, v.dataEnd)
+	}
+	v.dataEnd = entry.Offset + uint64(entry.Length)
+
+	data, err := v.reader.readAt(h.TileDataOffset+entry.Offset, uint64(entry.Length))
+	if err != nil {
+		v.report.add(VerifyError, "tile_data", &first, "couldn't read tile: %v", err)
+		return
+	}
+
+	if h.TileCompression == pmtiles.Gzip && !isGzipped(data) {
+		v.report.add(VerifyError, "tile_data", &first, "tile compression is gzip but the tile has no gzip header")
+		return
+	}
+	if h.TileCompression == pmtiles.Brotli || h.TileCompression == pmtiles.Zstd {
+		if data, err = decompressTile(data, h.TileCompression); err != nil {
+			v.report.add(VerifyError, "tile_data", &first, "tile compression is %s but the tile doesn't decompress: %v", tileCompressionName(h.TileCompression), err)
+			return
+		}
+	}
+
+	if err := CheckTileData(v.format, data); err != nil {
+		v.report.add(VerifyError, "tile_data", &first, "%v", err)
+	}
+}
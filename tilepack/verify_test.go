@@ -0,0 +1,258 @@
+package tilepack
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/protomaps/go-pmtiles/pmtiles"
+)
+
+// hasIssue returns true if report lists an issue of check.
+func hasIssue(report *VerifyReport, check string) bool {
+	for _, issue := range report.Issues {
+		if issue.Check == check {
+			return true
+		}
+	}
+	return false
+}
+
+// writeVerifiableMbtiles writes a valid pbf MBTiles file with metadata.
+func writeVerifiableMbtiles(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "valid.mbtiles")
+	o, err := NewMbtilesOutputter(path, 100, false, NewMbtilesMetadata(map[string]string{
+		"name": "valid", "format": "pbf", "json": `{"vector_layers":[]}`,
+	}))
+	if err != nil {
+		t.Fatalf("NewMbtilesOutputter: %v", err)
+	}
+	tile := encodeTestMVT(map[string][]testMVTFeature{"water": {{"kind": "lake"}}})
+	for _, tl := range []maptile.Tile{maptile.New(0, 0, 0), maptile.New(0, 0, 1), maptile.New(1, 1, 1)} {
+		if err := o.Save(tl, gzipBytes(tile)); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	o.AssignSpatialMetadata(orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}}, 0, 1)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func execSQL(t *testing.T, path string, query string, args ...interface{}) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func TestVerifyMbtiles_Valid(t *testing.T) {
+	report, err := VerifyArchive(writeVerifiableMbtiles(t))
+	if err != nil {
+		t.Fatalf("VerifyArchive: %v", err)
+	}
+	if !report.OK() || report.Warnings != 0 {
+		t.Errorf("expected a clean report, got %+v", report.Issues)
+	}
+	if report.TilesChecked != 3 {
+		t.Errorf("tiles checked: got %d, want 3", report.TilesChecked)
+	}
+}
+
+func TestVerifyMbtiles_Problems(t *testing.T) {
+	path := writeVerifiableMbtiles(t)
+
+	// A tile that doesn't decode, at a zoom outside of the advertised range.
+	execSQL(t, path, "INSERT INTO images (tile_id, tile_data) VALUES ('bad', ?)", []byte("not a tile"))
+	execSQL(t, path, "INSERT INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (2, 0, 0, 'bad')")
+	// A map row whose image is missing.
+	execSQL(t, path, "INSERT INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (1, 0, 0, 'missing')")
+	execSQL(t, path, "DELETE FROM metadata WHERE name = 'name'")
+
+	report, err := VerifyMbtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyMbtiles: %v", err)
+	}
+	if report.OK() {
+		t.Fatal("expected errors")
+	}
+	for _, check := range []string{"tile_data", "zoom_range", "missing_image", "metadata"} {
+		if !hasIssue(report, check) {
+			t.Errorf("expected a %s issue in %+v", check, report.Issues)
+		}
+	}
+}
+
+func TestVerifyMbtiles_OutOfBounds(t *testing.T) {
+	path := writeVerifiableMbtiles(t)
+	execSQL(t, path, "UPDATE metadata SET value = '10,10,20,20' WHERE name = 'bounds'")
+	execSQL(t, path, "UPDATE metadata SET value = '15,15,0' WHERE name = 'center'")
+
+	report, err := VerifyMbtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyMbtiles: %v", err)
+	}
+	// The bounds lie in the north-east tile at z1, which the archive lacks.
+	if !hasIssue(report, "bounds") || report.Errors != 2 {
+		t.Errorf("expected two bounds errors, got %+v", report.Issues)
+	}
+}
+
+func TestVerifyPmtiles_Valid(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nrest")
+	path := writeTestPmtiles(t, map[maptile.Tile][]byte{
+		maptile.New(0, 0, 0): png,
+		maptile.New(0, 0, 1): png,
+	})
+
+	report, err := VerifyArchive(path)
+	if err != nil {
+		t.Fatalf("VerifyArchive: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("expected a clean report, got %+v", report.Issues)
+	}
+}
+
+// writeRawPmtiles writes a png archive with the given root directory entries
+// over tileData.
+func writeRawPmtiles(t *testing.T, entries []pmtiles.EntryV3, tileData []byte) string {
+	t.Helper()
+	root := pmtiles.SerializeEntries(entries, pmtiles.NoCompression)
+	metadata, _ := pmtiles.SerializeMetadata(map[string]interface{}{}, pmtiles.NoCompression)
+
+	h := pmtiles.HeaderV3{
+		SpecVersion:         3,
+		InternalCompression: pmtiles.NoCompression,
+		TileCompression:     pmtiles.NoCompression,
+		TileType:            pmtiles.Png,
+		MaxZoom:             2,
+		MinLonE7:            -1800000000,
+		MinLatE7:            -850000000,
+		MaxLonE7:            1800000000,
+		MaxLatE7:            850000000,
+	}
+	h.RootOffset = pmtiles.HeaderV3LenBytes
+	h.RootLength = uint64(len(root))
+	h.MetadataOffset = h.RootOffset + h.RootLength
+	h.MetadataLength = uint64(len(metadata))
+	h.LeafDirectoryOffset = h.MetadataOffset + h.MetadataLength
+	h.TileDataOffset = h.LeafDirectoryOffset
+	h.TileDataLength = uint64(len(tileData))
+
+	var file []byte
+	file = append(file, pmtiles.SerializeHeader(h)...)
+	file = append(file, root...)
+	file = append(file, metadata...)
+	file = append(file, tileData...)
+
+	path := filepath.Join(t.TempDir(), "raw.pmtiles")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyPmtiles_Problems(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	tileData := append(append([]byte{}, png...), []byte("not a png")...)
+
+	path := writeRawPmtiles(t, []pmtiles.EntryV3{
+		{TileID: 3, Offset: 0, Length: 8, RunLength: 1},
+		// Out of order.
+		{TileID: 1, Offset: 0, Length: 8, RunLength: 1},
+		// Not a PNG.
+		{TileID: 4, Offset: 8, Length: 9, RunLength: 1},
+		// Past the end of the tile data.
+		{TileID: 5, Offset: 10, Length: 100, RunLength: 1},
+	}, tileData)
+
+	report, err := VerifyPmtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyPmtiles: %v", err)
+	}
+	for _, check := range []string{"directory", "tile_data", "tile_offset"} {
+		if !hasIssue(report, check) {
+			t.Errorf("expected a %s issue in %+v", check, report.Issues)
+		}
+	}
+}
+
+func TestVerifyPmtiles_NotAnArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "junk.pmtiles")
+	os.WriteFile(path, make([]byte, 200), 0644)
+
+	report, err := VerifyPmtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyPmtiles: %v", err)
+	}
+	if report.OK() || !hasIssue(report, "header") {
+		t.Errorf("expected a header error, got %+v", report.Issues)
+	}
+}
+
+func TestCheckTileData(t *testing.T) {
+	if err := CheckTileData("jpg", []byte{0xff, 0xd8, 0xff, 0xe0}); err != nil {
+		t.Errorf("jpg: %v", err)
+	}
+	if err := CheckTileData("webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")); err != nil {
+		t.Errorf("webp: %v", err)
+	}
+	if err := CheckTileData("png", []byte{0xff, 0xd8}); err == nil {
+		t.Error("png: expected an error for JPEG data")
+	}
+	if err := CheckTileData("png", nil); err == nil {
+		t.Error("expected an error for an empty tile")
+	}
+}
+
+func TestVerifyPmtiles_Unclustered(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	tileData := append(append([]byte{}, png...), png...)
+
+	// The second tile's data comes first.
+	path := writeRawPmtiles(t, []pmtiles.EntryV3{
+		{TileID: 1, Offset: 8, Length: 8, RunLength: 1},
+		{TileID: 2, Offset: 0, Length: 8, RunLength: 1},
+	}, tileData)
+
+	report, err := VerifyPmtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyPmtiles: %v", err)
+	}
+	if hasIssue(report, "clustered") {
+		t.Errorf("unexpected clustered issue for an archive not marked clustered: %+v", report.Issues)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := pmtiles.DeserializeHeader(data[:pmtiles.HeaderV3LenBytes])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Clustered = true
+	copy(data, pmtiles.SerializeHeader(header))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = VerifyPmtiles(path)
+	if err != nil {
+		t.Fatalf("VerifyPmtiles: %v", err)
+	}
+	if !hasIssue(report, "clustered") {
+		t.Errorf("expected a clustered issue in %+v", report.Issues)
+	}
+}
@@ -0,0 +1,597 @@
+package tilepack
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// webMercatorCRSCodes are the EPSG codes (and their historic aliases) of
+// tile matrix sets that line up with maptile's XYZ grid.
+var webMercatorCRSCodes = map[string]bool{
+	"3857":   true,
+	"900913": true,
+	"3785":   true,
+	"102100": true,
+	"102113": true,
+}
+
+// wmtsMetresPerPixel is the "standardized rendering pixel size" of 0.28mm
+// that WMTS scale denominators are defined against.
+const wmtsMetresPerPixel = 0.00028
+
+const (
+	WMTSEncodingKVP  = "kvp"
+	WMTSEncodingREST = "rest"
+)
+
+// WMTSJobGeneratorOptions configures a job generator created with
+// NewWMTSJobGenerator. The embedded XYZJobGeneratorOptions control bounds,
+// zooms and how tiles are fetched; its URLTemplate is ignored.
+type WMTSJobGeneratorOptions struct {
+	XYZJobGeneratorOptions
+	// Capabilities is the URL or local path of a WMTS GetCapabilities document.
+	Capabilities string
+	// Layer is the identifier of the layer to fetch. It may be empty if the
+	// service has exactly one layer.
+	Layer string
+	// Style defaults to the layer's default style.
+	Style string
+	// TileMatrixSet defaults to the first Web Mercator set linked to the layer.
+	TileMatrixSet string
+	// Format defaults to the layer's first format.
+	Format string
+	// Encoding is WMTSEncodingKVP or WMTSEncodingREST. When empty, REST is used
+	// if the layer advertises a tile ResourceURL, and KVP otherwise.
+	Encoding string
+}
+
+type wmtsCapabilities struct {
+	XMLName        xml.Name            `xml:"Capabilities"`
+	Operations     []wmtsOperation     `xml:"OperationsMetadata>Operation"`
+	Layers         []wmtsLayer         `xml:"Contents>Layer"`
+	TileMatrixSets []wmtsTileMatrixSet `xml:"Contents>TileMatrixSet"`
+}
+
+type wmtsOperation struct {
+	Name string    `xml:"name,attr"`
+	Gets []wmtsGet `xml:"DCP>HTTP>Get"`
+}
+
+type wmtsGet struct {
+	Href      string   `xml:"href,attr"`
+	Encodings []string `xml:"Constraint>AllowedValues>Value"`
+}
+
+type wmtsLayer struct {
+	Identifier         string                  `xml:"Identifier"`
+	Styles             []wmtsStyle             `xml:"Style"`
+	Formats            []string                `xml:"Format"`
+	TileMatrixSetLinks []wmtsTileMatrixSetLink `xml:"TileMatrixSetLink"`
+	ResourceURLs       []wmtsResourceURL       `xml:"ResourceURL"`
+	Dimensions         []wmtsDimension         `xml:"Dimension"`
+}
+
+type wmtsStyle struct {
+	Identifier string `xml:"Identifier"`
+	IsDefault  bool   `xml:"isDefault,attr"`
+}
+
+type wmtsTileMatrixSetLink struct {
+	TileMatrixSet string             `xml:"TileMatrixSet"`
+	Limits        []wmtsMatrixLimits `xml:"TileMatrixSetLimits>TileMatrixLimits"`
+}
+
+type wmtsMatrixLimits struct {
+	TileMatrix string `xml:"TileMatrix"`
+	MinTileRow uint32 `xml:"MinTileRow"`
+	MaxTileRow uint32 `xml:"MaxTileRow"`
+	MinTileCol uint32 `xml:"MinTileCol"`
+	MaxTileCol uint32 `xml:"MaxTileCol"`
+}
+
+type wmtsResourceURL struct {
+	Format       string `xml:"format,attr"`
+	ResourceType string `xml:"resourceType,attr"`
+	Template     string `xml:"template,attr"`
+}
+
+type wmtsDimension struct {
+	Identifier string `xml:"Identifier"`
+	Default    string `xml:"Default"`
+}
+
+type wmtsTileMatrixSet struct {
+	Identifier   string           `xml:"Identifier"`
+	SupportedCRS string           `xml:"SupportedCRS"`
+	TileMatrices []wmtsTileMatrix `xml:"TileMatrix"`
+}
+
+type wmtsTileMatrix struct {
+	Identifier       string  `xml:"Identifier"`
+	ScaleDenominator float64 `xml:"ScaleDenominator"`
+	TopLeftCorner    string  `xml:"TopLeftCorner"`
+	TileWidth        uint32  `xml:"TileWidth"`
+	TileHeight       uint32  `xml:"TileHeight"`
+	MatrixWidth      uint32  `xml:"MatrixWidth"`
+	MatrixHeight     uint32  `xml:"MatrixHeight"`
+}
+
+// wmtsZoomMatrix is a tile matrix resolved onto the XYZ grid at one zoom.
+type wmtsZoomMatrix struct {
+	identifier string
+	// colOffset and rowOffset are the XYZ coordinates of the matrix's
+	// top-left tile.
+	colOffset uint32
+	rowOffset uint32
+	width     uint32
+	height    uint32
+	limits    *wmtsMatrixLimits
+}
+
+// tileIndex returns the matrix column and row for an XYZ tile, and false if
+// the tile falls outside the matrix or its advertised limits.
+func (m *wmtsZoomMatrix) tileIndex(tile maptile.Tile) (uint32, uint32, bool) {
+	if tile.X < m.colOffset || tile.Y < m.rowOffset {
+		return 0, 0, false
+	}
+
+	col := tile.X - m.colOffset
+	row := tile.Y - m.rowOffset
+	if col >= m.width || row >= m.height {
+		return 0, 0, false
+	}
+
+	if m.limits != nil {
+		if col < m.limits.MinTileCol || col > m.limits.MaxTileCol || row < m.limits.MinTileRow || row > m.limits.MaxTileRow {
+			return 0, 0, false
+		}
+	}
+
+	return col, row, true
+}
+
+type wmtsJobGenerator struct {
+	fetcher  *xyzJobGenerator
+	opts     WMTSJobGeneratorOptions
+	matrices map[maptile.Zoom]*wmtsZoomMatrix
+	// Exactly one of kvpBase and restTemplate is set.
+	kvpBase      string
+	kvpParams    url.Values
+	restTemplate string
+}
+
+// NewWMTSJobGenerator reads a WMTS GetCapabilities document, resolves the
+// requested layer, style, format and tile matrix set, and returns a job
+// generator that requests tiles from it. Only tile matrix sets in Web Mercator
+// whose matrices line up with the XYZ grid are supported.
+func NewWMTSJobGenerator(opts *WMTSJobGeneratorOptions) (JobGenerator, error) {
+	fetcher, err := NewXYZJobGeneratorWithOptions(&opts.XYZJobGeneratorOptions)
+	if err != nil {
+		return nil, err
+	}
+	xyz := fetcher.(*xyzJobGenerator)
+
+	capsBytes, err := readWMTSCapabilities(xyz, opts.Capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WMTS capabilities: %s", xyz.redact(err.Error()))
+	}
+
+	var caps wmtsCapabilities
+	if err := xml.Unmarshal(capsBytes, &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse WMTS capabilities: %w", err)
+	}
+
+	return newWMTSJobGeneratorFromCapabilities(xyz, &caps, *opts)
+}
+
+func newWMTSJobGeneratorFromCapabilities(fetcher *xyzJobGenerator, caps *wmtsCapabilities, opts WMTSJobGeneratorOptions) (*wmtsJobGenerator, error) {
+	layer, err := caps.findLayer(opts.Layer)
+	if err != nil {
+		return nil, err
+	}
+	opts.Layer = layer.Identifier
+
+	if opts.Style == "" {
+		opts.Style = layer.defaultStyle()
+	} else if !layer.hasStyle(opts.Style) {
+		return nil, fmt.Errorf("layer %q has no style %q", layer.Identifier, opts.Style)
+	}
+
+	if opts.Format == "" {
+		if len(layer.Formats) == 0 {
+			return nil, fmt.Errorf("layer %q advertises no formats", layer.Identifier)
+		}
+		opts.Format = layer.Formats[0]
+	} else if !containsString(layer.Formats, opts.Format) {
+		return nil, fmt.Errorf("layer %q has no format %q", layer.Identifier, opts.Format)
+	}
+
+	link, tms, err := caps.findTileMatrixSet(layer, opts.TileMatrixSet)
+	if err != nil {
+		return nil, err
+	}
+	opts.TileMatrixSet = tms.Identifier
+
+	matrices, err := resolveWMTSMatrices(tms, link)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &wmtsJobGenerator{
+		fetcher:  fetcher,
+		opts:     opts,
+		matrices: matrices,
+	}
+
+	resourceURL := layer.tileResourceURL(opts.Format)
+
+	encoding := opts.Encoding
+	if encoding == "" {
+		if resourceURL != "" {
+			encoding = WMTSEncodingREST
+		} else {
+			encoding = WMTSEncodingKVP
+		}
+	}
+
+	switch encoding {
+	case WMTSEncodingREST:
+		if resourceURL == "" {
+			return nil, fmt.Errorf("layer %q has no tile ResourceURL for format %q", layer.Identifier, opts.Format)
+		}
+		g.restTemplate = expandWMTSDimensions(resourceURL, layer.Dimensions)
+	case WMTSEncodingKVP:
+		base := caps.getTileKVPEndpoint()
+		if base == "" {
+			return nil, fmt.Errorf("capabilities advertise no KVP GetTile endpoint")
+		}
+		g.kvpBase = base
+		g.kvpParams = url.Values{
+			"SERVICE":       {"WMTS"},
+			"REQUEST":       {"GetTile"},
+			"VERSION":       {"1.0.0"},
+			"LAYER":         {opts.Layer},
+			"STYLE":         {opts.Style},
+			"FORMAT":        {opts.Format},
+			"TILEMATRIXSET": {opts.TileMatrixSet},
+		}
+		for _, d := range layer.Dimensions {
+			g.kvpParams.Set(d.Identifier, d.Default)
+		}
+	default:
+		return nil, fmt.Errorf("unknown WMTS encoding %q: must be %q or %q", encoding, WMTSEncodingKVP, WMTSEncodingREST)
+	}
+
+	for _, z := range opts.Zooms {
+		if _, ok := matrices[z]; !ok {
+			log.Printf("WMTS tile matrix set %s has no matrix at zoom %d; skipping it", tms.Identifier, z)
+		}
+	}
+
+	return g, nil
+}
+
+func (g *wmtsJobGenerator) CreateWorker() (TileWorker, error) {
+	return g.fetcher.CreateWorker()
+}
+
+func (g *wmtsJobGenerator) CreateJobs(ctx context.Context, jobs chan<- *TileRequest) error {
+	GenerateTiles(&GenerateTilesOptions{
+		Bounds:    g.opts.Bounds,
+		Zooms:     g.opts.Zooms,
+		InvertedY: false,
+		Context:   ctx,
+		ConsumerFunc: func(tile maptile.Tile) {
+			matrix, ok := g.matrices[tile.Z]
+			if !ok {
+				return
+			}
+
+			col, row, ok := matrix.tileIndex(tile)
+			if !ok {
+				return
+			}
+
+			// Output tiles follow the same row convention as the xyz generator.
+			if g.opts.InvertedY {
+				tile.Y = flipY(tile.Y, tile.Z)
+			}
+
+			sendJob(ctx, jobs, &TileRequest{
+				Tile: tile,
+				URL:  g.tileURL(matrix.identifier, col, row),
+			})
+		},
+	})
+
+	return ctx.Err()
+}
+
+// tileURL builds the GetTile URL for one matrix cell.
+func (g *wmtsJobGenerator) tileURL(matrix string, col uint32, row uint32) string {
+	colStr := strconv.FormatUint(uint64(col), 10)
+	rowStr := strconv.FormatUint(uint64(row), 10)
+
+	if g.restTemplate != "" {
+		return strings.NewReplacer(
+			"{TileMatrixSet}", g.opts.TileMatrixSet,
+			"{TileMatrix}", matrix,
+			"{TileRow}", rowStr,
+			"{TileCol}", colStr,
+			"{Style}", g.opts.Style,
+			"{Layer}", g.opts.Layer,
+		).Replace(g.restTemplate)
+	}
+
+	params := url.Values{}
+	for k, v := range g.kvpParams {
+		params[k] = v
+	}
+	params.Set("TILEMATRIX", matrix)
+	params.Set("TILEROW", rowStr)
+	params.Set("TILECOL", colStr)
+
+	sep := "?"
+	if strings.Contains(g.kvpBase, "?") {
+		sep = "&"
+		if strings.HasSuffix(g.kvpBase, "?") || strings.HasSuffix(g.kvpBase, "&") {
+			sep = ""
+		}
+	}
+	return g.kvpBase + sep + params.Encode()
+}
+
+// readWMTSCapabilities loads a capabilities document from an http(s) URL,
+// using the fetcher's client, headers and retry policy, or from a local file.
+func readWMTSCapabilities(fetcher *xyzJobGenerator, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.ReadFile(location)
+	}
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = fetcher.headers.Clone()
+	// Capabilities documents are small; ask for them uncompressed so the
+	// body can be parsed directly.
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := doHTTPWithRetry(fetcher.httpClient, req, fetcher.retryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (c *wmtsCapabilities) findLayer(identifier string) (*wmtsLayer, error) {
+	if identifier == "" {
+		if len(c.Layers) == 1 {
+			return &c.Layers[0], nil
+		}
+		ids := make([]string, len(c.Layers))
+		for i, l := range c.Layers {
+			ids[i] = l.Identifier
+		}
+		return nil, fmt.Errorf("capabilities have %d layers, choose one of: %s", len(c.Layers), strings.Join(ids, ", "))
+	}
+
+	for i := range c.Layers {
+		if c.Layers[i].Identifier == identifier {
+			return &c.Layers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("capabilities have no layer %q", identifier)
+}
+
+// findTileMatrixSet returns the layer's link to the named set, or to the first
+// Web Mercator set if identifier is empty, together with the set itself.
+func (c *wmtsCapabilities) findTileMatrixSet(layer *wmtsLayer, identifier string) (*wmtsTileMatrixSetLink, *wmtsTileMatrixSet, error) {
+	for i := range layer.TileMatrixSetLinks {
+		link := &layer.TileMatrixSetLinks[i]
+		if identifier != "" && link.TileMatrixSet != identifier {
+			continue
+		}
+
+		var tms *wmtsTileMatrixSet
+		for j := range c.TileMatrixSets {
+			if c.TileMatrixSets[j].Identifier == link.TileMatrixSet {
+				tms = &c.TileMatrixSets[j]
+				break
+			}
+		}
+		if tms == nil {
+			return nil, nil, fmt.Errorf("layer %q links to undefined tile matrix set %q", layer.Identifier, link.TileMatrixSet)
+		}
+
+		if !isWebMercatorCRS(tms.SupportedCRS) {
+			if identifier != "" {
+				return nil, nil, fmt.Errorf("tile matrix set %q uses unsupported CRS %q; only Web Mercator is supported", identifier, tms.SupportedCRS)
+			}
+			continue
+		}
+
+		return link, tms, nil
+	}
+
+	if identifier != "" {
+		return nil, nil, fmt.Errorf("layer %q is not available in tile matrix set %q", layer.Identifier, identifier)
+	}
+	return nil, nil, fmt.Errorf("layer %q is not available in a Web Mercator tile matrix set", layer.Identifier)
+}
+
+// getTileKVPEndpoint returns the GetTile GET endpoint that accepts KVP
+// encoding. Endpoints without an encoding constraint are assumed to accept it.
+func (c *wmtsCapabilities) getTileKVPEndpoint() string {
+	for _, op := range c.Operations {
+		if op.Name != "GetTile" {
+			continue
+		}
+		for _, get := range op.Gets {
+			if len(get.Encodings) == 0 || containsString(get.Encodings, "KVP") {
+				return get.Href
+			}
+		}
+	}
+	return ""
+}
+
+func (l *wmtsLayer) defaultStyle() string {
+	for _, s := range l.Styles {
+		if s.IsDefault {
+			return s.Identifier
+		}
+	}
+	if len(l.Styles) > 0 {
+		return l.Styles[0].Identifier
+	}
+	return "default"
+}
+
+func (l *wmtsLayer) hasStyle(identifier string) bool {
+	for _, s := range l.Styles {
+		if s.Identifier == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *wmtsLayer) tileResourceURL(format string) string {
+	for _, r := range l.ResourceURLs {
+		if r.ResourceType == "tile" && r.Format == format {
+			return r.Template
+		}
+	}
+	return ""
+}
+
+// expandWMTSDimensions fills {Identifier} placeholders for the layer's extra
+// dimensions (e.g. {Time}) with their default values.
+func expandWMTSDimensions(template string, dimensions []wmtsDimension) string {
+	pairs := make([]string, 0, len(dimensions)*2)
+	for _, d := range dimensions {
+		pairs = append(pairs, "{"+d.Identifier+"}", d.Default)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+func isWebMercatorCRS(crs string) bool {
+	crs = strings.TrimSpace(crs)
+	code := crs[strings.LastIndex(crs, ":")+1:]
+	return webMercatorCRSCodes[code]
+}
+
+// resolveWMTSMatrices maps each tile matrix of a Web Mercator set onto the XYZ
+// zoom whose tiles cover the same ground distance. Matrices that do not line
+// up with the XYZ grid are skipped with a log message.
+func resolveWMTSMatrices(tms *wmtsTileMatrixSet, link *wmtsTileMatrixSetLink) (map[maptile.Zoom]*wmtsZoomMatrix, error) {
+	limits := make(map[string]*wmtsMatrixLimits, len(link.Limits))
+	for i := range link.Limits {
+		limits[link.Limits[i].TileMatrix] = &link.Limits[i]
+	}
+
+	matrices := make(map[maptile.Zoom]*wmtsZoomMatrix)
+
+	for _, tm := range tms.TileMatrices {
+		z, colOffset, rowOffset, err := tm.xyzPlacement()
+		if err != nil {
+			log.Printf("Skipping WMTS tile matrix %s/%s: %v", tms.Identifier, tm.Identifier, err)
+			continue
+		}
+
+		if _, exists := matrices[z]; exists {
+			continue
+		}
+
+		m := &wmtsZoomMatrix{
+			identifier: tm.Identifier,
+			colOffset:  colOffset,
+			rowOffset:  rowOffset,
+			width:      tm.MatrixWidth,
+			height:     tm.MatrixHeight,
+		}
+		if len(limits) > 0 {
+			l, ok := limits[tm.Identifier]
+			if !ok {
+				// The set limits the layer to other matrices only.
+				continue
+			}
+			m.limits = l
+		}
+		matrices[z] = m
+	}
+
+	if len(matrices) == 0 {
+		return nil, fmt.Errorf("tile matrix set %q has no matrices aligned with the XYZ grid", tms.Identifier)
+	}
+
+	return matrices, nil
+}
+
+// xyzPlacement returns the XYZ zoom of the matrix and the XYZ column and row
+// of its top-left tile.
+func (tm *wmtsTileMatrix) xyzPlacement() (maptile.Zoom, uint32, uint32, error) {
+	if tm.TileWidth == 0 || tm.TileWidth != tm.TileHeight {
+		return 0, 0, 0, fmt.Errorf("tiles are %dx%d, only square tiles are supported", tm.TileWidth, tm.TileHeight)
+	}
+
+	span := float64(tm.TileWidth) * tm.ScaleDenominator * wmtsMetresPerPixel
+	if span <= 0 {
+		return 0, 0, 0, fmt.Errorf("invalid scale denominator %v", tm.ScaleDenominator)
+	}
+
+	zf := math.Log2(2 * webMercatorOrigin / span)
+	zr := math.Round(zf)
+	if math.Abs(zf-zr) > 0.01 || zr < 0 || zr > 30 {
+		return 0, 0, 0, fmt.Errorf("scale denominator %v does not match an XYZ zoom", tm.ScaleDenominator)
+	}
+
+	corner := strings.Fields(tm.TopLeftCorner)
+	if len(corner) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid top left corner %q", tm.TopLeftCorner)
+	}
+	left, err := strconv.ParseFloat(corner[0], 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid top left corner %q: %w", tm.TopLeftCorner, err)
+	}
+	top, err := strconv.ParseFloat(corner[1], 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid top left corner %q: %w", tm.TopLeftCorner, err)
+	}
+
+	// Use the exact XYZ span for this zoom so offsets compare against the grid
+	// rather than against the rounded scale denominator.
+	gridSpan := 2 * webMercatorOrigin / math.Exp2(zr)
+	colF := (left + webMercatorOrigin) / gridSpan
+	rowF := (webMercatorOrigin - top) / gridSpan
+	col := math.Round(colF)
+	row := math.Round(rowF)
+	if math.Abs(colF-col) > 0.01 || math.Abs(rowF-row) > 0.01 || col < 0 || row < 0 {
+		return 0, 0, 0, fmt.Errorf("top left corner %q is not on a tile boundary", tm.TopLeftCorner)
+	}
+
+	return maptile.Zoom(zr), uint32(col), uint32(row), nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package tilepack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// testWMTSCapabilities is a trimmed-down capabilities document with one layer
+// available in a Web Mercator set (z0-z2, z2 limited to the north-west
+// quadrant) and in a geographic set that must be ignored.
+const testWMTSCapabilities = `<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:OperationsMetadata>
+    <ows:Operation name="GetTile">
+      <ows:DCP><ows:HTTP>
+        <ows:Get xlink:href="{{BASE}}/wmts?">
+          <ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint>
+        </ows:Get>
+      </ows:HTTP></ows:DCP>
+    </ows:Operation>
+  </ows:OperationsMetadata>
+  <Contents>
+    <Layer>
+      <ows:Identifier>roads</ows:Identifier>
+      <Style isDefault="true"><ows:Identifier>default</ows:Identifier></Style>
+      <Style><ows:Identifier>night</ows:Identifier></Style>
+      <Format>image/png</Format>
+      <Format>image/jpeg</Format>
+      <Dimension><ows:Identifier>Time</ows:Identifier><Default>2024</Default><Value>2024</Value></Dimension>
+      <TileMatrixSetLink><TileMatrixSet>WGS84</TileMatrixSet></TileMatrixSetLink>
+      <TileMatrixSetLink>
+        <TileMatrixSet>GoogleMapsCompatible</TileMatrixSet>
+        <TileMatrixSetLimits>
+          <TileMatrixLimits><TileMatrix>0</TileMatrix><MinTileRow>0</MinTileRow><MaxTileRow>0</MaxTileRow><MinTileCol>0</MinTileCol><MaxTileCol>0</MaxTileCol></TileMatrixLimits>
+          <TileMatrixLimits><TileMatrix>1</TileMatrix><MinTileRow>0</MinTileRow><MaxTileRow>1</MaxTileRow><MinTileCol>0</MinTileCol><MaxTileCol>1</MaxTileCol></TileMatrixLimits>
+          <TileMatrixLimits><TileMatrix>2</TileMatrix><MinTileRow>0</MinTileRow><MaxTileRow>1</MaxTileRow><MinTileCol>0</MinTileCol><MaxTileCol>1</MaxTileCol></TileMatrixLimits>
+        </TileMatrixSetLimits>
+      </TileMatrixSetLink>
+      <ResourceURL format="image/png" resourceType="tile" template="{{BASE}}/rest/roads/{Style}/{Time}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png"/>
+    </Layer>
+    <TileMatrixSet>
+      <ows:Identifier>WGS84</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:OGC:1.3:CRS84</ows:SupportedCRS>
+      <TileMatrix>
+        <ows:Identifier>0</ows:Identifier>
+        <ScaleDenominator>279541132.0143589</ScaleDenominator>
+        <TopLeftCorner>-180 90</TopLeftCorner>
+        <TileWidth>256</TileWidth><TileHeight>256</TileHeight>
+        <MatrixWidth>2</MatrixWidth><MatrixHeight>1</MatrixHeight>
+      </TileMatrix>
+    </TileMatrixSet>
+    <TileMatrixSet>
+      <ows:Identifier>GoogleMapsCompatible</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG:6.18.3:3857</ows:SupportedCRS>
+      <TileMatrix>
+        <ows:Identifier>0</ows:Identifier>
+        <ScaleDenominator>559082264.0287178</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>256</TileWidth><TileHeight>256</TileHeight>
+        <MatrixWidth>1</MatrixWidth><MatrixHeight>1</MatrixHeight>
+      </TileMatrix>
+      <TileMatrix>
+        <ows:Identifier>1</ows:Identifier>
+        <ScaleDenominator>279541132.0143589</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>256</TileWidth><TileHeight>256</TileHeight>
+        <MatrixWidth>2</MatrixWidth><MatrixHeight>2</MatrixHeight>
+      </TileMatrix>
+      <TileMatrix>
+        <ows:Identifier>2</ows:Identifier>
+        <ScaleDenominator>139770566.0071794</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>256</TileWidth><TileHeight>256</TileHeight>
+        <MatrixWidth>4</MatrixWidth><MatrixHeight>4</MatrixHeight>
+      </TileMatrix>
+    </TileMatrixSet>
+  </Contents>
+</Capabilities>`
+
+func writeTestCapabilities(t *testing.T, base string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "WMTSCapabilities.xml")
+	doc := strings.ReplaceAll(testWMTSCapabilities, "{{BASE}}", base)
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func collectJobs(t *testing.T, gen JobGenerator) []*TileRequest {
+	t.Helper()
+	jobs := make(chan *TileRequest, 100)
+	go func() {
+		gen.CreateJobs(context.Background(), jobs)
+		close(jobs)
+	}()
+
+	var reqs []*TileRequest
+	for r := range jobs {
+		reqs = append(reqs, r)
+	}
+	return reqs
+}
+
+var worldBounds = orb.Bound{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}}
+
+func TestNewWMTSJobGenerator_RESTDefaults(t *testing.T) {
+	// With no explicit choices the generator must pick the only layer, its
+	// default style, first format, the Web Mercator set and REST encoding.
+	path := writeTestCapabilities(t, "https://example.com")
+
+	gen, err := NewWMTSJobGenerator(&WMTSJobGeneratorOptions{
+		XYZJobGeneratorOptions: XYZJobGeneratorOptions{Bounds: worldBounds, Zooms: []maptile.Zoom{0}},
+		Capabilities:           path,
+	})
+	if err != nil {
+		t.Fatalf("NewWMTSJobGenerator: %v", err)
+	}
+
+	reqs := collectJobs(t, gen)
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(reqs))
+	}
+	expected := "https://example.com/rest/roads/default/2024/GoogleMapsCompatible/0/0/0.png"
+	if reqs[0].URL != expected {
+		t.Errorf("expected %q, got %q", expected, reqs[0].URL)
+	}
+}
+
+func TestNewWMTSJobGenerator_KVP(t *testing.T) {
+	// KVP encoding must put every GetTile parameter in the query string.
+	path := writeTestCapabilities(t, "https://example.com")
+
+	gen, err := NewWMTSJobGenerator(&WMTSJobGeneratorOptions{
+		XYZJobGeneratorOptions: XYZJobGeneratorOptions{Bounds: worldBounds, Zooms: []maptile.Zoom{1}},
+		Capabilities:           path,
+		Layer:                  "roads",
+		Style:                  "night",
+		Format:                 "image/jpeg",
+		Encoding:               WMTSEncodingKVP,
+	})
+	if err != nil {
+		t.Fatalf("NewWMTSJobGenerator: %v", err)
+	}
+
+	reqs := collectJobs(t, gen)
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 jobs at z1, got %d", len(reqs))
+	}
+
+	for _, r := range reqs {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			t.Fatalf("bad URL %q: %v", r.URL, err)
+		}
+		if !strings.HasPrefix(r.URL, "https://example.com/wmts?") {
+			t.Errorf("unexpected endpoint in %q", r.URL)
+		}
+		q := u.Query()
+		checks := map[string]string{
+			"SERVICE":       "WMTS",
+			"REQUEST":       "GetTile",
+			"LAYER":         "roads",
+			"STYLE":         "night",
+			"FORMAT":        "image/jpeg",
+			"TILEMATRIXSET": "GoogleMapsCompatible",
+			"TILEMATRIX":    "1",
+			"Time":          "2024",
+		}
+		for k, v := range checks {
+			if q.Get(k) != v {
+				t.Errorf("%s: expected %q, got %q in %s", k, v, q.Get(k), r.URL)
+			}
+		}
+		if q.Get("TILECOL") != strconv.Itoa(int(r.Tile.X)) || q.Get("TILEROW") != strconv.Itoa(int(r.Tile.Y)) {
+			t.Errorf("tile %v requested as col %s row %s", r.Tile, q.Get("TILECOL"), q.Get("TILEROW"))
+		}
+	}
+}
+
+func TestNewWMTSJobGenerator_LimitsAndZoomFilter(t *testing.T) {
+	// z2 is limited to the 2x2 north-west block, and z3 has no matrix at all.
+	path := writeTestCapabilities(t, "https://example.com")
+
+	gen, err := NewWMTSJobGenerator(&WMTSJobGeneratorOptions{
+		XYZJobGeneratorOptions: XYZJobGeneratorOptions{Bounds: worldBounds, Zooms: []maptile.Zoom{2, 3}},
+		Capabilities:           path,
+	})
+	if err != nil {
+		t.Fatalf("NewWMTSJobGenerator: %v", err)
+	}
+
+	reqs := collectJobs(t, gen)
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 jobs, got %d", len(reqs))
+	}
+	for _, r := range reqs {
+		if r.Tile.Z != 2 || r.Tile.X > 1 || r.Tile.Y > 1 {
+			t.Errorf("unexpected tile %v", r.Tile)
+		}
+	}
+}
+
+func TestNewWMTSJobGenerator_InvertedY(t *testing.T) {
+	// Output tiles follow the TMS row order when InvertedY is set, while the
+	// WMTS row in the URL stays in matrix (top-down) order.
+	path := writeTestCapabilities(t, "https://example.com")
+
+	gen, err := NewWMTSJobGenerator(&WMTSJobGeneratorOptions{
+		XYZJobGeneratorOptions: XYZJobGeneratorOptions{
+			Bounds:    orb.Bound{Min: orb.Point{-180, 1}, Max: orb.Point{-1, 85}},
+			Zooms:     []maptile.Zoom{1},
+			InvertedY: true,
+		},
+		Capabilities: path,
+	})
+	if err != nil {
+		t.Fatalf("NewWMTSJobGenerator: %v", err)
+	}
+
+	reqs := collectJobs(t, gen)
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(reqs))
+	}
+	if reqs[0].Tile != maptile.New(0, 1, 1) {
+		t.Errorf("expected TMS tile 1/0/1, got %v", reqs[0].Tile)
+	}
+	if !strings.HasSuffix(reqs[0].URL, "/1/0/0.png") {
+		t.Errorf("expected matrix row 0 in URL, got %q", reqs[0].URL)
+	}
+}
+
+func TestNewWMTSJobGenerator_Errors(t *testing.T) {
+	path := writeTestCapabilities(t, "https://example.com")
+
+	cases := map[string]WMTSJobGeneratorOptions{
+		"unknown layer":  {Capabilities: path, Layer: "rivers"},
+		"unknown style":  {Capabilities: path, Style: "pink"},
+		"unknown format": {Capabilities: path, Format: "image/webp"},
+		"geographic set": {Capabilities: path, TileMatrixSet: "WGS84"},
+		"bad encoding":   {Capabilities: path, Encoding: "soap"},
+		"missing file":   {Capabilities: filepath.Join(t.TempDir(), "nope.xml")},
+	}
+
+	for name, opts := range cases {
+		opts := opts
+		if _, err := NewWMTSJobGenerator(&opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNewWMTSJobGenerator_CapabilitiesOverHTTP(t *testing.T) {
+	// Capabilities may be fetched over HTTP with the configured headers, and
+	// tiles are then fetched with the shared xyz worker.
+	var gotKey string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/WMTSCapabilities.xml" {
+			gotKey = r.Header.Get("X-Api-Key")
+			w.Write([]byte(strings.ReplaceAll(testWMTSCapabilities, "{{BASE}}", srv.URL)))
+			return
+		}
+		w.Write([]byte("tile:" + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	gen, err := NewWMTSJobGenerator(&WMTSJobGeneratorOptions{
+		XYZJobGeneratorOptions: XYZJobGeneratorOptions{
+			Bounds:      worldBounds,
+			Zooms:       []maptile.Zoom{0},
+			HTTPTimeout: 5 * time.Second,
+			Headers:     http.Header{"X-Api-Key": {"k"}},
+		},
+		Capabilities: srv.URL + "/WMTSCapabilities.xml",
+	})
+	if err != nil {
+		t.Fatalf("NewWMTSJobGenerator: %v", err)
+	}
+	if gotKey != "k" {
+		t.Errorf("expected capabilities request to carry X-Api-Key, got %q", gotKey)
+	}
+
+	reqs := collectJobs(t, gen)
+	resp := runWorker(t, gen, reqs[0].URL, reqs[0].Tile)
+	if string(resp.Data) != "tile:/rest/roads/default/2024/GoogleMapsCompatible/0/0/0.png" {
+		t.Errorf("unexpected tile data %q", resp.Data)
+	}
+}
+
+func TestWMTSTileMatrix_XYZPlacement(t *testing.T) {
+	// A 512px matrix covers the same ground as a 256px matrix one zoom lower,
+	// and a matrix whose corner is offset from the world origin maps to the
+	// matching XYZ column and row.
+	tm := wmtsTileMatrix{
+		ScaleDenominator: 279541132.0143589,
+		TopLeftCorner:    "-20037508.3427892 20037508.3427892",
+		TileWidth:        512,
+		TileHeight:       512,
+	}
+	z, col, row, err := tm.xyzPlacement()
+	if err != nil || z != 0 || col != 0 || row != 0 {
+		t.Errorf("512px: got z%d %d/%d %v", z, col, row, err)
+	}
+
+	tm = wmtsTileMatrix{
+		ScaleDenominator: 139770566.0071794,
+		TopLeftCorner:    "0 10018754.1713946",
+		TileWidth:        256,
+		TileHeight:       256,
+	}
+	z, col, row, err = tm.xyzPlacement()
+	if err != nil || z != 2 || col != 2 || row != 1 {
+		t.Errorf("offset: got z%d %d/%d %v", z, col, row, err)
+	}
+
+	tm.ScaleDenominator = 100000000
+	if _, _, _, err := tm.xyzPlacement(); err == nil {
+		t.Error("expected error for a scale between zooms")
+	}
+}
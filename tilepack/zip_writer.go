@@ -0,0 +1,249 @@
+package tilepack
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	zipLocalHeaderSignature     = 0x04034b50
+	zipCentralHeaderSignature   = 0x02014b50
+	zipEndSignature             = 0x06054b50
+	zipEnd64Signature           = 0x06064b50
+	zipEnd64LocatorSignature    = 0x07064b50
+	zipVersion20                = 20
+	zipVersion45                = 45
+	zipCreatorUnix              = 3
+	zipFlagUTF8                 = 0x800
+	zipLocalHeaderLen           = 30
+	zipCentralHeaderLen         = 46
+	zipEndLen                   = 22
+	zipEnd64Len                 = 56
+	zipEnd64LocatorLen          = 20
+	zipExtraZip64               = 0x0001
+	zipMaxUint16                = math.MaxUint16
+	zipMaxUint32                = math.MaxUint32
+	zipExternalAttrsRegularFile = 0100644 << 16
+)
+
+// zipEntry is a file written to a zip. Several central directory records
+// may point at the same entry.
+type zipEntry struct {
+	offset           uint64
+	method           uint16
+	crc32            uint32
+	compressedSize   uint32
+	uncompressedSize uint32
+}
+
+// zipRecord is a central directory record, naming an entry.
+type zipRecord struct {
+	name  string
+	entry *zipEntry
+}
+
+// zipWriter streams files into a zip archive. Unlike archive/zip, it can
+// give one stored file several names with Alias, which is how duplicate
+// tiles are stored once. Files are held in memory while they are written, so
+// each must be smaller than 4 GiB; archives and file counts beyond the
+// classic zip limits are written with zip64 records.
+//
+// Readers that only follow the central directory, such as Go's archive/zip,
+// Java's ZipFile and most map SDKs, see aliases as ordinary files. Extractors
+// that check for overlapping files, such as Info-ZIP unzip since
+// CVE-2019-13232, refuse them, so aliases are optional.
+type zipWriter struct {
+	w        io.Writer
+	offset   uint64
+	method   uint16
+	modified time.Time
+	records  []zipRecord
+
+	buf   bytes.Buffer
+	flate *flate.Writer
+}
+
+// newZipWriter returns a zipWriter that stores files with method, either
+// zip.Store or zip.Deflate, and the modified time of every file.
+func newZipWriter(w io.Writer, method uint16, modified time.Time) *zipWriter {
+	return &zipWriter{w: w, method: method, modified: modified}
+}
+
+// Create writes a file. Deflated files that do not get smaller are stored
+// as they are.
+func (z *zipWriter) Create(name string, data []byte) (*zipEntry, error) {
+	if uint64(len(data)) >= zipMaxUint32 {
+		return nil, fmt.Errorf("zip file %s is too large", name)
+	}
+
+	entry := &zipEntry{
+		offset:           z.offset,
+		method:           zip.Store,
+		crc32:            crc32.ChecksumIEEE(data),
+		uncompressedSize: uint32(len(data)),
+	}
+
+	stored := data
+	if z.method == zip.Deflate {
+		compressed, err := z.deflate(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			entry.method = zip.Deflate
+			stored = compressed
+		}
+	}
+	entry.compressedSize = uint32(len(stored))
+
+	header := make([]byte, zipLocalHeaderLen, zipLocalHeaderLen+len(name))
+	binary.LittleEndian.PutUint32(header[0:], zipLocalHeaderSignature)
+	binary.LittleEndian.PutUint16(header[4:], zipVersion20)
+	binary.LittleEndian.PutUint16(header[6:], zipFlagUTF8)
+	binary.LittleEndian.PutUint16(header[8:], entry.method)
+	z.putModified(header[10:])
+	binary.LittleEndian.PutUint32(header[14:], entry.crc32)
+	binary.LittleEndian.PutUint32(header[18:], entry.compressedSize)
+	binary.LittleEndian.PutUint32(header[22:], entry.uncompressedSize)
+	binary.LittleEndian.PutUint16(header[26:], uint16(len(name)))
+	header = append(header, name...)
+
+	if err := z.write(header); err != nil {
+		return nil, err
+	}
+	if err := z.write(stored); err != nil {
+		return nil, err
+	}
+
+	z.records = append(z.records, zipRecord{name: name, entry: entry})
+	return entry, nil
+}
+
+// Alias gives the file of entry another name, without storing it again.
+func (z *zipWriter) Alias(name string, entry *zipEntry) {
+	z.records = append(z.records, zipRecord{name: name, entry: entry})
+}
+
+// Close writes the central directory. It does not close the underlying
+// writer.
+func (z *zipWriter) Close() error {
+	start := z.offset
+	for _, record := range z.records {
+		if len(record.name) > zipMaxUint16 {
+			return errors.New("zip file name too long")
+		}
+
+		var extra []byte
+		offset := uint32(record.entry.offset)
+		version := uint16(zipVersion20)
+		if record.entry.offset >= zipMaxUint32 {
+			offset = zipMaxUint32
+			version = zipVersion45
+			extra = make([]byte, 12)
+			binary.LittleEndian.PutUint16(extra[0:], zipExtraZip64)
+			binary.LittleEndian.PutUint16(extra[2:], 8)
+			binary.LittleEndian.PutUint64(extra[4:], record.entry.offset)
+		}
+
+		header := make([]byte, zipCentralHeaderLen, zipCentralHeaderLen+len(record.name)+len(extra))
+		binary.LittleEndian.PutUint32(header[0:], zipCentralHeaderSignature)
+		binary.LittleEndian.PutUint16(header[4:], zipCreatorUnix<<8|zipVersion45)
+		binary.LittleEndian.PutUint16(header[6:], version)
+		binary.LittleEndian.PutUint16(header[8:], zipFlagUTF8)
+		binary.LittleEndian.PutUint16(header[10:], record.entry.method)
+		z.putModified(header[12:])
+		binary.LittleEndian.PutUint32(header[16:], record.entry.crc32)
+		binary.LittleEndian.PutUint32(header[20:], record.entry.compressedSize)
+		binary.LittleEndian.PutUint32(header[24:], record.entry.uncompressedSize)
+		binary.LittleEndian.PutUint16(header[28:], uint16(len(record.name)))
+		binary.LittleEndian.PutUint16(header[30:], uint16(len(extra)))
+		binary.LittleEndian.PutUint32(header[38:], zipExternalAttrsRegularFile)
+		binary.LittleEndian.PutUint32(header[42:], offset)
+		header = append(header, record.name...)
+		header = append(header, extra...)
+
+		if err := z.write(header); err != nil {
+			return err
+		}
+	}
+	size := z.offset - start
+
+	count := uint64(len(z.records))
+	if count >= zipMaxUint16 || size >= zipMaxUint32 || start >= zipMaxUint32 {
+		end64 := z.offset
+
+		record := make([]byte, zipEnd64Len+zipEnd64LocatorLen)
+		binary.LittleEndian.PutUint32(record[0:], zipEnd64Signature)
+		binary.LittleEndian.PutUint64(record[4:], zipEnd64Len-12)
+		binary.LittleEndian.PutUint16(record[12:], zipCreatorUnix<<8|zipVersion45)
+		binary.LittleEndian.PutUint16(record[14:], zipVersion45)
+		binary.LittleEndian.PutUint64(record[24:], count)
+		binary.LittleEndian.PutUint64(record[32:], count)
+		binary.LittleEndian.PutUint64(record[40:], size)
+		binary.LittleEndian.PutUint64(record[48:], start)
+
+		locator := record[zipEnd64Len:]
+		binary.LittleEndian.PutUint32(locator[0:], zipEnd64LocatorSignature)
+		binary.LittleEndian.PutUint64(locator[8:], end64)
+		binary.LittleEndian.PutUint32(locator[16:], 1)
+
+		if err := z.write(record); err != nil {
+			return err
+		}
+
+		count = min(count, zipMaxUint16)
+		size = min(size, zipMaxUint32)
+		start = min(start, zipMaxUint32)
+	}
+
+	end := make([]byte, zipEndLen)
+	binary.LittleEndian.PutUint32(end[0:], zipEndSignature)
+	binary.LittleEndian.PutUint16(end[8:], uint16(count))
+	binary.LittleEndian.PutUint16(end[10:], uint16(count))
+	binary.LittleEndian.PutUint32(end[12:], uint32(size))
+	binary.LittleEndian.PutUint32(end[16:], uint32(start))
+	return z.write(end)
+}
+
+func (z *zipWriter) write(p []byte) error {
+	n, err := z.w.Write(p)
+	z.offset += uint64(n)
+	return err
+}
+
+// deflate compresses data. The result is only valid until the next call.
+func (z *zipWriter) deflate(data []byte) ([]byte, error) {
+	z.buf.Reset()
+	if z.flate == nil {
+		var err error
+		if z.flate, err = flate.NewWriter(&z.buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	}
+	z.flate.Reset(&z.buf)
+	if _, err := z.flate.Write(data); err != nil {
+		return nil, fmt.Errorf("deflate write: %w", err)
+	}
+	if err := z.flate.Close(); err != nil {
+		return nil, fmt.Errorf("deflate close: %w", err)
+	}
+	return z.buf.Bytes(), nil
+}
+
+// putModified puts the MS-DOS time and date of the modified time.
+func (z *zipWriter) putModified(b []byte) {
+	t := z.modified
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	binary.LittleEndian.PutUint16(b[0:], uint16(t.Hour()<<11|t.Minute()<<5|t.Second()>>1))
+	binary.LittleEndian.PutUint16(b[2:], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+}
@@ -0,0 +1,96 @@
+package tilepack
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func readZipFiles(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	files := make(map[string]string, len(r.File))
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open %s: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %s: %v", f.Name, err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestZipWriter_CreateAndAlias(t *testing.T) {
+	var buf bytes.Buffer
+	z := newZipWriter(&buf, zip.Deflate, time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC))
+
+	compressible := string(bytes.Repeat([]byte("ocean "), 100))
+	entry, err := z.Create("0/0/0.pbf", []byte(compressible))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if entry.method != zip.Deflate {
+		t.Errorf("compressible file method = %d, want deflate", entry.method)
+	}
+	stored, err := z.Create("1/0/0.pbf", []byte("x"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if stored.method != zip.Store {
+		t.Errorf("incompressible file method = %d, want store", stored.method)
+	}
+	z.Alias("1/1/1.pbf", entry)
+	if err := z.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files := readZipFiles(t, buf.Bytes())
+	want := map[string]string{"0/0/0.pbf": compressible, "1/0/0.pbf": "x", "1/1/1.pbf": compressible}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s = %.20q, want %.20q", name, files[name], content)
+		}
+	}
+	if len(files) != len(want) {
+		t.Errorf("got %d files, want %d", len(files), len(want))
+	}
+
+	r, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if modified := r.File[0].Modified; !modified.Equal(time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)) {
+		t.Errorf("modified = %v", modified)
+	}
+}
+
+func TestZipWriter_Zip64FileCount(t *testing.T) {
+	var buf bytes.Buffer
+	z := newZipWriter(&buf, zip.Store, time.Now())
+	entry, err := z.Create("tile", []byte("tile"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for i := 0; i < 70000; i++ {
+		z.Alias(fmt.Sprintf("alias/%d", i), entry)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	if len(r.File) != 70001 {
+		t.Errorf("got %d files, want 70001", len(r.File))
+	}
+}